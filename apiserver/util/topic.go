@@ -62,10 +62,13 @@ func (p *ProductTopic) Encode() ([]byte, error) {
 
 // DeviceTopic
 type DeviceTopic struct {
-	DeviceId     string `json:deviceId"`
-	DeviceSecret string `json:deviceKey"`
+	DeviceId     string `json:"deviceId"`
+	DeviceName   string `json:"deviceName"`
+	DeviceSecret string `json:"deviceKey"`
+	DeviceStatus string `json:"deviceStatus"`
 	Action       string `json:"action"`
 	ProductId    string `json:"productId"`
+	ProductKey   string `json:"productKey"`
 
 	encoded []byte
 	err     error
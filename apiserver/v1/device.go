@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/cloustone/sentel/apiserver/db"
+	"github.com/cloustone/sentel/apiserver/util"
 
 	"github.com/labstack/echo"
 	uuid "github.com/satori/go.uuid"
@@ -65,6 +66,19 @@ func registerDevice(ctx echo.Context) error {
 	if err != nil {
 		return ctx.JSON(http.StatusInternalServerError, &response{Success: false, Message: err.Error()})
 	}
+	// Notify kafka
+	util.AsyncProduceMessage(config,
+		"todo",
+		util.TopicNameDevice,
+		&util.DeviceTopic{
+			DeviceId:     dp.Id,
+			DeviceName:   dp.Name,
+			DeviceSecret: dp.DeviceSecret,
+			DeviceStatus: dp.DeviceStatus,
+			ProductId:    dp.ProductId,
+			ProductKey:   dp.ProductKey,
+			Action:       util.ObjectActionRegister,
+		})
 	return ctx.JSON(http.StatusOK, &response{Success: true,
 		Result: &registerDeviceResponse{
 			DeviceId:     dp.Id,
@@ -133,6 +147,14 @@ func deleteDevice(ctx echo.Context) error {
 	if err := registry.DeleteDevice(ctx.Param("id")); err != nil {
 		return ctx.JSON(http.StatusOK, &response{Success: false, Message: err.Error()})
 	}
+	// Notify kafka
+	util.AsyncProduceMessage(config,
+		"todo",
+		util.TopicNameDevice,
+		&util.DeviceTopic{
+			DeviceId: ctx.Param("id"),
+			Action:   util.ObjectActionDelete,
+		})
 	return ctx.JSON(http.StatusOK, rcp)
 }
 
@@ -183,6 +205,18 @@ func updateDevice(ctx echo.Context) error {
 		return ctx.JSON(http.StatusOK,
 			&response{RequestId: uuid.NewV4().String(), Success: false, Message: err.Error()})
 	}
+	// Notify kafka
+	util.AsyncProduceMessage(ctx.(*apiContext).config,
+		"todo",
+		util.TopicNameDevice,
+		&util.DeviceTopic{
+			DeviceId:     dp.Id,
+			DeviceName:   dp.Name,
+			DeviceSecret: dp.DeviceSecret,
+			DeviceStatus: dp.DeviceStatus,
+			ProductKey:   dp.ProductKey,
+			Action:       util.ObjectActionUpdate,
+		})
 	return ctx.JSON(http.StatusOK,
 		&response{Success: true,
 			Result: &updateDeviceResponse{
@@ -5,9 +5,11 @@
 Package api is a generated protocol buffer package.
 
 It is generated from these files:
+
 	api.proto
 
 It has these top-level messages:
+
 	VersionRequest
 	VersionReply
 	BrokerRequest
@@ -26,6 +28,7 @@ It has these top-level messages:
 	StatusReply
 	PluginsRequest
 	PluginsReply
+	PluginInfo
 	ServicesRequest
 	ServicesReply
 	ServiceInfo
@@ -149,6 +152,8 @@ type ClientsRequest struct {
 	Category string `protobuf:"bytes,1,opt,name=Category" json:"Category,omitempty"`
 	Service  string `protobuf:"bytes,2,opt,name=Service" json:"Service,omitempty"`
 	ClientId string `protobuf:"bytes,3,opt,name=ClientId" json:"ClientId,omitempty"`
+	Offset   uint32 `protobuf:"varint,4,opt,name=Offset" json:"Offset,omitempty"`
+	Limit    uint32 `protobuf:"varint,5,opt,name=Limit" json:"Limit,omitempty"`
 }
 
 func (m *ClientsRequest) Reset()                    { *m = ClientsRequest{} }
@@ -177,9 +182,24 @@ func (m *ClientsRequest) GetClientId() string {
 	return ""
 }
 
+func (m *ClientsRequest) GetOffset() uint32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *ClientsRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
 type ClientsReply struct {
 	Header  *ReplyMessageHeader `protobuf:"bytes,1,opt,name=Header" json:"Header,omitempty"`
 	Clients []*ClientInfo       `protobuf:"bytes,2,rep,name=Clients" json:"Clients,omitempty"`
+	Total   uint32              `protobuf:"varint,3,opt,name=Total" json:"Total,omitempty"`
 }
 
 func (m *ClientsReply) Reset()                    { *m = ClientsReply{} }
@@ -201,6 +221,13 @@ func (m *ClientsReply) GetClients() []*ClientInfo {
 	return nil
 }
 
+func (m *ClientsReply) GetTotal() uint32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
 type ClientInfo struct {
 	UserName     string `protobuf:"bytes,1,opt,name=UserName" json:"UserName,omitempty"`
 	CleanSession bool   `protobuf:"varint,2,opt,name=CleanSession" json:"CleanSession,omitempty"`
@@ -278,6 +305,8 @@ type RoutesRequest struct {
 	Category string `protobuf:"bytes,1,opt,name=Category" json:"Category,omitempty"`
 	Service  string `protobuf:"bytes,2,opt,name=Service" json:"Service,omitempty"`
 	Topic    string `protobuf:"bytes,3,opt,name=Topic" json:"Topic,omitempty"`
+	Offset   uint32 `protobuf:"varint,4,opt,name=Offset" json:"Offset,omitempty"`
+	Limit    uint32 `protobuf:"varint,5,opt,name=Limit" json:"Limit,omitempty"`
 }
 
 func (m *RoutesRequest) Reset()                    { *m = RoutesRequest{} }
@@ -306,9 +335,24 @@ func (m *RoutesRequest) GetTopic() string {
 	return ""
 }
 
+func (m *RoutesRequest) GetOffset() uint32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *RoutesRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
 type RoutesReply struct {
 	Header *ReplyMessageHeader `protobuf:"bytes,1,opt,name=Header" json:"Header,omitempty"`
 	Routes []*RouteInfo        `protobuf:"bytes,2,rep,name=Routes" json:"Routes,omitempty"`
+	Total  uint32              `protobuf:"varint,3,opt,name=Total" json:"Total,omitempty"`
 }
 
 func (m *RoutesReply) Reset()                    { *m = RoutesReply{} }
@@ -330,6 +374,13 @@ func (m *RoutesReply) GetRoutes() []*RouteInfo {
 	return nil
 }
 
+func (m *RoutesReply) GetTotal() uint32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
 type RouteInfo struct {
 	Topic string   `protobuf:"bytes,1,opt,name=Topic" json:"Topic,omitempty"`
 	Route []string `protobuf:"bytes,2,rep,name=Route" json:"Route,omitempty"`
@@ -380,6 +431,8 @@ func (m *StatusReply) GetHeader() *ReplyMessageHeader {
 }
 
 type PluginsRequest struct {
+	Category string `protobuf:"bytes,1,opt,name=Category" json:"Category,omitempty"`
+	Name     string `protobuf:"bytes,2,opt,name=Name" json:"Name,omitempty"`
 }
 
 func (m *PluginsRequest) Reset()                    { *m = PluginsRequest{} }
@@ -387,7 +440,23 @@ func (m *PluginsRequest) String() string            { return proto.CompactTextSt
 func (*PluginsRequest) ProtoMessage()               {}
 func (*PluginsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{16} }
 
+func (m *PluginsRequest) GetCategory() string {
+	if m != nil {
+		return m.Category
+	}
+	return ""
+}
+
+func (m *PluginsRequest) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
 type PluginsReply struct {
+	Header  *ReplyMessageHeader `protobuf:"bytes,1,opt,name=Header" json:"Header,omitempty"`
+	Plugins []*PluginInfo       `protobuf:"bytes,2,rep,name=Plugins" json:"Plugins,omitempty"`
 }
 
 func (m *PluginsReply) Reset()                    { *m = PluginsReply{} }
@@ -395,6 +464,68 @@ func (m *PluginsReply) String() string            { return proto.CompactTextStri
 func (*PluginsReply) ProtoMessage()               {}
 func (*PluginsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{17} }
 
+func (m *PluginsReply) GetHeader() *ReplyMessageHeader {
+	if m != nil {
+		return m.Header
+	}
+	return nil
+}
+
+func (m *PluginsReply) GetPlugins() []*PluginInfo {
+	if m != nil {
+		return m.Plugins
+	}
+	return nil
+}
+
+type PluginInfo struct {
+	Name        string `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
+	Version     string `protobuf:"bytes,2,opt,name=Version" json:"Version,omitempty"`
+	Description string `protobuf:"bytes,3,opt,name=Description" json:"Description,omitempty"`
+	State       string `protobuf:"bytes,4,opt,name=State" json:"State,omitempty"`
+	Error       string `protobuf:"bytes,5,opt,name=Error" json:"Error,omitempty"`
+}
+
+func (m *PluginInfo) Reset()                    { *m = PluginInfo{} }
+func (m *PluginInfo) String() string            { return proto.CompactTextString(m) }
+func (*PluginInfo) ProtoMessage()               {}
+func (*PluginInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{18} }
+
+func (m *PluginInfo) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *PluginInfo) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *PluginInfo) GetDescription() string {
+	if m != nil {
+		return m.Description
+	}
+	return ""
+}
+
+func (m *PluginInfo) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *PluginInfo) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
 // Service
 type ServicesRequest struct {
 	Category    string `protobuf:"bytes,1,opt,name=Category" json:"Category,omitempty"`
@@ -405,7 +536,7 @@ type ServicesRequest struct {
 func (m *ServicesRequest) Reset()                    { *m = ServicesRequest{} }
 func (m *ServicesRequest) String() string            { return proto.CompactTextString(m) }
 func (*ServicesRequest) ProtoMessage()               {}
-func (*ServicesRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{18} }
+func (*ServicesRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{19} }
 
 func (m *ServicesRequest) GetCategory() string {
 	if m != nil {
@@ -436,7 +567,7 @@ type ServicesReply struct {
 func (m *ServicesReply) Reset()                    { *m = ServicesReply{} }
 func (m *ServicesReply) String() string            { return proto.CompactTextString(m) }
 func (*ServicesReply) ProtoMessage()               {}
-func (*ServicesReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{19} }
+func (*ServicesReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{20} }
 
 func (m *ServicesReply) GetHeader() *ReplyMessageHeader {
 	if m != nil {
@@ -459,12 +590,13 @@ type ServiceInfo struct {
 	MaxClients     uint64 `protobuf:"varint,4,opt,name=MaxClients" json:"MaxClients,omitempty"`
 	CurrentClients uint64 `protobuf:"varint,5,opt,name=CurrentClients" json:"CurrentClients,omitempty"`
 	ShutdownCount  uint64 `protobuf:"varint,6,opt,name=ShutdownCount" json:"ShutdownCount,omitempty"`
+	Status         string `protobuf:"bytes,7,opt,name=Status" json:"Status,omitempty"`
 }
 
 func (m *ServiceInfo) Reset()                    { *m = ServiceInfo{} }
 func (m *ServiceInfo) String() string            { return proto.CompactTextString(m) }
 func (*ServiceInfo) ProtoMessage()               {}
-func (*ServiceInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{20} }
+func (*ServiceInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{21} }
 
 func (m *ServiceInfo) GetServiceName() string {
 	if m != nil {
@@ -508,17 +640,26 @@ func (m *ServiceInfo) GetShutdownCount() uint64 {
 	return 0
 }
 
+func (m *ServiceInfo) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
 // Subscription
 type SubscriptionsRequest struct {
 	Service      string `protobuf:"bytes,1,opt,name=Service" json:"Service,omitempty"`
 	Category     string `protobuf:"bytes,2,opt,name=Category" json:"Category,omitempty"`
 	Subscription string `protobuf:"bytes,3,opt,name=Subscription" json:"Subscription,omitempty"`
+	Offset       uint32 `protobuf:"varint,4,opt,name=Offset" json:"Offset,omitempty"`
+	Limit        uint32 `protobuf:"varint,5,opt,name=Limit" json:"Limit,omitempty"`
 }
 
 func (m *SubscriptionsRequest) Reset()                    { *m = SubscriptionsRequest{} }
 func (m *SubscriptionsRequest) String() string            { return proto.CompactTextString(m) }
 func (*SubscriptionsRequest) ProtoMessage()               {}
-func (*SubscriptionsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{21} }
+func (*SubscriptionsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{22} }
 
 func (m *SubscriptionsRequest) GetService() string {
 	if m != nil {
@@ -541,15 +682,30 @@ func (m *SubscriptionsRequest) GetSubscription() string {
 	return ""
 }
 
+func (m *SubscriptionsRequest) GetOffset() uint32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *SubscriptionsRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
 type SubscriptionsReply struct {
 	Header        *ReplyMessageHeader `protobuf:"bytes,1,opt,name=Header" json:"Header,omitempty"`
 	Subscriptions []*SubscriptionInfo `protobuf:"bytes,2,rep,name=Subscriptions" json:"Subscriptions,omitempty"`
+	Total         uint32              `protobuf:"varint,3,opt,name=Total" json:"Total,omitempty"`
 }
 
 func (m *SubscriptionsReply) Reset()                    { *m = SubscriptionsReply{} }
 func (m *SubscriptionsReply) String() string            { return proto.CompactTextString(m) }
 func (*SubscriptionsReply) ProtoMessage()               {}
-func (*SubscriptionsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{22} }
+func (*SubscriptionsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{23} }
 
 func (m *SubscriptionsReply) GetHeader() *ReplyMessageHeader {
 	if m != nil {
@@ -565,6 +721,13 @@ func (m *SubscriptionsReply) GetSubscriptions() []*SubscriptionInfo {
 	return nil
 }
 
+func (m *SubscriptionsReply) GetTotal() uint32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
 type SubscriptionInfo struct {
 	ClientId  string `protobuf:"bytes,1,opt,name=ClientId" json:"ClientId,omitempty"`
 	Topic     string `protobuf:"bytes,2,opt,name=Topic" json:"Topic,omitempty"`
@@ -574,7 +737,7 @@ type SubscriptionInfo struct {
 func (m *SubscriptionInfo) Reset()                    { *m = SubscriptionInfo{} }
 func (m *SubscriptionInfo) String() string            { return proto.CompactTextString(m) }
 func (*SubscriptionInfo) ProtoMessage()               {}
-func (*SubscriptionInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{23} }
+func (*SubscriptionInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{24} }
 
 func (m *SubscriptionInfo) GetClientId() string {
 	if m != nil {
@@ -603,12 +766,14 @@ type SessionsRequest struct {
 	Service    string          `protobuf:"bytes,2,opt,name=Service" json:"Service,omitempty"`
 	ClientId   string          `protobuf:"bytes,3,opt,name=ClientId" json:"ClientId,omitempty"`
 	Conditions map[string]bool `protobuf:"bytes,4,rep,name=Conditions" json:"Conditions,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	Offset     uint32          `protobuf:"varint,5,opt,name=Offset" json:"Offset,omitempty"`
+	Limit      uint32          `protobuf:"varint,6,opt,name=Limit" json:"Limit,omitempty"`
 }
 
 func (m *SessionsRequest) Reset()                    { *m = SessionsRequest{} }
 func (m *SessionsRequest) String() string            { return proto.CompactTextString(m) }
 func (*SessionsRequest) ProtoMessage()               {}
-func (*SessionsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{24} }
+func (*SessionsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{25} }
 
 func (m *SessionsRequest) GetCategory() string {
 	if m != nil {
@@ -638,15 +803,30 @@ func (m *SessionsRequest) GetConditions() map[string]bool {
 	return nil
 }
 
+func (m *SessionsRequest) GetOffset() uint32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *SessionsRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
 type SessionsReply struct {
 	Header   *ReplyMessageHeader `protobuf:"bytes,1,opt,name=Header" json:"Header,omitempty"`
 	Sessions []*SessionInfo      `protobuf:"bytes,2,rep,name=Sessions" json:"Sessions,omitempty"`
+	Total    uint32              `protobuf:"varint,3,opt,name=Total" json:"Total,omitempty"`
 }
 
 func (m *SessionsReply) Reset()                    { *m = SessionsReply{} }
 func (m *SessionsReply) String() string            { return proto.CompactTextString(m) }
 func (*SessionsReply) ProtoMessage()               {}
-func (*SessionsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{25} }
+func (*SessionsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{26} }
 
 func (m *SessionsReply) GetHeader() *ReplyMessageHeader {
 	if m != nil {
@@ -662,6 +842,13 @@ func (m *SessionsReply) GetSessions() []*SessionInfo {
 	return nil
 }
 
+func (m *SessionsReply) GetTotal() uint32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
 type SessionInfo struct {
 	ClientId           string `protobuf:"bytes,1,opt,name=ClientId" json:"ClientId,omitempty"`
 	CleanSession       bool   `protobuf:"varint,2,opt,name=CleanSession" json:"CleanSession,omitempty"`
@@ -678,7 +865,7 @@ type SessionInfo struct {
 func (m *SessionInfo) Reset()                    { *m = SessionInfo{} }
 func (m *SessionInfo) String() string            { return proto.CompactTextString(m) }
 func (*SessionInfo) ProtoMessage()               {}
-func (*SessionInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{26} }
+func (*SessionInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{27} }
 
 func (m *SessionInfo) GetClientId() string {
 	if m != nil {
@@ -755,12 +942,14 @@ type TopicsRequest struct {
 	Service  string `protobuf:"bytes,1,opt,name=Service" json:"Service,omitempty"`
 	Category string `protobuf:"bytes,2,opt,name=Category" json:"Category,omitempty"`
 	Topic    string `protobuf:"bytes,3,opt,name=Topic" json:"Topic,omitempty"`
+	Offset   uint32 `protobuf:"varint,4,opt,name=Offset" json:"Offset,omitempty"`
+	Limit    uint32 `protobuf:"varint,5,opt,name=Limit" json:"Limit,omitempty"`
 }
 
 func (m *TopicsRequest) Reset()                    { *m = TopicsRequest{} }
 func (m *TopicsRequest) String() string            { return proto.CompactTextString(m) }
 func (*TopicsRequest) ProtoMessage()               {}
-func (*TopicsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{27} }
+func (*TopicsRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{28} }
 
 func (m *TopicsRequest) GetService() string {
 	if m != nil {
@@ -783,15 +972,30 @@ func (m *TopicsRequest) GetTopic() string {
 	return ""
 }
 
+func (m *TopicsRequest) GetOffset() uint32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+func (m *TopicsRequest) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
 type TopicsReply struct {
 	Header *ReplyMessageHeader `protobuf:"bytes,1,opt,name=Header" json:"Header,omitempty"`
 	Topics []*TopicInfo        `protobuf:"bytes,2,rep,name=Topics" json:"Topics,omitempty"`
+	Total  uint32              `protobuf:"varint,3,opt,name=Total" json:"Total,omitempty"`
 }
 
 func (m *TopicsReply) Reset()                    { *m = TopicsReply{} }
 func (m *TopicsReply) String() string            { return proto.CompactTextString(m) }
 func (*TopicsReply) ProtoMessage()               {}
-func (*TopicsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{28} }
+func (*TopicsReply) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{29} }
 
 func (m *TopicsReply) GetHeader() *ReplyMessageHeader {
 	if m != nil {
@@ -807,6 +1011,13 @@ func (m *TopicsReply) GetTopics() []*TopicInfo {
 	return nil
 }
 
+func (m *TopicsReply) GetTotal() uint32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
 type TopicInfo struct {
 	Topic     string `protobuf:"bytes,1,opt,name=Topic" json:"Topic,omitempty"`
 	Attribute string `protobuf:"bytes,2,opt,name=Attribute" json:"Attribute,omitempty"`
@@ -815,7 +1026,7 @@ type TopicInfo struct {
 func (m *TopicInfo) Reset()                    { *m = TopicInfo{} }
 func (m *TopicInfo) String() string            { return proto.CompactTextString(m) }
 func (*TopicInfo) ProtoMessage()               {}
-func (*TopicInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{29} }
+func (*TopicInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{30} }
 
 func (m *TopicInfo) GetTopic() string {
 	if m != nil {
@@ -840,7 +1051,7 @@ type ReplyMessageHeader struct {
 func (m *ReplyMessageHeader) Reset()                    { *m = ReplyMessageHeader{} }
 func (m *ReplyMessageHeader) String() string            { return proto.CompactTextString(m) }
 func (*ReplyMessageHeader) ProtoMessage()               {}
-func (*ReplyMessageHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{30} }
+func (*ReplyMessageHeader) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{31} }
 
 func (m *ReplyMessageHeader) GetSuccess() bool {
 	if m != nil {
@@ -875,6 +1086,7 @@ func init() {
 	proto.RegisterType((*StatusReply)(nil), "api.StatusReply")
 	proto.RegisterType((*PluginsRequest)(nil), "api.PluginsRequest")
 	proto.RegisterType((*PluginsReply)(nil), "api.PluginsReply")
+	proto.RegisterType((*PluginInfo)(nil), "api.PluginInfo")
 	proto.RegisterType((*ServicesRequest)(nil), "api.ServicesRequest")
 	proto.RegisterType((*ServicesReply)(nil), "api.ServicesReply")
 	proto.RegisterType((*ServiceInfo)(nil), "api.ServiceInfo")
@@ -1328,76 +1540,84 @@ var _Api_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("api.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 1132 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xb4, 0x57, 0x5f, 0x8f, 0xdb, 0x44,
-	0x10, 0xaf, 0xf3, 0xef, 0x92, 0xc9, 0x5f, 0xb6, 0x07, 0x35, 0xe1, 0x8f, 0x4e, 0xab, 0xaa, 0x3a,
-	0x24, 0x14, 0xe0, 0x4e, 0xa2, 0x55, 0x11, 0xa0, 0x90, 0x1e, 0xa2, 0x12, 0x87, 0x8a, 0x53, 0x78,
-	0xe1, 0xc9, 0x71, 0xf6, 0x52, 0x73, 0x39, 0xdb, 0xd8, 0xeb, 0xb6, 0xf7, 0xca, 0x63, 0x3f, 0x05,
-	0xdf, 0x89, 0x2f, 0xc1, 0x97, 0x40, 0x42, 0xbb, 0x3b, 0xbb, 0xde, 0xf5, 0xb5, 0xa5, 0xe4, 0xc4,
-	0x5b, 0xe6, 0x37, 0xf3, 0x9b, 0x9d, 0x9d, 0xf1, 0xec, 0x4c, 0xa0, 0x17, 0x66, 0xf1, 0x2c, 0xcb,
-	0x53, 0x9e, 0x92, 0x66, 0x98, 0xc5, 0x74, 0x02, 0xa3, 0x9f, 0x59, 0x5e, 0xc4, 0x69, 0x12, 0xb0,
-	0xdf, 0x4a, 0x56, 0x70, 0x7a, 0x08, 0x03, 0x83, 0x64, 0xdb, 0x4b, 0xe2, 0xc3, 0x1e, 0xca, 0xbe,
-	0x77, 0xe0, 0x1d, 0xf6, 0x02, 0x2d, 0xd2, 0x13, 0x18, 0x7e, 0x93, 0xa7, 0xe7, 0x2c, 0x47, 0x2a,
-	0x99, 0x42, 0x77, 0x11, 0x72, 0xb6, 0x49, 0xf3, 0x4b, 0xb4, 0x35, 0xb2, 0x70, 0xb3, 0x64, 0xf9,
-	0xd3, 0x38, 0x62, 0x7e, 0x43, 0xb9, 0x41, 0x91, 0xfe, 0xd1, 0x80, 0xbe, 0xf6, 0x23, 0x0e, 0xfc,
-	0x04, 0x3a, 0xdf, 0xb1, 0x70, 0xcd, 0x72, 0xe9, 0xa3, 0x7f, 0x74, 0x6b, 0x26, 0x62, 0x96, 0xba,
-	0x53, 0x56, 0x14, 0xe1, 0x86, 0x29, 0x75, 0x80, 0x66, 0xe4, 0x33, 0x68, 0x2f, 0x79, 0xc8, 0x0b,
-	0xbf, 0x71, 0xd0, 0x3c, 0xec, 0x1f, 0xbd, 0x27, 0xed, 0x2d, 0x8f, 0x33, 0xa9, 0x3d, 0x49, 0x78,
-	0x7e, 0x19, 0x28, 0x4b, 0x72, 0x17, 0xf6, 0x4e, 0x19, 0xcf, 0xe3, 0xa8, 0xf0, 0x9b, 0x92, 0xf4,
-	0xc1, 0x15, 0x12, 0xea, 0x15, 0x4d, 0x5b, 0x4f, 0xef, 0x01, 0x54, 0xde, 0xc8, 0x04, 0x9a, 0xe7,
-	0x4c, 0xdf, 0x55, 0xfc, 0x24, 0xfb, 0xd0, 0x7e, 0x1a, 0x6e, 0x4b, 0x75, 0xc9, 0x56, 0xa0, 0x84,
-	0xfb, 0x8d, 0x7b, 0xde, 0xf4, 0x3e, 0x0c, 0x6c, 0x97, 0xff, 0x85, 0x4b, 0x57, 0x30, 0x5a, 0x6c,
-	0x63, 0x96, 0xf0, 0xe2, 0x5a, 0xa9, 0x96, 0x2c, 0xe9, 0xe7, 0xe1, 0xda, 0x6f, 0x22, 0x0b, 0x65,
-	0xfa, 0x2b, 0x0c, 0xcc, 0x19, 0x3b, 0x95, 0xe1, 0x23, 0xd8, 0x43, 0x07, 0x58, 0x88, 0xb1, 0x64,
-	0xe0, 0x01, 0xc9, 0x59, 0x1a, 0x68, 0x3d, 0x7d, 0xe1, 0x01, 0x54, 0xb8, 0x08, 0xeb, 0xa7, 0x82,
-	0xe5, 0x3f, 0x84, 0x17, 0x4c, 0x5f, 0x46, 0xcb, 0x84, 0x8a, 0xb0, 0x58, 0x98, 0x2c, 0x59, 0x21,
-	0xbf, 0x41, 0x71, 0xa3, 0x6e, 0xe0, 0x60, 0x82, 0xff, 0x88, 0x21, 0x1f, 0xaf, 0xa5, 0x65, 0x72,
-	0x00, 0xfd, 0x45, 0x9a, 0x24, 0x2c, 0xe2, 0x8f, 0xe3, 0x0b, 0xe6, 0xb7, 0xa4, 0xda, 0x86, 0xe8,
-	0x18, 0x86, 0xf3, 0xf5, 0x45, 0x9c, 0xe8, 0xdc, 0xd2, 0x21, 0xf4, 0x35, 0x90, 0x6d, 0x2f, 0x45,
-	0x8b, 0x2c, 0xb6, 0x65, 0xc1, 0xcd, 0x77, 0x4e, 0x47, 0x22, 0x26, 0x44, 0x84, 0xc5, 0x2f, 0x30,
-	0x0c, 0xd2, 0x92, 0xb3, 0x6b, 0x56, 0x67, 0x1f, 0xda, 0x8f, 0xd3, 0x2c, 0x8e, 0xf0, 0x0e, 0x4a,
-	0xa0, 0x67, 0xd0, 0xd7, 0xce, 0x77, 0x2a, 0xcb, 0x1d, 0xe8, 0x28, 0x3e, 0x56, 0x65, 0xa4, 0x08,
-	0x02, 0x92, 0x45, 0x41, 0x2d, 0xbd, 0x0b, 0x3d, 0x03, 0x56, 0xa1, 0x78, 0x56, 0x28, 0x02, 0x95,
-	0x26, 0xd2, 0x53, 0x2f, 0x50, 0x82, 0xc8, 0x9f, 0x68, 0x89, 0xd2, 0xe4, 0xef, 0x2b, 0xe8, 0x6b,
-	0x60, 0x97, 0x88, 0x45, 0xc2, 0x1f, 0x6d, 0xcb, 0x8d, 0x55, 0x91, 0x11, 0x0c, 0x0c, 0x22, 0x12,
-	0xbe, 0x81, 0x31, 0x26, 0xed, 0x8d, 0x52, 0x7e, 0x00, 0x7d, 0x34, 0x97, 0x9f, 0x88, 0x4a, 0xbb,
-	0x0d, 0x91, 0x77, 0xa0, 0xf3, 0x7d, 0x5c, 0x70, 0x96, 0x60, 0xee, 0x51, 0xa2, 0x09, 0x0c, 0xab,
-	0x83, 0x76, 0x4a, 0xff, 0xc7, 0xd0, 0xd5, 0x1e, 0xb0, 0x00, 0x13, 0x49, 0x41, 0x50, 0x96, 0xc0,
-	0x58, 0xd0, 0x3f, 0x3d, 0x13, 0xaa, 0xac, 0x43, 0x2d, 0x72, 0xef, 0x75, 0x91, 0x37, 0xec, 0xc8,
-	0xc9, 0xfb, 0xd0, 0x9b, 0x47, 0x11, 0xcb, 0x78, 0x9a, 0x17, 0xf2, 0x52, 0xad, 0xa0, 0x02, 0xc8,
-	0x87, 0x00, 0xa7, 0xe1, 0x73, 0xdd, 0xae, 0x2d, 0xa9, 0xb6, 0x10, 0x72, 0x07, 0x46, 0x8b, 0x32,
-	0xcf, 0x59, 0xc2, 0xb5, 0x4d, 0x5b, 0xda, 0xd4, 0x50, 0x72, 0x1b, 0x86, 0xcb, 0x27, 0x25, 0x5f,
-	0xa7, 0xcf, 0x92, 0x45, 0x5a, 0x26, 0xdc, 0xef, 0x48, 0x33, 0x17, 0xa4, 0x19, 0xec, 0x2f, 0xcb,
-	0x55, 0x11, 0xe5, 0x71, 0xc6, 0xe3, 0xd4, 0x94, 0xd5, 0x6e, 0x05, 0xef, 0xea, 0x43, 0xa5, 0xab,
-	0xd9, 0xa8, 0x55, 0x93, 0xc2, 0xc0, 0xf6, 0x86, 0x15, 0x73, 0x30, 0xfa, 0xbb, 0x07, 0xa4, 0x76,
-	0xe4, 0x4e, 0xd5, 0xfb, 0x02, 0x86, 0x8e, 0x1b, 0x2c, 0xe1, 0xdb, 0xaa, 0x84, 0x96, 0x46, 0xd6,
-	0xd1, 0xb5, 0xa5, 0x2b, 0x98, 0xd4, 0x4d, 0x9c, 0x17, 0xd8, 0x73, 0x5f, 0xe0, 0xaa, 0xe9, 0x1a,
-	0x76, 0xd3, 0x89, 0x42, 0x72, 0x9e, 0xc7, 0x2b, 0xd1, 0x78, 0xea, 0xae, 0x15, 0x40, 0xff, 0xf2,
-	0x44, 0x2b, 0xc8, 0x67, 0xf0, 0xff, 0x9b, 0x0d, 0xe4, 0x01, 0xc0, 0x22, 0x4d, 0xd6, 0xb1, 0xca,
-	0x41, 0x4b, 0xe6, 0xe0, 0x36, 0x7e, 0xc6, 0xce, 0xd9, 0xb3, 0xca, 0x4c, 0x0d, 0x4e, 0x8b, 0x37,
-	0xfd, 0x12, 0xc6, 0x35, 0xf5, 0xbf, 0x0d, 0xc1, 0xae, 0x3d, 0x04, 0x65, 0x2f, 0xea, 0xd3, 0x76,
-	0xef, 0x45, 0xe5, 0xa1, 0xd6, 0x8b, 0x12, 0xd4, 0xbd, 0xa8, 0x2c, 0xe8, 0xdf, 0x0d, 0xd1, 0x7c,
-	0x46, 0xf3, 0xda, 0xd2, 0xbd, 0xc9, 0x94, 0x9a, 0x01, 0xc1, 0xb0, 0x4e, 0xc3, 0xe7, 0x0f, 0x93,
-	0xb3, 0x6d, 0xbc, 0x79, 0xc2, 0xb1, 0x35, 0x5f, 0xa2, 0x21, 0x87, 0x30, 0x46, 0xd4, 0x18, 0xab,
-	0x46, 0xad, 0xc3, 0xa2, 0x5b, 0x0d, 0xf4, 0x63, 0xc9, 0x4a, 0xa6, 0xbb, 0xd5, 0x45, 0x2d, 0xbb,
-	0x07, 0x79, 0x9a, 0x65, 0x6c, 0x8d, 0xed, 0x5a, 0x43, 0xc5, 0xab, 0x33, 0x7f, 0x16, 0xc6, 0x3c,
-	0x4e, 0x36, 0x01, 0xdb, 0xfa, 0x7b, 0xd2, 0xc8, 0x86, 0xc4, 0x7d, 0xb5, 0xb8, 0x48, 0x2f, 0x32,
-	0xbf, 0x2b, 0x4d, 0x1c, 0xcc, 0xf6, 0x32, 0x8f, 0xce, 0xfd, 0x9e, 0xeb, 0x65, 0x1e, 0x9d, 0x8b,
-	0x4f, 0x7b, 0x91, 0xb3, 0x90, 0xb3, 0xf5, 0x9c, 0xfb, 0xa0, 0x3e, 0x6d, 0x03, 0x88, 0xa9, 0x2a,
-	0x3b, 0xe0, 0x9a, 0xcf, 0xc5, 0x2b, 0xa7, 0xaa, 0x76, 0xbe, 0xeb, 0x54, 0x55, 0x7c, 0x67, 0xaa,
-	0x4a, 0x48, 0x4d, 0x55, 0xa5, 0xa5, 0x5f, 0x43, 0xcf, 0x80, 0xaf, 0x98, 0xaa, 0x4e, 0x83, 0x37,
-	0xea, 0x0d, 0xfe, 0x2d, 0x90, 0xab, 0x61, 0xc8, 0x54, 0x94, 0x51, 0xc4, 0x8a, 0x42, 0xfa, 0xea,
-	0x06, 0x5a, 0x14, 0xf3, 0x20, 0x60, 0x61, 0x91, 0x9a, 0x79, 0xa0, 0xa4, 0xa3, 0x17, 0x6d, 0x68,
-	0xce, 0xb3, 0x98, 0x1c, 0x9b, 0x75, 0x9e, 0xdc, 0x94, 0x31, 0xbb, 0xeb, 0xff, 0xf4, 0x2d, 0x17,
-	0x14, 0xd3, 0xf6, 0x06, 0xf9, 0x14, 0x3a, 0x6a, 0x23, 0x22, 0x44, 0xaa, 0x9d, 0x7d, 0x69, 0x3a,
-	0x71, 0x30, 0xc5, 0x38, 0x16, 0xcb, 0xa0, 0x5c, 0x91, 0xf0, 0x18, 0x77, 0x85, 0xc2, 0x63, 0x9c,
-	0x2d, 0x4a, 0x1e, 0xa3, 0x96, 0x11, 0x3c, 0xc6, 0x59, 0xaa, 0xf0, 0x18, 0x6b, 0x17, 0x52, 0x0c,
-	0xb5, 0x6a, 0x20, 0xc3, 0x59, 0x44, 0x90, 0x61, 0xed, 0x22, 0x8a, 0xa1, 0xb6, 0x7c, 0x64, 0x38,
-	0xff, 0x60, 0x90, 0x61, 0xfd, 0x0d, 0x50, 0x57, 0xc1, 0xe5, 0x03, 0xaf, 0xe2, 0x2e, 0x27, 0x78,
-	0x15, 0x67, 0x3f, 0xb9, 0x41, 0x3e, 0xaf, 0xc6, 0x3e, 0xd9, 0xb7, 0x07, 0xbe, 0xa1, 0x91, 0x1a,
-	0xaa, 0x78, 0x27, 0xb5, 0x81, 0x43, 0xde, 0xbd, 0x32, 0x6a, 0x8c, 0x87, 0x5b, 0x2f, 0x53, 0x59,
-	0xe9, 0x57, 0x23, 0xfa, 0xa6, 0xb5, 0x85, 0x17, 0xf5, 0xf4, 0x57, 0xfb, 0xbe, 0x8e, 0x59, 0x3d,
-	0x7e, 0x26, 0x66, 0xe7, 0x75, 0x37, 0x31, 0x5b, 0xaf, 0xb0, 0x4a, 0xa9, 0xfa, 0xda, 0x31, 0xa5,
-	0x4e, 0xd7, 0x62, 0x4a, 0xad, 0x66, 0xa3, 0x37, 0x56, 0x1d, 0xf9, 0x0f, 0xf4, 0xf8, 0x9f, 0x00,
-	0x00, 0x00, 0xff, 0xff, 0x30, 0xe1, 0x4b, 0x7c, 0x8e, 0x0e, 0x00, 0x00,
+	// 1252 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xb4, 0x58, 0x5b, 0x6f, 0xdc, 0x44,
+	0x14, 0xae, 0xbd, 0x97, 0xec, 0x9e, 0xbd, 0x66, 0x1a, 0xa8, 0x31, 0x17, 0x45, 0xa3, 0xaa, 0x0a,
+	0x12, 0x0a, 0x90, 0x48, 0xb4, 0x2a, 0xe2, 0xb2, 0x6c, 0x82, 0xa8, 0xd4, 0x40, 0x71, 0x0a, 0xef,
+	0x8e, 0x77, 0xb2, 0x35, 0xd9, 0xd8, 0xc6, 0x1e, 0xb7, 0x8d, 0xc4, 0x03, 0x0f, 0x3c, 0x40, 0x9f,
+	0x78, 0x42, 0x3c, 0x21, 0xfe, 0x13, 0xbf, 0x07, 0x09, 0xcd, 0xd5, 0x33, 0x4e, 0x96, 0x26, 0x1b,
+	0x78, 0xdb, 0xf3, 0x9d, 0x8b, 0xcf, 0x9c, 0x33, 0xe7, 0xf8, 0xf3, 0x42, 0x37, 0xcc, 0xe2, 0xed,
+	0x2c, 0x4f, 0x69, 0x8a, 0x1a, 0x61, 0x16, 0xe3, 0x31, 0x0c, 0xbf, 0x25, 0x79, 0x11, 0xa7, 0x49,
+	0x40, 0xbe, 0x2f, 0x49, 0x41, 0xf1, 0x16, 0xf4, 0x35, 0x92, 0x2d, 0xce, 0x90, 0x07, 0x6b, 0x52,
+	0xf6, 0x9c, 0x4d, 0x67, 0xab, 0x1b, 0x28, 0x11, 0xef, 0xc3, 0xe0, 0xb3, 0x3c, 0x3d, 0x21, 0xb9,
+	0x74, 0x45, 0x3e, 0x74, 0xa6, 0x21, 0x25, 0xf3, 0x34, 0x3f, 0x93, 0xb6, 0x5a, 0x66, 0x61, 0x0e,
+	0x49, 0xfe, 0x34, 0x8e, 0x88, 0xe7, 0x8a, 0x30, 0x52, 0xc4, 0x7f, 0xba, 0xd0, 0x53, 0x71, 0xd8,
+	0x03, 0xdf, 0x85, 0xf6, 0x17, 0x24, 0x9c, 0x91, 0x9c, 0xc7, 0xe8, 0xed, 0xdc, 0xda, 0x66, 0x39,
+	0x73, 0xdd, 0x01, 0x29, 0x8a, 0x70, 0x4e, 0x84, 0x3a, 0x90, 0x66, 0xe8, 0x7d, 0x68, 0x1d, 0xd2,
+	0x90, 0x16, 0x9e, 0xbb, 0xd9, 0xd8, 0xea, 0xed, 0xbc, 0xce, 0xed, 0x8d, 0x88, 0xdb, 0x5c, 0xbb,
+	0x9f, 0xd0, 0xfc, 0x2c, 0x10, 0x96, 0xe8, 0x2e, 0xac, 0x1d, 0x10, 0x9a, 0xc7, 0x51, 0xe1, 0x35,
+	0xb8, 0xd3, 0x9b, 0xe7, 0x9c, 0xa4, 0x5e, 0xb8, 0x29, 0x6b, 0xff, 0x1e, 0x40, 0x15, 0x0d, 0x8d,
+	0xa1, 0x71, 0x42, 0xd4, 0x59, 0xd9, 0x4f, 0xb4, 0x01, 0xad, 0xa7, 0xe1, 0xa2, 0x14, 0x87, 0x6c,
+	0x06, 0x42, 0xb8, 0xef, 0xde, 0x73, 0xfc, 0xfb, 0xd0, 0x37, 0x43, 0x5e, 0xc5, 0x17, 0xff, 0xea,
+	0xc0, 0x70, 0xba, 0x88, 0x49, 0x42, 0x8b, 0x6b, 0xd5, 0x9a, 0x7b, 0xf1, 0x38, 0x0f, 0x66, 0x5e,
+	0x43, 0x7a, 0x49, 0x19, 0xbd, 0x0a, 0xed, 0xaf, 0x8e, 0x8f, 0x0b, 0x42, 0xbd, 0xe6, 0xa6, 0xb3,
+	0x35, 0x08, 0xa4, 0xc4, 0xd2, 0x7a, 0x18, 0x9f, 0xc6, 0xd4, 0x6b, 0x71, 0x58, 0x08, 0xf8, 0x47,
+	0x07, 0xfa, 0x3a, 0xa5, 0x95, 0xda, 0xf6, 0x36, 0xac, 0xc9, 0x00, 0xb2, 0x71, 0x23, 0xee, 0x21,
+	0xf3, 0x49, 0x8e, 0xd3, 0x40, 0xe9, 0x59, 0x0a, 0x8f, 0x53, 0x1a, 0x2e, 0x78, 0xce, 0x83, 0x40,
+	0x08, 0xf8, 0x85, 0x03, 0x50, 0x59, 0xb3, 0xb3, 0x7d, 0x53, 0x90, 0xfc, 0xcb, 0xf0, 0x94, 0xa8,
+	0x8a, 0x28, 0x19, 0x61, 0x96, 0x2c, 0x09, 0x93, 0x43, 0x52, 0xf0, 0x9b, 0xcc, 0xca, 0xd2, 0x09,
+	0x2c, 0x8c, 0xf9, 0x3f, 0x22, 0xd2, 0x5f, 0xd6, 0x46, 0xc9, 0x68, 0x13, 0x7a, 0xd3, 0x34, 0x49,
+	0x48, 0x44, 0x1f, 0xc7, 0xa7, 0x84, 0x17, 0xa8, 0x1b, 0x98, 0x10, 0x1e, 0xc1, 0x60, 0x32, 0x3b,
+	0x8d, 0x13, 0xd5, 0x20, 0x3c, 0x80, 0x9e, 0x02, 0xb2, 0xc5, 0x19, 0x1b, 0xb4, 0xe9, 0xa2, 0x2c,
+	0xa8, 0x9e, 0x16, 0x3c, 0x84, 0xbe, 0x46, 0x98, 0xc5, 0x2f, 0x0e, 0x0c, 0x82, 0xb4, 0xa4, 0xe4,
+	0x9a, 0x3d, 0xe6, 0xc5, 0xca, 0xe2, 0x48, 0x1e, 0x42, 0x08, 0x57, 0xec, 0xee, 0x0f, 0xd0, 0x53,
+	0xa9, 0xac, 0xd4, 0xdb, 0x3b, 0xd0, 0x16, 0xfe, 0xb2, 0xb5, 0x43, 0xe1, 0xc0, 0x20, 0xde, 0x59,
+	0xa9, 0x5d, 0xd2, 0xd8, 0xbb, 0xd0, 0xd5, 0xa6, 0xd5, 0x71, 0x1c, 0xf3, 0x38, 0x1b, 0xd0, 0xe2,
+	0x26, 0x3c, 0x7e, 0x37, 0x10, 0x02, 0x6b, 0x02, 0x9b, 0xce, 0x52, 0x37, 0xe1, 0x63, 0xe8, 0x29,
+	0x60, 0x95, 0x73, 0xe0, 0x4f, 0x61, 0xf8, 0x68, 0x51, 0xce, 0xe3, 0xe4, 0x52, 0x3d, 0x41, 0xd0,
+	0xe4, 0xb7, 0x47, 0x34, 0x84, 0xff, 0xc6, 0xdf, 0x41, 0x5f, 0x47, 0x58, 0x75, 0x4c, 0x64, 0x00,
+	0x6b, 0x4c, 0x04, 0x26, 0xc6, 0x44, 0xea, 0xf1, 0xcf, 0x0e, 0x40, 0x85, 0xeb, 0x74, 0x9c, 0x2a,
+	0x1d, 0x73, 0x9b, 0xbb, 0xd6, 0x36, 0x67, 0x57, 0x7c, 0x8f, 0x14, 0x51, 0x1e, 0x67, 0x94, 0x69,
+	0xc5, 0xe5, 0x31, 0x21, 0x56, 0x73, 0x56, 0x4c, 0x75, 0xfd, 0x85, 0xc0, 0xd0, 0xfd, 0x3c, 0x4f,
+	0x73, 0x7e, 0x81, 0xba, 0x81, 0x10, 0xf0, 0x1c, 0x46, 0xf2, 0x3e, 0x5e, 0xaa, 0x72, 0x9b, 0xd0,
+	0x93, 0xe6, 0x46, 0x01, 0x4d, 0x88, 0xdd, 0xdf, 0x87, 0x71, 0x41, 0x89, 0xca, 0x4c, 0x4a, 0x38,
+	0x81, 0x41, 0xf5, 0xa0, 0x95, 0x0a, 0xfc, 0x0e, 0x74, 0x54, 0x04, 0x59, 0xe1, 0x31, 0x77, 0x91,
+	0x20, 0x2f, 0xb1, 0xb6, 0xc0, 0x7f, 0x39, 0xd0, 0x33, 0x34, 0xf5, 0xcc, 0x9d, 0x7f, 0xcb, 0xdc,
+	0x35, 0x33, 0x47, 0x6f, 0x40, 0x77, 0x12, 0x45, 0x24, 0xa3, 0x69, 0x5e, 0xf0, 0x43, 0x35, 0x83,
+	0x0a, 0x40, 0x6f, 0x01, 0x1c, 0x84, 0xcf, 0xd5, 0x82, 0x6c, 0x72, 0xb5, 0x81, 0xa0, 0x3b, 0x30,
+	0x9c, 0x96, 0x79, 0x4e, 0x12, 0xaa, 0x6c, 0x5a, 0xdc, 0xa6, 0x86, 0xa2, 0xdb, 0x30, 0x38, 0x7c,
+	0x52, 0xd2, 0x59, 0xfa, 0x2c, 0x99, 0xa6, 0x65, 0x42, 0xbd, 0x36, 0x37, 0xb3, 0x41, 0xfc, 0x87,
+	0x03, 0x1b, 0x87, 0xe5, 0x91, 0xee, 0xb5, 0x6e, 0x9a, 0xb1, 0x66, 0x9c, 0xf3, 0xaf, 0x12, 0xd5,
+	0x4e, 0xb7, 0xd6, 0x4e, 0x0c, 0x7d, 0x33, 0x9a, 0x6c, 0x99, 0x85, 0x5d, 0x71, 0x21, 0xfd, 0xee,
+	0x00, 0xaa, 0x25, 0xb8, 0x52, 0xb3, 0x3f, 0x84, 0x81, 0x15, 0x46, 0x76, 0xfc, 0x15, 0xd1, 0x71,
+	0x43, 0xc3, 0xdb, 0x6e, 0xdb, 0x2e, 0xd9, 0x56, 0x47, 0x30, 0xae, 0x3b, 0x5a, 0xef, 0x59, 0xa7,
+	0xf6, 0x9e, 0xd5, 0x0b, 0xcd, 0x35, 0x17, 0x1a, 0xbb, 0x0d, 0x94, 0xe6, 0xf1, 0x11, 0x5b, 0x6a,
+	0xa2, 0x5e, 0x15, 0x80, 0x7f, 0x73, 0x61, 0x24, 0xdf, 0x53, 0xff, 0x23, 0x03, 0xd8, 0x03, 0x98,
+	0xa6, 0xc9, 0x2c, 0x16, 0x95, 0x69, 0xf2, 0xca, 0xdc, 0x96, 0xb3, 0x60, 0x3d, 0x7b, 0xbb, 0x32,
+	0x13, 0xfc, 0xc8, 0xf0, 0x33, 0x1a, 0xdb, 0xba, 0xb8, 0xb1, 0x6d, 0xa3, 0xb1, 0xfe, 0x47, 0x30,
+	0xaa, 0x05, 0x7b, 0x19, 0x33, 0xea, 0x98, 0xcc, 0xe8, 0x27, 0x07, 0x06, 0x55, 0x72, 0xab, 0xcf,
+	0x7f, 0x51, 0x18, 0xb7, 0x61, 0x6c, 0x9e, 0x59, 0xcd, 0xbf, 0xb0, 0x58, 0x72, 0x07, 0xfe, 0x76,
+	0xa1, 0x27, 0x4d, 0x5e, 0xda, 0xff, 0xcb, 0x70, 0x91, 0x6d, 0x40, 0x32, 0xd9, 0x83, 0xf0, 0xf9,
+	0x83, 0xe4, 0x78, 0x11, 0xcf, 0x9f, 0x50, 0xb9, 0x24, 0x2e, 0xd0, 0xa0, 0x2d, 0x18, 0x49, 0x54,
+	0x1b, 0x8b, 0x95, 0x51, 0x87, 0xd9, 0xde, 0xd0, 0xd0, 0xd7, 0x25, 0x29, 0x89, 0xda, 0x1b, 0x36,
+	0x6a, 0xd8, 0xed, 0xe5, 0x69, 0x96, 0x91, 0x99, 0x5c, 0x1c, 0x35, 0x94, 0xed, 0xbf, 0xc9, 0xb3,
+	0x30, 0xa6, 0x71, 0x32, 0x0f, 0xc8, 0xc2, 0x5b, 0xe3, 0x46, 0x26, 0xc4, 0xce, 0xab, 0xc4, 0x69,
+	0x7a, 0x9a, 0x79, 0x1d, 0x6e, 0x62, 0x61, 0x66, 0x94, 0x49, 0x74, 0xe2, 0x75, 0xed, 0x28, 0x93,
+	0xe8, 0x84, 0xcd, 0xc7, 0x34, 0x27, 0x21, 0x25, 0xb3, 0x09, 0xf5, 0x40, 0xcc, 0x87, 0x06, 0x38,
+	0x77, 0xe2, 0x73, 0x74, 0xcd, 0xc5, 0xf5, 0x1f, 0x71, 0x27, 0x95, 0xca, 0xaa, 0xdc, 0x49, 0xf8,
+	0x5b, 0xdc, 0x89, 0x43, 0x82, 0x3b, 0x09, 0xed, 0x92, 0x9b, 0xf8, 0x09, 0x74, 0xb5, 0xe9, 0x12,
+	0xee, 0x64, 0xad, 0x1a, 0xb7, 0xbe, 0x6a, 0x3e, 0x07, 0x74, 0x3e, 0x39, 0x5e, 0xce, 0x32, 0x8a,
+	0x48, 0x51, 0xf0, 0x58, 0x9d, 0x40, 0x89, 0xac, 0x38, 0x01, 0x09, 0x0b, 0x4d, 0x28, 0xa4, 0xb4,
+	0xf3, 0xa2, 0x05, 0x8d, 0x49, 0x16, 0xa3, 0x5d, 0xcd, 0x38, 0xd0, 0x4d, 0x7e, 0x12, 0xfb, 0x7b,
+	0xd3, 0x5f, 0xb7, 0x41, 0xc6, 0x84, 0x6f, 0xa0, 0xf7, 0xa0, 0x2d, 0xc8, 0x33, 0x42, 0x5c, 0x6d,
+	0x51, 0x6b, 0x7f, 0x6c, 0x61, 0xc2, 0x63, 0x17, 0xd6, 0x24, 0x9b, 0x96, 0x8f, 0xb1, 0xd9, 0xb6,
+	0xbf, 0x6e, 0x83, 0xfa, 0x31, 0x92, 0x88, 0xa2, 0x8a, 0xa0, 0xd6, 0x1e, 0x63, 0xf0, 0x60, 0xe1,
+	0x21, 0x08, 0xa5, 0xf4, 0xb0, 0xe8, 0xa6, 0x3f, 0xb6, 0x30, 0xed, 0x21, 0x3e, 0x2b, 0xa5, 0x87,
+	0xf5, 0xc9, 0xec, 0x8f, 0x2d, 0x4c, 0x1f, 0x45, 0x32, 0x3a, 0x79, 0x14, 0x9b, 0x82, 0xfa, 0xeb,
+	0x36, 0x28, 0x9c, 0x3e, 0xa8, 0x58, 0x0c, 0xda, 0x30, 0xf9, 0x8b, 0x76, 0x43, 0x35, 0x54, 0xf8,
+	0xed, 0xd7, 0x5e, 0x88, 0xe8, 0xb5, 0x73, 0xaf, 0x42, 0x1d, 0xe1, 0xd6, 0x45, 0x2a, 0xa3, 0xfc,
+	0x82, 0x71, 0xdc, 0x34, 0x3e, 0xe3, 0x8a, 0x7a, 0xf9, 0xab, 0x0f, 0x46, 0x95, 0xb3, 0xda, 0xab,
+	0x17, 0xbd, 0x67, 0x7c, 0x54, 0x43, 0x75, 0x49, 0xe5, 0x0c, 0xa0, 0x6a, 0x36, 0x6a, 0x4d, 0x30,
+	0x46, 0x10, 0xdf, 0x38, 0x6a, 0xf3, 0xbf, 0x3c, 0x76, 0xff, 0x19, 0x00, 0x08, 0xae, 0x03, 0x7c,
+	0xff, 0x10, 0x00, 0x00,
 }
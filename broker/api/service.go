@@ -18,6 +18,7 @@ import (
 	"sync"
 
 	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/plugins"
 	"github.com/cloustone/sentel/core"
 
 	"github.com/golang/glog"
@@ -111,7 +112,9 @@ func (s *ApiService) Routes(ctx context.Context, req *RoutesRequest) (*RoutesRep
 	switch req.Category {
 	case "list":
 		routes := mgr.GetRoutes(req.Service)
-		for _, route := range routes {
+		reply.Total = uint32(len(routes))
+		start, end := page(len(routes), req.Offset, req.Limit)
+		for _, route := range routes[start:end] {
 			reply.Routes = append(reply.Routes, &RouteInfo{Topic: route.Topic, Route: route.Route})
 		}
 	case "show":
@@ -144,8 +147,42 @@ func (s *ApiService) Broker(ctx context.Context, req *BrokerRequest) (*BrokerRep
 	return nil, fmt.Errorf("Invalid broker request with categoru:%s", req.Category)
 }
 
+// Plugins delegate plugins command
 func (s *ApiService) Plugins(ctx context.Context, req *PluginsRequest) (*PluginsReply, error) {
-	return nil, nil
+	reply := &PluginsReply{
+		Header:  &ReplyMessageHeader{Success: true},
+		Plugins: []*PluginInfo{},
+	}
+	var err error
+	switch req.Category {
+	case "list", "":
+	case "start":
+		err = plugins.StartPlugin(req.Name)
+	case "stop":
+		err = plugins.StopPlugin(req.Name)
+	case "reload":
+		err = plugins.ReloadPlugin(req.Name)
+	default:
+		return nil, fmt.Errorf("Invalid plugins command category:%s", req.Category)
+	}
+	if err != nil {
+		reply.Header.Success = false
+		reply.Header.Reason = fmt.Sprintf("%v", err)
+	}
+	for _, plugin := range plugins.GetPlugins() {
+		if req.Name != "" && plugin.Name != req.Name {
+			continue
+		}
+		reply.Plugins = append(reply.Plugins,
+			&PluginInfo{
+				Name:        plugin.Name,
+				Version:     plugin.Version,
+				Description: plugin.Description,
+				State:       plugin.State,
+				Error:       plugin.Error,
+			})
+	}
+	return reply, nil
 }
 
 // Services delegate  services command
@@ -167,6 +204,7 @@ func (s *ApiService) Services(ctx context.Context, req *ServicesRequest) (*Servi
 					MaxClients:     service.MaxClients,
 					CurrentClients: service.CurrentClients,
 					ShutdownCount:  service.ShutdownCount,
+					Status:         service.Status,
 				})
 		}
 
@@ -174,7 +212,7 @@ func (s *ApiService) Services(ctx context.Context, req *ServicesRequest) (*Servi
 	case "stop":
 	}
 
-	return nil, nil
+	return reply, nil
 }
 
 //Subscriptions delete subscriptions command
@@ -187,7 +225,9 @@ func (s *ApiService) Subscriptions(ctx context.Context, req *SubscriptionsReques
 	switch req.Category {
 	case "list":
 		subs := mgr.GetSubscriptions(req.Service)
-		for _, sub := range subs {
+		reply.Total = uint32(len(subs))
+		start, end := page(len(subs), req.Offset, req.Limit)
+		for _, sub := range subs[start:end] {
 			reply.Subscriptions = append(reply.Subscriptions,
 				&SubscriptionInfo{
 					ClientId:  sub.ClientId,
@@ -196,8 +236,11 @@ func (s *ApiService) Subscriptions(ctx context.Context, req *SubscriptionsReques
 				})
 		}
 	case "show":
-		sub := mgr.GetSubscription(req.Service, req.Subscription)
-		if sub != nil {
+		// Subscriptions of all clients on the topic
+		subs := mgr.GetTopicSubscriptions(req.Service, req.Subscription)
+		reply.Total = uint32(len(subs))
+		start, end := page(len(subs), req.Offset, req.Limit)
+		for _, sub := range subs[start:end] {
 			reply.Subscriptions = append(reply.Subscriptions,
 				&SubscriptionInfo{
 					ClientId:  sub.ClientId,
@@ -221,7 +264,9 @@ func (s *ApiService) Clients(ctx context.Context, req *ClientsRequest) (*Clients
 	case "list":
 		// Get all client information for specified service
 		clients := mgr.GetClients(req.Service)
-		for _, client := range clients {
+		reply.Total = uint32(len(clients))
+		start, end := page(len(clients), req.Offset, req.Limit)
+		for _, client := range clients[start:end] {
 			reply.Clients = append(reply.Clients,
 				&ClientInfo{
 					UserName:     client.UserName,
@@ -262,7 +307,9 @@ func (s *ApiService) Sessions(ctx context.Context, req *SessionsRequest) (*Sessi
 	switch req.Category {
 	case "list":
 		sessions := mgr.GetSessions(req.Service, req.Conditions)
-		for _, session := range sessions {
+		reply.Total = uint32(len(sessions))
+		start, end := page(len(sessions), req.Offset, req.Limit)
+		for _, session := range sessions[start:end] {
 			reply.Sessions = append(reply.Sessions,
 				&SessionInfo{
 					ClientId:           session.ClientId,
@@ -307,7 +354,9 @@ func (s *ApiService) Topics(ctx context.Context, req *TopicsRequest) (*TopicsRep
 	switch req.Category {
 	case "list":
 		topics := mgr.GetTopics(req.Service)
-		for _, topic := range topics {
+		reply.Total = uint32(len(topics))
+		start, end := page(len(topics), req.Offset, req.Limit)
+		for _, topic := range topics[start:end] {
 			reply.Topics = append(reply.Topics,
 				&TopicInfo{
 					Topic:     topic.Topic,
@@ -326,3 +375,17 @@ func (s *ApiService) Topics(ctx context.Context, req *TopicsRequest) (*TopicsRep
 	}
 	return reply, nil
 }
+
+// page return range of list items in the page with offset and limit, all
+// items after offset are in the page if limit is zero
+func page(total int, offset uint32, limit uint32) (int, int) {
+	start := int(offset)
+	if start > total {
+		start = total
+	}
+	end := total
+	if limit > 0 && start+int(limit) < total {
+		end = start + int(limit)
+	}
+	return start, end
+}
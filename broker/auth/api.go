@@ -84,7 +84,10 @@ func (auth *AuthApi) GetPskKey(ctx context.Context, hint string, identity string
 		Hint:     hint,
 		Username: identity,
 	})
-	return reply.Key, err
+	if err != nil {
+		return "", err
+	}
+	return reply.Key, nil
 }
 
 func (auth *AuthApi) Close() {
@@ -92,8 +95,8 @@ func (auth *AuthApi) Close() {
 }
 
 func NewAuthApi(c core.Config) (IAuthAPI, error) {
-	address := ""
-	if address, err := c.String("auth", "address"); err != nil || address == "" {
+	address, err := c.String("auth", "address")
+	if err != nil || address == "" {
 		return nil, fmt.Errorf("Invalid autlet address:'%s'", address)
 	}
 
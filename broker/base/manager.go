@@ -14,6 +14,7 @@ package base
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 
@@ -133,7 +134,7 @@ func (s *ServiceManager) StopService(id string) error {
 func (s *ServiceManager) GetServicesByName(name string) []Service {
 	services := []Service{}
 	for k, service := range s.services {
-		if strings.IndexAny(k, name) >= 0 {
+		if strings.Contains(k, name) {
 			services = append(services, service)
 		}
 	}
@@ -151,11 +152,12 @@ func (s *ServiceManager) GetAllProtocolServices() []ProtocolService {
 	return services
 }
 
-// GetProtocolServiceByname return protocol services by name
+// GetProtocolServiceByname return protocol services by name, or matched by
+// part of name, all protocol services are returned if name is empty
 func (s *ServiceManager) GetProtocolServices(name string) []ProtocolService {
 	services := []ProtocolService{}
 	for k, service := range s.services {
-		if strings.IndexAny(k, name) >= 0 {
+		if strings.Contains(k, name) {
 			if p, ok := service.(ProtocolService); ok {
 				services = append(services, p)
 			}
@@ -207,6 +209,8 @@ func (s *ServiceManager) GetClients(serviceName string) []*ClientInfo {
 		list := service.GetClients()
 		clients = append(clients, list...)
 	}
+	// Clients are sorted so that they are listed in pages
+	sort.Slice(clients, func(i, j int) bool { return clients[i].PeerName < clients[j].PeerName })
 	return clients
 }
 
@@ -239,12 +243,19 @@ func (s *ServiceManager) GetSessions(serviceName string, conditions map[string]b
 	sessions := []*SessionInfo{}
 	services := s.GetProtocolServices(serviceName)
 
+	// Services of the same protocol share storage, sessions are reported
+	// only once
+	found := make(map[string]bool)
 	for _, service := range services {
-		list := service.GetSessions(conditions)
-		sessions = append(sessions, list...)
+		for _, info := range service.GetSessions(conditions) {
+			if !found[info.ClientId] {
+				found[info.ClientId] = true
+				sessions = append(sessions, info)
+			}
+		}
 	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ClientId < sessions[j].ClientId })
 	return sessions
-
 }
 
 // GetSession return specified session information with session id
@@ -264,10 +275,16 @@ func (s *ServiceManager) GetRoutes(serviceName string) []*RouteInfo {
 	routes := []*RouteInfo{}
 	services := s.GetProtocolServices(serviceName)
 
+	found := make(map[string]bool)
 	for _, service := range services {
-		list := service.GetRoutes()
-		routes = append(routes, list...)
+		for _, route := range service.GetRoutes() {
+			if !found[route.Topic] {
+				found[route.Topic] = true
+				routes = append(routes, route)
+			}
+		}
 	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Topic < routes[j].Topic })
 	return routes
 }
 
@@ -289,10 +306,16 @@ func (s *ServiceManager) GetTopics(serviceName string) []*TopicInfo {
 	topics := []*TopicInfo{}
 	services := s.GetProtocolServices(serviceName)
 
+	found := make(map[string]bool)
 	for _, service := range services {
-		list := service.GetTopics()
-		topics = append(topics, list...)
+		for _, topic := range service.GetTopics() {
+			if !found[topic.Topic] {
+				found[topic.Topic] = true
+				topics = append(topics, topic)
+			}
+		}
 	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
 	return topics
 }
 
@@ -315,23 +338,41 @@ func (s *ServiceManager) GetSubscriptions(serviceName string) []*SubscriptionInf
 	services := s.GetProtocolServices(serviceName)
 
 	for _, service := range services {
-		list := service.GetSubscriptions()
-		subs = append(subs, list...)
+		subs = append(subs, service.GetSubscriptions()...)
 	}
-	return subs
+	return uniqueSubscriptions(subs)
 }
 
-// GetSubscription return subscription information for specified topic
-func (s *ServiceManager) GetSubscription(serviceName string, sub string) *SubscriptionInfo {
+// GetTopicSubscriptions return subscriptions of clients on specified topic
+func (s *ServiceManager) GetTopicSubscriptions(serviceName string, topic string) []*SubscriptionInfo {
+	subs := []*SubscriptionInfo{}
 	services := s.GetProtocolServices(serviceName)
 
 	for _, service := range services {
-		info := service.GetSubscription(sub)
-		if info != nil {
-			return info
+		subs = append(subs, service.GetTopicSubscriptions(topic)...)
+	}
+	return uniqueSubscriptions(subs)
+}
+
+// uniqueSubscriptions remove subscriptions reported by services sharing
+// storage, and sort them by topic and client id
+func uniqueSubscriptions(subs []*SubscriptionInfo) []*SubscriptionInfo {
+	found := make(map[string]bool)
+	list := []*SubscriptionInfo{}
+	for _, sub := range subs {
+		key := sub.ClientId + "\x00" + sub.Topic
+		if !found[key] {
+			found[key] = true
+			list = append(list, sub)
 		}
 	}
-	return nil
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Topic != list[j].Topic {
+			return list[i].Topic < list[j].Topic
+		}
+		return list[i].ClientId < list[j].ClientId
+	})
+	return list
 }
 
 // GetAllServiceInfo return all service information
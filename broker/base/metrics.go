@@ -41,7 +41,15 @@ func (m *Metrics) Get() map[string]uint64 {
 	}
 	return m.metrics
 }
-func (m *Metrics) addMetric(name string, value uint64) {
+func (m *Metrics) GetMetric(name string) uint64 {
+	if m.mutex != nil {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+	}
+	return m.metrics[name]
+}
+
+func (m *Metrics) AddMetric(name string, value uint64) {
 	if m.mutex != nil {
 		m.mutex.Lock()
 		defer m.mutex.Unlock()
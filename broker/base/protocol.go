@@ -19,6 +19,8 @@ type ClientInfo struct {
 	CleanSession bool
 	PeerName     string
 	ConnectTime  string
+	TLSVersion   string
+	TLSCipher    string
 }
 
 // SessionInfo
@@ -73,7 +75,7 @@ type ProtocolService interface {
 
 	// Route info
 	GetRoutes() []*RouteInfo
-	GetRoute(id string) *RouteInfo
+	GetRoute(topic string) *RouteInfo
 
 	// Topic info
 	GetTopics() []*TopicInfo
@@ -81,7 +83,7 @@ type ProtocolService interface {
 
 	// SubscriptionInfo
 	GetSubscriptions() []*SubscriptionInfo
-	GetSubscription(id string) *SubscriptionInfo
+	GetTopicSubscriptions(topic string) []*SubscriptionInfo
 }
 
 type SessionObserver interface {
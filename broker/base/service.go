@@ -14,6 +14,7 @@ package base
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/cloustone/sentel/core"
 
@@ -28,6 +29,7 @@ type ServiceInfo struct {
 	MaxClients     uint64
 	CurrentClients uint64
 	ShutdownCount  uint64
+	Status         string
 }
 type Service interface {
 	Info() *ServiceInfo
@@ -52,12 +54,19 @@ func RegisterService(name string, configs map[string]string, factory ServiceFact
 	_serviceFactories[name] = factory
 }
 
-// CreateService create service instance according to service name
+// CreateService create service instance according to service name, service
+// named "type:instance" is created by factory of type if the name itself is
+// not registered
 func CreateService(name string, c core.Config, ch chan ServiceCommand) (Service, error) {
 	glog.Infof("Creating service '%s'...", name)
 
 	if factory, ok := _serviceFactories[name]; ok && factory != nil {
-		return _serviceFactories[name].New(name, c, ch)
+		return factory.New(name, c, ch)
+	}
+	if index := strings.Index(name, ":"); index > 0 {
+		if factory, ok := _serviceFactories[name[:index]]; ok && factory != nil {
+			return factory.New(name, c, ch)
+		}
 	}
 	return nil, fmt.Errorf("Invalid service '%s'", name)
 }
@@ -50,6 +50,22 @@ func (s *Stats) AddStat(name string, value uint64) {
 	s.stats[name] += value
 }
 
+func (s *Stats) SetStat(name string, value uint64) {
+	if s.mutex != nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	s.stats[name] = value
+}
+
+func (s *Stats) GetStat(name string) uint64 {
+	if s.mutex != nil {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	return s.stats[name]
+}
+
 func (s *Stats) AddStats(stats *Stats) {
 	if s.mutex != nil {
 		s.mutex.Lock()
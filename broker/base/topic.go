@@ -0,0 +1,35 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package base
+
+import "strings"
+
+// MatchTopic check whether topic match filter with wildcards as mqtt
+// subscription does, topic beginning with $ is not matched by filter
+// beginning with wildcard
+func MatchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filters := strings.Split(filter, "/")
+	topics := strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(topics) || (f != "+" && f != topics[i]) {
+			return false
+		}
+	}
+	return len(filters) == len(topics)
+}
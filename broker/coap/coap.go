@@ -14,30 +14,61 @@ package coap
 
 import (
 	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/cloustone/sentel/broker/auth"
 	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/mqtt"
 	"github.com/cloustone/sentel/core"
 
-	uuid "src/github.com/satori/go.uuid"
+	uuid "github.com/satori/go.uuid"
 
 	"github.com/golang/glog"
 )
 
 const (
 	protocolName = "coap"
+	maxDatagram  = 65535
+)
+
+// Stats and metrics of coap service
+const (
+	statSessionsCount      = "sessions/count"
+	statObservationsCount  = "observations/count"
+	metricPacketReceived   = "packets/received"
+	metricPacketSent       = "packets/sent"
+	metricPacketDuplicated = "packets/duplicated"
+	metricPacketResent     = "packets/retransmitted"
+	metricMessageReceived  = "messages/received"
+	metricMessageSent      = "messages/sent"
+	metricMessageDropped   = "messages/dropped"
 )
 
 type coap struct {
-	config     core.Config
-	chn        chan base.ServiceCommand
-	index      int64
-	sessions   map[string]base.Session
-	mutex      sync.Mutex // Maybe not so good
-	protocol   uint8
-	wg         sync.WaitGroup
-	localAddrs []string
+	config          core.Config
+	chn             chan base.ServiceCommand
+	sessions        map[string]*coapSession // Sessions keyed by endpoint address
+	mutex           sync.Mutex              // Maybe not so good
+	protocol        string
+	wg              sync.WaitGroup
+	localAddrs      []string
+	gateway         *mqtt.Gateway
+	authapi         auth.IAuthAPI
+	conn            net.PacketConn
+	resources       []*resource
+	stats           *base.Stats
+	metrics         *base.Metrics
+	blockSzx        uint8         // Preferred block size exponent in block-wise transfer
+	sizeLimit       int           // Max payload size of published message
+	sessionTimeout  time.Duration // Idle endpoint without observation is removed
+	notifyQueueSize int
+	allowAnonymous  bool
+	quit            chan bool
 }
 
 // CoapFactory
@@ -60,102 +91,303 @@ func (m *CoapFactory) New(protocol string, c core.Config, ch chan base.ServiceCo
 	if len(localAddrs) == 0 {
 		return nil, errors.New("Failed to get local address")
 	}
+	// Messages are routed through storage shared with mqtt
+	gateway, err := mqtt.GetGateway(c)
+	if err != nil {
+		return nil, err
+	}
+	authapi, err := auth.NewAuthApi(c)
+	if err != nil {
+		return nil, err
+	}
 	t := &coap{config: c,
-		chn:        ch,
-		index:      -1,
-		sessions:   make(map[string]base.Session),
-		protocol:   2,
-		localAddrs: localAddrs,
+		chn:             ch,
+		sessions:        make(map[string]*coapSession),
+		protocol:        protocol,
+		localAddrs:      localAddrs,
+		gateway:         gateway,
+		authapi:         authapi,
+		stats:           base.NewStats(true),
+		metrics:         base.NewMetrics(true),
+		blockSzx:        6,
+		sessionTimeout:  300 * time.Second,
+		notifyQueueSize: 256,
+		quit:            make(chan bool),
+	}
+	if size, err := c.Int(protocol, "block_size"); err == nil && size >= 16 {
+		t.blockSzx = blockSzx(size)
+	}
+	if limit, err := c.Int(protocol, "message_size_limit"); err == nil && limit > 0 {
+		t.sizeLimit = limit
+	}
+	if timeout, err := c.Int(protocol, "session_timeout"); err == nil && timeout > 0 {
+		t.sessionTimeout = time.Duration(timeout) * time.Second
+	}
+	if size, err := c.Int(protocol, "notify_queue_size"); err == nil && size > 0 {
+		t.notifyQueueSize = size
+	}
+	t.allowAnonymous, _ = c.Bool(protocol, "allow_anonymous")
+	t.resources = []*resource{
+		{path: ".well-known/core", handler: t.handleDiscovery},
+		{path: pubsubPath + "/", prefix: true, handler: t.handlePubSub},
 	}
 	return t, nil
 }
 
-// MQTT Service
+// Coap Service
 
-func (m *coap) NewSession(conn net.Conn) (base.Session, error) {
-	id := m.CreateSessionId()
-	s, err := newCoapSession(m, conn, id)
-	return s, err
+// newSession create session for endpoint which send the first datagram
+func (m *coap) newSession(addr net.Addr) *coapSession {
+	return newCoapSession(m, addr, m.createSessionId())
 }
 
-// CreateSessionId create id for new session
-func (m *coap) CreateSessionId() string {
+// createSessionId create id for new session
+func (m *coap) createSessionId() string {
 	return uuid.NewV4().String()
 }
 
-// GetSessionTotalCount get total session count
-func (m *coap) GetSessionTotalCount() int64 {
+// getSessionTotalCount get total session count
+func (m *coap) getSessionTotalCount() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	return int64(len(m.sessions))
 }
 
-func (m *coap) RemoveSession(s base.Session) {
+// removeSession remove session of endpoint
+func (m *coap) removeSession(s *coapSession) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	m.sessions[s.Identifier()] = nil
+	if m.sessions[s.addr.String()] == s {
+		delete(m.sessions, s.addr.String())
+	}
+	m.stats.SetStat(statSessionsCount, uint64(len(m.sessions)))
 }
-func (m *coap) RegisterSession(s base.Session) {
+
+// dispatch pass datagram to session of endpoint, session is created and
+// launched for new endpoint
+func (m *coap) dispatch(addr net.Addr, data []uint8) {
+	m.metrics.AddMetric(metricPacketReceived, 1)
 	m.mutex.Lock()
-	m.sessions[s.Identifier()] = s
+	s, ok := m.sessions[addr.String()]
+	if !ok {
+		s = m.newSession(addr)
+		if l, ok := m.conn.(*dtlsListener); ok {
+			s.authenticate(l.identity(addr))
+		}
+		m.sessions[addr.String()] = s
+		m.stats.SetStat(statSessionsCount, uint64(len(m.sessions)))
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			s.Handle()
+		}()
+	}
 	m.mutex.Unlock()
+	s.receive(data)
 }
 
-// Start
+// closeSession remove session of endpoint whose secure session is closed
+func (m *coap) closeSession(addr net.Addr) {
+	m.mutex.Lock()
+	s, ok := m.sessions[addr.String()]
+	m.mutex.Unlock()
+	if ok {
+		s.Destroy()
+	}
+}
+
+// writeTo send datagram to endpoint
+func (m *coap) writeTo(data []uint8, addr net.Addr) error {
+	m.metrics.AddMetric(metricPacketSent, 1)
+	_, err := m.conn.WriteTo(data, addr)
+	return err
+}
+
+// getSessions return sessions in order of creation
+func (m *coap) getSessions() []*coapSession {
+	m.mutex.Lock()
+	sessions := make([]*coapSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].createdAt.Before(sessions[j].createdAt) })
+	return sessions
+}
+
+// findSession return session with id
+func (m *coap) findSession(id string) *coapSession {
+	for _, s := range m.getSessions() {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// listen create packet connection according to service's transport, all
+// transports share the same session handling
+func (m *coap) listen(host string) (net.PacketConn, error) {
+	switch m.protocol {
+	case "coap:dtls":
+		return newDTLSListener(m, host)
+	default:
+		return net.ListenPacket("udp", host)
+	}
+}
+
+// Start listen on address and dispatch datagrams to sessions
 func (m *coap) Start() error {
-	host, _ := m.config.String("coap", "host")
+	host, _ := m.config.String(m.protocol, "listen")
 
-	listen, err := net.Listen("tcp", host)
+	conn, err := m.listen(host)
 	if err != nil {
 		glog.Errorf("Coap listen failed:%s", err)
 		return err
 	}
+	m.conn = conn
 	glog.Infof("Coap server is listening on '%s'...", host)
+	buf := make([]uint8, maxDatagram)
 	for {
-		conn, err := listen.Accept()
+		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			select {
+			case <-m.quit:
+				return nil
+			default:
+			}
+			glog.Errorf("Coap failed to read datagram:%s", err)
 			continue
 		}
-		session, err := m.NewSession(conn)
-		if err != nil {
-			glog.Error("Mqtt create session failed")
-			return err
-		}
-		glog.Infof("Mqtt new connection:%s", session.Identifier())
-		m.RegisterSession(session)
-		go session.Handle()
+		m.dispatch(addr, append([]uint8{}, buf[:n]...))
 	}
-	// notify main
-	m.chn <- 1
-	return nil
 }
 
-func (m *coap) Stop() {}
+// Stop close listener and remove all sessions
+func (m *coap) Stop() {
+	close(m.quit)
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	for _, s := range m.getSessions() {
+		s.Destroy()
+	}
+	m.wg.Wait()
+}
+
+// Info
+func (m *coap) Info() *base.ServiceInfo { return m.GetServiceInfo() }
 
-// Name
-func (m *coap) Info() *base.ServiceInfo {
-	return &base.ServiceInfo{
-		ServiceName: "coap",
+func (m *coap) GetMetrics() *base.Metrics { return m.metrics }
+
+// GetStats return stats with observation count of all endpoints
+func (m *coap) GetStats() *base.Stats {
+	count := uint64(0)
+	for _, s := range m.getSessions() {
+		count += s.stats.GetStat(statObservationsCount)
+	}
+	m.stats.SetStat(statObservationsCount, count)
+	return m.stats
+}
+
+// GetClients return endpoints talking with service
+func (m *coap) GetClients() []*base.ClientInfo {
+	clients := []*base.ClientInfo{}
+	for _, s := range m.getSessions() {
+		clients = append(clients, s.clientInfo())
+	}
+	return clients
+}
+
+// GetClient return endpoint with session id
+func (m *coap) GetClient(id string) *base.ClientInfo {
+	if s := m.findSession(id); s != nil {
+		return s.clientInfo()
+	}
+	return nil
+}
+
+// KickoffClient remove session and observations of endpoint
+func (m *coap) KickoffClient(id string) error {
+	if s := m.findSession(id); s != nil {
+		return s.Destroy()
 	}
+	return fmt.Errorf("Client '%s' is not found", id)
 }
 
-func (m *coap) GetMetrics() *base.Metrics            { return nil }
-func (m *coap) GetStats() *base.Stats                { return nil }
-func (m *coap) GetClients() []*base.ClientInfo       { return nil }
-func (m *coap) GetClient(id string) *base.ClientInfo { return nil }
-func (m *coap) KickoffClient(id string) error        { return nil }
+// GetSessions return sessions of all endpoints, coap sessions are always
+// transient
+func (m *coap) GetSessions(conditions map[string]bool) []*base.SessionInfo {
+	sessions := []*base.SessionInfo{}
+	if conditions["persistent"] && !conditions["transient"] {
+		return sessions
+	}
+	for _, s := range m.getSessions() {
+		sessions = append(sessions, s.Info())
+	}
+	return sessions
+}
 
-func (m *coap) GetSessions(conditions map[string]bool) []*base.SessionInfo { return nil }
-func (m *coap) GetSession(id string) *base.SessionInfo                     { return nil }
+// GetSession return session information with id
+func (m *coap) GetSession(id string) *base.SessionInfo {
+	if s := m.findSession(id); s != nil {
+		return s.Info()
+	}
+	return nil
+}
 
-func (m *coap) GetRoutes() []*base.RouteInfo { return nil }
-func (m *coap) GetRoute() *base.RouteInfo    { return nil }
+// Routes and topics are kept by mqtt which coap share storage with
+func (m *coap) GetRoutes() []*base.RouteInfo          { return nil }
+func (m *coap) GetRoute(topic string) *base.RouteInfo { return nil }
 
 // Topic info
 func (m *coap) GetTopics() []*base.TopicInfo       { return nil }
 func (m *coap) GetTopic(id string) *base.TopicInfo { return nil }
 
-// SubscriptionInfo
-func (m *coap) GetSubscriptions() []*base.SubscriptionInfo       { return nil }
-func (m *coap) GetSubscription(id string) *base.SubscriptionInfo { return nil }
+// GetSubscriptions return observations of all endpoints
+func (m *coap) GetSubscriptions() []*base.SubscriptionInfo {
+	subs := []*base.SubscriptionInfo{}
+	for _, s := range m.getSessions() {
+		subs = append(subs, s.subscriptions()...)
+	}
+	return subs
+}
+
+// GetTopicSubscriptions return observations on topic
+func (m *coap) GetTopicSubscriptions(topic string) []*base.SubscriptionInfo {
+	subs := []*base.SubscriptionInfo{}
+	for _, sub := range m.GetSubscriptions() {
+		if sub.Topic == topic {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// GetServiceInfo return service information
+func (m *coap) GetServiceInfo() *base.ServiceInfo {
+	host, _ := m.config.String(m.protocol, "listen")
+	return &base.ServiceInfo{
+		ServiceName:    m.protocol,
+		Listen:         host,
+		CurrentClients: uint64(m.getSessionTotalCount()),
+	}
+}
+
+// resource handle requests on path, requests on sub paths are also handled
+// if it is prefix
+type resource struct {
+	path    string
+	prefix  bool
+	handler func(s *coapSession, req *message, path string) *message
+}
 
-// Service Info
-func (m *coap) GetServiceInfo() *base.ServiceInfo { return nil }
+// route return resource matched with request path
+func (m *coap) route(path string) *resource {
+	for _, r := range m.resources {
+		if path == r.path || (r.prefix && strings.HasPrefix(path, r.path)) {
+			return r
+		}
+	}
+	return nil
+}
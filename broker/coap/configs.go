@@ -13,8 +13,34 @@
 package coap
 
 var Configs = map[string]string{
-	"host":               "localhost:1884",
+	"listen":             "localhost:5683",
 	"loglevel":           "debug",
-	"message_size_limit": "500",
+	"message_size_limit": "65536",
 	"allow_anonymous":    "true",
+	// Preferred block size in block-wise transfer, 16 to 1024
+	"block_size": "1024",
+	// Idle endpoint without observation is removed after timeout in seconds
+	"session_timeout":   "300",
+	"notify_queue_size": "256",
+}
+
+// DtlsConfigs is configurations of coap over DTLS with pre-shared keys
+var DtlsConfigs = map[string]string{
+	"listen":             "localhost:5684",
+	"loglevel":           "debug",
+	"message_size_limit": "65536",
+	"allow_anonymous":    "false",
+	"block_size":         "1024",
+	"session_timeout":    "300",
+	"notify_queue_size":  "256",
+	// Identity hint sent to endpoint and passed to auth api with identity
+	"psk_hint": "",
+	// Keys returned by auth api are "raw" bytes or "hex" encoded
+	"psk_key_format": "raw",
+	// Handshake not finished in timeout seconds is discarded
+	"handshake_timeout": "30",
+	// Idle DTLS session is discarded after timeout seconds
+	"dtls_session_timeout": "3600",
+	// Keys resolved by auth api are cached for timeout seconds
+	"psk_cache_timeout": "60",
 }
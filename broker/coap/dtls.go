@@ -0,0 +1,517 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package coap
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloustone/sentel/broker/auth"
+	"github.com/golang/glog"
+)
+
+// Record content types
+const (
+	contentChangeCipherSpec uint8 = 20
+	contentAlert            uint8 = 21
+	contentHandshake        uint8 = 22
+	contentApplicationData  uint8 = 23
+)
+
+// Alert levels and descriptions
+const (
+	alertLevelWarning       uint8 = 1
+	alertLevelFatal         uint8 = 2
+	alertCloseNotify        uint8 = 0
+	alertHandshakeFailure   uint8 = 40
+	alertDecryptError       uint8 = 51
+	alertUnknownPskIdentity uint8 = 115
+)
+
+const (
+	dtlsVersion10      uint16 = 0xFEFF
+	dtlsVersion12      uint16 = 0xFEFD
+	recordHeaderSize          = 13
+	explicitNonceLen          = 8
+	replayWindowSize          = 64
+	maxDeferredRecords        = 16
+	dtlsTick                  = time.Second
+)
+
+var (
+	errorPeerNotEstablished = errors.New("DTLS session is not established")
+	errorRecordFormat       = errors.New("Invalid DTLS record format")
+)
+
+// record is DTLS record, fragment is encrypted in epoch 1
+type record struct {
+	typ      uint8
+	version  uint16
+	epoch    uint16
+	seq      uint64
+	fragment []uint8
+}
+
+// parseRecords decode records in datagram, records following malformed
+// record are discarded
+func parseRecords(data []uint8) []*record {
+	records := []*record{}
+	for len(data) >= recordHeaderSize {
+		length := int(data[11])<<8 | int(data[12])
+		if len(data) < recordHeaderSize+length {
+			break
+		}
+		r := &record{
+			typ:      data[0],
+			version:  uint16(data[1])<<8 | uint16(data[2]),
+			epoch:    uint16(data[3])<<8 | uint16(data[4]),
+			fragment: data[recordHeaderSize : recordHeaderSize+length],
+		}
+		for _, b := range data[5:11] {
+			r.seq = r.seq<<8 | uint64(b)
+		}
+		records = append(records, r)
+		data = data[recordHeaderSize+length:]
+	}
+	return records
+}
+
+// recordHeader encode record header with fragment length
+func recordHeader(typ uint8, version uint16, epoch uint16, seq uint64, length int) []uint8 {
+	return []uint8{
+		typ, uint8(version >> 8), uint8(version),
+		uint8(epoch >> 8), uint8(epoch),
+		uint8(seq >> 40), uint8(seq >> 32), uint8(seq >> 24), uint8(seq >> 16), uint8(seq >> 8), uint8(seq),
+		uint8(length >> 8), uint8(length),
+	}
+}
+
+// additionalData return AEAD additional data of record in RFC 5246
+func additionalData(typ uint8, epoch uint16, seq uint64, length int) []uint8 {
+	ad := recordHeader(typ, dtlsVersion12, epoch, seq, length)
+	return append(ad[3:11], ad[0], ad[1], ad[2], ad[11], ad[12])
+}
+
+// Peer states
+const (
+	peerHandshaking = iota
+	peerEstablished
+	peerClosed
+)
+
+// flightMessage is message in the last flight sent to peer, the flight is
+// sent again if peer retransmit its flight
+type flightMessage struct {
+	typ   uint8
+	epoch uint16
+	data  []uint8
+}
+
+// dtlsPeer is DTLS session with endpoint address
+type dtlsPeer struct {
+	addr         net.Addr
+	mutex        sync.Mutex
+	state        int
+	identity     string
+	suite        *cipherSuite
+	clientRandom []uint8
+	serverRandom []uint8
+	masterSecret []uint8
+	transcript   []uint8 // Handshake messages for Finished verification
+	recvSeq      uint16  // Next handshake message expected from peer
+	sendSeq      uint16  // Next handshake message sent to peer
+	flightStart  uint16  // The first message of peer's last flight
+	flight       []flightMessage
+	fragments    *handshakeFragments
+	readEpoch    uint16
+	readAEAD     cipher.AEAD
+	readIV       []uint8
+	pendingAEAD  cipher.AEAD // Read cipher activated by ChangeCipherSpec
+	pendingIV    []uint8
+	writeAEAD    cipher.AEAD
+	writeIV      []uint8
+	writeSeq     [2]uint64 // Record sequence of epoch 0 and 1
+	replayMax    uint64
+	replayBits   uint64
+	resolving    bool      // PSK key is being resolved off the read loop
+	deferred     []*record // Records received while key is resolved
+	createdAt    time.Time
+	lastActive   time.Time
+}
+
+// datagram is application data received from established peer
+type datagram struct {
+	addr net.Addr
+	data []uint8
+}
+
+// dtlsListener is packet connection over DTLS 1.2 with pre-shared keys,
+// handshake is done in ReadFrom and only application data is returned.
+// Keys of PSK identities are resolved through auth api
+type dtlsListener struct {
+	conn             net.PacketConn
+	authapi          auth.IAuthAPI
+	hint             string
+	keyFormat        string
+	cookieSecret     []uint8
+	handshakeTimeout time.Duration
+	sessionTimeout   time.Duration
+	pskTimeout       time.Duration
+	onClose          func(addr net.Addr)
+	mutex            sync.Mutex
+	peers            map[string]*dtlsPeer
+	pskMutex         sync.Mutex
+	pskKeys          map[string]*pskEntry
+	lookups          chan bool // Bound concurrent lookups of PSK keys
+	received         []datagram
+	buf              []uint8
+	quit             chan bool
+	closeOnce        sync.Once
+}
+
+// newDTLSListener create DTLS listener on host with service configurations
+func newDTLSListener(m *coap, host string) (net.PacketConn, error) {
+	l := &dtlsListener{
+		authapi:          m.authapi,
+		keyFormat:        "raw",
+		cookieSecret:     make([]uint8, 32),
+		handshakeTimeout: 30 * time.Second,
+		sessionTimeout:   3600 * time.Second,
+		pskTimeout:       60 * time.Second,
+		onClose:          m.closeSession,
+		peers:            make(map[string]*dtlsPeer),
+		pskKeys:          make(map[string]*pskEntry),
+		lookups:          make(chan bool, maxPskLookups),
+		buf:              make([]uint8, maxDatagram),
+		quit:             make(chan bool),
+	}
+	l.hint, _ = m.config.String(m.protocol, "psk_hint")
+	if format, err := m.config.String(m.protocol, "psk_key_format"); err == nil && format != "" {
+		if format != "raw" && format != "hex" {
+			return nil, fmt.Errorf("Invalid psk key format '%s'", format)
+		}
+		l.keyFormat = format
+	}
+	if timeout, err := m.config.Int(m.protocol, "handshake_timeout"); err == nil && timeout > 0 {
+		l.handshakeTimeout = time.Duration(timeout) * time.Second
+	}
+	if timeout, err := m.config.Int(m.protocol, "dtls_session_timeout"); err == nil && timeout > 0 {
+		l.sessionTimeout = time.Duration(timeout) * time.Second
+	}
+	if timeout, err := m.config.Int(m.protocol, "psk_cache_timeout"); err == nil && timeout >= 0 {
+		l.pskTimeout = time.Duration(timeout) * time.Second
+	}
+	if _, err := rand.Read(l.cookieSecret); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp", host)
+	if err != nil {
+		return nil, err
+	}
+	l.conn = conn
+	go l.expire()
+	glog.Infof("Coap dtls is served on '%s'", host)
+	return l, nil
+}
+
+// ReadFrom return application data received from established peer
+func (l *dtlsListener) ReadFrom(b []uint8) (int, net.Addr, error) {
+	for len(l.received) == 0 {
+		n, addr, err := l.conn.ReadFrom(l.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, r := range parseRecords(l.buf[:n]) {
+			l.handleRecord(addr, r)
+		}
+	}
+	d := l.received[0]
+	l.received = l.received[1:]
+	return copy(b, d.data), d.addr, nil
+}
+
+// WriteTo send application data to established peer
+func (l *dtlsListener) WriteTo(b []uint8, addr net.Addr) (int, error) {
+	p := l.getPeer(addr)
+	if p == nil {
+		return 0, errorPeerNotEstablished
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state != peerEstablished {
+		return 0, errorPeerNotEstablished
+	}
+	if err := l.writeRecords(p, []flightMessage{{typ: contentApplicationData, epoch: 1, data: b}}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close notify established peers and close connection
+func (l *dtlsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+		l.mutex.Lock()
+		peers := l.peers
+		l.peers = make(map[string]*dtlsPeer)
+		l.mutex.Unlock()
+		for _, p := range peers {
+			p.mutex.Lock()
+			if p.state == peerEstablished {
+				l.sendAlert(p, alertLevelWarning, alertCloseNotify)
+			}
+			p.state = peerClosed
+			p.mutex.Unlock()
+		}
+	})
+	return l.conn.Close()
+}
+
+func (l *dtlsListener) LocalAddr() net.Addr                { return l.conn.LocalAddr() }
+func (l *dtlsListener) SetDeadline(t time.Time) error      { return l.conn.SetDeadline(t) }
+func (l *dtlsListener) SetReadDeadline(t time.Time) error  { return l.conn.SetReadDeadline(t) }
+func (l *dtlsListener) SetWriteDeadline(t time.Time) error { return l.conn.SetWriteDeadline(t) }
+
+// identity return PSK identity of established peer
+func (l *dtlsListener) identity(addr net.Addr) (string, string) {
+	if p := l.getPeer(addr); p != nil {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		if p.state == peerEstablished {
+			return p.identity, p.suite.name
+		}
+	}
+	return "", ""
+}
+
+func (l *dtlsListener) getPeer(addr net.Addr) *dtlsPeer {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.peers[addr.String()]
+}
+
+// removePeer remove peer, session of established peer is closed
+func (l *dtlsListener) removePeer(p *dtlsPeer) {
+	l.mutex.Lock()
+	if l.peers[p.addr.String()] == p {
+		delete(l.peers, p.addr.String())
+	}
+	l.mutex.Unlock()
+	p.mutex.Lock()
+	established := p.state == peerEstablished
+	p.state = peerClosed
+	p.mutex.Unlock()
+	if established && l.onClose != nil {
+		l.onClose(p.addr)
+	}
+}
+
+// expire remove peers whose handshake is not finished in time and idle
+// established peers
+func (l *dtlsListener) expire() {
+	ticker := time.NewTicker(dtlsTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			expired := []*dtlsPeer{}
+			l.mutex.Lock()
+			for _, p := range l.peers {
+				p.mutex.Lock()
+				if (p.state == peerHandshaking && now.Sub(p.createdAt) > l.handshakeTimeout) ||
+					(p.state == peerEstablished && now.Sub(p.lastActive) > l.sessionTimeout) {
+					expired = append(expired, p)
+				}
+				p.mutex.Unlock()
+			}
+			l.mutex.Unlock()
+			for _, p := range expired {
+				glog.Infof("DTLS session with %s is expired", p.addr)
+				l.removePeer(p)
+			}
+			l.expirePskKeys(now)
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// handleRecord handle record received from address, invalid records are
+// discarded silently as RFC 6347 recommended
+func (l *dtlsListener) handleRecord(addr net.Addr, r *record) {
+	if r.version != dtlsVersion12 && r.version != dtlsVersion10 {
+		return
+	}
+	p := l.getPeer(addr)
+	if r.epoch == 0 && r.typ == contentHandshake && isClientHello(r.fragment) {
+		// Client hello start new handshake, or it is retransmitted
+		if p == nil || !p.isRetransmittedHello(r.fragment) {
+			l.handleClientHello(addr, p, r)
+			return
+		}
+	}
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	data, fatal := l.handlePeerRecord(p, r)
+	state := p.state
+	p.mutex.Unlock()
+	if fatal || state == peerClosed {
+		l.removePeer(p)
+		return
+	}
+	if data != nil {
+		l.received = append(l.received, datagram{addr: addr, data: data})
+	}
+}
+
+// handlePeerRecord handle record of peer, application data is returned
+// and fatal is true if the peer should be removed
+func (l *dtlsListener) handlePeerRecord(p *dtlsPeer, r *record) ([]uint8, bool) {
+	if p.state == peerClosed {
+		return nil, false
+	}
+	if p.resolving {
+		p.deferRecord(r)
+		return nil, false
+	}
+	fragment := r.fragment
+	if r.epoch == 1 {
+		if p.readAEAD == nil || p.replayed(r.seq) {
+			return nil, false
+		}
+		plaintext, err := p.open(r)
+		if err != nil {
+			return nil, false
+		}
+		p.accept(r.seq)
+		fragment = plaintext
+	} else if r.epoch != 0 || (p.readEpoch == 1 && r.typ != contentHandshake && r.typ != contentChangeCipherSpec) {
+		return nil, false
+	}
+	p.lastActive = time.Now()
+
+	switch r.typ {
+	case contentHandshake:
+		return nil, l.handleHandshake(p, r.epoch, fragment)
+	case contentChangeCipherSpec:
+		if len(fragment) != 1 || fragment[0] != 1 || p.pendingAEAD == nil {
+			return nil, false
+		}
+		p.readAEAD, p.readIV = p.pendingAEAD, p.pendingIV
+		p.pendingAEAD, p.pendingIV = nil, nil
+		p.readEpoch = 1
+	case contentAlert:
+		if len(fragment) != 2 {
+			return nil, false
+		}
+		if fragment[0] == alertLevelFatal || fragment[1] == alertCloseNotify {
+			glog.Infof("DTLS alert %d from %s, session is closed", fragment[1], p.addr)
+			return nil, true
+		}
+	case contentApplicationData:
+		if p.state == peerEstablished && r.epoch == 1 {
+			return fragment, false
+		}
+	}
+	return nil, false
+}
+
+// deferRecord keep copy of record received while PSK key is resolved, it
+// is handled once handshake is resumed
+func (p *dtlsPeer) deferRecord(r *record) {
+	if len(p.deferred) >= maxDeferredRecords {
+		return
+	}
+	deferred := *r
+	deferred.fragment = append([]uint8{}, r.fragment...)
+	p.deferred = append(p.deferred, &deferred)
+}
+
+// replayed check wether record in epoch 1 was received in replay window
+func (p *dtlsPeer) replayed(seq uint64) bool {
+	if seq > p.replayMax {
+		return false
+	}
+	diff := p.replayMax - seq
+	return diff >= replayWindowSize || p.replayBits&(1<<diff) != 0
+}
+
+// accept mark record sequence as received in replay window
+func (p *dtlsPeer) accept(seq uint64) {
+	if seq > p.replayMax {
+		diff := seq - p.replayMax
+		if diff >= replayWindowSize {
+			p.replayBits = 0
+		} else {
+			p.replayBits <<= diff
+		}
+		p.replayMax = seq
+	}
+	p.replayBits |= 1 << (p.replayMax - seq)
+}
+
+// open decrypt record with AEAD, explicit nonce is prefixed to ciphertext
+func (p *dtlsPeer) open(r *record) ([]uint8, error) {
+	if len(r.fragment) < explicitNonceLen+p.readAEAD.Overhead() {
+		return nil, errorRecordFormat
+	}
+	nonce := append(append([]uint8{}, p.readIV...), r.fragment[:explicitNonceLen]...)
+	length := len(r.fragment) - explicitNonceLen - p.readAEAD.Overhead()
+	ad := additionalData(r.typ, r.epoch, r.seq, length)
+	return p.readAEAD.Open(nil, nonce, r.fragment[explicitNonceLen:], ad)
+}
+
+// seal encrypt fragment of record in epoch 1
+func (p *dtlsPeer) seal(typ uint8, seq uint64, fragment []uint8) []uint8 {
+	explicit := recordHeader(typ, dtlsVersion12, 1, seq, 0)[3:11]
+	nonce := append(append([]uint8{}, p.writeIV...), explicit...)
+	ad := additionalData(typ, 1, seq, len(fragment))
+	return p.writeAEAD.Seal(append([]uint8{}, explicit...), nonce, fragment, ad)
+}
+
+// writeRecords send messages to peer in one datagram, each message is in
+// its own record with new sequence
+func (l *dtlsListener) writeRecords(p *dtlsPeer, msgs []flightMessage) error {
+	data := []uint8{}
+	for _, msg := range msgs {
+		seq := p.writeSeq[msg.epoch]
+		p.writeSeq[msg.epoch]++
+		fragment := msg.data
+		if msg.epoch == 1 {
+			fragment = p.seal(msg.typ, seq, fragment)
+		}
+		data = append(data, recordHeader(msg.typ, dtlsVersion12, msg.epoch, seq, len(fragment))...)
+		data = append(data, fragment...)
+	}
+	_, err := l.conn.WriteTo(data, p.addr)
+	return err
+}
+
+// sendAlert send alert to peer in its current write epoch
+func (l *dtlsListener) sendAlert(p *dtlsPeer, level uint8, description uint8) {
+	epoch := uint16(0)
+	if p.writeAEAD != nil {
+		epoch = 1
+	}
+	msg := flightMessage{typ: contentAlert, epoch: epoch, data: []uint8{level, description}}
+	if err := l.writeRecords(p, []flightMessage{msg}); err != nil {
+		glog.Errorf("Failed to send DTLS alert to %s:%s", p.addr, err)
+	}
+}
@@ -0,0 +1,237 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package coap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+// Cipher suites with pre-shared key, TLS_PSK_WITH_AES_128_CCM_8 is
+// mandatory for coap in RFC 7252
+const (
+	tlsPskWithAes128Ccm8      uint16 = 0xC0A8
+	tlsPskWithAes128GcmSha256 uint16 = 0x00A8
+)
+
+// cipherSuite is AEAD cipher suite, keys are derived with SHA256 PRF
+type cipherSuite struct {
+	id      uint16
+	name    string
+	keyLen  int
+	ivLen   int
+	newAEAD func(key []uint8) (cipher.AEAD, error)
+}
+
+// cipherSuites are supported cipher suites in order of preference
+var cipherSuites = []*cipherSuite{
+	{
+		id:      tlsPskWithAes128Ccm8,
+		name:    "TLS_PSK_WITH_AES_128_CCM_8",
+		keyLen:  16,
+		ivLen:   4,
+		newAEAD: func(key []uint8) (cipher.AEAD, error) { return newCCM(key, 8) },
+	},
+	{
+		id:     tlsPskWithAes128GcmSha256,
+		name:   "TLS_PSK_WITH_AES_128_GCM_SHA256",
+		keyLen: 16,
+		ivLen:  4,
+		newAEAD: func(key []uint8) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		},
+	},
+}
+
+// selectCipherSuite return the most preferred suite offered by client
+func selectCipherSuite(offered []uint16) *cipherSuite {
+	for _, suite := range cipherSuites {
+		for _, id := range offered {
+			if id == suite.id {
+				return suite
+			}
+		}
+	}
+	return nil
+}
+
+// prf is pseudo random function of TLS 1.2 in RFC 5246
+func prf(secret []uint8, label string, seed []uint8, n int) []uint8 {
+	seed = append([]uint8(label), seed...)
+	h := hmac.New(sha256.New, secret)
+	out := []uint8{}
+	a := seed
+	for len(out) < n {
+		h.Reset()
+		h.Write(a)
+		a = h.Sum(nil)
+		h.Reset()
+		h.Write(a)
+		h.Write(seed)
+		out = h.Sum(out)
+	}
+	return out[:n]
+}
+
+// pskPremasterSecret return premaster secret of plain PSK key exchange in
+// RFC 4279, the other secret is zeros in length of key
+func pskPremasterSecret(key []uint8) []uint8 {
+	n := len(key)
+	secret := make([]uint8, 0, 4+2*n)
+	secret = append(secret, uint8(n>>8), uint8(n))
+	secret = append(secret, make([]uint8, n)...)
+	secret = append(secret, uint8(n>>8), uint8(n))
+	return append(secret, key...)
+}
+
+// ccm is AES-CCM in RFC 3610, nonce is 12 bytes in CCM_8 suites of RFC
+// 6655 and length field is 15 - nonce size bytes
+type ccm struct {
+	block     cipher.Block
+	tagSize   int
+	nonceSize int
+}
+
+const ccmNonceSize = 12
+
+var errorCCMAuthentication = errors.New("Message authentication failed")
+
+// newCCM create AES-CCM AEAD with tag size and 12 bytes nonce
+func newCCM(key []uint8, tagSize int) (cipher.AEAD, error) {
+	return newCCMWithNonceSize(key, tagSize, ccmNonceSize)
+}
+
+// newCCMWithNonceSize create AES-CCM AEAD with tag and nonce size
+func newCCMWithNonceSize(key []uint8, tagSize int, nonceSize int) (cipher.AEAD, error) {
+	if tagSize < 4 || tagSize > 16 || tagSize%2 != 0 || nonceSize < 7 || nonceSize > 13 {
+		return nil, errors.New("Invalid ccm tag or nonce size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ccm{block: block, tagSize: tagSize, nonceSize: nonceSize}, nil
+}
+
+func (c *ccm) NonceSize() int { return c.nonceSize }
+func (c *ccm) Overhead() int  { return c.tagSize }
+
+// putLength encode n in length field at the end of block
+func (c *ccm) putLength(b []uint8, n int) {
+	for i := aes.BlockSize - 1; i > c.nonceSize; i-- {
+		b[i] = uint8(n)
+		n >>= 8
+	}
+}
+
+// counter return counter block i
+func (c *ccm) counter(nonce []uint8, i int) []uint8 {
+	a := make([]uint8, aes.BlockSize)
+	a[0] = uint8(aes.BlockSize - 1 - c.nonceSize - 1)
+	copy(a[1:], nonce)
+	c.putLength(a, i)
+	return a
+}
+
+// mac compute CBC-MAC of additional data and plaintext
+func (c *ccm) mac(nonce []uint8, plaintext []uint8, data []uint8) []uint8 {
+	b := make([]uint8, aes.BlockSize)
+	b[0] = uint8((c.tagSize-2)/2)<<3 | uint8(aes.BlockSize-1-c.nonceSize-1)
+	if len(data) > 0 {
+		b[0] |= 0x40
+	}
+	copy(b[1:], nonce)
+	c.putLength(b, len(plaintext))
+
+	x := make([]uint8, aes.BlockSize)
+	c.block.Encrypt(x, b)
+	update := func(in []uint8) {
+		for len(in) > 0 {
+			chunk := in
+			if len(chunk) > aes.BlockSize {
+				chunk = chunk[:aes.BlockSize]
+			}
+			for i := range chunk {
+				x[i] ^= chunk[i]
+			}
+			c.block.Encrypt(x, x)
+			in = in[len(chunk):]
+		}
+	}
+	if len(data) > 0 {
+		// Additional data is prefixed with its length and padded to block
+		ad := append([]uint8{uint8(len(data) >> 8), uint8(len(data))}, data...)
+		update(ad)
+	}
+	update(plaintext)
+	return x[:c.tagSize]
+}
+
+// crypt encrypt or decrypt in counter mode from counter block 1
+func (c *ccm) crypt(dst []uint8, nonce []uint8, src []uint8) {
+	s := make([]uint8, aes.BlockSize)
+	for i := 0; i*aes.BlockSize < len(src); i++ {
+		c.block.Encrypt(s, c.counter(nonce, i+1))
+		start := i * aes.BlockSize
+		end := start + aes.BlockSize
+		if end > len(src) {
+			end = len(src)
+		}
+		for j := start; j < end; j++ {
+			dst[j] = src[j] ^ s[j-start]
+		}
+	}
+}
+
+// tag encrypt CBC-MAC with counter block 0
+func (c *ccm) tag(nonce []uint8, mac []uint8) []uint8 {
+	s := make([]uint8, aes.BlockSize)
+	c.block.Encrypt(s, c.counter(nonce, 0))
+	t := make([]uint8, c.tagSize)
+	for i := range t {
+		t[i] = mac[i] ^ s[i]
+	}
+	return t
+}
+
+func (c *ccm) Seal(dst, nonce, plaintext, data []uint8) []uint8 {
+	if len(nonce) != c.nonceSize {
+		panic("coap: invalid ccm nonce size")
+	}
+	out := make([]uint8, len(plaintext))
+	c.crypt(out, nonce, plaintext)
+	out = append(out, c.tag(nonce, c.mac(nonce, plaintext, data))...)
+	return append(dst, out...)
+}
+
+func (c *ccm) Open(dst, nonce, ciphertext, data []uint8) ([]uint8, error) {
+	if len(nonce) != c.nonceSize || len(ciphertext) < c.tagSize {
+		return nil, errorCCMAuthentication
+	}
+	n := len(ciphertext) - c.tagSize
+	plaintext := make([]uint8, n)
+	c.crypt(plaintext, nonce, ciphertext[:n])
+	expected := c.tag(nonce, c.mac(nonce, plaintext, data))
+	if subtle.ConstantTimeCompare(expected, ciphertext[n:]) != 1 {
+		return nil, errorCCMAuthentication
+	}
+	return append(dst, plaintext...), nil
+}
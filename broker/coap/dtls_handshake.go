@@ -0,0 +1,584 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Handshake message types
+const (
+	handshakeClientHello       uint8 = 1
+	handshakeServerHello       uint8 = 2
+	handshakeHelloVerify       uint8 = 3
+	handshakeServerKeyExchange uint8 = 12
+	handshakeServerHelloDone   uint8 = 14
+	handshakeClientKeyExchange uint8 = 16
+	handshakeFinished          uint8 = 20
+)
+
+const (
+	handshakeHeaderSize    = 12
+	randomSize             = 32
+	cookieSize             = 16
+	masterSecretSize       = 48
+	verifyDataSize         = 12
+	maxHandshakeSize       = 16384
+	extensionRenegotiation = 0xFF01
+	scsvRenegotiation      = 0x00FF
+	pskKeyTimeout          = 5 * time.Second
+	pskFailureTimeout      = 5 * time.Second
+	maxPskLookups          = 16
+	maxPskKeys             = 4096
+)
+
+var errorHandshakeFormat = errors.New("Invalid DTLS handshake message")
+
+// handshakeHeader is header of handshake message fragment
+type handshakeHeader struct {
+	typ    uint8
+	length int
+	seq    uint16
+	offset int
+	size   int
+}
+
+// parseHandshakeHeader decode header of the first fragment in data
+func parseHandshakeHeader(data []uint8) (*handshakeHeader, error) {
+	if len(data) < handshakeHeaderSize {
+		return nil, errorHandshakeFormat
+	}
+	h := &handshakeHeader{
+		typ:    data[0],
+		length: int(data[1])<<16 | int(data[2])<<8 | int(data[3]),
+		seq:    uint16(data[4])<<8 | uint16(data[5]),
+		offset: int(data[6])<<16 | int(data[7])<<8 | int(data[8]),
+		size:   int(data[9])<<16 | int(data[10])<<8 | int(data[11]),
+	}
+	if h.length > maxHandshakeSize || h.offset+h.size > h.length || len(data) < handshakeHeaderSize+h.size {
+		return nil, errorHandshakeFormat
+	}
+	return h, nil
+}
+
+// handshakeMessage encode unfragmented handshake message
+func handshakeMessage(typ uint8, seq uint16, body []uint8) []uint8 {
+	n := len(body)
+	msg := []uint8{
+		typ, uint8(n >> 16), uint8(n >> 8), uint8(n),
+		uint8(seq >> 8), uint8(seq),
+		0, 0, 0,
+		uint8(n >> 16), uint8(n >> 8), uint8(n),
+	}
+	return append(msg, body...)
+}
+
+// handshakeFragments reassemble handshake message sent in fragments
+type handshakeFragments struct {
+	typ      uint8
+	seq      uint16
+	body     []uint8
+	received []bool
+	count    int
+}
+
+// reassemble add fragment and return message body once it is completed
+func (p *dtlsPeer) reassemble(h *handshakeHeader, fragment []uint8) ([]uint8, bool) {
+	if h.offset == 0 && h.size == h.length {
+		return fragment, true
+	}
+	f := p.fragments
+	if f == nil || f.seq != h.seq || f.typ != h.typ || len(f.body) != h.length {
+		f = &handshakeFragments{
+			typ:      h.typ,
+			seq:      h.seq,
+			body:     make([]uint8, h.length),
+			received: make([]bool, h.length),
+		}
+		p.fragments = f
+	}
+	copy(f.body[h.offset:], fragment)
+	for i := h.offset; i < h.offset+h.size; i++ {
+		if !f.received[i] {
+			f.received[i] = true
+			f.count++
+		}
+	}
+	if f.count < h.length {
+		return nil, false
+	}
+	p.fragments = nil
+	return f.body, true
+}
+
+// clientHello is ClientHello message in RFC 6347
+type clientHello struct {
+	version             uint16
+	random              []uint8
+	sessionID           []uint8
+	cookie              []uint8
+	cipherSuites        []uint16
+	compressions        []uint8
+	secureRenegotiation bool
+}
+
+// isClientHello check wether handshake record begin with ClientHello
+func isClientHello(fragment []uint8) bool {
+	return len(fragment) > 0 && fragment[0] == handshakeClientHello
+}
+
+// parseClientHello decode ClientHello body
+func parseClientHello(body []uint8) (*clientHello, error) {
+	hello := &clientHello{}
+	r := &reader{data: body}
+	hello.version = r.uint16()
+	hello.random = r.bytes(randomSize)
+	hello.sessionID = r.bytes(int(r.uint8()))
+	hello.cookie = r.bytes(int(r.uint8()))
+	suites := r.bytes(int(r.uint16()))
+	hello.compressions = r.bytes(int(r.uint8()))
+	if r.err != nil || len(suites)%2 != 0 {
+		return nil, errorHandshakeFormat
+	}
+	for i := 0; i < len(suites); i += 2 {
+		suite := uint16(suites[i])<<8 | uint16(suites[i+1])
+		if suite == scsvRenegotiation {
+			hello.secureRenegotiation = true
+		}
+		hello.cipherSuites = append(hello.cipherSuites, suite)
+	}
+	if r.empty() {
+		return hello, nil
+	}
+	extensions := &reader{data: r.bytes(int(r.uint16()))}
+	for r.err == nil && !extensions.empty() {
+		typ := extensions.uint16()
+		extensions.bytes(int(extensions.uint16()))
+		if typ == extensionRenegotiation {
+			hello.secureRenegotiation = true
+		}
+	}
+	if r.err != nil || extensions.err != nil {
+		return nil, errorHandshakeFormat
+	}
+	return hello, nil
+}
+
+// reader decode fields of handshake message, err is set if data is short
+type reader struct {
+	data []uint8
+	err  error
+}
+
+func (r *reader) bytes(n int) []uint8 {
+	if r.err != nil || len(r.data) < n {
+		r.err = errorHandshakeFormat
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return uint16(b[0])<<8 | uint16(b[1])
+	}
+	return 0
+}
+
+func (r *reader) empty() bool { return len(r.data) == 0 }
+
+// cookie return stateless cookie bound to client address and hello
+func (l *dtlsListener) cookie(addr net.Addr, hello *clientHello) []uint8 {
+	h := hmac.New(sha256.New, l.cookieSecret)
+	h.Write([]uint8(addr.String()))
+	h.Write([]uint8{uint8(hello.version >> 8), uint8(hello.version)})
+	h.Write(hello.random)
+	h.Write(hello.sessionID)
+	for _, suite := range hello.cipherSuites {
+		h.Write([]uint8{uint8(suite >> 8), uint8(suite)})
+	}
+	h.Write(hello.compressions)
+	return h.Sum(nil)[:cookieSize]
+}
+
+// isRetransmittedHello check wether ClientHello belong to current handshake
+func (p *dtlsPeer) isRetransmittedHello(fragment []uint8) bool {
+	h, err := parseHandshakeHeader(fragment)
+	if err != nil || h.offset != 0 || h.size < 2+randomSize {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	random := fragment[handshakeHeaderSize+2 : handshakeHeaderSize+2+randomSize]
+	return p.state != peerClosed && bytes.Equal(random, p.clientRandom)
+}
+
+// handleClientHello verify cookie of ClientHello and start handshake,
+// HelloVerifyRequest is sent without keeping state if cookie is invalid
+func (l *dtlsListener) handleClientHello(addr net.Addr, old *dtlsPeer, r *record) {
+	h, err := parseHandshakeHeader(r.fragment)
+	if err != nil || h.offset != 0 || h.size != h.length {
+		return
+	}
+	body := r.fragment[handshakeHeaderSize : handshakeHeaderSize+h.length]
+	hello, err := parseClientHello(body)
+	if err != nil {
+		glog.Warningf("Invalid DTLS ClientHello from %s:%s", addr, err)
+		return
+	}
+	cookie := l.cookie(addr, hello)
+	if !hmac.Equal(cookie, hello.cookie) {
+		verify := append([]uint8{uint8(dtlsVersion10 >> 8), uint8(dtlsVersion10 & 0xFF), cookieSize}, cookie...)
+		msg := handshakeMessage(handshakeHelloVerify, h.seq, verify)
+		data := append(recordHeader(contentHandshake, dtlsVersion10, 0, r.seq, len(msg)), msg...)
+		if _, err := l.conn.WriteTo(data, addr); err != nil {
+			glog.Errorf("Failed to send DTLS HelloVerifyRequest to %s:%s", addr, err)
+		}
+		return
+	}
+	// Client with verified address start new session
+	if old != nil {
+		l.removePeer(old)
+	}
+	now := time.Now()
+	p := &dtlsPeer{
+		addr:         addr,
+		state:        peerHandshaking,
+		clientRandom: append([]uint8{}, hello.random...),
+		serverRandom: make([]uint8, randomSize),
+		recvSeq:      h.seq + 1,
+		sendSeq:      h.seq,
+		flightStart:  h.seq,
+		createdAt:    now,
+		lastActive:   now,
+	}
+	p.writeSeq[0] = r.seq
+	p.suite = selectCipherSuite(hello.cipherSuites)
+	if p.suite == nil || bytes.IndexByte(hello.compressions, 0) < 0 {
+		glog.Warningf("No DTLS cipher suite is acceptable for %s", addr)
+		l.sendAlert(p, alertLevelFatal, alertHandshakeFailure)
+		return
+	}
+	if _, err := rand.Read(p.serverRandom); err != nil {
+		glog.Errorf("Failed to generate DTLS random:%s", err)
+		return
+	}
+	p.transcript = append(p.transcript, r.fragment[:handshakeHeaderSize+h.length]...)
+
+	// ServerHello, ServerKeyExchange with identity hint and ServerHelloDone
+	// are sent in one flight
+	serverHello := []uint8{uint8(dtlsVersion12 >> 8), uint8(dtlsVersion12 & 0xFF)}
+	serverHello = append(serverHello, p.serverRandom...)
+	serverHello = append(serverHello, 0, uint8(p.suite.id>>8), uint8(p.suite.id), 0)
+	if hello.secureRenegotiation {
+		serverHello = append(serverHello, 0, 5, uint8(extensionRenegotiation>>8), uint8(extensionRenegotiation&0xFF), 0, 1, 0)
+	}
+	p.queueHandshake(handshakeServerHello, 0, serverHello)
+	if l.hint != "" {
+		keyExchange := append([]uint8{uint8(len(l.hint) >> 8), uint8(len(l.hint))}, l.hint...)
+		p.queueHandshake(handshakeServerKeyExchange, 0, keyExchange)
+	}
+	p.queueHandshake(handshakeServerHelloDone, 0, nil)
+
+	l.mutex.Lock()
+	l.peers[addr.String()] = p
+	l.mutex.Unlock()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := l.writeRecords(p, p.flight); err != nil {
+		glog.Errorf("Failed to send DTLS handshake to %s:%s", addr, err)
+	}
+}
+
+// queueHandshake add handshake message to flight and transcript
+func (p *dtlsPeer) queueHandshake(typ uint8, epoch uint16, body []uint8) {
+	msg := handshakeMessage(typ, p.sendSeq, body)
+	p.sendSeq++
+	p.transcript = append(p.transcript, msg...)
+	p.flight = append(p.flight, flightMessage{typ: contentHandshake, epoch: epoch, data: msg})
+}
+
+// handleHandshake handle handshake messages in record, the last flight is
+// sent again if peer retransmit its flight. It return true if handshake
+// failed
+func (l *dtlsListener) handleHandshake(p *dtlsPeer, epoch uint16, data []uint8) bool {
+	retransmitted := false
+	for len(data) > 0 {
+		h, err := parseHandshakeHeader(data)
+		if err != nil {
+			return false
+		}
+		fragment := data[handshakeHeaderSize : handshakeHeaderSize+h.size]
+		data = data[handshakeHeaderSize+h.size:]
+
+		if h.seq < p.recvSeq {
+			if h.seq == p.flightStart && !retransmitted {
+				retransmitted = true
+				if err := l.writeRecords(p, p.flight); err != nil {
+					glog.Errorf("Failed to send DTLS handshake to %s:%s", p.addr, err)
+				}
+			}
+			continue
+		}
+		// Messages not protected by negotiated cipher are only accepted
+		// before ChangeCipherSpec
+		if h.seq > p.recvSeq || (epoch == 0 && p.readEpoch == 1) || p.state != peerHandshaking {
+			continue
+		}
+		body, ok := p.reassemble(h, fragment)
+		if !ok {
+			continue
+		}
+		msg := handshakeMessage(h.typ, h.seq, body)
+		switch {
+		case h.typ == handshakeClientKeyExchange && epoch == 0:
+			identity, err := parsePskIdentity(body)
+			if err != nil {
+				return l.rejectClientKeyExchange(p, err)
+			}
+			if e := l.cachedPskKey(identity); e != nil {
+				if l.acceptClientKeyExchange(p, identity, e.key, e.err, h.seq, msg) {
+					return true
+				}
+				continue
+			}
+			// Key is resolved off the read loop, the flight is dropped and
+			// retransmitted by peer if too many keys are being resolved
+			select {
+			case l.lookups <- true:
+			default:
+				return false
+			}
+			p.resolving = true
+			if len(data) > 0 {
+				p.deferRecord(&record{typ: contentHandshake, epoch: epoch, fragment: data})
+			}
+			go l.resolvePskKey(p, identity, h.seq, msg)
+			return false
+		case h.typ == handshakeFinished && epoch == 1:
+			expected := prf(p.masterSecret, "client finished", transcriptHash(p.transcript), verifyDataSize)
+			if !hmac.Equal(expected, body) {
+				glog.Warningf("DTLS Finished from %s is not verified", p.addr)
+				l.sendAlert(p, alertLevelFatal, alertDecryptError)
+				return true
+			}
+			p.transcript = append(p.transcript, msg...)
+			p.recvSeq++
+			l.finishHandshake(p)
+			continue
+		default:
+			glog.Warningf("Unexpected DTLS handshake message %d from %s", h.typ, p.addr)
+			l.sendAlert(p, alertLevelFatal, alertHandshakeFailure)
+			return true
+		}
+	}
+	return false
+}
+
+// parsePskIdentity decode PSK identity in ClientKeyExchange body
+func parsePskIdentity(body []uint8) (string, error) {
+	r := &reader{data: body}
+	identity := string(r.bytes(int(r.uint16())))
+	if r.err != nil || !r.empty() {
+		return "", errorHandshakeFormat
+	}
+	return identity, nil
+}
+
+// resolvePskKey resolve key of identity through auth api and resume
+// handshake with records received meanwhile
+func (l *dtlsListener) resolvePskKey(p *dtlsPeer, identity string, seq uint16, msg []uint8) {
+	key, err := l.pskKey(identity)
+	l.storePskKey(identity, key, err)
+	<-l.lookups
+
+	p.mutex.Lock()
+	if p.state != peerHandshaking || !p.resolving {
+		p.mutex.Unlock()
+		return
+	}
+	p.resolving = false
+	deferred := p.deferred
+	p.deferred = nil
+	fatal := l.acceptClientKeyExchange(p, identity, key, err, seq, msg)
+	for _, r := range deferred {
+		if fatal || p.state == peerClosed {
+			break
+		}
+		// Peer can not send application data before handshake is finished
+		_, fatal = l.handlePeerRecord(p, r)
+	}
+	state := p.state
+	p.mutex.Unlock()
+	if fatal || state == peerClosed {
+		l.removePeer(p)
+	}
+}
+
+// acceptClientKeyExchange derive keys with key of identity and add
+// ClientKeyExchange to transcript. It return true if handshake failed
+func (l *dtlsListener) acceptClientKeyExchange(p *dtlsPeer, identity string, key []uint8, err error, seq uint16, msg []uint8) bool {
+	if err == nil {
+		err = l.handleClientKeyExchange(p, identity, key)
+	}
+	if err != nil {
+		return l.rejectClientKeyExchange(p, err)
+	}
+	p.flightStart = seq
+	p.transcript = append(p.transcript, msg...)
+	p.recvSeq++
+	return false
+}
+
+// rejectClientKeyExchange notify peer that handshake failed
+func (l *dtlsListener) rejectClientKeyExchange(p *dtlsPeer, err error) bool {
+	glog.Warningf("DTLS handshake with %s failed:%s", p.addr, err)
+	l.sendAlert(p, alertLevelFatal, alertUnknownPskIdentity)
+	return true
+}
+
+// handleClientKeyExchange derive keys with key of PSK identity, read cipher
+// is activated when ChangeCipherSpec is received
+func (l *dtlsListener) handleClientKeyExchange(p *dtlsPeer, identity string, key []uint8) error {
+	seed := append(append([]uint8{}, p.clientRandom...), p.serverRandom...)
+	p.masterSecret = prf(pskPremasterSecret(key), "master secret", seed, masterSecretSize)
+	p.identity = identity
+	clientKey, _, clientIV, _ := p.keys()
+	aead, err := p.suite.newAEAD(clientKey)
+	if err != nil {
+		return err
+	}
+	p.pendingAEAD, p.pendingIV = aead, clientIV
+	return nil
+}
+
+// finishHandshake send ChangeCipherSpec and Finished, session is
+// established with identity
+func (l *dtlsListener) finishHandshake(p *dtlsPeer) {
+	_, serverKey, _, serverIV := p.keys()
+	aead, err := p.suite.newAEAD(serverKey)
+	if err != nil {
+		glog.Errorf("Failed to create DTLS cipher for %s:%s", p.addr, err)
+		p.state = peerClosed
+		return
+	}
+	verify := prf(p.masterSecret, "server finished", transcriptHash(p.transcript), verifyDataSize)
+	p.flight = []flightMessage{{typ: contentChangeCipherSpec, epoch: 0, data: []uint8{1}}}
+	p.queueHandshake(handshakeFinished, 1, verify)
+	p.writeAEAD, p.writeIV = aead, serverIV
+	p.state = peerEstablished
+	p.fragments = nil
+	if err := l.writeRecords(p, p.flight); err != nil {
+		glog.Errorf("Failed to send DTLS handshake to %s:%s", p.addr, err)
+	}
+	glog.Infof("DTLS session with %s is established, identity:%s, cipher:%s", p.addr, p.identity, p.suite.name)
+}
+
+// keys return client and server write keys and IVs from key block
+func (p *dtlsPeer) keys() ([]uint8, []uint8, []uint8, []uint8) {
+	keyLen, ivLen := p.suite.keyLen, p.suite.ivLen
+	seed := append(append([]uint8{}, p.serverRandom...), p.clientRandom...)
+	block := prf(p.masterSecret, "key expansion", seed, 2*keyLen+2*ivLen)
+	return block[:keyLen], block[keyLen : 2*keyLen],
+		block[2*keyLen : 2*keyLen+ivLen], block[2*keyLen+ivLen:]
+}
+
+// transcriptHash return hash of handshake messages
+func transcriptHash(transcript []uint8) []uint8 {
+	sum := sha256.Sum256(transcript)
+	return sum[:]
+}
+
+// pskKey resolve key of identity through auth api, key is hex encoded if
+// psk_key_format is hex
+func (l *dtlsListener) pskKey(identity string) ([]uint8, error) {
+	if l.authapi == nil {
+		return nil, errors.New("No auth api to resolve psk key")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pskKeyTimeout)
+	defer cancel()
+	key, err := l.authapi.GetPskKey(ctx, l.hint, identity)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, fmt.Errorf("No psk key for identity '%s'", identity)
+	}
+	if l.keyFormat == "hex" {
+		return hex.DecodeString(key)
+	}
+	return []uint8(key), nil
+}
+
+// pskEntry is cached result of resolving key of identity
+type pskEntry struct {
+	key       []uint8
+	err       error
+	expiresAt time.Time
+}
+
+// cachedPskKey return cached key of identity, nil is returned if it is
+// not cached or expired
+func (l *dtlsListener) cachedPskKey(identity string) *pskEntry {
+	l.pskMutex.Lock()
+	defer l.pskMutex.Unlock()
+	if e, found := l.pskKeys[identity]; found && time.Now().Before(e.expiresAt) {
+		return e
+	}
+	return nil
+}
+
+// storePskKey cache key of identity, failure is cached for a short time to
+// limit lookups of unknown identities
+func (l *dtlsListener) storePskKey(identity string, key []uint8, err error) {
+	timeout := l.pskTimeout
+	if err != nil {
+		timeout = pskFailureTimeout
+	}
+	l.pskMutex.Lock()
+	defer l.pskMutex.Unlock()
+	if _, found := l.pskKeys[identity]; (found || len(l.pskKeys) < maxPskKeys) && timeout > 0 {
+		l.pskKeys[identity] = &pskEntry{key: key, err: err, expiresAt: time.Now().Add(timeout)}
+	}
+}
+
+// expirePskKeys remove expired keys from cache
+func (l *dtlsListener) expirePskKeys(now time.Time) {
+	l.pskMutex.Lock()
+	defer l.pskMutex.Unlock()
+	for identity, e := range l.pskKeys {
+		if !now.Before(e.expiresAt) {
+			delete(l.pskKeys, identity)
+		}
+	}
+}
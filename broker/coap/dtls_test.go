@@ -0,0 +1,430 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package coap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fromHex(s string) []uint8 {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestCCMVectors(t *testing.T) {
+	cases := []struct {
+		key, nonce, data, plaintext, ciphertext string
+		nonceSize                               int
+	}{
+		// RFC 3610 packet vector #1 and #2
+		{
+			"c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000003020100a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e",
+			"588c979a61c663d2f066d0c2c0f989806d5f6b61dac38417e8d12cfdf926e0", 13,
+		},
+		{
+			"c0c1c2c3c4c5c6c7c8c9cacbcccdcecf", "00000004030201a0a1a2a3a4a5", "0001020304050607",
+			"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+			"72c91a36e135f8cf291ca894085c87e3cc15c439c9e43a3ba091d56e10400916", 13,
+		},
+		// NIST SP 800-38C example 3, 12 bytes nonce and 8 bytes tag as
+		// CCM_8 suites of RFC 6655
+		{
+			"404142434445464748494a4b4c4d4e4f", "101112131415161718191a1b", "000102030405060708090a0b0c0d0e0f10111213",
+			"202122232425262728292a2b2c2d2e2f3031323334353637",
+			"e3b201a9f5b71a7a9b1ceaeccd97e70b6176aad9a4428aa5484392fbc1b09951", 12,
+		},
+	}
+	for i, c := range cases {
+		aead, err := newCCMWithNonceSize(fromHex(c.key), 8, c.nonceSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, data := fromHex(c.nonce), fromHex(c.data)
+		sealed := aead.Seal(nil, nonce, fromHex(c.plaintext), data)
+		if hex.EncodeToString(sealed) != c.ciphertext {
+			t.Errorf("vector %d: seal = %x, want %s", i, sealed, c.ciphertext)
+		}
+		opened, err := aead.Open(nil, nonce, fromHex(c.ciphertext), data)
+		if err != nil || hex.EncodeToString(opened) != c.plaintext {
+			t.Errorf("vector %d: open = %x, %v", i, opened, err)
+		}
+		// Any modified byte fail authentication
+		for j := range sealed {
+			tampered := append([]uint8{}, sealed...)
+			tampered[j] ^= 1
+			if _, err := aead.Open(nil, nonce, tampered, data); err == nil {
+				t.Errorf("vector %d: ciphertext modified at %d is opened", i, j)
+			}
+		}
+		if _, err := aead.Open(nil, nonce, sealed, append(data, 0)); err == nil {
+			t.Errorf("vector %d: modified additional data is opened", i)
+		}
+	}
+}
+
+func TestPRF(t *testing.T) {
+	// TLS 1.2 PRF with SHA256 vector published on IETF TLS mailing list
+	secret := fromHex("9bbe436ba940f017b17652849a71db35")
+	seed := fromHex("a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66"
+	if got := hex.EncodeToString(prf(secret, "test label", seed, 100)); got != want {
+		t.Fatalf("prf = %s, want %s", got, want)
+	}
+	// Premaster secret of RFC 4279
+	if got := hex.EncodeToString(pskPremasterSecret([]uint8{1, 2})); got != "0002000000020102" {
+		t.Fatalf("premaster secret = %s", got)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	p := &dtlsPeer{}
+	if p.replayed(0) {
+		t.Fatal("first record is replayed")
+	}
+	p.accept(0)
+	if !p.replayed(0) {
+		t.Fatal("record 0 is not replayed")
+	}
+	p.accept(100)
+	cases := []struct {
+		seq      uint64
+		replayed bool
+	}{
+		{100, true},
+		{101, false},
+		{99, false},
+		// The oldest record in window
+		{100 - replayWindowSize + 1, false},
+		// Records out of window are considered replayed
+		{100 - replayWindowSize, true},
+		{0, true},
+	}
+	for _, c := range cases {
+		if p.replayed(c.seq) != c.replayed {
+			t.Errorf("replayed(%d) = %v, want %v", c.seq, !c.replayed, c.replayed)
+		}
+	}
+	p.accept(37)
+	if !p.replayed(37) || p.replayed(38) {
+		t.Fatal("record in window is not marked")
+	}
+	// Moving window by its size forget all records in it
+	p.accept(100 + replayWindowSize)
+	if !p.replayed(100) || p.replayed(101) || p.replayed(100+replayWindowSize-1) {
+		t.Fatal("window is not moved")
+	}
+	p.accept(100 + replayWindowSize + 1)
+	if !p.replayed(100+replayWindowSize) || !p.replayed(100+replayWindowSize+1) {
+		t.Fatal("window is not shifted")
+	}
+}
+
+// testAuthApi resolve psk keys of identities and count lookups
+type testAuthApi struct {
+	keys    map[string]string
+	lookups int32
+}
+
+func (a *testAuthApi) GetVersion(ctx context.Context) int { return 1 }
+func (a *testAuthApi) CheckAcl(ctx context.Context, clientid string, username string, topic string, access string) error {
+	return nil
+}
+func (a *testAuthApi) CheckUserNameAndPassword(ctx context.Context, username string, password string) error {
+	return nil
+}
+func (a *testAuthApi) GetPskKey(ctx context.Context, hint string, identity string) (string, error) {
+	atomic.AddInt32(&a.lookups, 1)
+	// Lookup is slow enough to receive the whole flight meanwhile
+	time.Sleep(20 * time.Millisecond)
+	if key, found := a.keys[identity]; found {
+		return key, nil
+	}
+	return "", errors.New("Unknown identity")
+}
+
+// newTestDTLSListener listen on local address and return datagrams read
+// from established peers
+func newTestDTLSListener(t *testing.T, authapi *testAuthApi) (*dtlsListener, chan datagram) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &dtlsListener{
+		conn:             conn,
+		authapi:          authapi,
+		hint:             "sentel",
+		keyFormat:        "hex",
+		cookieSecret:     []uint8("cookie secret"),
+		handshakeTimeout: 30 * time.Second,
+		sessionTimeout:   3600 * time.Second,
+		pskTimeout:       60 * time.Second,
+		peers:            make(map[string]*dtlsPeer),
+		pskKeys:          make(map[string]*pskEntry),
+		lookups:          make(chan bool, maxPskLookups),
+		buf:              make([]uint8, maxDatagram),
+		quit:             make(chan bool),
+	}
+	go l.expire()
+	received := make(chan datagram, 16)
+	go func() {
+		buf := make([]uint8, maxDatagram)
+		for {
+			n, addr, err := l.ReadFrom(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- datagram{addr: addr, data: append([]uint8{}, buf[:n]...)}
+		}
+	}()
+	return l, received
+}
+
+// testDTLSClient is DTLS client with pre-shared key, keys are kept in peer
+// with client and server roles exchanged
+type testDTLSClient struct {
+	t       *testing.T
+	conn    net.Conn
+	peer    *dtlsPeer
+	msgSeq  uint16
+	records []*record
+}
+
+func newTestDTLSClient(t *testing.T, l *dtlsListener) *testDTLSClient {
+	conn, err := net.Dial("udp", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &dtlsPeer{clientRandom: make([]uint8, randomSize), suite: cipherSuites[0]}
+	for i := range p.clientRandom {
+		p.clientRandom[i] = uint8(i)
+	}
+	return &testDTLSClient{t: t, conn: conn, peer: p}
+}
+
+func (c *testDTLSClient) send(msgs ...flightMessage) {
+	data := []uint8{}
+	for _, msg := range msgs {
+		seq := c.peer.writeSeq[msg.epoch]
+		c.peer.writeSeq[msg.epoch]++
+		fragment := msg.data
+		if msg.epoch == 1 {
+			fragment = c.peer.seal(msg.typ, seq, fragment)
+		}
+		data = append(data, recordHeader(msg.typ, dtlsVersion12, msg.epoch, seq, len(fragment))...)
+		data = append(data, fragment...)
+	}
+	if _, err := c.conn.Write(data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// handshake return handshake message sent with next sequence
+func (c *testDTLSClient) handshake(typ uint8, body []uint8) []uint8 {
+	msg := handshakeMessage(typ, c.msgSeq, body)
+	c.msgSeq++
+	return msg
+}
+
+// recv return next record from listener, epoch 1 record is decrypted
+func (c *testDTLSClient) recv() *record {
+	for len(c.records) == 0 {
+		buf := make([]uint8, maxDatagram)
+		c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		c.records = parseRecords(buf[:n])
+	}
+	r := c.records[0]
+	c.records = c.records[1:]
+	if r.epoch == 1 {
+		plaintext, err := c.peer.open(r)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		r.fragment = plaintext
+	}
+	return r
+}
+
+// expectHandshake return handshake message of type in next record
+func (c *testDTLSClient) expectHandshake(typ uint8) []uint8 {
+	r := c.recv()
+	if r.typ != contentHandshake || len(r.fragment) < handshakeHeaderSize || r.fragment[0] != typ {
+		c.t.Fatalf("handshake %d is expected, record %d %x is received", typ, r.typ, r.fragment)
+	}
+	return r.fragment
+}
+
+func (c *testDTLSClient) clientHello(cookie []uint8) []uint8 {
+	body := []uint8{uint8(dtlsVersion12 >> 8), uint8(dtlsVersion12 & 0xFF)}
+	body = append(body, c.peer.clientRandom...)
+	body = append(body, 0, uint8(len(cookie)))
+	body = append(body, cookie...)
+	body = append(body, 0, 2, uint8(c.peer.suite.id>>8), uint8(c.peer.suite.id), 1, 0)
+	return c.handshake(handshakeClientHello, body)
+}
+
+// connect do handshake with identity and key, Finished of server is
+// verified
+func (c *testDTLSClient) connect(identity string, key []uint8) {
+	// Cookie exchange is not included in transcript
+	c.send(flightMessage{typ: contentHandshake, data: c.clientHello(nil)})
+	verify := c.expectHandshake(handshakeHelloVerify)[handshakeHeaderSize:]
+	cookie := verify[3 : 3+int(verify[2])]
+
+	hello := c.clientHello(cookie)
+	c.send(flightMessage{typ: contentHandshake, data: hello})
+	transcript := append([]uint8{}, hello...)
+	serverHello := c.expectHandshake(handshakeServerHello)
+	c.peer.serverRandom = serverHello[handshakeHeaderSize+2 : handshakeHeaderSize+2+randomSize]
+	transcript = append(transcript, serverHello...)
+	keyExchange := c.expectHandshake(handshakeServerKeyExchange)
+	if hint := string(keyExchange[handshakeHeaderSize+2:]); hint != "sentel" {
+		c.t.Fatalf("identity hint = %s", hint)
+	}
+	transcript = append(transcript, keyExchange...)
+	transcript = append(transcript, c.expectHandshake(handshakeServerHelloDone)...)
+
+	clientKeyExchange := c.handshake(handshakeClientKeyExchange, append([]uint8{0, uint8(len(identity))}, identity...))
+	transcript = append(transcript, clientKeyExchange...)
+	seed := append(append([]uint8{}, c.peer.clientRandom...), c.peer.serverRandom...)
+	c.peer.masterSecret = prf(pskPremasterSecret(key), "master secret", seed, masterSecretSize)
+	clientKey, serverKey, clientIV, serverIV := c.peer.keys()
+	c.peer.writeAEAD, _ = c.peer.suite.newAEAD(clientKey)
+	c.peer.readAEAD, _ = c.peer.suite.newAEAD(serverKey)
+	c.peer.writeIV, c.peer.readIV = clientIV, serverIV
+	finished := c.handshake(handshakeFinished, prf(c.peer.masterSecret, "client finished", transcriptHash(transcript), verifyDataSize))
+	transcript = append(transcript, finished...)
+	// The whole flight is sent in one datagram
+	c.send(
+		flightMessage{typ: contentHandshake, data: clientKeyExchange},
+		flightMessage{typ: contentChangeCipherSpec, data: []uint8{1}},
+		flightMessage{typ: contentHandshake, epoch: 1, data: finished},
+	)
+
+	if r := c.recv(); r.typ != contentChangeCipherSpec {
+		c.t.Fatalf("ChangeCipherSpec is expected, record %d is received", r.typ)
+	}
+	serverFinished := c.expectHandshake(handshakeFinished)[handshakeHeaderSize:]
+	expected := prf(c.peer.masterSecret, "server finished", transcriptHash(transcript), verifyDataSize)
+	if !hmac.Equal(serverFinished, expected) {
+		c.t.Fatal("Finished of server is not verified")
+	}
+}
+
+func expectDatagram(t *testing.T, received chan datagram, data string) datagram {
+	select {
+	case d := <-received:
+		if string(d.data) != data {
+			t.Fatalf("datagram '%s' is received, want '%s'", d.data, data)
+		}
+		return d
+	case <-time.After(3 * time.Second):
+		t.Fatalf("datagram '%s' is not received", data)
+	}
+	return datagram{}
+}
+
+func TestDTLSHandshake(t *testing.T) {
+	authapi := &testAuthApi{keys: map[string]string{"dev1": "31323334"}}
+	l, received := newTestDTLSListener(t, authapi)
+	defer l.Close()
+
+	c := newTestDTLSClient(t, l)
+	c.connect("dev1", []uint8("1234"))
+	c.send(flightMessage{typ: contentApplicationData, epoch: 1, data: []uint8("hello")})
+	d := expectDatagram(t, received, "hello")
+	if identity, suite := l.identity(d.addr); identity != "dev1" || suite != cipherSuites[0].name {
+		t.Fatalf("peer identity = %s, suite = %s", identity, suite)
+	}
+	if _, err := l.WriteTo([]uint8("world"), d.addr); err != nil {
+		t.Fatal(err)
+	}
+	if r := c.recv(); r.typ != contentApplicationData || string(r.fragment) != "world" {
+		t.Fatalf("record %d '%s' is received", r.typ, r.fragment)
+	}
+
+	// Replayed record is discarded
+	c.peer.writeSeq[1]--
+	c.send(flightMessage{typ: contentApplicationData, epoch: 1, data: []uint8("hello")})
+	c.send(flightMessage{typ: contentApplicationData, epoch: 1, data: []uint8("next")})
+	expectDatagram(t, received, "next")
+
+	// Key of identity is cached for the second client
+	c2 := newTestDTLSClient(t, l)
+	c2.peer.suite = cipherSuites[1]
+	c2.connect("dev1", []uint8("1234"))
+	c2.send(flightMessage{typ: contentApplicationData, epoch: 1, data: []uint8("cached")})
+	expectDatagram(t, received, "cached")
+	if lookups := atomic.LoadInt32(&authapi.lookups); lookups != 1 {
+		t.Fatalf("psk key is looked up %d times", lookups)
+	}
+}
+
+func TestDTLSUnknownIdentity(t *testing.T) {
+	l, _ := newTestDTLSListener(t, &testAuthApi{})
+	defer l.Close()
+
+	c := newTestDTLSClient(t, l)
+	c.send(flightMessage{typ: contentHandshake, data: c.clientHello(nil)})
+	verify := c.expectHandshake(handshakeHelloVerify)[handshakeHeaderSize:]
+	c.send(flightMessage{typ: contentHandshake, data: c.clientHello(verify[3:])})
+	for i := 0; i < 3; i++ {
+		c.recv()
+	}
+	c.send(flightMessage{typ: contentHandshake, data: c.handshake(handshakeClientKeyExchange, []uint8{0, 1, 'x'})})
+	r := c.recv()
+	if r.typ != contentAlert || !bytes.Equal(r.fragment, []uint8{alertLevelFatal, alertUnknownPskIdentity}) {
+		t.Fatalf("alert is expected, record %d %x is received", r.typ, r.fragment)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if l.getPeer(c.conn.LocalAddr()) != nil {
+		t.Fatal("peer of failed handshake is not removed")
+	}
+}
+
+func TestDTLSCookie(t *testing.T) {
+	l := &dtlsListener{cookieSecret: []uint8("cookie secret")}
+	hello := &clientHello{version: dtlsVersion12, random: make([]uint8, randomSize), cipherSuites: []uint16{tlsPskWithAes128Ccm8}}
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5684}
+	b := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5685}
+	cookie := l.cookie(a, hello)
+	if len(cookie) != cookieSize || !bytes.Equal(cookie, l.cookie(a, hello)) {
+		t.Fatal("cookie is not stable")
+	}
+	if bytes.Equal(cookie, l.cookie(b, hello)) {
+		t.Fatal("cookie is not bound to address")
+	}
+	hello.random[0] = 1
+	if bytes.Equal(cookie, l.cookie(a, hello)) {
+		t.Fatal("cookie is not bound to hello")
+	}
+}
@@ -0,0 +1,374 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package coap
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const coapVersion = 1
+
+// Message types
+const (
+	typeConfirmable     uint8 = 0
+	typeNonConfirmable  uint8 = 1
+	typeAcknowledgement uint8 = 2
+	typeReset           uint8 = 3
+)
+
+// Message codes in format of class.detail, class is in the high 3 bits
+const (
+	codeEmpty  uint8 = 0x00
+	codeGET    uint8 = 0x01
+	codePOST   uint8 = 0x02
+	codePUT    uint8 = 0x03
+	codeDELETE uint8 = 0x04
+
+	codeCreated                 uint8 = 0x41 // 2.01
+	codeDeleted                 uint8 = 0x42 // 2.02
+	codeValid                   uint8 = 0x43 // 2.03
+	codeChanged                 uint8 = 0x44 // 2.04
+	codeContent                 uint8 = 0x45 // 2.05
+	codeContinue                uint8 = 0x5F // 2.31
+	codeBadRequest              uint8 = 0x80 // 4.00
+	codeUnauthorized            uint8 = 0x81 // 4.01
+	codeBadOption               uint8 = 0x82 // 4.02
+	codeForbidden               uint8 = 0x83 // 4.03
+	codeNotFound                uint8 = 0x84 // 4.04
+	codeMethodNotAllowed        uint8 = 0x85 // 4.05
+	codeRequestEntityIncomplete uint8 = 0x88 // 4.08
+	codeRequestEntityTooLarge   uint8 = 0x8D // 4.13
+	codeInternalServerError     uint8 = 0xA0 // 5.00
+)
+
+// Option numbers
+const (
+	optionIfMatch       uint16 = 1
+	optionUriHost       uint16 = 3
+	optionETag          uint16 = 4
+	optionIfNoneMatch   uint16 = 5
+	optionObserve       uint16 = 6
+	optionUriPort       uint16 = 7
+	optionLocationPath  uint16 = 8
+	optionUriPath       uint16 = 11
+	optionContentFormat uint16 = 12
+	optionMaxAge        uint16 = 14
+	optionUriQuery      uint16 = 15
+	optionAccept        uint16 = 17
+	optionLocationQuery uint16 = 20
+	optionBlock2        uint16 = 23
+	optionBlock1        uint16 = 27
+	optionSize2         uint16 = 28
+	optionProxyUri      uint16 = 35
+	optionProxyScheme   uint16 = 39
+	optionSize1         uint16 = 60
+)
+
+// knownOptions are options understood by server, request with unknown
+// critical option is rejected
+var knownOptions = map[uint16]bool{
+	optionIfMatch:       true,
+	optionUriHost:       true,
+	optionETag:          true,
+	optionIfNoneMatch:   true,
+	optionObserve:       true,
+	optionUriPort:       true,
+	optionLocationPath:  true,
+	optionUriPath:       true,
+	optionContentFormat: true,
+	optionMaxAge:        true,
+	optionUriQuery:      true,
+	optionAccept:        true,
+	optionLocationQuery: true,
+	optionBlock2:        true,
+	optionBlock1:        true,
+	optionSize2:         true,
+	optionSize1:         true,
+}
+
+// Content format of link format document
+const contentFormatLinkFormat = 40
+
+const payloadMarker = 0xFF
+
+var (
+	errorMessageFormat = errors.New("Invalid coap message format")
+	errorVersion       = errors.New("Unsupported coap version")
+)
+
+type option struct {
+	number uint16
+	value  []uint8
+}
+
+// message is coap message in RFC 7252
+type message struct {
+	typ     uint8
+	code    uint8
+	id      uint16
+	token   []uint8
+	options []option
+	payload []uint8
+}
+
+// parseMessage decode message from datagram
+func parseMessage(data []uint8) (*message, error) {
+	if len(data) < 4 {
+		return nil, errorMessageFormat
+	}
+	if data[0]>>6 != coapVersion {
+		return nil, errorVersion
+	}
+	m := &message{
+		typ:  (data[0] >> 4) & 0x03,
+		code: data[1],
+		id:   uint16(data[2])<<8 | uint16(data[3]),
+	}
+	tkl := int(data[0] & 0x0F)
+	if tkl > 8 || len(data) < 4+tkl {
+		return nil, errorMessageFormat
+	}
+	m.token = append([]uint8{}, data[4:4+tkl]...)
+	pos := 4 + tkl
+	number := 0
+	for pos < len(data) {
+		if data[pos] == payloadMarker {
+			if pos+1 == len(data) {
+				// Payload marker followed by empty payload is format error
+				return nil, errorMessageFormat
+			}
+			m.payload = append([]uint8{}, data[pos+1:]...)
+			break
+		}
+		delta, length := int(data[pos]>>4), int(data[pos]&0x0F)
+		pos++
+		var err error
+		if delta, pos, err = readOptionNibble(data, pos, delta); err != nil {
+			return nil, err
+		}
+		if length, pos, err = readOptionNibble(data, pos, length); err != nil {
+			return nil, err
+		}
+		if pos+length > len(data) {
+			return nil, errorMessageFormat
+		}
+		number += delta
+		if number > 0xFFFF {
+			return nil, errorMessageFormat
+		}
+		m.options = append(m.options, option{
+			number: uint16(number),
+			value:  append([]uint8{}, data[pos:pos+length]...),
+		})
+		pos += length
+	}
+	if m.code == codeEmpty && (len(m.token) > 0 || len(m.options) > 0 || len(m.payload) > 0) {
+		return nil, errorMessageFormat
+	}
+	return m, nil
+}
+
+// readOptionNibble read extended option delta or length
+func readOptionNibble(data []uint8, pos int, nibble int) (int, int, error) {
+	switch nibble {
+	case 13:
+		if pos+1 > len(data) {
+			return 0, pos, errorMessageFormat
+		}
+		return int(data[pos]) + 13, pos + 1, nil
+	case 14:
+		if pos+2 > len(data) {
+			return 0, pos, errorMessageFormat
+		}
+		return (int(data[pos])<<8 | int(data[pos+1])) + 269, pos + 2, nil
+	case 15:
+		return 0, pos, errorMessageFormat
+	}
+	return nibble, pos, nil
+}
+
+// encode serialize message, options are sorted by number
+func (m *message) encode() ([]uint8, error) {
+	if len(m.token) > 8 {
+		return nil, errorMessageFormat
+	}
+	data := make([]uint8, 4, 4+len(m.token)+len(m.payload)+16)
+	data[0] = coapVersion<<6 | m.typ<<4 | uint8(len(m.token))
+	data[1] = m.code
+	data[2] = uint8(m.id >> 8)
+	data[3] = uint8(m.id)
+	data = append(data, m.token...)
+
+	options := append([]option{}, m.options...)
+	sort.SliceStable(options, func(i, j int) bool { return options[i].number < options[j].number })
+	last := 0
+	for _, o := range options {
+		delta, deltaExt := optionNibble(int(o.number) - last)
+		length, lengthExt := optionNibble(len(o.value))
+		data = append(data, uint8(delta<<4|length))
+		data = append(data, deltaExt...)
+		data = append(data, lengthExt...)
+		data = append(data, o.value...)
+		last = int(o.number)
+	}
+	if len(m.payload) > 0 {
+		data = append(data, payloadMarker)
+		data = append(data, m.payload...)
+	}
+	return data, nil
+}
+
+// optionNibble return nibble and extended bytes for option delta or length
+func optionNibble(value int) (int, []uint8) {
+	switch {
+	case value < 13:
+		return value, nil
+	case value < 269:
+		return 13, []uint8{uint8(value - 13)}
+	default:
+		value -= 269
+		return 14, []uint8{uint8(value >> 8), uint8(value)}
+	}
+}
+
+// isRequest check wether message code is request method
+func (m *message) isRequest() bool {
+	return m.code != codeEmpty && m.code>>5 == 0
+}
+
+// option return value of the first option with number
+func (m *message) option(number uint16) ([]uint8, bool) {
+	for _, o := range m.options {
+		if o.number == number {
+			return o.value, true
+		}
+	}
+	return nil, false
+}
+
+// stringOptions return values of repeatable string option
+func (m *message) stringOptions(number uint16) []string {
+	values := []string{}
+	for _, o := range m.options {
+		if o.number == number {
+			values = append(values, string(o.value))
+		}
+	}
+	return values
+}
+
+// uintOption return value of unsigned integer option
+func (m *message) uintOption(number uint16) (uint32, bool) {
+	value, ok := m.option(number)
+	if !ok || len(value) > 4 {
+		return 0, false
+	}
+	n := uint32(0)
+	for _, b := range value {
+		n = n<<8 | uint32(b)
+	}
+	return n, true
+}
+
+// addOption append option to message
+func (m *message) addOption(number uint16, value []uint8) {
+	m.options = append(m.options, option{number: number, value: value})
+}
+
+// addUintOption append unsigned integer option in minimal bytes
+func (m *message) addUintOption(number uint16, n uint32) {
+	value := []uint8{}
+	for n > 0 {
+		value = append([]uint8{uint8(n)}, value...)
+		n >>= 8
+	}
+	m.addOption(number, value)
+}
+
+// unknownCriticalOption return the first critical option not understood,
+// critical options have odd numbers
+func (m *message) unknownCriticalOption() (uint16, bool) {
+	for _, o := range m.options {
+		if o.number&0x01 != 0 && !knownOptions[o.number] {
+			return o.number, true
+		}
+	}
+	return 0, false
+}
+
+// path return request path joined from Uri-Path options
+func (m *message) path() string {
+	return strings.Join(m.stringOptions(optionUriPath), "/")
+}
+
+// query return value of query parameter in Uri-Query options
+func (m *message) query(name string) (string, bool) {
+	for _, q := range m.stringOptions(optionUriQuery) {
+		if q == name {
+			return "", true
+		}
+		if strings.HasPrefix(q, name+"=") {
+			return q[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// codeString return readable code in format of class.detail
+func codeString(code uint8) string {
+	return fmt.Sprintf("%d.%02d", code>>5, code&0x1F)
+}
+
+// block is value of Block1 and Block2 option in RFC 7959
+type block struct {
+	num  uint32
+	more bool
+	szx  uint8
+}
+
+// parseBlock decode block option value, szx 7 is reserved
+func parseBlock(value uint32) (block, error) {
+	b := block{
+		num:  value >> 4,
+		more: value&0x08 != 0,
+		szx:  uint8(value & 0x07),
+	}
+	if b.szx == 7 {
+		return b, errorMessageFormat
+	}
+	return b, nil
+}
+
+// size return block size in bytes
+func (b block) size() int { return 1 << (b.szx + 4) }
+
+// value encode block option value
+func (b block) value() uint32 {
+	v := b.num<<4 | uint32(b.szx)
+	if b.more {
+		v |= 0x08
+	}
+	return v
+}
+
+// blockSzx return the largest szx whose block size is not larger than size
+func blockSzx(size int) uint8 {
+	szx := uint8(0)
+	for szx < 6 && 1<<(szx+5) <= size {
+		szx++
+	}
+	return szx
+}
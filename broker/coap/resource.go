@@ -0,0 +1,249 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package coap
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloustone/sentel/broker/auth"
+	"github.com/cloustone/sentel/broker/mqtt"
+	"github.com/golang/glog"
+)
+
+// pubsubPath is root of topics, topic levels are path segments under it
+const pubsubPath = "ps"
+
+// Observe option values in request
+const (
+	observeRegister   = 0
+	observeDeregister = 1
+)
+
+// splitTopic return levels of topic
+func splitTopic(topic string) []string {
+	return strings.Split(topic, "/")
+}
+
+// handleDiscovery return resources in link format of RFC 6690
+func (m *coap) handleDiscovery(s *coapSession, req *message, path string) *message {
+	if req.code != codeGET {
+		return newResponse(codeMethodNotAllowed)
+	}
+	resp := newResponse(codeContent)
+	resp.addUintOption(optionContentFormat, contentFormatLinkFormat)
+	resp.payload = []uint8(`</` + pubsubPath + `>;rt="core.ps";obs`)
+	return resp
+}
+
+// handlePubSub publish message on topic with POST and PUT, message
+// published with PUT is retained. Topic is observed or its retained message
+// is read with GET, and retained message is cleared with DELETE
+func (m *coap) handlePubSub(s *coapSession, req *message, path string) *message {
+	topic := strings.TrimPrefix(path, pubsubPath+"/")
+	switch req.code {
+	case codePOST, codePUT:
+		return s.handlePublish(req, path, topic)
+	case codeGET:
+		return s.handleGet(req, path, topic)
+	case codeDELETE:
+		if err := s.checkAcl(topic, auth.AclActionWrite); err != nil {
+			return newResponse(codeForbidden)
+		}
+		if err := m.gateway.DeleteRetainedMessage(topic); err != nil {
+			return newResponse(codeInternalServerError)
+		}
+		return newResponse(codeDeleted)
+	}
+	return newResponse(codeMethodNotAllowed)
+}
+
+// handlePublish route payload received in one or more blocks to topic,
+// qos is 1 for confirmable request and 0 for non-confirmable request if it
+// is not specified by qos query
+func (s *coapSession) handlePublish(req *message, path string, topic string) *message {
+	if err := s.checkAcl(topic, auth.AclActionWrite); err != nil {
+		glog.Errorf("Coap publish to '%s' from %s is denied:%s", topic, s.addr, err)
+		return newResponse(codeForbidden)
+	}
+	payload, resp := s.assemble(req, path)
+	if resp != nil {
+		return resp
+	}
+	msg := &mqtt.Message{
+		Topic:   topic,
+		Retain:  req.code == codePUT,
+		Payload: payload,
+	}
+	if req.typ == typeConfirmable {
+		msg.Qos = 1
+	}
+	if value, ok := req.query("qos"); ok {
+		qos, err := strconv.Atoi(value)
+		if err != nil || qos < 0 || qos > 2 {
+			return newResponse(codeBadRequest)
+		}
+		msg.Qos = uint8(qos)
+	}
+	if value, ok := req.query("retain"); ok {
+		msg.Retain = value == "" || value == "true"
+	}
+	if err := s.mgr.gateway.Publish(s.id, msg); err != nil {
+		glog.Warningf("Failed to publish on '%s' from %s:%s", topic, s.addr, err)
+		return newResponse(codeBadRequest)
+	}
+	s.mgr.metrics.AddMetric(metricMessageReceived, 1)
+	resp = newResponse(codeChanged)
+	if value, ok := req.uintOption(optionBlock1); ok {
+		resp.addUintOption(optionBlock1, value)
+	}
+	return resp
+}
+
+// assemble return request payload, payload sent in blocks is collected
+// and continue response is returned until the last block is received
+func (s *coapSession) assemble(req *message, path string) ([]uint8, *message) {
+	value, ok := req.uintOption(optionBlock1)
+	if !ok {
+		if s.mgr.sizeLimit > 0 && len(req.payload) > s.mgr.sizeLimit {
+			return nil, s.entityTooLarge()
+		}
+		return req.payload, nil
+	}
+	b, err := parseBlock(value)
+	if err != nil {
+		return nil, newResponse(codeBadOption)
+	}
+	key := path + "#" + string(req.token)
+	if b.num == 0 {
+		s.uploads[key] = &upload{}
+	}
+	u, ok := s.uploads[key]
+	if !ok || b.num != u.next || (b.more && len(req.payload) != b.size()) {
+		delete(s.uploads, key)
+		return nil, newResponse(codeRequestEntityIncomplete)
+	}
+	u.payload = append(u.payload, req.payload...)
+	if s.mgr.sizeLimit > 0 && len(u.payload) > s.mgr.sizeLimit {
+		delete(s.uploads, key)
+		return nil, s.entityTooLarge()
+	}
+	if b.more {
+		u.next++
+		u.expiresAt = time.Now().Add(exchangeLifetime)
+		resp := newResponse(codeContinue)
+		resp.addUintOption(optionBlock1, b.value())
+		return nil, resp
+	}
+	delete(s.uploads, key)
+	return u.payload, nil
+}
+
+// entityTooLarge return response with max payload size
+func (s *coapSession) entityTooLarge() *message {
+	resp := newResponse(codeRequestEntityTooLarge)
+	resp.addUintOption(optionSize1, uint32(s.mgr.sizeLimit))
+	return resp
+}
+
+// handleGet register or deregister observation with Observe option, and
+// return retained message on topic
+func (s *coapSession) handleGet(req *message, path string, topic string) *message {
+	if err := s.checkAcl(topic, auth.AclActionRead); err != nil {
+		glog.Errorf("Coap read on '%s' from %s is denied:%s", topic, s.addr, err)
+		return newResponse(codeForbidden)
+	}
+	if value, ok := req.uintOption(optionObserve); ok {
+		switch value {
+		case observeRegister:
+			return s.handleObserve(req, path, topic)
+		case observeDeregister:
+			s.cancelObservation(string(req.token))
+		}
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return newResponse(codeBadRequest)
+	}
+	// Smaller block size requested by endpoint is preferred
+	b := block{szx: s.mgr.blockSzx}
+	if value, ok := req.uintOption(optionBlock2); ok {
+		requested, err := parseBlock(value)
+		if err != nil {
+			return newResponse(codeBadOption)
+		}
+		b.num = requested.num
+		if requested.szx < b.szx {
+			b.szx = requested.szx
+		}
+	}
+	payload, ok := s.content(path, topic, b.num)
+	if !ok {
+		return newResponse(codeNotFound)
+	}
+	if b.num > 0 && int(b.num)*b.size() >= len(payload) {
+		return newResponse(codeBadOption)
+	}
+	resp := newResponse(codeContent)
+	if b.szx == s.mgr.blockSzx {
+		s.setContent(resp, path, payload, b.num)
+	} else {
+		s.contents[path] = payload
+		s.writeBlock(resp, payload, b)
+	}
+	return resp
+}
+
+// content return payload of topic, following blocks are read from the
+// notified payload which is not retained
+func (s *coapSession) content(path string, topic string, num uint32) ([]uint8, bool) {
+	if payload, ok := s.contents[path]; ok && num > 0 {
+		return payload, true
+	}
+	delete(s.contents, path)
+	if strings.ContainsAny(topic, "+#") {
+		return nil, false
+	}
+	msgs := s.mgr.gateway.RetainedMessages(topic)
+	if len(msgs) == 0 {
+		return nil, false
+	}
+	return msgs[0].Payload, true
+}
+
+// handleObserve add observation on topic, retained message on topic is
+// returned in response, retained messages matched with wildcard topic are
+// sent as notifications
+func (s *coapSession) handleObserve(req *message, path string, topic string) *message {
+	o, err := s.observe(req.token, topic)
+	if err != nil {
+		glog.Warningf("Failed to observe '%s' from %s:%s", topic, s.addr, err)
+		return newResponse(codeBadRequest)
+	}
+	resp := newResponse(codeContent)
+	resp.addUintOption(optionObserve, o.nextSeq())
+	msgs := s.mgr.gateway.RetainedMessages(topic)
+	if !strings.ContainsAny(topic, "+#") {
+		if len(msgs) > 0 {
+			s.setContent(resp, path, msgs[0].Payload, 0)
+		}
+		return resp
+	}
+	for _, msg := range msgs {
+		select {
+		case s.notifications <- &notification{token: string(req.token), msg: msg}:
+		default:
+		}
+	}
+	return resp
+}
@@ -13,52 +13,568 @@
 package coap
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/mqtt"
+	"github.com/cloustone/sentel/broker/plugins"
 	"github.com/cloustone/sentel/core"
 
 	"github.com/golang/glog"
 )
 
+// Transmission parameters in RFC 7252
+const (
+	ackTimeout       = 2 * time.Second
+	ackRandomFactor  = 1.5
+	maxRetransmit    = 4
+	exchangeLifetime = 247 * time.Second
+	nonLifetime      = 145 * time.Second
+	sessionTick      = 250 * time.Millisecond
+	incomingQueue    = 64
+)
+
+// exchange is response of received message, it is sent again if the
+// message is duplicated
+type exchange struct {
+	response  []uint8
+	expiresAt time.Time
+}
+
+// upload is request payload received in blocks
+type upload struct {
+	payload   []uint8
+	next      uint32
+	expiresAt time.Time
+}
+
+// observation is topic observed by endpoint with token, the topic may
+// contain mqtt wildcards
+type observation struct {
+	id    string // Receiver id in gateway
+	token []uint8
+	topic string
+	seq   uint32
+}
+
+// pending is notification sent to endpoint, confirmable notification is
+// retransmitted until it is acknowledged
+type pending struct {
+	data        []uint8
+	token       string
+	confirmable bool
+	attempts    int
+	timeout     time.Duration
+	deadline    time.Time
+}
+
+// notification is message matched with observation
+type notification struct {
+	token string
+	msg   *mqtt.Message
+}
+
 type coapSession struct {
-	mgr      *coap
-	config   core.Config
-	conn     net.Conn
-	id       string
-	state    uint8
-	observer base.SessionObserver
+	mgr           *coap
+	config        core.Config
+	addr          net.Addr
+	id            string
+	username      string // PSK identity authenticated in DTLS handshake
+	cipher        string
+	observer      base.SessionObserver
+	incoming      chan []uint8
+	notifications chan *notification
+	mutex         sync.Mutex
+	exchanges     map[uint16]*exchange
+	uploads       map[string]*upload
+	observations  map[string]*observation // Observations keyed by token
+	pendings      map[uint16]*pending     // Notifications keyed by message id
+	contents      map[string][]uint8      // Notified payload fetched in blocks
+	lastMid       uint16
+	createdAt     time.Time
+	lastActive    time.Time
+	stats         *base.Stats
+	metrics       *base.Metrics
+	quit          chan bool
+	destroyOnce   sync.Once
 }
 
-// newCoapSession create new session  for each client connection
-func newCoapSession(m *coap, conn net.Conn, id string) (*coapSession, error) {
+// newCoapSession create new session for each endpoint
+func newCoapSession(m *coap, addr net.Addr, id string) *coapSession {
 	s := &coapSession{
-		mgr:      m,
-		config:   m.config,
-		conn:     conn,
-		id:       id,
-		observer: nil,
+		mgr:           m,
+		config:        m.config,
+		addr:          addr,
+		id:            id,
+		observer:      nil,
+		incoming:      make(chan []uint8, incomingQueue),
+		notifications: make(chan *notification, m.notifyQueueSize),
+		exchanges:     make(map[uint16]*exchange),
+		uploads:       make(map[string]*upload),
+		observations:  make(map[string]*observation),
+		pendings:      make(map[uint16]*pending),
+		contents:      make(map[string][]uint8),
+		lastMid:       uint16(rand.Intn(0x10000)),
+		createdAt:     time.Now(),
+		lastActive:    time.Now(),
+		stats:         base.NewStats(true),
+		metrics:       base.NewMetrics(true),
+		quit:          make(chan bool),
 	}
-	return s, nil
+	return s
 }
 
+// RegisterObserver register observer, identity authenticated before is
+// reported to it
 func (s *coapSession) RegisterObserver(o base.SessionObserver) {
 	if s.observer != nil {
-		glog.Error("MqttSession register multiple observer")
+		glog.Error("CoapSession register multiple observer")
 	}
 	s.observer = o
+	if o != nil && s.username != "" {
+		if err := o.OnAuthenticate(s, s.username, ""); err != nil {
+			glog.Warningf("Coap identity '%s' from %s is rejected:%s", s.username, s.addr, err)
+			s.username = ""
+		}
+	}
+}
+
+// authenticate set identity of endpoint authenticated in secure session
+func (s *coapSession) authenticate(identity string, cipher string) {
+	if identity == "" {
+		return
+	}
+	s.username = identity
+	s.cipher = cipher
+	if s.observer != nil {
+		if err := s.observer.OnAuthenticate(s, identity, ""); err != nil {
+			glog.Warningf("Coap identity '%s' from %s is rejected:%s", identity, s.addr, err)
+			s.username = ""
+		}
+	}
+}
+
+// checkAcl check topic access of endpoint with its identity, anonymous
+// endpoint is only checked by plugins when allow_anonymous is set
+func (s *coapSession) checkAcl(topic string, access string) error {
+	if s.username == "" && !s.mgr.allowAnonymous {
+		return fmt.Errorf("Anonymous endpoint %s can not access '%s'", s.addr, topic)
+	}
+	if err := plugins.CheckAcl(s.id, s.username, topic, access); err != nil {
+		return err
+	}
+	if s.username == "" {
+		return nil
+	}
+	return s.mgr.authapi.CheckAcl(context.Background(), s.id, s.username, topic, access)
+}
+
+// receive queue datagram from endpoint, datagram is dropped if session is
+// busy and endpoint will retransmit it
+func (s *coapSession) receive(data []uint8) {
+	select {
+	case s.incoming <- data:
+	default:
+		glog.Warningf("Datagram from %s is dropped, session is busy", s.addr)
+	}
 }
 
-// handle is mainprocessor for iot device client
-// Loop to read packet from conn
+// Handle is mainprocessor for endpoint, datagrams and notifications are
+// handled in order, session is removed after idle timeout if endpoint
+// observe nothing
 func (s *coapSession) Handle() error {
+	glog.Infof("Handling coap session:%s from %s", s.id, s.addr)
+	defer s.Destroy()
+
+	ticker := time.NewTicker(sessionTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case data := <-s.incoming:
+			s.lastActive = time.Now()
+			s.handleDatagram(data)
+		case n := <-s.notifications:
+			s.notify(n)
+		case now := <-ticker.C:
+			s.retransmit(now)
+			s.expire(now)
+			if s.idle(now) {
+				glog.Infof("Coap session %s is idle", s.id)
+				return nil
+			}
+		case <-s.quit:
+			return nil
+		}
+	}
+}
+
+// handleDatagram decode message and handle it according to its type
+func (s *coapSession) handleDatagram(data []uint8) {
+	msg, err := parseMessage(data)
+	if err != nil {
+		// Confirmable message with format error is rejected
+		if err == errorMessageFormat && len(data) >= 4 && (data[0]>>4)&0x03 == typeConfirmable {
+			s.sendReset(uint16(data[2])<<8 | uint16(data[3]))
+		}
+		glog.Warningf("Invalid coap message from %s:%s", s.addr, err)
+		return
+	}
+	switch msg.typ {
+	case typeAcknowledgement:
+		s.acknowledge(msg.id, false)
+	case typeReset:
+		s.acknowledge(msg.id, true)
+	default:
+		if !msg.isRequest() {
+			// Empty confirmable message is ping, response is not expected
+			if msg.typ == typeConfirmable {
+				s.sendReset(msg.id)
+			}
+			return
+		}
+		s.handleRequest(msg)
+	}
+}
+
+// handleRequest route request to resource, duplicated request is not
+// handled again and its response is sent again for confirmable request
+func (s *coapSession) handleRequest(req *message) {
+	if ex, ok := s.exchanges[req.id]; ok {
+		s.mgr.metrics.AddMetric(metricPacketDuplicated, 1)
+		if req.typ == typeConfirmable {
+			s.write(ex.response)
+		}
+		return
+	}
+	resp := s.serve(req)
+	resp.token = req.token
+	lifetime := exchangeLifetime
+	if req.typ == typeConfirmable {
+		resp.typ = typeAcknowledgement
+		resp.id = req.id
+	} else {
+		resp.typ = typeNonConfirmable
+		resp.id = s.nextMid()
+		lifetime = nonLifetime
+	}
+	data, err := resp.encode()
+	if err != nil {
+		glog.Errorf("Failed to encode coap response to %s:%s", s.addr, err)
+		return
+	}
+	s.exchanges[req.id] = &exchange{response: data, expiresAt: time.Now().Add(lifetime)}
+	s.write(data)
+}
+
+// serve return response of request from matched resource
+func (s *coapSession) serve(req *message) *message {
+	if number, ok := req.unknownCriticalOption(); ok {
+		glog.Warningf("Unknown critical option %d from %s", number, s.addr)
+		return newResponse(codeBadOption)
+	}
+	if s.username == "" && !s.mgr.allowAnonymous {
+		return newResponse(codeUnauthorized)
+	}
+	path := req.path()
+	r := s.mgr.route(path)
+	if r == nil {
+		return newResponse(codeNotFound)
+	}
+	glog.Infof("Coap %s on '%s' from %s", codeString(req.code), path, s.addr)
+	return r.handler(s, req, path)
+}
+
+// newResponse create response with code, type and id are set when it is sent
+func newResponse(code uint8) *message {
+	return &message{code: code}
+}
+
+// nextMid return message id for message initiated by server
+func (s *coapSession) nextMid() uint16 {
+	s.lastMid++
+	return s.lastMid
+}
+
+// write send datagram to endpoint
+func (s *coapSession) write(data []uint8) {
+	if err := s.mgr.writeTo(data, s.addr); err != nil {
+		glog.Errorf("Failed to send coap message to %s:%s", s.addr, err)
+	}
+}
+
+// sendReset reject message with id
+func (s *coapSession) sendReset(id uint16) {
+	data, _ := (&message{typ: typeReset, code: codeEmpty, id: id}).encode()
+	s.write(data)
+}
+
+// acknowledge handle acknowledge or reset of notification, observation is
+// cancelled if notification is rejected
+func (s *coapSession) acknowledge(id uint16, reset bool) {
+	s.mutex.Lock()
+	p, ok := s.pendings[id]
+	delete(s.pendings, id)
+	s.mutex.Unlock()
+	if ok && reset {
+		glog.Infof("Notification is rejected by %s, observation is cancelled", s.addr)
+		s.cancelObservation(p.token)
+	}
+}
+
+// retransmit send confirmable notifications not acknowledged in timeout,
+// observation is cancelled after max retransmission
+func (s *coapSession) retransmit(now time.Time) {
+	expired := []string{}
+	s.mutex.Lock()
+	for id, p := range s.pendings {
+		if now.Before(p.deadline) {
+			continue
+		}
+		if !p.confirmable || p.attempts >= maxRetransmit {
+			delete(s.pendings, id)
+			if p.confirmable {
+				expired = append(expired, p.token)
+			}
+			continue
+		}
+		p.attempts++
+		p.timeout *= 2
+		p.deadline = now.Add(p.timeout)
+		s.mgr.metrics.AddMetric(metricPacketResent, 1)
+		s.write(p.data)
+	}
+	s.mutex.Unlock()
+	for _, token := range expired {
+		glog.Infof("Notification is not acknowledged by %s, observation is cancelled", s.addr)
+		s.cancelObservation(token)
+	}
+}
+
+// expire remove exchanges and uploads out of lifetime
+func (s *coapSession) expire(now time.Time) {
+	for id, ex := range s.exchanges {
+		if now.After(ex.expiresAt) {
+			delete(s.exchanges, id)
+		}
+	}
+	for key, u := range s.uploads {
+		if now.After(u.expiresAt) {
+			delete(s.uploads, key)
+		}
+	}
+}
+
+// idle check wether session can be removed
+func (s *coapSession) idle(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.observations) == 0 && len(s.pendings) == 0 &&
+		now.Sub(s.lastActive) > s.mgr.sessionTimeout
+}
+
+// observe add observation on topic with token, observation with the same
+// token is replaced
+func (s *coapSession) observe(token []uint8, topic string) (*observation, error) {
+	s.cancelObservation(string(token))
+	o := &observation{
+		id:    fmt.Sprintf("%s#%x", s.id, token),
+		token: token,
+		topic: topic,
+		seq:   2,
+	}
+	key := string(token)
+	err := s.mgr.gateway.Subscribe(o.id, topic, 1, func(msg *mqtt.Message) {
+		select {
+		case s.notifications <- &notification{token: key, msg: msg}:
+		default:
+			s.mgr.metrics.AddMetric(metricMessageDropped, 1)
+			glog.Warningf("Notification to %s is dropped, queue is full", s.addr)
+		}
+	})
+	if err != nil {
+		s.mgr.gateway.Unsubscribe(o.id)
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.observations[key] = o
+	count := len(s.observations)
+	s.mutex.Unlock()
+	s.stats.SetStat(statObservationsCount, uint64(count))
+	return o, nil
+}
+
+// cancelObservation remove observation with token
+func (s *coapSession) cancelObservation(token string) {
+	s.mutex.Lock()
+	o, ok := s.observations[token]
+	delete(s.observations, token)
+	count := len(s.observations)
+	s.mutex.Unlock()
+	if ok {
+		s.mgr.gateway.Unsubscribe(o.id)
+		s.stats.SetStat(statObservationsCount, uint64(count))
+	}
+}
+
+// nextSeq return observe sequence of next notification, it is 24 bits
+func (o *observation) nextSeq() uint32 {
+	o.seq = (o.seq + 1) & 0xFFFFFF
+	return o.seq
+}
+
+// notify send message to endpoint observing it, qos 1 and 2 messages are
+// sent as confirmable notification
+func (s *coapSession) notify(n *notification) {
+	s.mutex.Lock()
+	o, ok := s.observations[n.token]
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+	msg := &message{
+		typ:   typeNonConfirmable,
+		code:  codeContent,
+		id:    s.nextMid(),
+		token: o.token,
+	}
+	if n.msg.Qos > 0 {
+		msg.typ = typeConfirmable
+	}
+	msg.addUintOption(optionObserve, o.nextSeq())
+	if o.topic != n.msg.Topic {
+		// Endpoint observing wildcard topic get the published topic
+		for _, level := range splitTopic(n.msg.Topic) {
+			msg.addOption(optionLocationPath, []uint8(level))
+		}
+	}
+	s.setContent(msg, pubsubPath+"/"+n.msg.Topic, n.msg.Payload, 0)
+	data, err := msg.encode()
+	if err != nil {
+		glog.Errorf("Failed to encode notification to %s:%s", s.addr, err)
+		return
+	}
+	timeout := time.Duration(float64(ackTimeout) * (1 + rand.Float64()*(ackRandomFactor-1)))
+	lifetime := timeout
+	if msg.typ == typeNonConfirmable {
+		lifetime = nonLifetime
+	}
+	s.mutex.Lock()
+	s.pendings[msg.id] = &pending{
+		data:        data,
+		token:       n.token,
+		confirmable: msg.typ == typeConfirmable,
+		timeout:     timeout,
+		deadline:    time.Now().Add(lifetime),
+	}
+	s.mutex.Unlock()
+	s.mgr.metrics.AddMetric(metricMessageSent, 1)
+	s.write(data)
+}
+
+// setContent put payload into response, the payload is split into blocks
+// if it is larger than block size, num is the block requested by endpoint
+func (s *coapSession) setContent(resp *message, path string, payload []uint8, num uint32) {
+	size := block{szx: s.mgr.blockSzx}.size()
+	if num == 0 && len(payload) <= size {
+		resp.payload = payload
+		return
+	}
+	if num == 0 {
+		// Endpoint fetch following blocks of the payload with GET
+		s.contents[path] = payload
+	}
+	s.writeBlock(resp, payload, block{num: num, szx: s.mgr.blockSzx})
+}
+
+// writeBlock put block of payload into response with Block2 option
+func (s *coapSession) writeBlock(resp *message, payload []uint8, b block) {
+	start := int(b.num) * b.size()
+	end := start + b.size()
+	if end > len(payload) {
+		end = len(payload)
+	}
+	b.more = end < len(payload)
+	resp.payload = payload[start:end]
+	resp.addUintOption(optionBlock2, b.value())
+	if b.num == 0 {
+		resp.addUintOption(optionSize2, uint32(len(payload)))
+	}
+}
+
+// Destroy remove observations and session
+func (s *coapSession) Destroy() error {
+	s.destroyOnce.Do(func() {
+		close(s.quit)
+		s.mutex.Lock()
+		tokens := []string{}
+		for token := range s.observations {
+			tokens = append(tokens, token)
+		}
+		s.mutex.Unlock()
+		for _, token := range tokens {
+			s.cancelObservation(token)
+		}
+		s.mgr.removeSession(s)
+		glog.Infof("Coap session %s is destroyed", s.id)
+	})
 	return nil
 }
 
-// removeConnection remove current connection from coapManaager if errors occured
-func (s *coapSession) Destroy() error            { return nil }
-func (s *coapSession) Identifier() string        { return "" }
-func (s *coapSession) Service() base.Service     { return nil }
-func (s *coapSession) GetStats() *base.Stats     { return nil }
-func (s *coapSession) GetMetrics() *base.Metrics { return nil }
-func (s *coapSession) Info() *base.SessionInfo   { return nil }
+func (s *coapSession) Identifier() string        { return s.id }
+func (s *coapSession) Service() base.Service     { return s.mgr }
+func (s *coapSession) GetStats() *base.Stats     { return s.stats }
+func (s *coapSession) GetMetrics() *base.Metrics { return s.metrics }
+
+// Info return session information
+func (s *coapSession) Info() *base.SessionInfo {
+	s.mutex.Lock()
+	inflight := 0
+	for _, p := range s.pendings {
+		if p.confirmable {
+			inflight++
+		}
+	}
+	s.mutex.Unlock()
+	return &base.SessionInfo{
+		ClientId:        s.id,
+		CleanSession:    true,
+		MessageInflight: uint64(inflight),
+		MessageInQueue:  uint64(len(s.notifications)),
+		CreatedAt:       s.createdAt.Format(time.RFC3339),
+	}
+}
+
+// clientInfo return endpoint information
+func (s *coapSession) clientInfo() *base.ClientInfo {
+	info := &base.ClientInfo{
+		UserName:     s.username,
+		CleanSession: true,
+		PeerName:     s.addr.String(),
+		ConnectTime:  s.createdAt.Format(time.RFC3339),
+	}
+	if s.cipher != "" {
+		info.TLSVersion = "DTLS 1.2"
+		info.TLSCipher = s.cipher
+	}
+	return info
+}
+
+// subscriptions return observations of endpoint
+func (s *coapSession) subscriptions() []*base.SubscriptionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subs := []*base.SubscriptionInfo{}
+	for _, o := range s.observations {
+		subs = append(subs, &base.SubscriptionInfo{
+			ClientId:  s.id,
+			Topic:     o.topic,
+			Attribute: "observe",
+		})
+	}
+	return subs
+}
@@ -1 +1,86 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
 package codec
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Codec convert payload between wire format and generic value, which is
+// composed of map[string]interface{}, []interface{}, string, []byte, bool,
+// numbers and nil
+type Codec interface {
+	Decode(data []byte) (interface{}, error)
+	Encode(v interface{}) ([]byte, error)
+}
+
+// Options of codec, it is read from config section of binding
+type Options map[string]string
+
+// CodecFactory create codec with options
+type CodecFactory interface {
+	New(opts Options) (Codec, error)
+}
+
+var _allCodecs = make(map[string]CodecFactory)
+
+// RegisterCodec register codec factory
+func RegisterCodec(name string, factory CodecFactory) {
+	if _allCodecs[name] != nil {
+		glog.Errorf("Codec '%s' is already registered", name)
+		return
+	}
+	_allCodecs[name] = factory
+}
+
+// NewCodec lookup registered codec list, create a new codec instance
+func NewCodec(name string, opts Options) (Codec, error) {
+	if _allCodecs[name] == nil {
+		return nil, fmt.Errorf("Codec '%s' is not registered", name)
+	}
+	return _allCodecs[name].New(opts)
+}
+
+// normalize convert maps with non-string keys decoded by binary codecs,
+// so that value can be encoded by any codec
+func normalize(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			val[k] = normalize(item)
+		}
+		return val
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[fmt.Sprintf("%v", k)] = normalize(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range val {
+			val[i] = normalize(item)
+		}
+		return val
+	default:
+		return v
+	}
+}
+
+func init() {
+	RegisterCodec("json", jsonCodecFactory{})
+	RegisterCodec("cbor", cborCodecFactory{})
+	RegisterCodec("msgpack", msgpackCodecFactory{})
+	RegisterCodec("protobuf", protobufCodecFactory{})
+}
@@ -0,0 +1,183 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package codec
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	pd "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// newTestProtobufCodec create codec of message with double, int32, string,
+// packed repeated int32 and fixed32 fields
+func newTestProtobufCodec(t *testing.T) Codec {
+	field := func(name string, number int32, typ pd.FieldDescriptorProto_Type, label pd.FieldDescriptorProto_Label) *pd.FieldDescriptorProto {
+		return &pd.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Type: typ.Enum(), Label: label.Enum()}
+	}
+	optional, repeated := pd.FieldDescriptorProto_LABEL_OPTIONAL, pd.FieldDescriptorProto_LABEL_REPEATED
+	set := &pd.FileDescriptorSet{File: []*pd.FileDescriptorProto{{
+		Name:    proto.String("reading.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*pd.DescriptorProto{{
+			Name: proto.String("Reading"),
+			Field: []*pd.FieldDescriptorProto{
+				field("d", 1, pd.FieldDescriptorProto_TYPE_DOUBLE, optional),
+				field("n", 2, pd.FieldDescriptorProto_TYPE_INT32, optional),
+				field("s", 3, pd.FieldDescriptorProto_TYPE_STRING, optional),
+				field("r", 4, pd.FieldDescriptorProto_TYPE_INT32, repeated),
+				field("f", 5, pd.FieldDescriptorProto_TYPE_FIXED32, optional),
+			},
+		}},
+	}}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "codec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reading.desc")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCodec("protobuf", Options{"protobuf_descriptor": path, "protobuf_message": "test.Reading"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func newTestCodecs(t *testing.T) map[string]Codec {
+	codecs := map[string]Codec{"protobuf": newTestProtobufCodec(t)}
+	for _, name := range []string{"json", "cbor", "msgpack"} {
+		c, err := NewCodec(name, Options{"message_size_limit": "1024"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		codecs[name] = c
+	}
+	return codecs
+}
+
+func TestCodecDecode(t *testing.T) {
+	codecs := newTestCodecs(t)
+	cases := []struct {
+		codec   string
+		payload string
+		want    interface{}
+	}{
+		{"json", `{"a":1}`, map[string]interface{}{"a": float64(1)}},
+		{"cbor", "a1616101", map[string]interface{}{"a": uint64(1)}},
+		// Indefinite length string of two chunks
+		{"cbor", "7f61616162ff", "ab"},
+		{"msgpack", "81a16101", map[string]interface{}{"a": int64(1)}},
+		{"protobuf", "09000000000000f03f10fe01", map[string]interface{}{"d": float64(1), "n": int64(254)}},
+		// Packed and unpacked repeated fields
+		{"protobuf", "2202010220032d04000000", map[string]interface{}{"r": []interface{}{int64(1), int64(2), int64(3)}, "f": uint64(4)}},
+	}
+	for _, c := range cases {
+		payload := []byte(c.payload)
+		if c.codec != "json" {
+			payload, _ = hex.DecodeString(c.payload)
+		}
+		got, err := codecs[c.codec].Decode(payload)
+		if err != nil {
+			t.Errorf("%s decode %s failed:%s", c.codec, c.payload, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s decode %s = %#v, want %#v", c.codec, c.payload, got, c.want)
+		}
+	}
+}
+
+func TestCodecDecodeMalformed(t *testing.T) {
+	codecs := newTestCodecs(t)
+	cases := []struct {
+		codec   string
+		payload string
+	}{
+		{"json", "7b2261223a"},
+		{"json", "ff"},
+		// Chunk of indefinite length string declare 3.6GB
+		{"cbor", "5f7ad9c01337c9"},
+		{"cbor", "7a7fffffff61"},
+		{"cbor", "9b7fffffffffffffff"},
+		{"cbor", "bf61"},
+		{"cbor", "1c"},
+		{"cbor", "ff"},
+		{"msgpack", "dbffffffff61"},
+		{"msgpack", "ddffffffff"},
+		{"msgpack", "dfffffffff"},
+		{"msgpack", "c1"},
+		// Varint received for double field
+		{"protobuf", "0801"},
+		// Fixed32 received for double field
+		{"protobuf", "0d01000000"},
+		// Length delimited received for string field beyond payload
+		{"protobuf", "1a05616263"},
+		{"protobuf", "10ffffffffffffffffffff01"},
+		// Packed fixed32 with short element
+		{"protobuf", "2a03010203"},
+		{"protobuf", "0b"},
+	}
+	for _, c := range cases {
+		payload, _ := hex.DecodeString(c.payload)
+		if v, err := codecs[c.codec].Decode(payload); err == nil {
+			t.Errorf("%s decode malformed %s = %#v", c.codec, c.payload, v)
+		}
+	}
+}
+
+func TestCodecSizeLimit(t *testing.T) {
+	codecs := newTestCodecs(t)
+	// Valid cbor and msgpack byte strings of 2000 bytes
+	payloads := map[string][]byte{
+		"cbor":    append([]byte{0x59, 0x07, 0xd0}, make([]byte, 2000)...),
+		"msgpack": append([]byte{0xc5, 0x07, 0xd0}, make([]byte, 2000)...),
+	}
+	for name, payload := range payloads {
+		if _, err := codecs[name].Decode(payload); err == nil {
+			t.Errorf("%s decode payload beyond size limit", name)
+		}
+		if _, err := codecs[name].Decode(payload[:1000]); err == nil {
+			t.Errorf("%s decode truncated payload", name)
+		}
+	}
+	if _, err := NewCodec("cbor", Options{"message_size_limit": "-1"}); err == nil {
+		t.Error("invalid size limit is accepted")
+	}
+}
+
+func TestCodecDecodeRandom(t *testing.T) {
+	codecs := newTestCodecs(t)
+	r := rand.New(rand.NewSource(1))
+	payload := make([]byte, 30)
+	for i := 0; i < 20000; i++ {
+		r.Read(payload)
+		for _, c := range codecs {
+			// Decode must not panic or allocate memory for declared length
+			c.Decode(payload)
+		}
+	}
+}
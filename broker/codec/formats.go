@@ -0,0 +1,210 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	ugorji "github.com/ugorji/go/codec"
+)
+
+var mapType = reflect.TypeOf(map[string]interface{}(nil))
+
+const (
+	// Default limit of payload decoded by binary codecs
+	defaultSizeLimit = 256 * 1024
+	// Collections are allocated up to the length and grown when they are
+	// filled, declared length of malformed payload is not trusted
+	maxInitLen   = 1024
+	maxCborDepth = 64
+)
+
+var errCborFormat = errors.New("Invalid cbor payload")
+
+// sizeLimit return payload size limit in options
+func sizeLimit(opts Options) (int, error) {
+	val, ok := opts["message_size_limit"]
+	if !ok || val == "" {
+		return defaultSizeLimit, nil
+	}
+	limit, err := strconv.Atoi(val)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("Invalid message size limit '%s'", val)
+	}
+	return limit, nil
+}
+
+// jsonCodec use encoding/json
+type jsonCodec struct{}
+
+type jsonCodecFactory struct{}
+
+func (f jsonCodecFactory) New(opts Options) (Codec, error) { return jsonCodec{}, nil }
+
+func (c jsonCodec) Decode(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (c jsonCodec) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(normalize(v))
+}
+
+// ugorjiCodec encode and decode with handle of ugorji codec, payload is
+// checked before decoding if check is set
+type ugorjiCodec struct {
+	handle ugorji.Handle
+	limit  int
+	check  func(data []byte) error
+}
+
+func (c ugorjiCodec) Decode(data []byte) (interface{}, error) {
+	if len(data) > c.limit {
+		return nil, fmt.Errorf("Payload size %d exceed limit %d", len(data), c.limit)
+	}
+	if c.check != nil {
+		if err := c.check(data); err != nil {
+			return nil, err
+		}
+	}
+	var v interface{}
+	if err := ugorji.NewDecoderBytes(data, c.handle).Decode(&v); err != nil {
+		return nil, err
+	}
+	return normalize(v), nil
+}
+
+func (c ugorjiCodec) Encode(v interface{}) ([]byte, error) {
+	var data []byte
+	err := ugorji.NewEncoderBytes(&data, c.handle).Encode(normalize(v))
+	return data, err
+}
+
+type cborCodecFactory struct{}
+
+func (f cborCodecFactory) New(opts Options) (Codec, error) {
+	limit, err := sizeLimit(opts)
+	if err != nil {
+		return nil, err
+	}
+	h := &ugorji.CborHandle{}
+	h.MapType = mapType
+	h.MaxInitLen = maxInitLen
+	return ugorjiCodec{handle: h, limit: limit, check: checkCbor}, nil
+}
+
+type msgpackCodecFactory struct{}
+
+func (f msgpackCodecFactory) New(opts Options) (Codec, error) {
+	limit, err := sizeLimit(opts)
+	if err != nil {
+		return nil, err
+	}
+	h := &ugorji.MsgpackHandle{}
+	h.MapType = mapType
+	h.MaxInitLen = maxInitLen
+	h.RawToString = true
+	h.WriteExt = true
+	return ugorjiCodec{handle: h, limit: limit}, nil
+}
+
+// checkCbor check lengths declared in cbor payload, ugorji codec allocate
+// chunks of indefinite length strings with declared length before reading
+// them
+func checkCbor(data []byte) error {
+	_, err := checkCborItem(data, 0)
+	return err
+}
+
+// checkCborItem check data item at the beginning of data and return bytes
+// following it
+func checkCborItem(data []byte, depth int) ([]byte, error) {
+	if len(data) == 0 || depth > maxCborDepth {
+		return nil, errCborFormat
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(data) < n {
+			return nil, errCborFormat
+		}
+		for _, b := range data[:n] {
+			arg = arg<<8 | uint64(b)
+		}
+		data = data[n:]
+	case info == 31:
+		return checkCborIndefinite(major, data, depth)
+	default:
+		return nil, errCborFormat
+	}
+	switch major {
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, errCborFormat
+		}
+		return data[arg:], nil
+	case 4, 5:
+		// Every item has one byte at least
+		if major == 5 {
+			arg *= 2
+		}
+		if arg > uint64(len(data)) {
+			return nil, errCborFormat
+		}
+		var err error
+		for i := uint64(0); i < arg; i++ {
+			if data, err = checkCborItem(data, depth+1); err != nil {
+				return nil, err
+			}
+		}
+	case 6:
+		return checkCborItem(data, depth+1)
+	}
+	return data, nil
+}
+
+// checkCborIndefinite check items of indefinite length string, array or
+// map until break
+func checkCborIndefinite(major uint8, data []byte, depth int) ([]byte, error) {
+	if major < 2 || major > 5 {
+		return nil, errCborFormat
+	}
+	var err error
+	for {
+		if len(data) == 0 {
+			return nil, errCborFormat
+		}
+		if data[0] == 0xff {
+			return data[1:], nil
+		}
+		// Chunks of string are definite strings of the same type
+		if (major == 2 || major == 3) && (data[0]>>5 != major || data[0]&0x1f == 31) {
+			return nil, errCborFormat
+		}
+		if data, err = checkCborItem(data, depth+1); err != nil {
+			return nil, err
+		}
+	}
+}
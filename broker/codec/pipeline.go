@@ -0,0 +1,193 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package codec
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// Metrics names of payload conversion
+const (
+	MetricPublishErrors = "codec/publish/errors"
+	MetricDeliverErrors = "codec/deliver/errors"
+	MetricDeadLetter    = "codec/deadletter"
+)
+
+// Options read from binding's section and passed to codecs
+var optionKeys = []string{"protobuf_descriptor", "protobuf_message", "message_size_limit"}
+
+// BindingSection return name of binding's config section
+func BindingSection(name string) string {
+	return "codec:" + name
+}
+
+// chain decode payload with decoder and encode it with encoder
+type chain struct {
+	decoder Codec
+	encoder Codec
+}
+
+func (c *chain) convert(payload []byte) ([]byte, error) {
+	v, err := c.decoder.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.encoder.Encode(v)
+}
+
+// binding bind topic filter with conversion chains of published and
+// delivered messages
+type binding struct {
+	name    string
+	filter  string
+	publish *chain
+	deliver *chain
+}
+
+// Pipeline convert payload of messages whose topic match bindings, the
+// first matched binding is used
+type Pipeline struct {
+	bindings   []*binding
+	deadLetter string
+}
+
+var (
+	_pipeline      *Pipeline
+	_pipelineMutex sync.Mutex
+)
+
+// GetPipeline return codec pipeline shared by all sessions, it is created
+// with configurations in codec section at first time
+func GetPipeline(c core.Config) *Pipeline {
+	_pipelineMutex.Lock()
+	defer _pipelineMutex.Unlock()
+	if _pipeline == nil {
+		_pipeline = NewPipeline(c)
+	}
+	return _pipeline
+}
+
+// NewPipeline create pipeline with bindings in codec section, binding with
+// invalid configurations is ignored
+func NewPipeline(c core.Config) *Pipeline {
+	p := &Pipeline{}
+	p.deadLetter, _ = c.String("codec", "dead_letter_topic")
+	names, err := c.String("codec", "bindings")
+	if err != nil {
+		return p
+	}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		b, err := newBinding(c, name)
+		if err != nil {
+			glog.Errorf("Failed to create codec binding '%s':%s", name, err)
+			continue
+		}
+		p.bindings = append(p.bindings, b)
+	}
+	return p
+}
+
+func newBinding(c core.Config, name string) (*binding, error) {
+	section := BindingSection(name)
+	b := &binding{name: name}
+	if topic, err := c.String(section, "topic"); err == nil && topic != "" {
+		b.filter = topic
+	} else if mp, err := c.String(section, "mountpoint"); err == nil && mp != "" {
+		// Mount point is prefix of topics of its clients
+		b.filter = strings.TrimSuffix(mp, "/") + "/#"
+	} else {
+		return nil, fmt.Errorf("Topic or mountpoint must be set")
+	}
+	opts := Options{}
+	for _, key := range optionKeys {
+		if val, err := c.String(section, key); err == nil && val != "" {
+			opts[key] = val
+		} else if val, err := c.String("codec", key); err == nil && val != "" {
+			// Options in codec section are shared by all bindings
+			opts[key] = val
+		}
+	}
+	var err error
+	if b.publish, err = newChain(c, section, "publish", opts); err != nil {
+		return nil, err
+	}
+	if b.deliver, err = newChain(c, section, "deliver", opts); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// newChain create chain from value like "cbor>json", nil is returned if
+// key is not set
+func newChain(c core.Config, section string, key string, opts Options) (*chain, error) {
+	val, err := c.String(section, key)
+	if err != nil || val == "" {
+		return nil, nil
+	}
+	names := strings.Split(val, ">")
+	if len(names) != 2 {
+		return nil, fmt.Errorf("Invalid codec chain '%s'", val)
+	}
+	ch := &chain{}
+	if ch.decoder, err = NewCodec(strings.TrimSpace(names[0]), opts); err != nil {
+		return nil, err
+	}
+	if ch.encoder, err = NewCodec(strings.TrimSpace(names[1]), opts); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+// Publish convert payload published to topic before it is routed
+func (p *Pipeline) Publish(topic string, payload []byte) ([]byte, error) {
+	for _, b := range p.bindings {
+		if base.MatchTopic(b.filter, topic) {
+			if b.publish == nil {
+				return payload, nil
+			}
+			return b.publish.convert(payload)
+		}
+	}
+	return payload, nil
+}
+
+// Deliver convert payload of topic before it is delivered to subscribers
+func (p *Pipeline) Deliver(topic string, payload []byte) ([]byte, error) {
+	for _, b := range p.bindings {
+		if base.MatchTopic(b.filter, topic) {
+			if b.deliver == nil {
+				return payload, nil
+			}
+			return b.deliver.convert(payload)
+		}
+	}
+	return payload, nil
+}
+
+// DeadLetterTopic return topic which message failed to be converted is
+// routed to, empty if dead letter is disabled
+func (p *Pipeline) DeadLetterTopic(topic string) string {
+	if p.deadLetter == "" {
+		return ""
+	}
+	return p.deadLetter + "/" + topic
+}
@@ -0,0 +1,533 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package codec
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pd "github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// Protobuf wire type
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("Truncated protobuf message")
+
+// protobufCodec convert protobuf message to generic value with descriptor
+// of product, the descriptor is FileDescriptorSet generated by
+// 'protoc --include_imports -o'. Fields are keyed by their names
+type protobufCodec struct {
+	message  *pd.DescriptorProto
+	proto3   bool
+	messages map[string]*pd.DescriptorProto
+	enums    map[string]*pd.EnumDescriptorProto
+}
+
+type protobufCodecFactory struct{}
+
+func (f protobufCodecFactory) New(opts Options) (Codec, error) {
+	path := opts["protobuf_descriptor"]
+	name := opts["protobuf_message"]
+	if path == "" || name == "" {
+		return nil, errors.New("Protobuf descriptor and message must be set")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := &pd.FileDescriptorSet{}
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("Invalid protobuf descriptor '%s':%s", path, err)
+	}
+	c := &protobufCodec{
+		messages: make(map[string]*pd.DescriptorProto),
+		enums:    make(map[string]*pd.EnumDescriptorProto),
+	}
+	syntax := make(map[string]bool)
+	for _, file := range set.File {
+		prefix := ""
+		if file.GetPackage() != "" {
+			prefix = "." + file.GetPackage()
+		}
+		for _, e := range file.EnumType {
+			c.enums[prefix+"."+e.GetName()] = e
+		}
+		for _, m := range file.MessageType {
+			c.addMessage(prefix, m)
+			syntax[prefix+"."+m.GetName()] = file.GetSyntax() == "proto3"
+		}
+	}
+	if !strings.HasPrefix(name, ".") {
+		name = "." + name
+	}
+	if c.message = c.messages[name]; c.message == nil {
+		return nil, fmt.Errorf("Protobuf message '%s' is not found in '%s'", name, path)
+	}
+	for top, proto3 := range syntax {
+		if name == top || strings.HasPrefix(name, top+".") {
+			c.proto3 = proto3
+		}
+	}
+	return c, nil
+}
+
+// addMessage add message and its nested types with full name
+func (c *protobufCodec) addMessage(prefix string, m *pd.DescriptorProto) {
+	name := prefix + "." + m.GetName()
+	c.messages[name] = m
+	for _, e := range m.EnumType {
+		c.enums[name+"."+e.GetName()] = e
+	}
+	for _, nested := range m.NestedType {
+		c.addMessage(name, nested)
+	}
+}
+
+func (c *protobufCodec) Decode(data []byte) (interface{}, error) {
+	return c.decodeMessage(c.message, data)
+}
+
+func (c *protobufCodec) Encode(v interface{}) ([]byte, error) {
+	return c.encodeMessage(c.message, v)
+}
+
+func (c *protobufCodec) decodeMessage(m *pd.DescriptorProto, data []byte) (map[string]interface{}, error) {
+	fields := make(map[int32]*pd.FieldDescriptorProto, len(m.Field))
+	for _, f := range m.Field {
+		fields[f.GetNumber()] = f
+	}
+	result := make(map[string]interface{})
+	for len(data) > 0 {
+		tag, n := proto.DecodeVarint(data)
+		if n == 0 {
+			return nil, errTruncated
+		}
+		data = data[n:]
+		num, wire := int32(tag>>3), int(tag&7)
+		raw, rest, err := readWireValue(wire, data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		f := fields[num]
+		if f == nil {
+			// Unknown field is skipped
+			continue
+		}
+		if err := c.decodeField(result, f, wire, raw); err != nil {
+			return nil, fmt.Errorf("Field '%s':%s", f.GetName(), err)
+		}
+	}
+	return result, nil
+}
+
+// readWireValue split value of wire type from data, varint and fixed values
+// are returned as their encoded bytes
+func readWireValue(wire int, data []byte) ([]byte, []byte, error) {
+	switch wire {
+	case wireVarint:
+		if _, n := proto.DecodeVarint(data); n > 0 {
+			return data[:n], data[n:], nil
+		}
+	case wireFixed64:
+		if len(data) >= 8 {
+			return data[:8], data[8:], nil
+		}
+	case wireFixed32:
+		if len(data) >= 4 {
+			return data[:4], data[4:], nil
+		}
+	case wireBytes:
+		if length, n := proto.DecodeVarint(data); n > 0 && uint64(len(data)-n) >= length {
+			end := n + int(length)
+			return data[n:end], data[end:], nil
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unsupported wire type %d", wire)
+	}
+	return nil, nil, errTruncated
+}
+
+func (c *protobufCodec) decodeField(result map[string]interface{}, f *pd.FieldDescriptorProto, wire int, raw []byte) error {
+	name := f.GetName()
+	// Packed repeated scalars are encoded as bytes
+	packed := wire == wireBytes && isPackable(f.GetType())
+	if wire != scalarWireType(f.GetType()) && !packed {
+		return fmt.Errorf("Wire type %d of field '%s' is not %s", wire, name, f.GetType())
+	}
+	if f.GetType() == pd.FieldDescriptorProto_TYPE_MESSAGE {
+		m := c.messages[f.GetTypeName()]
+		if m == nil {
+			return fmt.Errorf("Unknown message type '%s'", f.GetTypeName())
+		}
+		val, err := c.decodeMessage(m, raw)
+		if err != nil {
+			return err
+		}
+		switch {
+		case m.GetOptions().GetMapEntry():
+			entries, _ := result[name].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				result[name] = entries
+			}
+			entries[fmt.Sprintf("%v", val["key"])] = val["value"]
+		case f.GetLabel() == pd.FieldDescriptorProto_LABEL_REPEATED:
+			list, _ := result[name].([]interface{})
+			result[name] = append(list, val)
+		default:
+			result[name] = val
+		}
+		return nil
+	}
+	if packed {
+		list, _ := result[name].([]interface{})
+		for len(raw) > 0 {
+			item, rest, err := readWireValue(scalarWireType(f.GetType()), raw)
+			if err != nil {
+				return err
+			}
+			raw = rest
+			val, err := c.decodeScalar(f, item)
+			if err != nil {
+				return err
+			}
+			list = append(list, val)
+		}
+		result[name] = list
+		return nil
+	}
+	val, err := c.decodeScalar(f, raw)
+	if err != nil {
+		return err
+	}
+	if f.GetLabel() == pd.FieldDescriptorProto_LABEL_REPEATED {
+		list, _ := result[name].([]interface{})
+		result[name] = append(list, val)
+	} else {
+		result[name] = val
+	}
+	return nil
+}
+
+func (c *protobufCodec) decodeScalar(f *pd.FieldDescriptorProto, raw []byte) (interface{}, error) {
+	var x uint64
+	switch scalarWireType(f.GetType()) {
+	case wireVarint:
+		n := 0
+		if x, n = proto.DecodeVarint(raw); n == 0 {
+			return nil, errTruncated
+		}
+	case wireFixed64:
+		if len(raw) < 8 {
+			return nil, errTruncated
+		}
+		x = binary.LittleEndian.Uint64(raw)
+	case wireFixed32:
+		if len(raw) < 4 {
+			return nil, errTruncated
+		}
+		x = uint64(binary.LittleEndian.Uint32(raw))
+	}
+	switch f.GetType() {
+	case pd.FieldDescriptorProto_TYPE_STRING:
+		return string(raw), nil
+	case pd.FieldDescriptorProto_TYPE_BYTES:
+		return append([]byte{}, raw...), nil
+	case pd.FieldDescriptorProto_TYPE_BOOL:
+		return x != 0, nil
+	case pd.FieldDescriptorProto_TYPE_INT32, pd.FieldDescriptorProto_TYPE_SFIXED32:
+		return int64(int32(x)), nil
+	case pd.FieldDescriptorProto_TYPE_INT64, pd.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(x), nil
+	case pd.FieldDescriptorProto_TYPE_UINT32, pd.FieldDescriptorProto_TYPE_FIXED32,
+		pd.FieldDescriptorProto_TYPE_UINT64, pd.FieldDescriptorProto_TYPE_FIXED64:
+		return x, nil
+	case pd.FieldDescriptorProto_TYPE_SINT32, pd.FieldDescriptorProto_TYPE_SINT64:
+		return int64(x>>1) ^ -int64(x&1), nil
+	case pd.FieldDescriptorProto_TYPE_FLOAT:
+		return float64(math.Float32frombits(uint32(x))), nil
+	case pd.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64frombits(x), nil
+	case pd.FieldDescriptorProto_TYPE_ENUM:
+		if e := c.enums[f.GetTypeName()]; e != nil {
+			for _, v := range e.Value {
+				if v.GetNumber() == int32(x) {
+					return v.GetName(), nil
+				}
+			}
+		}
+		return int64(int32(x)), nil
+	}
+	return nil, nil
+}
+
+func isPackable(t pd.FieldDescriptorProto_Type) bool {
+	switch t {
+	case pd.FieldDescriptorProto_TYPE_STRING, pd.FieldDescriptorProto_TYPE_BYTES,
+		pd.FieldDescriptorProto_TYPE_MESSAGE, pd.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	}
+	return true
+}
+
+func scalarWireType(t pd.FieldDescriptorProto_Type) int {
+	switch t {
+	case pd.FieldDescriptorProto_TYPE_DOUBLE, pd.FieldDescriptorProto_TYPE_FIXED64,
+		pd.FieldDescriptorProto_TYPE_SFIXED64:
+		return wireFixed64
+	case pd.FieldDescriptorProto_TYPE_FLOAT, pd.FieldDescriptorProto_TYPE_FIXED32,
+		pd.FieldDescriptorProto_TYPE_SFIXED32:
+		return wireFixed32
+	case pd.FieldDescriptorProto_TYPE_STRING, pd.FieldDescriptorProto_TYPE_BYTES,
+		pd.FieldDescriptorProto_TYPE_MESSAGE:
+		return wireBytes
+	}
+	return wireVarint
+}
+
+func (c *protobufCodec) encodeMessage(m *pd.DescriptorProto, v interface{}) ([]byte, error) {
+	values, ok := normalize(v).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Message '%s' must be encoded from object", m.GetName())
+	}
+	buf := []byte{}
+	for _, f := range m.Field {
+		val, ok := values[f.GetName()]
+		if !ok && f.GetJsonName() != "" {
+			val, ok = values[f.GetJsonName()]
+		}
+		if !ok || val == nil {
+			continue
+		}
+		var err error
+		if buf, err = c.encodeField(buf, f, val); err != nil {
+			return nil, fmt.Errorf("Field '%s':%s", f.GetName(), err)
+		}
+	}
+	return buf, nil
+}
+
+func appendTag(buf []byte, num int32, wire int) []byte {
+	return append(buf, proto.EncodeVarint(uint64(num)<<3|uint64(wire))...)
+}
+
+func (c *protobufCodec) encodeField(buf []byte, f *pd.FieldDescriptorProto, val interface{}) ([]byte, error) {
+	if f.GetLabel() != pd.FieldDescriptorProto_LABEL_REPEATED {
+		return c.encodeValue(buf, f, val)
+	}
+	// Map field is repeated entry message with key and value
+	if m := c.messages[f.GetTypeName()]; m != nil && m.GetOptions().GetMapEntry() {
+		entries, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Map field must be encoded from object")
+		}
+		for k, item := range entries {
+			entry, err := c.encodeMessage(m, map[string]interface{}{"key": k, "value": item})
+			if err != nil {
+				return nil, err
+			}
+			buf = appendTag(buf, f.GetNumber(), wireBytes)
+			buf = append(buf, proto.EncodeVarint(uint64(len(entry)))...)
+			buf = append(buf, entry...)
+		}
+		return buf, nil
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		list = []interface{}{val}
+	}
+	packed := c.proto3
+	if f.GetOptions() != nil && f.GetOptions().Packed != nil {
+		packed = f.GetOptions().GetPacked()
+	}
+	if !packed || !isPackable(f.GetType()) {
+		for _, item := range list {
+			var err error
+			if buf, err = c.encodeValue(buf, f, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	data := []byte{}
+	for _, item := range list {
+		x, err := c.scalarBits(f, item)
+		if err != nil {
+			return nil, err
+		}
+		data = appendScalar(data, scalarWireType(f.GetType()), x)
+	}
+	buf = appendTag(buf, f.GetNumber(), wireBytes)
+	buf = append(buf, proto.EncodeVarint(uint64(len(data)))...)
+	return append(buf, data...), nil
+}
+
+func (c *protobufCodec) encodeValue(buf []byte, f *pd.FieldDescriptorProto, val interface{}) ([]byte, error) {
+	var data []byte
+	switch f.GetType() {
+	case pd.FieldDescriptorProto_TYPE_MESSAGE:
+		m := c.messages[f.GetTypeName()]
+		if m == nil {
+			return nil, fmt.Errorf("Unknown message type '%s'", f.GetTypeName())
+		}
+		var err error
+		if data, err = c.encodeMessage(m, val); err != nil {
+			return nil, err
+		}
+	case pd.FieldDescriptorProto_TYPE_STRING:
+		data = []byte(fmt.Sprintf("%v", val))
+	case pd.FieldDescriptorProto_TYPE_BYTES:
+		switch b := val.(type) {
+		case []byte:
+			data = b
+		case string:
+			// Bytes in JSON is base64 encoded string
+			var err error
+			if data, err = base64.StdEncoding.DecodeString(b); err != nil {
+				data = []byte(b)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid bytes value %v", val)
+		}
+	default:
+		x, err := c.scalarBits(f, val)
+		if err != nil {
+			return nil, err
+		}
+		wire := scalarWireType(f.GetType())
+		buf = appendTag(buf, f.GetNumber(), wire)
+		return appendScalar(buf, wire, x), nil
+	}
+	buf = appendTag(buf, f.GetNumber(), wireBytes)
+	buf = append(buf, proto.EncodeVarint(uint64(len(data)))...)
+	return append(buf, data...), nil
+}
+
+func appendScalar(buf []byte, wire int, x uint64) []byte {
+	switch wire {
+	case wireFixed64:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], x)
+		return append(buf, b[:]...)
+	case wireFixed32:
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(x))
+		return append(buf, b[:]...)
+	}
+	return append(buf, proto.EncodeVarint(x)...)
+}
+
+// scalarBits return wire bits of scalar value
+func (c *protobufCodec) scalarBits(f *pd.FieldDescriptorProto, val interface{}) (uint64, error) {
+	switch f.GetType() {
+	case pd.FieldDescriptorProto_TYPE_BOOL:
+		if b, ok := val.(bool); ok {
+			if b {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Invalid bool value %v", val)
+	case pd.FieldDescriptorProto_TYPE_FLOAT:
+		x, err := toFloat(val)
+		return uint64(math.Float32bits(float32(x))), err
+	case pd.FieldDescriptorProto_TYPE_DOUBLE:
+		x, err := toFloat(val)
+		return math.Float64bits(x), err
+	case pd.FieldDescriptorProto_TYPE_ENUM:
+		if name, ok := val.(string); ok {
+			if e := c.enums[f.GetTypeName()]; e != nil {
+				for _, v := range e.Value {
+					if v.GetName() == name {
+						return uint64(int64(v.GetNumber())), nil
+					}
+				}
+			}
+			return 0, fmt.Errorf("Unknown enum value '%s'", name)
+		}
+		x, err := toInt(val)
+		return uint64(x), err
+	case pd.FieldDescriptorProto_TYPE_UINT32, pd.FieldDescriptorProto_TYPE_FIXED32:
+		x, err := toInt(val)
+		return uint64(uint32(x)), err
+	case pd.FieldDescriptorProto_TYPE_UINT64, pd.FieldDescriptorProto_TYPE_FIXED64:
+		if x, ok := val.(uint64); ok {
+			return x, nil
+		}
+		x, err := toInt(val)
+		return uint64(x), err
+	case pd.FieldDescriptorProto_TYPE_SFIXED32:
+		x, err := toInt(val)
+		return uint64(uint32(int32(x))), err
+	case pd.FieldDescriptorProto_TYPE_SINT32, pd.FieldDescriptorProto_TYPE_SINT64:
+		x, err := toInt(val)
+		return uint64(x<<1) ^ uint64(x>>63), err
+	default:
+		// int32, int64 and sfixed64, negative int32 is sign extended
+		x, err := toInt(val)
+		return uint64(x), err
+	}
+}
+
+func toInt(val interface{}) (int64, error) {
+	switch x := val.(type) {
+	case int64:
+		return x, nil
+	case uint64:
+		return int64(x), nil
+	case int:
+		return int64(x), nil
+	case float64:
+		return int64(x), nil
+	case json.Number:
+		return x.Int64()
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	}
+	return 0, fmt.Errorf("Invalid integer value %v", val)
+}
+
+func toFloat(val interface{}) (float64, error) {
+	switch x := val.(type) {
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case int64:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	case int:
+		return float64(x), nil
+	case json.Number:
+		return x.Float64()
+	case string:
+		return strconv.ParseFloat(x, 64)
+	}
+	return 0, fmt.Errorf("Invalid number value %v", val)
+}
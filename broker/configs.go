@@ -16,11 +16,95 @@ var defaultConfigs = map[string]map[string]string{
 	"broker": {
 		"loglevel": "debug",
 		"kafka":    "localhost:9092",
-		"services": "mqtt:tcp,mqtt:ws, mqtt:ssl, api",
+		"services": "mqtt:tcp,mqtt:ws, mqtt:ssl, mqtt:sys, api",
+		// round_robin, random, hash or sticky
+		"shared_subscription_strategy": "round_robin",
 	},
 	"storage": {
 		"repository": "local",
 		"loglevel":   "debug",
+		// "local" keep data in memory, "disk" persist data in path
+		"name":              "local",
+		"path":              "/var/lib/sentel/broker",
+		"snapshot_interval": "300",
+		"compact_size":      "67108864",
+		"sync_writes":       "false",
+	},
+	"quto": {
+		// Publish rate in messages and bytes per second, 0 is no limit
+		"client_publish_rate":       "0",
+		"client_publish_bytes":      "0",
+		"username_publish_rate":     "0",
+		"username_publish_bytes":    "0",
+		"mountpoint_publish_rate":   "0",
+		"mountpoint_publish_bytes":  "0",
+		"tenant_max_connections":    "0",
+		"session_max_subscriptions": "0",
+		// drop, disconnect or delay
+		"violation_action": "drop",
+		// Max delay in milliseconds for delay action
+		"max_delay": "1000",
+	},
+	"event": {
+		// Comma separated sinks, "webhook" or "kafka"
+		"sinks": "",
+		// Comma separated event types sent to sinks, all if empty
+		"types":                  "",
+		"queue_size":             "1024",
+		"include_payload":        "false",
+		"webhook_url":            "",
+		"webhook_batch_size":     "100",
+		"webhook_batch_interval": "1000",
+		"webhook_retries":        "3",
+		"webhook_retry_interval": "1000",
+		"webhook_timeout":        "5000",
+		"kafka_topic":            "broker-event",
+	},
+	"plugins": {
+		// Comma separated plugins to load, plugin's configurations are in
+		// its own section named "plugin:<name>"
+		"load": "",
+	},
+	"codec": {
+		// Comma separated bindings, binding's configurations are in its own
+		// section named "codec:<name>" with keys "topic" or "mountpoint",
+		// "publish" and "deliver" chains like "cbor>json", and codec
+		// options such as "protobuf_descriptor" and "protobuf_message"
+		"bindings": "",
+		// Payload larger than limit in bytes is not decoded, it can be set
+		// in section of binding too
+		"message_size_limit": "262144",
+		// Message failed to be converted is routed to "<topic>/<original
+		// topic>", it is dropped if empty
+		"dead_letter_topic": "",
+	},
+	"metadata": {
+		// Clients are authenticated as devices of products registered in
+		// apiserver, with username "deviceName&productKey" and device
+		// secret as password
+		"enabled": "false",
+		// Mongo hosts of apiserver registry, products and devices are
+		// loaded from it at startup
+		"registry": "",
+		// Kafka of apiserver notifications, broker's kafka is used if empty
+		"kafka": "",
+	},
+	"cluster": {
+		// Subscribed topic filters are advertised to other nodes, and
+		// messages are forwarded to nodes with matched subscriptions
+		"enabled": "false",
+		// Kafka of cluster, kafka in mqttbroker section is used if empty
+		"kafka":         "",
+		"route_topic":   "broker-route",
+		"message_topic": "broker-message",
+		// Topic filters are advertised in interval seconds, and routes of
+		// node are removed if it is not seen in timeout seconds
+		"heartbeat_interval": "10",
+		"node_timeout":       "30",
+		// Notifications waiting to be sent to kafka, more are dropped
+		"produce_buffer": "1024",
+		// Shared subscription group with members on several nodes is
+		// dispatched by one of them, which is selected by group's hash
 	},
 	"security": {
 		"cafile":              "",
@@ -28,10 +112,21 @@ var defaultConfigs = map[string]map[string]string{
 		"certfile":            "",
 		"keyfile":             "",
 		"require_certificate": "false",
+		// Use "cn" or "san" in client certificate as "username" or "clientid"
+		"certificate_identity":    "",
+		"certificate_identity_as": "username",
+		// Certificate files are checked for renewal in interval seconds
+		"reload_interval": "60",
 	},
 	"mqttp:tcp": {
 		"listen": "localhost:1883",
 	},
+	"mqtt:ssl": {
+		"listen": "localhost:8883",
+	},
+	"mqtt:ws": {
+		"listen": "localhost:8083",
+	},
 	"mqttp:api": {
 		"listen": "localhost:55001",
 	},
@@ -0,0 +1,238 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package event
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// Handler is in-process callback of events
+type Handler func(e *Event)
+
+// Sink deliver events outside of broker, Send must not block for long time
+type Sink interface {
+	Send(e *Event)
+	Close()
+}
+
+type sinkFactory interface {
+	New(c core.Config) (Sink, error)
+}
+
+var _allSinks = make(map[string]sinkFactory)
+
+func registerSink(name string, f sinkFactory) {
+	if _allSinks[name] != nil {
+		glog.Fatalf("Event sink %s already registered", name)
+		return
+	}
+	_allSinks[name] = f
+}
+
+// NewSink lookup registered sink list, create a new sink instance
+func NewSink(name string, c core.Config) (Sink, error) {
+	if _allSinks[name] == nil {
+		return nil, fmt.Errorf("Event sink %s is not registered", name)
+	}
+	return _allSinks[name].New(c)
+}
+
+type subscriber struct {
+	id      uint64
+	kind    string
+	handler Handler
+}
+
+// Bus dispatch events to subscribers and sinks in background, event is
+// dropped if dispatching can not catch up
+type Bus struct {
+	mutex          sync.RWMutex
+	subscribers    []subscriber
+	sinks          []Sink
+	sinkTypes      map[string]bool // Event types sent to sinks, all if empty
+	includePayload bool
+	events         chan *Event
+	lastID         uint64
+	dropped        uint64
+	quit           chan bool
+	waitgroup      sync.WaitGroup
+}
+
+var (
+	_bus      *Bus
+	_busMutex sync.Mutex
+)
+
+// GetBus return event bus shared by all services, it is created with
+// configurations in event section at first time
+func GetBus(c core.Config) *Bus {
+	_busMutex.Lock()
+	defer _busMutex.Unlock()
+	if _bus == nil {
+		_bus = NewBus(c)
+	}
+	return _bus
+}
+
+// NewBus create event bus and sinks in event section
+func NewBus(c core.Config) *Bus {
+	size, err := c.Int("event", "queue_size")
+	if err != nil || size <= 0 {
+		size = 1024
+	}
+	b := &Bus{
+		sinkTypes: make(map[string]bool),
+		events:    make(chan *Event, size),
+		quit:      make(chan bool),
+	}
+	b.includePayload, _ = c.Bool("event", "include_payload")
+	if types, err := c.String("event", "types"); err == nil {
+		for _, kind := range strings.Split(types, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				b.sinkTypes[kind] = true
+			}
+		}
+	}
+	if names, err := c.String("event", "sinks"); err == nil {
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			sink, err := NewSink(name, c)
+			if err != nil {
+				glog.Errorf("Failed to create event sink '%s':%s", name, err)
+				continue
+			}
+			b.sinks = append(b.sinks, sink)
+		}
+	}
+	b.waitgroup.Add(1)
+	go b.dispatch()
+	return b
+}
+
+// Subscribe register handler for events of kind, all events are handled
+// if kind is empty. The returned id is used to unsubscribe
+func (b *Bus) Subscribe(kind string, handler Handler) uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lastID++
+	b.subscribers = append(b.subscribers, subscriber{id: b.lastID, kind: kind, handler: handler})
+	return b.lastID
+}
+
+// Unsubscribe remove handler registered with id
+func (b *Bus) Unsubscribe(id uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	// Subscribers are copied, because dispatcher may be iterating them
+	subscribers := make([]subscriber, 0, len(b.subscribers))
+	for _, sub := range b.subscribers {
+		if sub.id != id {
+			subscribers = append(subscribers, sub)
+		}
+	}
+	b.subscribers = subscribers
+}
+
+// AddSink add sink created outside of configurations
+func (b *Bus) AddSink(sink Sink) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+// Notify queue event for dispatching
+func (b *Bus) Notify(e *Event) {
+	b.mutex.RLock()
+	idle := len(b.subscribers) == 0 && len(b.sinks) == 0
+	b.mutex.RUnlock()
+	if idle {
+		return
+	}
+	select {
+	case b.events <- e:
+	default:
+		if atomic.AddUint64(&b.dropped, 1)%1000 == 1 {
+			glog.Warningf("Event bus is full, event '%s' of %s is dropped", e.Type, e.ClientID)
+		}
+	}
+}
+
+// Dropped return count of events dropped because bus is full
+func (b *Bus) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// dispatch deliver queued events to subscribers and sinks
+func (b *Bus) dispatch() {
+	defer b.waitgroup.Done()
+	for {
+		select {
+		case e := <-b.events:
+			b.deliver(e)
+		case <-b.quit:
+			// Deliver events left before quit
+			for {
+				select {
+				case e := <-b.events:
+					b.deliver(e)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *Bus) deliver(e *Event) {
+	b.mutex.RLock()
+	subscribers := b.subscribers
+	sinks := b.sinks
+	b.mutex.RUnlock()
+
+	for _, sub := range subscribers {
+		if sub.kind == "" || sub.kind == e.Type {
+			sub.handler(e)
+		}
+	}
+	if len(sinks) == 0 || (len(b.sinkTypes) > 0 && !b.sinkTypes[e.Type]) {
+		return
+	}
+	if !b.includePayload && e.Payload != nil {
+		stripped := *e
+		stripped.Payload = nil
+		e = &stripped
+	}
+	for _, sink := range sinks {
+		sink.Send(e)
+	}
+}
+
+// Close stop dispatching and close all sinks
+func (b *Bus) Close() {
+	close(b.quit)
+	b.waitgroup.Wait()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, sink := range b.sinks {
+		sink.Close()
+	}
+	b.sinks = nil
+}
@@ -1 +1,74 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
 package event
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// TopicNameEvent is default kafka topic of events
+const TopicNameEvent = "broker-event"
+
+// Event type
+const (
+	ClientConnected     = "client.connected"
+	ClientDisconnected  = "client.disconnected"
+	AuthFailed          = "client.auth_failed"
+	SessionSubscribed   = "session.subscribed"
+	SessionUnsubscribed = "session.unsubscribed"
+	MessagePublished    = "message.published"
+	MessageDelivered    = "message.delivered"
+	MessageAcked        = "message.acked"
+	MessageDropped      = "message.dropped"
+)
+
+// Event happened in broker, fields not related with event type are empty
+type Event struct {
+	Type       string    `json:"type"`
+	Timestamp  time.Time `json:"timestamp"`
+	ClientID   string    `json:"clientId"`
+	Username   string    `json:"username,omitempty"`
+	MountPoint string    `json:"mountPoint,omitempty"`
+	Address    string    `json:"address,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	Topic      string    `json:"topic,omitempty"`
+	Qos        uint8     `json:"qos"`
+	Retain     bool      `json:"retain,omitempty"`
+	Payload    []byte    `json:"payload,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+
+	encoded []byte
+	err     error
+}
+
+func (e *Event) ensureEncoded() {
+	if e.encoded == nil && e.err == nil {
+		e.encoded, e.err = json.Marshal(e)
+	}
+}
+
+func (e *Event) Length() int {
+	e.ensureEncoded()
+	return len(e.encoded)
+}
+
+func (e *Event) Encode() ([]byte, error) {
+	e.ensureEncoded()
+	return e.encoded, e.err
+}
+
+func init() {
+	registerSink("webhook", webhookSinkFactory{})
+	registerSink("kafka", kafkaSinkFactory{})
+}
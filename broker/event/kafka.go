@@ -0,0 +1,68 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package event
+
+import (
+	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// kafkaSink produce events to kafka topic
+type kafkaSink struct {
+	config core.Config
+	topic  string
+	events chan *Event
+	done   chan bool
+}
+
+type kafkaSinkFactory struct{}
+
+func (k kafkaSinkFactory) New(c core.Config) (Sink, error) {
+	topic, err := c.String("event", "kafka_topic")
+	if err != nil || topic == "" {
+		topic = TopicNameEvent
+	}
+	s := &kafkaSink{
+		config: c,
+		topic:  topic,
+		events: make(chan *Event, 1024),
+		done:   make(chan bool),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Send queue event for producing, it is dropped if kafka is too slow
+func (s *kafkaSink) Send(e *Event) {
+	select {
+	case s.events <- e:
+	default:
+		glog.Warningf("Kafka sink is busy, event '%s' of %s is dropped", e.Type, e.ClientID)
+	}
+}
+
+func (s *kafkaSink) run() {
+	defer close(s.done)
+	for e := range s.events {
+		if err := base.AsyncProduceMessage(s.config, s.topic, e); err != nil {
+			glog.Errorf("Failed to produce event '%s' of %s:%s", e.Type, e.ClientID, err)
+		}
+	}
+}
+
+// Close produce events left and stop sink
+func (s *kafkaSink) Close() {
+	close(s.events)
+	<-s.done
+}
@@ -0,0 +1,156 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// webhookSink post events in batch to http endpoint as json array, batch
+// is posted again after retry interval if it failed
+type webhookSink struct {
+	url           string
+	client        *http.Client
+	batchSize     int
+	batchInterval time.Duration
+	retries       int
+	retryInterval time.Duration
+	events        chan *Event
+	quit          chan bool
+	done          chan bool
+}
+
+type webhookSinkFactory struct{}
+
+func (w webhookSinkFactory) New(c core.Config) (Sink, error) {
+	url, err := c.String("event", "webhook_url")
+	if err != nil || url == "" {
+		return nil, errors.New("Webhook url is not set")
+	}
+	intValue := func(key string, val int) int {
+		if v, err := c.Int("event", key); err == nil && v >= 0 {
+			return v
+		}
+		return val
+	}
+	s := &webhookSink{
+		url:           url,
+		client:        &http.Client{Timeout: time.Duration(intValue("webhook_timeout", 5000)) * time.Millisecond},
+		batchSize:     intValue("webhook_batch_size", 100),
+		batchInterval: time.Duration(intValue("webhook_batch_interval", 1000)) * time.Millisecond,
+		retries:       intValue("webhook_retries", 3),
+		retryInterval: time.Duration(intValue("webhook_retry_interval", 1000)) * time.Millisecond,
+		quit:          make(chan bool),
+		done:          make(chan bool),
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = 1
+	}
+	if s.batchInterval <= 0 {
+		s.batchInterval = time.Second
+	}
+	s.events = make(chan *Event, s.batchSize*10)
+	go s.run()
+	return s, nil
+}
+
+// Send queue event for next batch, it is dropped if webhook is too slow
+func (s *webhookSink) Send(e *Event) {
+	select {
+	case s.events <- e:
+	default:
+		glog.Warningf("Webhook '%s' is busy, event '%s' of %s is dropped", s.url, e.Type, e.ClientID)
+	}
+}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.batchInterval)
+	defer ticker.Stop()
+	batch := make([]*Event, 0, s.batchSize)
+	for {
+		select {
+		case e := <-s.events:
+			if batch = append(batch, e); len(batch) >= s.batchSize {
+				s.post(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.post(batch)
+				batch = batch[:0]
+			}
+		case <-s.quit:
+			for {
+				select {
+				case e := <-s.events:
+					batch = append(batch, e)
+				default:
+					if len(batch) > 0 {
+						s.post(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// post send batch to webhook with retries
+func (s *webhookSink) post(batch []*Event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		glog.Errorf("Failed to encode events for webhook '%s':%s", s.url, err)
+		return
+	}
+	for i := 0; i <= s.retries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(s.retryInterval * time.Duration(i)):
+			case <-s.quit:
+				// Last chance to deliver when sink is closing
+			}
+		}
+		if err = s.postOnce(body); err == nil {
+			return
+		}
+		glog.Warningf("Failed to post %d events to webhook '%s':%s", len(batch), s.url, err)
+	}
+	glog.Errorf("%d events are dropped by webhook '%s'", len(batch), s.url)
+}
+
+func (s *webhookSink) postOnce(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status '%s'", resp.Status)
+	}
+	return nil
+}
+
+// Close post events left and stop sink
+func (s *webhookSink) Close() {
+	close(s.quit)
+	<-s.done
+}
@@ -15,8 +15,12 @@ package broker
 import (
 	"github.com/cloustone/sentel/broker/api"
 	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/coap"
+	"github.com/cloustone/sentel/broker/metadata"
 	"github.com/cloustone/sentel/broker/metric"
 	"github.com/cloustone/sentel/broker/mqtt"
+	"github.com/cloustone/sentel/broker/mqttsn"
+	"github.com/cloustone/sentel/broker/plugins"
 	"github.com/cloustone/sentel/core"
 
 	"github.com/golang/glog"
@@ -35,6 +39,23 @@ func RunWithConfigFile(fileName string) error {
 	if err != nil {
 		return err
 	}
+	// Load products and devices before services accept clients
+	cache := metadata.GetCache(config)
+	if err := cache.Start(); err != nil {
+		return err
+	}
+	defer cache.Stop()
+
+	// Load and start plugins before services accept clients
+	if err := plugins.Load(config); err != nil {
+		return err
+	}
+	plugins.Start()
+	defer plugins.Stop()
+
+	// Routes of this node are removed by other nodes when broker quit
+	defer mqtt.LeaveCluster()
+
 	// Create service manager according to the configuration
 	mgr, err := base.NewServiceManager(config)
 	if err != nil {
@@ -52,6 +73,11 @@ func init() {
 	base.RegisterService("mqtt:tcp", mqtt.Configs, &mqtt.MqttFactory{})
 	base.RegisterService("mqtt:ssl", mqtt.Configs, &mqtt.MqttFactory{})
 	base.RegisterService("mqtt:ws", mqtt.Configs, &mqtt.MqttFactory{})
+	base.RegisterService("mqtt:sys", mqtt.SysConfigs, &mqtt.SysFactory{})
+	base.RegisterService("coap:udp", coap.Configs, &coap.CoapFactory{})
+	base.RegisterService("coap:dtls", coap.DtlsConfigs, &coap.CoapFactory{})
+	base.RegisterService("mqttsn:udp", mqttsn.Configs, &mqttsn.MqttsnFactory{})
+	base.RegisterService("bridge", mqtt.BridgeConfigs, &mqtt.BridgeFactory{})
 	base.RegisterService("api", api.Configs, &api.ApiServiceFactory{})
 	base.RegisterService("metric", metric.Configs, &metric.MetricServiceFactory{})
 }
@@ -1 +1,297 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
 package metadata
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// Device status
+const (
+	DeviceStatusEnabled  = "enabled"
+	DeviceStatusDisabled = "disabled"
+)
+
+var (
+	ErrorDeviceNotFound  = errors.New("Device is not found")
+	ErrorDeviceDisabled  = errors.New("Device is disabled")
+	ErrorInvalidSecret   = errors.New("Invalid device secret")
+	ErrorInvalidUsername = errors.New("Invalid device username")
+)
+
+// Product is product registered in apiserver, product key is the product
+// id in registry
+type Product struct {
+	Key      string
+	Name     string
+	TenantID string
+}
+
+// Device is device registered in apiserver, device secret is not kept and
+// only its hash is used to authenticate device
+type Device struct {
+	ID         string
+	Name       string
+	ProductKey string
+	Status     string
+	SecretHash string
+}
+
+// Enabled return whether device is allowed to connect, device without
+// status is enabled
+func (d *Device) Enabled() bool {
+	return d.Status != DeviceStatusDisabled
+}
+
+// CheckSecret check whether secret match device's secret hash
+func (d *Device) CheckSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(d.SecretHash)) == 1
+}
+
+// MountPoint return mount point of device, devices of product share topics
+// under the product key
+func (d *Device) MountPoint() string {
+	return d.ProductKey + "/"
+}
+
+// HashSecret return hex encoded sha256 hash of device secret
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseUsername split username of device in format "deviceName&productKey"
+func ParseUsername(username string) (deviceName string, productKey string, err error) {
+	index := strings.LastIndex(username, "&")
+	if index <= 0 || index == len(username)-1 {
+		return "", "", ErrorInvalidUsername
+	}
+	return username[:index], username[index+1:], nil
+}
+
+// Watcher is called when device is disabled or removed, including devices
+// of removed product
+type Watcher func(d *Device)
+
+// Cache keep products and devices in memory, it is loaded from registry and
+// updated by notifications of apiserver
+type Cache struct {
+	config    core.Config
+	enabled   bool
+	mutex     sync.RWMutex
+	products  map[string]*Product
+	devices   map[string]*Device // Devices keyed by product key and name
+	deviceIDs map[string]*Device
+	watchers  []Watcher
+	notifier  *notifier
+}
+
+var (
+	_cache      *Cache
+	_cacheMutex sync.Mutex
+)
+
+// GetCache return metadata cache shared by all services, it is created
+// with configurations in metadata section at first time
+func GetCache(c core.Config) *Cache {
+	_cacheMutex.Lock()
+	defer _cacheMutex.Unlock()
+	if _cache == nil {
+		_cache = NewCache(c)
+	}
+	return _cache
+}
+
+// NewCache create empty metadata cache
+func NewCache(c core.Config) *Cache {
+	enabled, _ := c.Bool("metadata", "enabled")
+	return &Cache{
+		config:    c,
+		enabled:   enabled,
+		products:  make(map[string]*Product),
+		devices:   make(map[string]*Device),
+		deviceIDs: make(map[string]*Device),
+	}
+}
+
+// Enabled return whether clients are authenticated as devices in cache
+func (m *Cache) Enabled() bool { return m.enabled }
+
+// Start load products and devices from registry and keep them updated with
+// notifications from apiserver
+func (m *Cache) Start() error {
+	if !m.enabled {
+		return nil
+	}
+	if err := m.load(); err != nil {
+		return err
+	}
+	n, err := newNotifier(m)
+	if err != nil {
+		return err
+	}
+	m.notifier = n
+	return nil
+}
+
+// Stop stop receiving notifications
+func (m *Cache) Stop() {
+	if m.notifier != nil {
+		m.notifier.close()
+		m.notifier = nil
+	}
+}
+
+// Watch add watcher of disabled and removed devices
+func (m *Cache) Watch(w Watcher) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.watchers = append(m.watchers, w)
+}
+
+// GetProduct return product with key
+func (m *Cache) GetProduct(key string) *Product {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.products[key]
+}
+
+// GetDevice return device with product key and device name
+func (m *Cache) GetDevice(productKey string, deviceName string) *Device {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.devices[deviceKey(productKey, deviceName)]
+}
+
+// Authenticate authenticate device with username in format
+// "deviceName&productKey" and device secret as password
+func (m *Cache) Authenticate(username string, password string) (*Device, error) {
+	name, key, err := ParseUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	d := m.GetDevice(key, name)
+	switch {
+	case d == nil:
+		return nil, ErrorDeviceNotFound
+	case !d.Enabled():
+		return nil, ErrorDeviceDisabled
+	case !d.CheckSecret(password):
+		return nil, ErrorInvalidSecret
+	}
+	return d, nil
+}
+
+// Authorize check whether device authenticated before is still registered
+// and enabled, topics of device are limited by its mount point
+func (m *Cache) Authorize(d *Device) error {
+	current := m.GetDevice(d.ProductKey, d.Name)
+	switch {
+	case current == nil:
+		return ErrorDeviceNotFound
+	case !current.Enabled():
+		return ErrorDeviceDisabled
+	}
+	return nil
+}
+
+// UpdateProduct add or update product
+func (m *Cache) UpdateProduct(p *Product) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.products[p.Key] = p
+}
+
+// DeleteProduct remove product and its devices
+func (m *Cache) DeleteProduct(key string) {
+	m.mutex.Lock()
+	delete(m.products, key)
+	removed := []*Device{}
+	for k, d := range m.devices {
+		if d.ProductKey == key {
+			delete(m.devices, k)
+			delete(m.deviceIDs, d.ID)
+			removed = append(removed, d)
+		}
+	}
+	watchers := m.watchers
+	m.mutex.Unlock()
+	for _, d := range removed {
+		notifyWatchers(watchers, d)
+	}
+}
+
+// UpdateDevice add or update device, watchers are notified if device is
+// disabled
+func (m *Cache) UpdateDevice(d *Device) {
+	m.mutex.Lock()
+	if old := m.deviceIDs[d.ID]; old != nil && d.ID != "" {
+		delete(m.devices, deviceKey(old.ProductKey, old.Name))
+		// Fields not carried by notification are kept
+		if d.Name == "" {
+			d.Name = old.Name
+		}
+		if d.ProductKey == "" {
+			d.ProductKey = old.ProductKey
+		}
+		if d.SecretHash == "" {
+			d.SecretHash = old.SecretHash
+		}
+		if d.Status == "" {
+			d.Status = old.Status
+		}
+	}
+	m.devices[deviceKey(d.ProductKey, d.Name)] = d
+	if d.ID != "" {
+		m.deviceIDs[d.ID] = d
+	}
+	watchers := m.watchers
+	m.mutex.Unlock()
+	if !d.Enabled() {
+		notifyWatchers(watchers, d)
+	}
+}
+
+// DeleteDevice remove device with id
+func (m *Cache) DeleteDevice(id string) {
+	m.mutex.Lock()
+	d := m.deviceIDs[id]
+	if d != nil {
+		delete(m.deviceIDs, id)
+		delete(m.devices, deviceKey(d.ProductKey, d.Name))
+	}
+	watchers := m.watchers
+	m.mutex.Unlock()
+	if d != nil {
+		notifyWatchers(watchers, d)
+	}
+}
+
+func notifyWatchers(watchers []Watcher, d *Device) {
+	glog.Infof("Device '%s' of product '%s' is disabled or removed", d.Name, d.ProductKey)
+	for _, w := range watchers {
+		w(d)
+	}
+}
+
+func deviceKey(productKey string, deviceName string) string {
+	return productKey + "/" + deviceName
+}
@@ -0,0 +1,147 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/glog"
+)
+
+// Topics and actions of notifications published by apiserver
+const (
+	TopicNameProduct = "product"
+	TopicNameDevice  = "device"
+
+	ObjectActionRegister = "register"
+	ObjectActionUpdate   = "update"
+	ObjectActionDelete   = "delete"
+)
+
+// productNotify is product notification from apiserver
+type productNotify struct {
+	ProductId   string `json:"productId"`
+	ProductName string `json:"productName"`
+	Action      string `json:"action"`
+	TenantId    string `json:"tenantId"`
+}
+
+// deviceNotify is device notification from apiserver
+type deviceNotify struct {
+	DeviceId     string `json:"deviceId"`
+	DeviceName   string `json:"deviceName"`
+	DeviceSecret string `json:"deviceKey"`
+	DeviceStatus string `json:"deviceStatus"`
+	Action       string `json:"action"`
+	ProductId    string `json:"productId"`
+	ProductKey   string `json:"productKey"`
+}
+
+// notifier consume product and device notifications from kafka
+type notifier struct {
+	cache     *Cache
+	consumer  sarama.Consumer
+	consumers []sarama.PartitionConsumer
+	wg        sync.WaitGroup
+}
+
+func newNotifier(m *Cache) (*notifier, error) {
+	khosts, err := m.config.String("metadata", "kafka")
+	if err != nil || khosts == "" {
+		khosts, _ = m.config.String("broker", "kafka")
+	}
+	consumer, err := sarama.NewConsumer(strings.Split(khosts, ","), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting with kafka:%s failed", khosts)
+	}
+	n := &notifier{cache: m, consumer: consumer}
+	for _, topic := range []string{TopicNameProduct, TopicNameDevice} {
+		partitionList, err := consumer.Partitions(topic)
+		if err != nil {
+			n.close()
+			return nil, fmt.Errorf("Failed to get list of partions:%v", err)
+		}
+		for _, partition := range partitionList {
+			pc, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				glog.Errorf("Failed  to start consumer for partion %d:%s", partition, err)
+				continue
+			}
+			n.consumers = append(n.consumers, pc)
+			n.wg.Add(1)
+			go func(pc sarama.PartitionConsumer) {
+				defer n.wg.Done()
+				for msg := range pc.Messages() {
+					if err := n.handleNotifications(msg.Topic, msg.Value); err != nil {
+						glog.Errorf("Metadata notification failure:%s", err)
+					}
+				}
+			}(pc)
+		}
+	}
+	return n, nil
+}
+
+func (n *notifier) close() {
+	for _, pc := range n.consumers {
+		pc.AsyncClose()
+	}
+	n.wg.Wait()
+	n.consumer.Close()
+}
+
+// handleNotifications handle notification from kafka
+func (n *notifier) handleNotifications(topic string, value []byte) error {
+	switch topic {
+	case TopicNameProduct:
+		obj := &productNotify{}
+		if err := json.Unmarshal(value, obj); err != nil {
+			return err
+		}
+		n.handleProductNotify(obj)
+	case TopicNameDevice:
+		obj := &deviceNotify{}
+		if err := json.Unmarshal(value, obj); err != nil {
+			return err
+		}
+		n.handleDeviceNotify(obj)
+	}
+	return nil
+}
+
+// handleProductNotify handle notification about product from apiserver
+func (n *notifier) handleProductNotify(p *productNotify) {
+	glog.Infof("Product(%s) notification received", p.ProductId)
+	switch p.Action {
+	case ObjectActionRegister, ObjectActionUpdate:
+		n.cache.UpdateProduct(&Product{Key: p.ProductId, Name: p.ProductName, TenantID: p.TenantId})
+	case ObjectActionDelete:
+		n.cache.DeleteProduct(p.ProductId)
+	}
+}
+
+// handleDeviceNotify handle notification about device from apiserver
+func (n *notifier) handleDeviceNotify(d *deviceNotify) {
+	glog.Infof("Device(%s) notification received", d.DeviceId)
+	switch d.Action {
+	case ObjectActionRegister, ObjectActionUpdate:
+		n.cache.UpdateDevice(newDevice(d.DeviceId, d.DeviceName, d.ProductKey, d.ProductId,
+			d.DeviceStatus, d.DeviceSecret))
+	case ObjectActionDelete:
+		n.cache.DeleteDevice(d.DeviceId)
+	}
+}
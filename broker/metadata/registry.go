@@ -0,0 +1,90 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package metadata
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// Registry collections and documents written by apiserver
+const (
+	dbNameRegistry = "registry"
+	dbNameDevices  = "devices"
+	dbNameProducts = "products"
+)
+
+type registryProduct struct {
+	Id   string `bson:"id"`
+	Name string `bson:"name"`
+}
+
+type registryDevice struct {
+	Id           string `bson:"id"`
+	Name         string `bson:"name"`
+	ProductId    string `bson:"productid"`
+	ProductKey   string `bson:"productkey"`
+	DeviceStatus string `bson:"devicestatus"`
+	DeviceSecret string `bson:"devicesecret"`
+}
+
+// load load all products and devices from registry, nothing is loaded if
+// registry is not configured
+func (m *Cache) load() error {
+	hosts, err := m.config.String("metadata", "registry")
+	if err != nil || hosts == "" {
+		return nil
+	}
+	glog.Infof("Loading metadata from registry:%s...", hosts)
+	session, err := mgo.DialWithTimeout(hosts, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	db := session.DB(dbNameRegistry)
+
+	var product registryProduct
+	iter := db.C(dbNameProducts).Find(nil).Iter()
+	for iter.Next(&product) {
+		m.UpdateProduct(&Product{Key: product.Id, Name: product.Name})
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	var device registryDevice
+	iter = db.C(dbNameDevices).Find(nil).Iter()
+	for iter.Next(&device) {
+		m.UpdateDevice(newDevice(device.Id, device.Name, device.ProductKey, device.ProductId,
+			device.DeviceStatus, device.DeviceSecret))
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	glog.Infof("Loaded %d products and %d devices", len(m.products), len(m.devices))
+	return nil
+}
+
+// newDevice create device with fields in registry, product id is used if
+// product key is not set
+func newDevice(id, name, productKey, productId, status, secret string) *Device {
+	d := &Device{ID: id, Name: name, ProductKey: productKey, Status: status}
+	if d.ProductKey == "" {
+		d.ProductKey = productId
+	}
+	if secret != "" {
+		d.SecretHash = HashSecret(secret)
+	}
+	return d
+}
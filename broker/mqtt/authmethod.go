@@ -0,0 +1,57 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// AuthMethod is enhanced authentication method used in MQTT v5 AUTH exchange.
+// Authenticate is called with authentication data received from client, and
+// return authentication data sent back to client, the exchange continues
+// until done is true or error is returned.
+type AuthMethod interface {
+	Authenticate(clientid string, username string, data []uint8) (resp []uint8, done bool, err error)
+}
+
+var (
+	_authMethods     = make(map[string]AuthMethod)
+	_authMethodMutex sync.RWMutex
+)
+
+// RegisterAuthMethod register enhanced authentication method with name
+func RegisterAuthMethod(name string, m AuthMethod) {
+	_authMethodMutex.Lock()
+	defer _authMethodMutex.Unlock()
+	if _authMethods[name] != nil {
+		glog.Errorf("Auth method '%s' is already registered", name)
+		return
+	}
+	_authMethods[name] = m
+}
+
+// UnregisterAuthMethod remove enhanced authentication method with name
+func UnregisterAuthMethod(name string) {
+	_authMethodMutex.Lock()
+	defer _authMethodMutex.Unlock()
+	delete(_authMethods, name)
+}
+
+// getAuthMethod return registered authentication method
+func getAuthMethod(name string) AuthMethod {
+	_authMethodMutex.RLock()
+	defer _authMethodMutex.RUnlock()
+	return _authMethods[name]
+}
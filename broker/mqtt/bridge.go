@@ -0,0 +1,983 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/queue"
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// Directions of bridged topics
+const (
+	bridgeDirectionIn   = "in"   // Messages on remote broker are published locally
+	bridgeDirectionOut  = "out"  // Local messages are published on remote broker
+	bridgeDirectionBoth = "both" // Messages are bridged in both directions
+)
+
+// Connection states of bridge
+const (
+	bridgeStateConnecting   = "connecting"
+	bridgeStateConnected    = "connected"
+	bridgeStateDisconnected = "disconnected"
+)
+
+const (
+	bridgeSection        = "bridge"
+	bridgeMaxInflight    = 20 // Messages published on remote broker without acknowledge
+	bridgeConnectTimeout = 30 * time.Second
+)
+
+// BridgeConfigs is default configurations for bridges, each bridge is added
+// as service "bridge:<name>" and its own configurations in section with the
+// same name override the defaults
+var BridgeConfigs = map[string]string{
+	// Remote broker address in "host:port"
+	"address":       "",
+	"clientid":      "",
+	"username":      "",
+	"password":      "",
+	"clean_session": "false",
+	"keepalive":     "60",
+	// MQTT version used with remote broker, 4 or 5. Remote broker of
+	// version 5 don't send back messages published by bridge, in version 4
+	// out topics must not be matched with in topics on remote broker
+	"protocol_version": "5",
+	// Comma separated topics in format "pattern [in|out|both] [qos]
+	// [local_prefix] [remote_prefix]", "" is used for empty prefix
+	"topics":       "",
+	"max_qos":      "1",
+	"tls":          "false",
+	"cafile":       "",
+	"certfile":     "",
+	"keyfile":      "",
+	"tls_insecure": "false",
+	// Reconnect backoff in seconds, it is doubled after each failure
+	"reconnect_min": "1",
+	"reconnect_max": "60",
+	// Messages are buffered in directory named with bridge under the path,
+	// or in memory if path is empty
+	"buffer_path":         "/var/lib/sentel/broker/bridge",
+	"buffer_max_messages": "10000",
+	"buffer_max_bytes":    "0",
+}
+
+// bridgeTopic is topic pattern bridged between local and remote broker,
+// prefixes are prepended to pattern on each side
+type bridgeTopic struct {
+	pattern      string
+	direction    string
+	qos          uint8
+	localPrefix  string
+	remotePrefix string
+}
+
+// bridge connect to remote broker as mqtt client, local messages matched
+// with out topics are buffered and published on remote broker, messages
+// matched with in topics on remote broker are published locally
+type bridge struct {
+	sent         uint64 // Messages published on remote broker
+	received     uint64 // Messages received from remote broker
+	disconnects  uint64
+	config       core.Config
+	chn          chan base.ServiceCommand
+	name         string
+	sourceID     string // Source of messages received from remote broker
+	storage      Storage
+	cluster      *clusterRouter
+	address      string
+	tlsConfig    *tls.Config
+	clientID     string
+	username     string
+	password     string
+	cleanSession bool
+	keepalive    time.Duration
+	version      uint8 // MQTT protocol version with remote broker
+	topics       []*bridgeTopic
+	in           *topicTree // Remote filters of in topics by topic index
+	out          *topicTree // Local filters of out topics by topic index
+	backoffMin   time.Duration
+	backoffMax   time.Duration
+	buffer       queue.Queue
+	pending      chan bool // Wake up sender when message is buffered
+	mutex        sync.Mutex
+	writeMutex   sync.Mutex
+	state        string
+	lastError    string
+	inflight     map[uint16]uint64 // Buffer sequence of messages by mid
+	released     map[uint16]bool   // Qos 2 messages waiting for PUBCOMP after PUBREC
+	lastMid      uint16
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+}
+
+var (
+	_bridges      = make(map[string]*bridge)
+	_bridgesMutex sync.RWMutex
+)
+
+// forwardToBridges buffer message on all bridges with matched out topics
+func forwardToBridges(msg StorageMessage) {
+	_bridgesMutex.RLock()
+	defer _bridgesMutex.RUnlock()
+	for _, b := range _bridges {
+		b.forward(msg)
+	}
+}
+
+// dispatchMessage route message which is not published by mqtt client to
+// local subscribers, cluster nodes and bridges
+func dispatchMessage(storage Storage, cluster *clusterRouter, msg StorageMessage) error {
+	if msg.Retain {
+		if err := storage.StoreRetainMessage(msg.Topic, msg); err != nil {
+			return err
+		}
+	}
+	cluster.forward(msg)
+	forwardToBridges(msg)
+	return storage.QueueMessage(msg.SourceID, msg)
+}
+
+// BridgeFactory create bridge service
+type BridgeFactory struct{}
+
+// New create bridge with configurations in its section
+func (m *BridgeFactory) New(name string, c core.Config, ch chan base.ServiceCommand) (base.Service, error) {
+	instance := strings.TrimPrefix(name, bridgeSection+":")
+	if instance == name || instance == "" {
+		return nil, fmt.Errorf("Bridge service '%s' must be named as 'bridge:<name>'", name)
+	}
+	address := bridgeOption(c, name, "address")
+	if address == "" {
+		return nil, fmt.Errorf("No remote address is set for bridge '%s'", name)
+	}
+	maxQos := uint8(bridgeInt(c, name, "max_qos", 1))
+	if maxQos > 2 {
+		maxQos = 2
+	}
+	topics, err := parseBridgeTopics(bridgeOption(c, name, "topics"), maxQos)
+	if err != nil {
+		return nil, err
+	}
+	version := uint8(bridgeInt(c, name, "protocol_version", PROTOCOL_VERSION_V5))
+	switch version {
+	case PROTOCOL_VERSION_V311:
+		if err := checkBridgeLoops(topics); err != nil {
+			return nil, err
+		}
+	case PROTOCOL_VERSION_V5:
+	default:
+		return nil, fmt.Errorf("Unsupported protocol version %d of bridge '%s'", version, name)
+	}
+	tlsConfig, err := newBridgeTLSConfig(c, name, address)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := getSharedStorage(c.MustString("storage", "name"), c)
+	if err != nil {
+		return nil, errors.New("Failed to create storage in bridge")
+	}
+	opts := queue.Options{
+		MaxCount:   bridgeInt(c, name, "buffer_max_messages", 10000),
+		MaxBytes:   int64(bridgeInt(c, name, "buffer_max_bytes", 0)),
+		DropPolicy: queue.DropOldest,
+	}
+	if path := bridgeOption(c, name, "buffer_path"); path != "" {
+		opts.Path = filepath.Join(path, instance)
+	}
+	buffer, err := queue.New(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open buffer of bridge '%s':%s", name, err)
+	}
+	clientID := bridgeOption(c, name, "clientid")
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = hostname + "-" + instance
+	}
+	backoffMin := time.Duration(bridgeInt(c, name, "reconnect_min", 1)) * time.Second
+	backoffMax := time.Duration(bridgeInt(c, name, "reconnect_max", 60)) * time.Second
+	if backoffMin <= 0 {
+		backoffMin = time.Second
+	}
+	if backoffMax < backoffMin {
+		backoffMax = backoffMin
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &bridge{
+		config:       c,
+		chn:          ch,
+		name:         name,
+		sourceID:     "$bridge:" + instance,
+		storage:      storage,
+		cluster:      getClusterRouter(c, storage),
+		address:      address,
+		tlsConfig:    tlsConfig,
+		clientID:     clientID,
+		username:     bridgeOption(c, name, "username"),
+		password:     bridgeOption(c, name, "password"),
+		cleanSession: bridgeOption(c, name, "clean_session") == "true",
+		keepalive:    time.Duration(bridgeInt(c, name, "keepalive", 60)) * time.Second,
+		version:      version,
+		topics:       topics,
+		in:           newTopicTree(),
+		out:          newTopicTree(),
+		backoffMin:   backoffMin,
+		backoffMax:   backoffMax,
+		buffer:       buffer,
+		pending:      make(chan bool, 1),
+		inflight:     make(map[uint16]uint64),
+		released:     make(map[uint16]bool),
+		state:        bridgeStateDisconnected,
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+	for i, t := range topics {
+		index := strconv.Itoa(i)
+		if t.direction != bridgeDirectionOut {
+			b.in.subscribe(t.remotePrefix+t.pattern, index, t.qos, 0)
+		}
+		if t.direction != bridgeDirectionIn {
+			b.out.subscribe(t.localPrefix+t.pattern, index, t.qos, 0)
+		}
+	}
+	return b, nil
+}
+
+// bridgeOption return option of bridge in its own section, default in
+// bridge section is used if it is not set
+func bridgeOption(c core.Config, name string, key string) string {
+	if val, err := c.String(name, key); err == nil && val != "" {
+		return val
+	}
+	val, _ := c.String(bridgeSection, key)
+	return val
+}
+
+// bridgeInt return integer option of bridge, or default value if it is
+// not set or invalid
+func bridgeInt(c core.Config, name string, key string, def int) int {
+	if val, err := strconv.Atoi(bridgeOption(c, name, key)); err == nil && val >= 0 {
+		return val
+	}
+	return def
+}
+
+// parseBridgeTopics parse comma separated topics, qos of topic is limited
+// by max qos
+func parseBridgeTopics(topics string, maxQos uint8) ([]*bridgeTopic, error) {
+	list := []*bridgeTopic{}
+	for _, item := range strings.Split(topics, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		t := &bridgeTopic{
+			pattern:   fields[0],
+			direction: bridgeDirectionOut,
+			qos:       maxQos,
+		}
+		if len(fields) > 1 {
+			switch fields[1] {
+			case bridgeDirectionIn, bridgeDirectionOut, bridgeDirectionBoth:
+				t.direction = fields[1]
+			default:
+				return nil, fmt.Errorf("Invalid direction '%s' of bridge topic '%s'", fields[1], t.pattern)
+			}
+		}
+		if len(fields) > 2 {
+			qos, err := strconv.Atoi(fields[2])
+			if err != nil || qos < 0 || qos > 2 {
+				return nil, fmt.Errorf("Invalid qos '%s' of bridge topic '%s'", fields[2], t.pattern)
+			}
+			if uint8(qos) < t.qos {
+				t.qos = uint8(qos)
+			}
+		}
+		if len(fields) > 3 {
+			t.localPrefix = bridgePrefix(fields[3])
+		}
+		if len(fields) > 4 {
+			t.remotePrefix = bridgePrefix(fields[4])
+		}
+		list = append(list, t)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("No topic is bridged")
+	}
+	return list, nil
+}
+
+// checkBridgeLoops check that messages published on remote broker through
+// out topics are not sent back through in topics, which can't be detected
+// without no local subscription of MQTT v5
+func checkBridgeLoops(topics []*bridgeTopic) error {
+	for _, out := range topics {
+		if out.direction == bridgeDirectionIn {
+			continue
+		}
+		for _, in := range topics {
+			if in.direction == bridgeDirectionOut {
+				continue
+			}
+			if overlapTopicFilters(out.remotePrefix+out.pattern, in.remotePrefix+in.pattern) {
+				return fmt.Errorf("Bridge topic '%s' is sent back by '%s' in protocol version 4", out.pattern, in.pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// bridgePrefix return topic prefix, "" stand for empty prefix
+func bridgePrefix(prefix string) string {
+	if prefix == `""` {
+		return ""
+	}
+	return prefix
+}
+
+// newBridgeTLSConfig create tls config to connect remote broker, nil is
+// returned if tls is not enabled
+func newBridgeTLSConfig(c core.Config, name string, address string) (*tls.Config, error) {
+	if bridgeOption(c, name, "tls") != "true" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: bridgeOption(c, name, "tls_insecure") == "true",
+	}
+	if caFile := bridgeOption(c, name, "cafile"); caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No valid certificate in '%s'", caFile)
+		}
+		config.RootCAs = pool
+	}
+	certFile := bridgeOption(c, name, "certfile")
+	keyFile := bridgeOption(c, name, "keyfile")
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// Info return connection state and message counts of bridge
+func (b *bridge) Info() *base.ServiceInfo {
+	b.mutex.Lock()
+	state := b.state
+	lastError := b.lastError
+	b.mutex.Unlock()
+
+	info := &base.ServiceInfo{
+		ServiceName:   b.name,
+		Listen:        b.address,
+		ShutdownCount: atomic.LoadUint64(&b.disconnects),
+	}
+	if state == bridgeStateConnected {
+		info.CurrentClients = 1
+	}
+	info.Status = fmt.Sprintf("%s buffered=%d dropped=%d sent=%d received=%d",
+		state, b.buffer.Len(), b.buffer.Dropped(),
+		atomic.LoadUint64(&b.sent), atomic.LoadUint64(&b.received))
+	if state != bridgeStateConnected && lastError != "" {
+		info.Status += " error=" + lastError
+	}
+	return info
+}
+
+// Start register bridge to receive local messages and connect remote broker
+func (b *bridge) Start() error {
+	_bridgesMutex.Lock()
+	_bridges[b.name] = b
+	_bridgesMutex.Unlock()
+
+	b.wg.Add(1)
+	go b.run()
+	return nil
+}
+
+// Stop disconnect from remote broker, messages not published are kept in
+// buffer if it is durable
+func (b *bridge) Stop() {
+	_bridgesMutex.Lock()
+	delete(_bridges, b.name)
+	_bridgesMutex.Unlock()
+
+	b.cancel()
+	b.wg.Wait()
+	b.buffer.Close()
+}
+
+// setState update connection state of bridge
+func (b *bridge) setState(state string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = state
+	if err != nil {
+		b.lastError = err.Error()
+	}
+}
+
+// run connect remote broker until bridge is stopped, reconnect is delayed
+// with exponential backoff after failure
+func (b *bridge) run() {
+	defer b.wg.Done()
+	backoff := b.backoffMin
+	for {
+		conn, err := b.connect()
+		if err == nil {
+			glog.Infof("Bridge '%s' is connected to '%s'", b.name, b.address)
+			backoff = b.backoffMin
+			err = b.serve(conn)
+			atomic.AddUint64(&b.disconnects, 1)
+		}
+		b.setState(bridgeStateDisconnected, err)
+		select {
+		case <-b.ctx.Done():
+			return
+		default:
+		}
+		glog.Errorf("Bridge '%s' is disconnected from '%s', reconnect in %s:%v", b.name, b.address, backoff, err)
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > b.backoffMax {
+			backoff = b.backoffMax
+		}
+	}
+}
+
+// connect dial remote broker and wait for connection to be accepted
+func (b *bridge) connect() (net.Conn, error) {
+	b.setState(bridgeStateConnecting, nil)
+	dialer := &net.Dialer{Timeout: bridgeConnectTimeout}
+	conn, err := dialer.DialContext(b.ctx, "tcp", b.address)
+	if err != nil {
+		return nil, err
+	}
+	if b.tlsConfig != nil {
+		conn = tls.Client(conn, b.tlsConfig)
+	}
+	conn.SetDeadline(time.Now().Add(bridgeConnectTimeout))
+	if err := b.writePacket(conn, b.connectPacket()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p := newMqttPacket()
+	if err := p.DecodeFromReader(conn, base.NilDecodeFeedback{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if p.command&0xF0 != CONNACK || p.remainingLength < 2 {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected command %d while connecting", int(p.command))
+	}
+	// Return code of version 4 and reason code of version 5 are both 0 on
+	// success
+	if result := p.payload[1]; result != CONNACK_ACCEPTED {
+		conn.Close()
+		return nil, fmt.Errorf("Connection is refused by remote broker with code %d", result)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// serve subscribe in topics and publish buffered messages until connection
+// is broken or bridge is stopped, messages not acknowledged are published
+// again after reconnect. Qos 2 messages received by remote broker are not
+// published again, PUBREL is resent for them instead
+func (b *bridge) serve(conn net.Conn) error {
+	b.setState(bridgeStateConnected, nil)
+	defer func() {
+		conn.Close()
+		b.mutex.Lock()
+		for mid, seq := range b.inflight {
+			if !b.released[mid] {
+				b.buffer.Requeue(seq)
+				delete(b.inflight, mid)
+			}
+		}
+		b.mutex.Unlock()
+	}()
+
+	if err := b.subscribe(conn); err != nil {
+		return err
+	}
+	if err := b.resendReleases(conn); err != nil {
+		return err
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- b.receive(conn) }()
+
+	var ping <-chan time.Time
+	if b.keepalive > 0 {
+		ticker := time.NewTicker(b.keepalive)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+	for {
+		if err := b.flush(conn); err != nil {
+			return err
+		}
+		select {
+		case <-b.pending:
+		case <-ping:
+			if err := b.writePacket(conn, newSimplePacket(PINGREQ)); err != nil {
+				return err
+			}
+		case err := <-errs:
+			return err
+		case <-b.ctx.Done():
+			b.writePacket(conn, newSimplePacket(DISCONNECT))
+			return nil
+		}
+	}
+}
+
+// receive handle packets from remote broker
+func (b *bridge) receive(conn net.Conn) error {
+	awaitingRel := make(map[uint16]bool) // Incoming qos 2 messages
+	p := newMqttPacket()
+	for {
+		if b.keepalive > 0 {
+			conn.SetReadDeadline(time.Now().Add(b.keepalive * 3 / 2))
+		}
+		p.Clear()
+		if err := p.DecodeFromReader(conn, base.NilDecodeFeedback{}); err != nil {
+			return err
+		}
+		var err error
+		var mid uint16
+		switch p.command & 0xF0 {
+		case PUBLISH:
+			err = b.handlePublish(conn, &p, awaitingRel)
+		case PUBACK, PUBCOMP:
+			if mid, err = p.readUint16(); err == nil {
+				b.acknowledge(mid)
+			}
+		case PUBREC:
+			if mid, err = p.readUint16(); err == nil {
+				err = b.release(conn, &p, mid)
+			}
+		case PUBREL:
+			if mid, err = p.readUint16(); err == nil {
+				delete(awaitingRel, mid)
+				err = b.writePacket(conn, newCommandPacket(PUBCOMP, mid, false))
+			}
+		case SUBACK:
+			if _, err = p.readUint16(); err == nil && b.version == PROTOCOL_VERSION_V5 {
+				_, err = p.readProperties()
+			}
+			if err == nil {
+				for _, code := range p.payload[p.pos:p.remainingLength] {
+					if code >= REASON_UNSPECIFIED_ERROR {
+						glog.Errorf("Subscription of bridge '%s' is refused by '%s'", b.name, b.address)
+					}
+				}
+			}
+		case PINGRESP:
+		case DISCONNECT:
+			err = errors.New("Disconnected by remote broker")
+		default:
+			err = fmt.Errorf("Unexpected command %d from remote broker", int(p.command))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handlePublish publish message from remote broker locally and acknowledge
+// it, qos 2 message is published only once before PUBREL is received
+func (b *bridge) handlePublish(conn net.Conn, p *mqttPacket, awaitingRel map[uint16]bool) error {
+	qos := (p.command & 0x06) >> 1
+	retain := p.command&0x01 != 0
+	topic, err := p.readString()
+	if err != nil {
+		return err
+	}
+	var mid uint16
+	if qos > 0 {
+		if mid, err = p.readUint16(); err != nil {
+			return err
+		}
+	}
+	if b.version == PROTOCOL_VERSION_V5 {
+		if _, err = p.readProperties(); err != nil {
+			return err
+		}
+	}
+	payload := append([]uint8{}, p.payload[p.pos:p.remainingLength]...)
+
+	switch qos {
+	case 0:
+		b.deliver(topic, qos, retain, payload)
+	case 1:
+		b.deliver(topic, qos, retain, payload)
+		return b.writePacket(conn, newCommandPacket(PUBACK, mid, false))
+	case 2:
+		if !awaitingRel[mid] {
+			awaitingRel[mid] = true
+			b.deliver(topic, qos, retain, payload)
+		}
+		return b.writePacket(conn, newCommandPacket(PUBREC, mid, false))
+	default:
+		return mqttErrorInvalidProtocol
+	}
+	return nil
+}
+
+// deliver route message from remote broker to local subscribers, cluster
+// nodes and other bridges
+func (b *bridge) deliver(topic string, qos uint8, retain bool, payload []uint8) {
+	atomic.AddUint64(&b.received, 1)
+	t := b.matchTopic(b.in, topic)
+	if t == nil {
+		glog.Warningf("Message on '%s' from bridge '%s' is not matched with any topic", topic, b.name)
+		return
+	}
+	if qos > t.qos {
+		qos = t.qos
+	}
+	msg := StorageMessage{
+		SourceID:  b.sourceID,
+		Topic:     t.localPrefix + strings.TrimPrefix(topic, t.remotePrefix),
+		Direction: MessageDirectionIn,
+		Qos:       qos,
+		Retain:    retain,
+		Payload:   payload,
+	}
+	if err := dispatchMessage(b.storage, b.cluster, msg); err != nil {
+		glog.Errorf("Failed to deliver message from bridge '%s':%s", b.name, err)
+	}
+}
+
+// forward buffer local message matched with out topics, message received
+// by the bridge itself is not sent back
+func (b *bridge) forward(msg StorageMessage) {
+	if msg.SourceID == b.sourceID || msg.Expired() {
+		return
+	}
+	t := b.matchTopic(b.out, msg.Topic)
+	if t == nil {
+		return
+	}
+	qos := msg.Qos
+	if qos > t.qos {
+		qos = t.qos
+	}
+	data, err := json.Marshal(&StorageMessage{
+		SourceID:  msg.SourceID,
+		Topic:     t.remotePrefix + strings.TrimPrefix(msg.Topic, t.localPrefix),
+		Direction: MessageDirectionOut,
+		Qos:       qos,
+		Retain:    msg.Retain,
+		Payload:   msg.Payload,
+		ExpiryAt:  msg.ExpiryAt,
+	})
+	if err != nil {
+		glog.Errorf("Failed to encode message for bridge '%s':%s", b.name, err)
+		return
+	}
+	if _, err := b.buffer.Push(data); err != nil {
+		glog.Errorf("Failed to buffer message for bridge '%s':%s", b.name, err)
+		return
+	}
+	select {
+	case b.pending <- true:
+	default:
+	}
+}
+
+// matchTopic return the first configured topic whose filter in tree is
+// matched with topic
+func (b *bridge) matchTopic(tree *topicTree, topic string) *bridgeTopic {
+	subs, _ := tree.match(topic)
+	matched := -1
+	for _, sub := range subs {
+		if index, err := strconv.Atoi(sub.sessionid); err == nil && (matched < 0 || index < matched) {
+			matched = index
+		}
+	}
+	if matched < 0 {
+		return nil
+	}
+	return b.topics[matched]
+}
+
+// flush publish buffered messages on remote broker until inflight window
+// is full or buffer is empty
+func (b *bridge) flush(conn net.Conn) error {
+	for {
+		b.mutex.Lock()
+		if len(b.inflight) >= bridgeMaxInflight {
+			b.mutex.Unlock()
+			return nil
+		}
+		m, err := b.buffer.Pop()
+		if err != nil {
+			b.mutex.Unlock()
+			return nil
+		}
+		msg := StorageMessage{}
+		if err := json.Unmarshal(m.Data, &msg); err != nil || msg.Expired() {
+			b.buffer.Ack(m.Seq)
+			b.mutex.Unlock()
+			continue
+		}
+		var mid uint16
+		if msg.Qos > 0 {
+			mid = b.nextMid()
+			b.inflight[mid] = m.Seq
+		}
+		b.mutex.Unlock()
+
+		if err := b.writePacket(conn, newBridgePublishPacket(&msg, mid, m.Deliveries > 1, b.version)); err != nil {
+			if msg.Qos == 0 {
+				b.buffer.Requeue(m.Seq)
+			}
+			return err
+		}
+		if msg.Qos == 0 {
+			b.buffer.Ack(m.Seq)
+		}
+		atomic.AddUint64(&b.sent, 1)
+	}
+}
+
+// acknowledge remove message acknowledged by remote broker from buffer
+func (b *bridge) acknowledge(mid uint16) {
+	b.mutex.Lock()
+	seq, ok := b.inflight[mid]
+	delete(b.inflight, mid)
+	delete(b.released, mid)
+	b.mutex.Unlock()
+	if ok {
+		b.buffer.Ack(seq)
+		select {
+		case b.pending <- true:
+		default:
+		}
+	}
+}
+
+// release send PUBREL for qos 2 message received by remote broker, the
+// message is kept until PUBCOMP is received even if connection is broken.
+// Message rejected by remote broker of MQTT v5 is removed at once
+func (b *bridge) release(conn net.Conn, p *mqttPacket, mid uint16) error {
+	if b.version == PROTOCOL_VERSION_V5 && p.remainingLength > 2 {
+		if reason, err := p.readByte(); err == nil && reason >= REASON_UNSPECIFIED_ERROR {
+			glog.Warningf("Message(%d) of bridge '%s' is rejected with reason:%d", mid, b.name, reason)
+			b.acknowledge(mid)
+			return nil
+		}
+	}
+	b.mutex.Lock()
+	_, ok := b.inflight[mid]
+	if ok {
+		b.released[mid] = true
+	}
+	b.mutex.Unlock()
+	return b.writePacket(conn, newCommandPacket(PUBREL|0x02, mid, false))
+}
+
+// resendReleases send PUBREL again after reconnect for qos 2 messages
+// whose PUBCOMP is not received
+func (b *bridge) resendReleases(conn net.Conn) error {
+	b.mutex.Lock()
+	mids := make([]int, 0, len(b.released))
+	for mid := range b.released {
+		mids = append(mids, int(mid))
+	}
+	b.mutex.Unlock()
+	sort.Ints(mids)
+	for _, mid := range mids {
+		if err := b.writePacket(conn, newCommandPacket(PUBREL|0x02, uint16(mid), false)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nextMid return message identifier not used by inflight messages, the
+// caller must hold lock
+func (b *bridge) nextMid() uint16 {
+	for {
+		b.lastMid++
+		if _, ok := b.inflight[b.lastMid]; b.lastMid != 0 && !ok {
+			return b.lastMid
+		}
+	}
+}
+
+// subscribe subscribe remote filters of in topics, messages published by
+// bridge itself are not sent back by remote broker of MQTT v5
+func (b *bridge) subscribe(conn net.Conn) error {
+	length := 0
+	for _, t := range b.topics {
+		if t.direction != bridgeDirectionOut {
+			length += 2 + len(t.remotePrefix+t.pattern) + 1
+		}
+	}
+	if length == 0 {
+		return nil
+	}
+	length += 2
+	options := uint8(0)
+	if b.version == PROTOCOL_VERSION_V5 {
+		length++
+		options = SubscriptionNoLocal
+	}
+	b.mutex.Lock()
+	mid := b.nextMid()
+	b.mutex.Unlock()
+
+	packet := &mqttPacket{
+		command:         SUBSCRIBE,
+		qos:             1,
+		remainingLength: length,
+	}
+	if err := packet.initializePacket(); err != nil {
+		return err
+	}
+	packet.writeUint16(mid)
+	if b.version == PROTOCOL_VERSION_V5 {
+		packet.writeVarInt(0)
+	}
+	for _, t := range b.topics {
+		if t.direction != bridgeDirectionOut {
+			packet.writeString(t.remotePrefix + t.pattern)
+			packet.writeByte(t.qos | options)
+		}
+	}
+	return b.writePacket(conn, packet)
+}
+
+// writePacket write whole packet to connection, packets are written by
+// sender and receiver of bridge
+func (b *bridge) writePacket(conn net.Conn, p *mqttPacket) error {
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	_, err := conn.Write(p.payload[:p.length])
+	return err
+}
+
+// connectPacket build CONNECT packet with bridge's identity, no property is
+// sent in MQTT v5
+func (b *bridge) connectPacket() *mqttPacket {
+	length := 10 + 2 + len(b.clientID)
+	if b.version == PROTOCOL_VERSION_V5 {
+		length++
+	}
+	flags := uint8(0)
+	if b.cleanSession {
+		flags |= 0x02
+	}
+	if b.username != "" {
+		flags |= 0x80
+		length += 2 + len(b.username)
+		if b.password != "" {
+			flags |= 0x40
+			length += 2 + len(b.password)
+		}
+	}
+	packet := &mqttPacket{
+		command:         CONNECT,
+		remainingLength: length,
+	}
+	packet.initializePacket()
+	packet.writeString(PROTOCOL_NAME_V311)
+	packet.writeByte(b.version)
+	packet.writeByte(flags)
+	packet.writeUint16(uint16(b.keepalive / time.Second))
+	if b.version == PROTOCOL_VERSION_V5 {
+		packet.writeVarInt(0)
+	}
+	packet.writeString(b.clientID)
+	if flags&0x80 != 0 {
+		packet.writeString(b.username)
+	}
+	if flags&0x40 != 0 {
+		packet.writeString(b.password)
+	}
+	return packet
+}
+
+// newBridgePublishPacket build PUBLISH packet of protocol version, no
+// property is sent in MQTT v5
+func newBridgePublishPacket(msg *StorageMessage, mid uint16, dup bool, version uint8) *mqttPacket {
+	packet := &mqttPacket{
+		command:         PUBLISH,
+		dup:             dup && msg.Qos > 0,
+		qos:             msg.Qos,
+		retain:          msg.Retain,
+		remainingLength: 2 + len(msg.Topic) + len(msg.Payload),
+	}
+	if msg.Qos > 0 {
+		packet.remainingLength += 2
+	}
+	if version == PROTOCOL_VERSION_V5 {
+		packet.remainingLength++
+	}
+	packet.initializePacket()
+	packet.writeString(msg.Topic)
+	if msg.Qos > 0 {
+		packet.writeUint16(mid)
+	}
+	if version == PROTOCOL_VERSION_V5 {
+		packet.writeVarInt(0)
+	}
+	packet.writeBytes(msg.Payload)
+	return packet
+}
+
+// newSimplePacket build packet without variable header and payload
+func newSimplePacket(command uint8) *mqttPacket {
+	packet := &mqttPacket{command: command}
+	packet.initializePacket()
+	return packet
+}
@@ -0,0 +1,607 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloustone/sentel/core"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/glog"
+)
+
+// Actions of route notifications
+const (
+	routeActionJoin   = "join"   // Node is started, peers reply with sync
+	routeActionSync   = "sync"   // All topic filters of node
+	routeActionAdd    = "add"    // Topic filters subscribed on node
+	routeActionRemove = "remove" // Topic filters unsubscribed on node
+	routeActionLeave  = "leave"  // Node is stopped
+)
+
+// routeNotify advertise topic filters subscribed on node, filters are
+// aggregated by node and not by client. Shared subscription is advertised
+// with its group, so that each group is dispatched on one node
+type routeNotify struct {
+	Node    string   `json:"node"`
+	Action  string   `json:"action"`
+	Filters []string `json:"filters,omitempty"`
+}
+
+// forwardNotify is message published on node and forwarded to nodes which
+// have subscribers matched with its topic
+type forwardNotify struct {
+	Node    string         `json:"node"`
+	Targets []string       `json:"targets"`
+	Message StorageMessage `json:"message"`
+}
+
+// clusterNode is topic filters subscribed on peer node
+type clusterNode struct {
+	filters  map[string]bool
+	lastSeen time.Time
+}
+
+// clusterRouter keep route table of cluster, messages published on this
+// node are forwarded to nodes with matched topic filters, and messages
+// forwarded by other nodes are delivered to local subscribers
+type clusterRouter struct {
+	config       core.Config
+	storage      Storage
+	enabled      bool
+	routeTopic   string
+	messageTopic string
+	interval     time.Duration
+	timeout      time.Duration
+	buffer       int
+	mutex        sync.Mutex
+	local        map[string]int // Local subscription count on topic filters and shared subscriptions
+	nodes        map[string]*clusterNode
+	routes       *topicTree // Topic filters of peers subscribed by node id
+	producer     sarama.AsyncProducer
+	produceMutex sync.Mutex
+	dropped      uint64 // Notifications dropped because producer is busy
+	consumer     sarama.Consumer
+	consumers    []sarama.PartitionConsumer
+	wg           sync.WaitGroup
+	quit         chan bool
+}
+
+var (
+	_clusterRouter      *clusterRouter
+	_clusterRouterMutex sync.Mutex
+)
+
+// LeaveCluster advertise peers that this node leave cluster, its routes
+// are removed by peers
+func LeaveCluster() {
+	_clusterRouterMutex.Lock()
+	defer _clusterRouterMutex.Unlock()
+	if _clusterRouter != nil {
+		_clusterRouter.stop()
+		_clusterRouter = nil
+	}
+}
+
+// getClusterRouter return cluster router shared by all mqtt services, it
+// is created and started with storage at first time
+func getClusterRouter(c core.Config, storage Storage) *clusterRouter {
+	_clusterRouterMutex.Lock()
+	defer _clusterRouterMutex.Unlock()
+	if _clusterRouter == nil {
+		_clusterRouter = newClusterRouter(c, storage)
+		if err := _clusterRouter.start(); err != nil {
+			glog.Errorf("Failed to start cluster router, messages are routed in node:%s", err)
+			_clusterRouter.enabled = false
+		}
+	}
+	return _clusterRouter
+}
+
+// newClusterRouter create router with configurations in cluster section
+func newClusterRouter(c core.Config, storage Storage) *clusterRouter {
+	r := &clusterRouter{
+		config:       c,
+		storage:      storage,
+		routeTopic:   "broker-route",
+		messageTopic: "broker-message",
+		interval:     10 * time.Second,
+		timeout:      30 * time.Second,
+		buffer:       1024,
+		local:        make(map[string]int),
+		nodes:        make(map[string]*clusterNode),
+		routes:       newTopicTree(),
+		quit:         make(chan bool),
+	}
+	r.enabled, _ = c.Bool("cluster", "enabled")
+	if topic, err := c.String("cluster", "route_topic"); err == nil && topic != "" {
+		r.routeTopic = topic
+	}
+	if topic, err := c.String("cluster", "message_topic"); err == nil && topic != "" {
+		r.messageTopic = topic
+	}
+	if interval, err := c.Int("cluster", "heartbeat_interval"); err == nil && interval > 0 {
+		r.interval = time.Duration(interval) * time.Second
+	}
+	if timeout, err := c.Int("cluster", "node_timeout"); err == nil && timeout > 0 {
+		r.timeout = time.Duration(timeout) * time.Second
+	}
+	if buffer, err := c.Int("cluster", "produce_buffer"); err == nil && buffer > 0 {
+		r.buffer = buffer
+	}
+	// Subscriptions restored from backup are advertised at startup
+	storage.WalkClientSubscriptions(func(sessionid string, topic string, qos uint8) {
+		r.local[topic]++
+	})
+	storage.WatchSubscriptions(r.updateLocalRoute)
+	storage.SetShareFilter(r.ownShare)
+	return r
+}
+
+// start connect with kafka and join cluster
+func (r *clusterRouter) start() error {
+	if !r.enabled {
+		return nil
+	}
+	khosts, err := r.config.String("cluster", "kafka")
+	if err != nil || khosts == "" {
+		khosts, _ = r.config.String("mqttbroker", "kafka")
+	}
+	hosts := strings.Split(khosts, ",")
+	consumer, err := sarama.NewConsumer(hosts, nil)
+	if err != nil {
+		return fmt.Errorf("Connecting with kafka:%s failed", khosts)
+	}
+	r.consumer = consumer
+	for _, topic := range []string{r.routeTopic, r.messageTopic} {
+		partitionList, err := consumer.Partitions(topic)
+		if err != nil {
+			r.close()
+			return fmt.Errorf("Failed to get list of partions:%v", err)
+		}
+		for _, partition := range partitionList {
+			pc, err := consumer.ConsumePartition(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				glog.Errorf("Failed  to start consumer for partion %d:%s", partition, err)
+				continue
+			}
+			r.consumers = append(r.consumers, pc)
+			r.wg.Add(1)
+			go func(pc sarama.PartitionConsumer) {
+				defer r.wg.Done()
+				for msg := range pc.Messages() {
+					if err := r.handleNotifications(msg.Topic, msg.Value); err != nil {
+						glog.Errorf("Cluster notification failure:%s", err)
+					}
+				}
+			}(pc)
+		}
+	}
+	config := sarama.NewConfig()
+	config.ChannelBufferSize = r.buffer
+	producer, err := sarama.NewAsyncProducer(hosts, config)
+	if err != nil {
+		r.close()
+		return fmt.Errorf("Connecting with kafka:%s failed", khosts)
+	}
+	r.produceMutex.Lock()
+	r.producer = producer
+	r.produceMutex.Unlock()
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for err := range producer.Errors() {
+			glog.Errorf("Failed to produce cluster notification:%s", err)
+		}
+	}()
+	r.wg.Add(1)
+	go r.heartbeat()
+
+	r.advertise(routeActionJoin, r.localFilters())
+	glog.Infof("Node %s joined cluster", nodeID)
+	return nil
+}
+
+// stop leave cluster and close connections with kafka
+func (r *clusterRouter) stop() {
+	if !r.enabled {
+		return
+	}
+	r.advertise(routeActionLeave, nil)
+	close(r.quit)
+	r.close()
+}
+
+func (r *clusterRouter) close() {
+	r.produceMutex.Lock()
+	if r.producer != nil {
+		r.producer.AsyncClose()
+		r.producer = nil
+	}
+	r.produceMutex.Unlock()
+	for _, pc := range r.consumers {
+		pc.AsyncClose()
+	}
+	r.wg.Wait()
+	if r.consumer != nil {
+		r.consumer.Close()
+	}
+}
+
+// heartbeat advertise all local topic filters periodically, and remove
+// routes of nodes which are not seen in timeout
+func (r *clusterRouter) heartbeat() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case now := <-ticker.C:
+			r.advertise(routeActionSync, r.localFilters())
+			r.mutex.Lock()
+			expired := []string{}
+			for id, node := range r.nodes {
+				if now.Sub(node.lastSeen) > r.timeout {
+					expired = append(expired, id)
+				}
+			}
+			r.mutex.Unlock()
+			for _, id := range expired {
+				glog.Warningf("Node %s is not seen in %v, removing its routes", id, r.timeout)
+				r.removeNode(id)
+			}
+		}
+	}
+}
+
+// produce send notification to kafka, notifications of the same node are
+// in one partition so that they are handled in order. Publishing is never
+// blocked by kafka, notification is dropped if producer's buffer is full
+func (r *clusterRouter) produce(topic string, value interface{}) bool {
+	data, err := json.Marshal(value)
+	if err != nil {
+		glog.Errorf("Failed to encode cluster notification:%s", err)
+		return false
+	}
+	r.produceMutex.Lock()
+	defer r.produceMutex.Unlock()
+	// Notifications are dropped after router is stopped
+	if r.producer == nil {
+		return false
+	}
+	select {
+	case r.producer.Input() <- &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(nodeID),
+		Value: sarama.ByteEncoder(data),
+	}:
+		return true
+	default:
+		// Lost routes are recovered by next heartbeat
+		dropped := atomic.AddUint64(&r.dropped, 1)
+		glog.Warningf("Cluster notification on '%s' is dropped, producer is busy(%d dropped)", topic, dropped)
+		return false
+	}
+}
+
+// advertise send local topic filters to peers
+func (r *clusterRouter) advertise(action string, filters []string) {
+	r.produce(r.routeTopic, &routeNotify{Node: nodeID, Action: action, Filters: filters})
+}
+
+// updateLocalRoute count local subscriptions on topic filter, filter is
+// advertised when it is subscribed firstly or unsubscribed lastly
+func (r *clusterRouter) updateLocalRoute(filter string, subscribed bool) {
+	r.mutex.Lock()
+	count := r.local[filter]
+	if subscribed {
+		r.local[filter] = count + 1
+	} else if count <= 1 {
+		delete(r.local, filter)
+	} else {
+		r.local[filter] = count - 1
+	}
+	r.mutex.Unlock()
+
+	switch {
+	case !r.enabled:
+	case subscribed && count == 0:
+		r.advertise(routeActionAdd, []string{filter})
+	case !subscribed && count == 1:
+		r.advertise(routeActionRemove, []string{filter})
+	}
+}
+
+// localFilters return topic filters subscribed on this node
+func (r *clusterRouter) localFilters() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	filters := make([]string, 0, len(r.local))
+	for filter := range r.local {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// handleNotifications handle route and forwarded message notifications
+func (r *clusterRouter) handleNotifications(topic string, value []byte) error {
+	switch topic {
+	case r.routeTopic:
+		obj := &routeNotify{}
+		if err := json.Unmarshal(value, obj); err != nil {
+			return err
+		}
+		if obj.Node != nodeID {
+			r.handleRouteNotify(obj)
+		}
+	case r.messageTopic:
+		obj := &forwardNotify{}
+		if err := json.Unmarshal(value, obj); err != nil {
+			return err
+		}
+		if obj.Node != nodeID {
+			r.handleForwardNotify(obj)
+		}
+	}
+	return nil
+}
+
+// handleRouteNotify update routes of peer node
+func (r *clusterRouter) handleRouteNotify(n *routeNotify) {
+	switch n.Action {
+	case routeActionJoin, routeActionSync:
+		r.syncNode(n.Node, n.Filters)
+		if n.Action == routeActionJoin {
+			glog.Infof("Node %s joined cluster", n.Node)
+			r.advertise(routeActionSync, r.localFilters())
+		}
+	case routeActionAdd:
+		r.updateNode(n.Node, n.Filters, true)
+	case routeActionRemove:
+		r.updateNode(n.Node, n.Filters, false)
+	case routeActionLeave:
+		glog.Infof("Node %s left cluster", n.Node)
+		r.removeNode(n.Node)
+	}
+}
+
+// syncNode replace all topic filters of node
+func (r *clusterRouter) syncNode(id string, filters []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	node := r.node(id)
+	current := make(map[string]bool)
+	for _, filter := range filters {
+		current[filter] = true
+		if !node.filters[filter] {
+			node.filters[filter] = true
+			r.addRoute(filter, id)
+		}
+	}
+	for filter := range node.filters {
+		if !current[filter] {
+			delete(node.filters, filter)
+			r.removeRoute(filter, id)
+		}
+	}
+}
+
+// updateNode add or remove topic filters of node
+func (r *clusterRouter) updateNode(id string, filters []string, subscribed bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	node := r.node(id)
+	for _, filter := range filters {
+		if subscribed && !node.filters[filter] {
+			node.filters[filter] = true
+			r.addRoute(filter, id)
+		} else if !subscribed && node.filters[filter] {
+			delete(node.filters, filter)
+			r.removeRoute(filter, id)
+		}
+	}
+}
+
+// addRoute add topic filter or shared subscription of node into routes
+func (r *clusterRouter) addRoute(filter string, id string) {
+	if group, topic, ok := parseSharedSubscription(filter); ok {
+		r.routes.subscribeShared(topic, group, id, 0, 0)
+	} else {
+		r.routes.subscribe(filter, id, 0, 0)
+	}
+}
+
+// removeRoute remove topic filter or shared subscription of node from routes
+func (r *clusterRouter) removeRoute(filter string, id string) {
+	if group, topic, ok := parseSharedSubscription(filter); ok {
+		r.routes.unsubscribeShared(topic, group, id)
+	} else {
+		r.routes.unsubscribe(filter, id)
+	}
+}
+
+// node return peer node and refresh its last seen time, the caller must
+// hold lock
+func (r *clusterRouter) node(id string) *clusterNode {
+	node, ok := r.nodes[id]
+	if !ok {
+		node = &clusterNode{filters: make(map[string]bool)}
+		r.nodes[id] = node
+	}
+	node.lastSeen = time.Now()
+	return node
+}
+
+// removeNode remove peer node and its routes
+func (r *clusterRouter) removeNode(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if node, ok := r.nodes[id]; ok {
+		for filter := range node.filters {
+			r.removeRoute(filter, id)
+		}
+		delete(r.nodes, id)
+	}
+}
+
+// handleForwardNotify deliver message forwarded by peer to local
+// subscribers, it is not forwarded again. Shared subscription groups are
+// only dispatched if they are owned by this node
+func (r *clusterRouter) handleForwardNotify(n *forwardNotify) {
+	for _, target := range n.Targets {
+		if target != nodeID {
+			continue
+		}
+		msg := n.Message
+		if msg.Retain {
+			if err := r.storage.StoreRetainMessage(msg.Topic, msg); err != nil {
+				glog.Errorf("Failed to store retained message forwarded from %s:%s", n.Node, err)
+			}
+		}
+		if err := r.storage.QueueMessage(msg.SourceID, msg); err != nil {
+			glog.Errorf("Failed to deliver message forwarded from %s:%s", n.Node, err)
+		}
+		return
+	}
+}
+
+// matchNodes return peer nodes which have topic filters matched with topic
+// or own shared subscription groups matched with topic
+func (r *clusterRouter) matchNodes(topic string) []string {
+	subs, groups := r.routes.match(topic)
+	matched := make(map[string]bool)
+	for _, sub := range subs {
+		matched[sub.sessionid] = true
+	}
+	for _, g := range groups {
+		if owner := r.shareOwner(g.subscription(), g.sessions()); owner != nodeID {
+			matched[owner] = true
+		}
+	}
+	nodes := make([]string, 0, len(matched))
+	for id := range matched {
+		nodes = append(nodes, id)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// ownShare check wether shared subscription group is dispatched on this
+// node, it is called by storage before message is sent to group member
+func (r *clusterRouter) ownShare(share string) bool {
+	if !r.enabled {
+		return true
+	}
+	peers := []string{}
+	if group, filter, ok := parseSharedSubscription(share); ok {
+		if g := r.routes.sharedGroup(filter, group); g != nil {
+			peers = g.sessions()
+		}
+	}
+	return r.shareOwner(share, peers) == nodeID
+}
+
+// shareOwner select node which dispatch message to shared subscription
+// group among nodes with members, the same node is selected by all nodes
+// as long as they have the same routes
+func (r *clusterRouter) shareOwner(share string, peers []string) string {
+	nodes := append([]string{}, peers...)
+	r.mutex.Lock()
+	if r.local[share] > 0 {
+		nodes = append(nodes, nodeID)
+	}
+	r.mutex.Unlock()
+	if len(nodes) == 0 {
+		return nodeID
+	}
+	sort.Strings(nodes)
+	h := fnv.New32a()
+	h.Write([]byte(share))
+	return nodes[h.Sum32()%uint32(len(nodes))]
+}
+
+// forward send message published on this node to peers with matched
+// subscriptions, retained message is sent to all peers to be stored. False
+// is returned if message is dropped
+func (r *clusterRouter) forward(msg StorageMessage) bool {
+	if !r.enabled {
+		return true
+	}
+	targets := []string{}
+	if msg.Retain {
+		r.mutex.Lock()
+		for id := range r.nodes {
+			targets = append(targets, id)
+		}
+		r.mutex.Unlock()
+	} else {
+		targets = r.matchNodes(msg.Topic)
+	}
+	if len(targets) > 0 {
+		return r.produce(r.messageTopic, &forwardNotify{Node: nodeID, Targets: targets, Message: msg})
+	}
+	return true
+}
+
+// peers return id of peer nodes known by router
+func (r *clusterRouter) peers() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	ids := make([]string, 0, len(r.nodes))
+	for id := range r.nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// getRoutes return route table of cluster, which map topic filters to
+// nodes subscribing them
+func (r *clusterRouter) getRoutes() map[string][]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	routes := make(map[string][]string)
+	for filter := range r.local {
+		routes[filter] = append(routes[filter], nodeID)
+	}
+	for id, node := range r.nodes {
+		for filter := range node.filters {
+			routes[filter] = append(routes[filter], id)
+		}
+	}
+	for _, nodes := range routes {
+		sort.Strings(nodes)
+	}
+	return routes
+}
+
+// getRoute return nodes which message published on topic is routed to
+func (r *clusterRouter) getRoute(topic string) []string {
+	nodes := r.matchNodes(topic)
+	if len(r.storage.MatchSubscribers(topic)) > 0 {
+		nodes = append(nodes, nodeID)
+		sort.Strings(nodes)
+	}
+	return nodes
+}
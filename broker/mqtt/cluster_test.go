@@ -0,0 +1,88 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestClusterRouter create router of node id with local subscriptions
+// and routes synchronized from peers
+func newTestClusterRouter(id string, subscriptions map[string][]string) *clusterRouter {
+	r := &clusterRouter{
+		enabled: true,
+		local:   make(map[string]int),
+		nodes:   make(map[string]*clusterNode),
+		routes:  newTopicTree(),
+	}
+	for node, filters := range subscriptions {
+		if node == id {
+			for _, filter := range filters {
+				r.local[filter]++
+			}
+		} else {
+			r.syncNode(node, filters)
+		}
+	}
+	return r
+}
+
+func TestClusterShareOwner(t *testing.T) {
+	defer func(id string) { nodeID = id }(nodeID)
+	subscriptions := map[string][]string{
+		"node-1": {"$share/g/a/+", "$share/h/a/b"},
+		"node-2": {"$share/g/a/+", "$share/h/a/b"},
+		"node-3": {"a/b", "$share/h/a/b"},
+		"node-4": {},
+	}
+	shares := []string{"$share/g/a/+", "$share/h/a/b"}
+	owners := map[string]string{}
+	targets := map[string]string{}
+	for id := range subscriptions {
+		nodeID = id
+		r := newTestClusterRouter(id, subscriptions)
+		targets[id] = strings.Join(r.matchNodes("a/b"), ",")
+		for _, share := range shares {
+			if !r.ownShare(share) {
+				continue
+			}
+			if owner, ok := owners[share]; ok {
+				t.Errorf("'%s' is owned by %s and %s", share, owner, id)
+			}
+			owners[share] = id
+		}
+	}
+	if owner := owners["$share/g/a/+"]; owner != "node-1" && owner != "node-2" {
+		t.Errorf("'$share/g/a/+' is owned by '%s' without member", owner)
+	}
+	if owners["$share/h/a/b"] == "" {
+		t.Errorf("'$share/h/a/b' is not owned by any node")
+	}
+	// Message is forwarded to owners of groups and subscribers of plain
+	// filters by every other node
+	for id, nodes := range targets {
+		want := []string{"node-3"}
+		for _, share := range shares {
+			want = append(want, owners[share])
+		}
+		for _, node := range want {
+			if node != id && !strings.Contains(nodes, node) {
+				t.Errorf("%s: matchNodes('a/b') = %s, %s is missed", id, nodes, node)
+			}
+		}
+		if strings.Contains(nodes, id) {
+			t.Errorf("%s: matchNodes('a/b') = %s, include itself", id, nodes)
+		}
+	}
+}
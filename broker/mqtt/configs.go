@@ -13,10 +13,22 @@
 package mqtt
 
 var Configs = map[string]string{
-	"bind_address":       "localhost:1883",
-	"max_connections":    "1000",
-	"loglevel":           "debug",
-	"message_size_limit": "500",
-	"allow_anonymous":    "true",
-	"session_queue_size": "20",
+	"bind_address":               "localhost:1883",
+	"max_connections":            "1000",
+	"loglevel":                   "debug",
+	"message_size_limit":         "500",
+	"allow_anonymous":            "true",
+	"session_queue_size":         "20",
+	"max_inflight_messages":      "20",
+	"retry_interval":             "20",
+	"connect_timeout":            "30",
+	"max_topic_alias":            "10",
+	"allow_zero_length_clientid": "true",
+	"websocket_path":             "/mqtt",
+	"websocket_origins":          "",
+	"sys_admin_users":            "admin",
+	"max_queued_messages":        "1000",
+	"max_queued_bytes":           "0",
+	"queue_drop_policy":          "oldest",
+	"session_transfer_timeout":   "3",
 }
@@ -0,0 +1,512 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+const (
+	diskSnapshotFile   = "snapshot.json"
+	diskJournalPrefix  = "journal."
+	diskRecordHeadSize = 8 // Record length and crc32 checksum
+)
+
+// diskStorage keep all data in memory as local storage, and record every
+// change in append-only journal. Journal is compacted into snapshot
+// periodically or when it grows too large, the broker is recovered from
+// snapshot and journals after restart
+type diskStorage struct {
+	*localStorage
+	path             string
+	syncWrites       bool
+	snapshotInterval time.Duration
+	compactSize      int64
+	journalMutex     sync.Mutex
+	journal          *os.File
+	journalSeq       uint64
+	journalSize      int64
+	snapshotMutex    sync.Mutex
+	compact          chan bool
+	quit             chan bool
+	waitgroup        sync.WaitGroup
+}
+
+// diskSnapshot is full image of storage, journals whose sequence is less
+// than Seq are included in it
+type diskSnapshot struct {
+	Seq           uint64                      `json:"seq"`
+	LastID        uint                        `json:"lastid"`
+	Sessions      []StorageSession            `json:"sessions"`
+	Subscriptions []storageRecord             `json:"subscriptions"`
+	Retained      []storageRecord             `json:"retained"`
+	Messages      map[string][]StorageMessage `json:"messages"`
+}
+
+// Open restore data from disk and start journal
+func (d *diskStorage) Open() error {
+	glog.Infof("disk storage Open in '%s'", d.path)
+	if err := os.MkdirAll(d.path, 0755); err != nil {
+		return err
+	}
+	if err := d.Restore(); err != nil {
+		return err
+	}
+	d.localStorage.journal = d.appendRecord
+	// Compact journals left by last run
+	if err := d.Backup(false); err != nil {
+		return err
+	}
+	d.waitgroup.Add(1)
+	go d.compactLoop()
+	return nil
+}
+
+// Close write the last snapshot and close journal
+func (d *diskStorage) Close() {
+	close(d.quit)
+	d.waitgroup.Wait()
+	if err := d.Backup(true); err != nil {
+		glog.Errorf("Failed to backup disk storage:%s", err)
+	}
+}
+
+// compactLoop write snapshot periodically or when journal is too large
+func (d *diskStorage) compactLoop() {
+	defer d.waitgroup.Done()
+	ticker := time.NewTicker(d.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.compact:
+		case <-d.quit:
+			return
+		}
+		if err := d.Backup(false); err != nil {
+			glog.Errorf("Failed to backup disk storage:%s", err)
+		}
+	}
+}
+
+// appendRecord write record into journal
+func (d *diskStorage) appendRecord(r *storageRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Failed to encode storage record:%s", err)
+		return
+	}
+	buf := make([]byte, diskRecordHeadSize+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[diskRecordHeadSize:], data)
+
+	d.journalMutex.Lock()
+	defer d.journalMutex.Unlock()
+	if d.journal == nil {
+		glog.Errorf("Journal is closed, '%s' record is lost", r.Op)
+		return
+	}
+	if _, err := d.journal.Write(buf); err != nil {
+		glog.Errorf("Failed to write journal:%s", err)
+		return
+	}
+	if d.syncWrites {
+		d.journal.Sync()
+	}
+	d.journalSize += int64(len(buf))
+	if d.compactSize > 0 && d.journalSize > d.compactSize {
+		select {
+		case d.compact <- true:
+		default:
+		}
+	}
+}
+
+// journalPath return file path of journal with sequence
+func (d *diskStorage) journalPath(seq uint64) string {
+	return filepath.Join(d.path, fmt.Sprintf("%s%08d", diskJournalPrefix, seq))
+}
+
+// journalSeqs return sequences of journal files in ascending order
+func (d *diskStorage) journalSeqs() ([]uint64, error) {
+	files, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	seqs := []uint64{}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), diskJournalPrefix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimPrefix(f.Name(), diskJournalPrefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// rotateJournal switch to new journal file and return its sequence, changes
+// after rotation are not lost even if they are not in snapshot
+func (d *diskStorage) rotateJournal(shutdown bool) (uint64, error) {
+	d.journalMutex.Lock()
+	defer d.journalMutex.Unlock()
+	if d.journal != nil {
+		d.journal.Close()
+		d.journal = nil
+	}
+	d.journalSeq++
+	d.journalSize = 0
+	if shutdown {
+		return d.journalSeq, nil
+	}
+	f, err := os.OpenFile(d.journalPath(d.journalSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	d.journal = f
+	return d.journalSeq, nil
+}
+
+// Backup write snapshot and remove compacted journals, journal is closed
+// if broker is shutting down
+func (d *diskStorage) Backup(shutdown bool) error {
+	d.snapshotMutex.Lock()
+	defer d.snapshotMutex.Unlock()
+
+	seq, err := d.rotateJournal(shutdown)
+	if err != nil {
+		return err
+	}
+	snapshot := d.capture()
+	snapshot.Seq = seq
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(d.path, diskSnapshotFile), data); err != nil {
+		return err
+	}
+	seqs, err := d.journalSeqs()
+	if err != nil {
+		return err
+	}
+	for _, s := range seqs {
+		if s < seq {
+			os.Remove(d.journalPath(s))
+		}
+	}
+	glog.Infof("Disk storage snapshot(%d) is written", seq)
+	return nil
+}
+
+// capture collect persistent sessions, their subscriptions and messages,
+// and all retained messages
+func (d *diskStorage) capture() *diskSnapshot {
+	l := d.localStorage
+	snapshot := &diskSnapshot{
+		Sessions:      []StorageSession{},
+		Subscriptions: []storageRecord{},
+		Retained:      []storageRecord{},
+		Messages:      make(map[string][]StorageMessage),
+	}
+	clients := make(map[string]bool)
+	l.sessionMutex.RLock()
+	for id, s := range l.sessions {
+		if s.cleanSession == 0 {
+			clients[id] = true
+			snapshot.Sessions = append(snapshot.Sessions, s.storageSession())
+		}
+	}
+	for id, ss := range l.stored {
+		clients[id] = true
+		snapshot.Sessions = append(snapshot.Sessions, ss)
+	}
+	l.sessionMutex.RUnlock()
+
+	l.subMutex.Lock()
+	for id, topics := range l.subscriptions {
+		if !clients[id] {
+			continue
+		}
+		for topic, leaf := range topics {
+			snapshot.Subscriptions = append(snapshot.Subscriptions, storageRecord{
+				Op:      recordSubscribe,
+				Client:  id,
+				Topic:   topic,
+				Qos:     leaf.qos,
+				Options: leaf.options,
+			})
+		}
+	}
+	l.subMutex.Unlock()
+
+	l.tree.walkRetain(func(topic string, msg StorageMessage) {
+		m := msg
+		snapshot.Retained = append(snapshot.Retained, storageRecord{Op: recordRetain, Topic: topic, Message: &m})
+	})
+
+	l.messageMutex.Lock()
+	snapshot.LastID = l.lastID
+	for id := range l.messages {
+		if clients[id] {
+			snapshot.Messages[id] = l.queuedMessages(id)
+		}
+	}
+	l.messageMutex.Unlock()
+	return snapshot
+}
+
+// Restore load snapshot and replay journals written after it, broken
+// record at the tail of journal is truncated
+func (d *diskStorage) Restore() error {
+	snapshot := &diskSnapshot{}
+	data, err := ioutil.ReadFile(filepath.Join(d.path, diskSnapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return fmt.Errorf("Broken snapshot in '%s':%s", d.path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	d.applySnapshot(snapshot)
+
+	seqs, err := d.journalSeqs()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, seq := range seqs {
+		if seq < snapshot.Seq {
+			continue
+		}
+		n, err := d.replayJournal(seq, snapshot.LastID)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+	if len(seqs) > 0 && seqs[len(seqs)-1] > d.journalSeq {
+		d.journalSeq = seqs[len(seqs)-1]
+	}
+	d.dropUnpersistent()
+	glog.Infof("Disk storage is restored with %d sessions and %d journal records", len(d.stored), count)
+	return nil
+}
+
+// applySnapshot load snapshot into memory
+func (d *diskStorage) applySnapshot(snapshot *diskSnapshot) {
+	l := d.localStorage
+	d.journalSeq = snapshot.Seq
+	for _, ss := range snapshot.Sessions {
+		l.stored[ss.Id] = ss
+	}
+	for _, r := range snapshot.Subscriptions {
+		l.AddSubscription(r.Client, r.Topic, r.Qos, r.Options)
+	}
+	for _, r := range snapshot.Retained {
+		if r.Message != nil {
+			l.StoreRetainMessage(r.Topic, *r.Message)
+		}
+	}
+	for id, msgs := range snapshot.Messages {
+		for _, msg := range msgs {
+			l.appendMessage(id, msg)
+		}
+	}
+	l.lastID = snapshot.LastID
+}
+
+// replayJournal apply records in journal, messages whose id is not greater
+// than lastID are already in snapshot
+func (d *diskStorage) replayJournal(seq uint64, lastID uint) (int, error) {
+	path := d.journalPath(seq)
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(f)
+	offset := int64(0)
+	count := 0
+	head := make([]byte, diskRecordHeadSize)
+	for {
+		if _, err := io.ReadFull(reader, head); err != nil {
+			if err != io.EOF {
+				glog.Warningf("Truncated record header in '%s' at %d", path, offset)
+				return count, f.Truncate(offset)
+			}
+			return count, nil
+		}
+		// Corrupted length must not allocate more than rest of the journal
+		length := int64(binary.BigEndian.Uint32(head[0:4]))
+		if length > info.Size()-offset-diskRecordHeadSize {
+			glog.Warningf("Invalid record length %d in '%s' at %d, journal is truncated", length, path, offset)
+			return count, f.Truncate(offset)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil || crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(head[4:8]) {
+			glog.Warningf("Broken record in '%s' at %d, journal is truncated", path, offset)
+			return count, f.Truncate(offset)
+		}
+		r := &storageRecord{}
+		if err := json.Unmarshal(data, r); err != nil {
+			glog.Warningf("Invalid record in '%s' at %d, journal is truncated", path, offset)
+			return count, f.Truncate(offset)
+		}
+		d.applyRecord(r, lastID)
+		offset += int64(diskRecordHeadSize + len(data))
+		count++
+	}
+}
+
+// applyRecord apply one journal record, records may already be included in
+// snapshot, so that applying must be idempotent
+func (d *diskStorage) applyRecord(r *storageRecord, lastID uint) {
+	l := d.localStorage
+	switch r.Op {
+	case recordSession:
+		if r.Session != nil {
+			l.stored[r.Client] = *r.Session
+		}
+	case recordDeleteSession:
+		l.DeleteSession(r.Client)
+	case recordSubscribe:
+		l.AddSubscription(r.Client, r.Topic, r.Qos, r.Options)
+	case recordUnsubscribe:
+		l.RemoveSubscription(r.Client, r.Topic)
+	case recordRetain:
+		if r.Message != nil {
+			l.StoreRetainMessage(r.Topic, *r.Message)
+		}
+	case recordDeleteRetain:
+		l.DeleteRetainMessage(r.Topic)
+	case recordStoreMessage:
+		if r.Message != nil && r.Message.ID > lastID {
+			l.appendMessage(r.Client, *r.Message)
+			if r.Message.ID > l.lastID {
+				l.lastID = r.Message.ID
+			}
+		}
+	case recordDeleteMessages:
+		ids := make(map[uint]bool)
+		for _, id := range r.IDs {
+			ids[id] = true
+		}
+		l.removeMessages(r.Client, func(msg StorageMessage) bool {
+			return !ids[msg.ID]
+		})
+	default:
+		glog.Warningf("Unknown storage record '%s'", r.Op)
+	}
+}
+
+// dropUnpersistent remove subscriptions and messages of clean sessions which
+// were connected when broker quit
+func (d *diskStorage) dropUnpersistent() {
+	l := d.localStorage
+	for id, topics := range l.subscriptions {
+		if _, ok := l.stored[id]; ok {
+			continue
+		}
+		for topic := range topics {
+			l.RemoveSubscription(id, topic)
+		}
+	}
+	for id := range l.messages {
+		if _, ok := l.stored[id]; !ok {
+			delete(l.messages, id)
+		}
+	}
+}
+
+// writeFileSync write file atomically through temporary file
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// diskStorageFactory
+type diskStorageFactory struct{}
+
+func (d *diskStorageFactory) New(c core.Config) (Storage, error) {
+	local, err := (&localStorageFactory{}).New(c)
+	if err != nil {
+		return nil, err
+	}
+	path, err := c.String("storage", "path")
+	if err != nil || path == "" {
+		return nil, errors.New("Path of disk storage is not set")
+	}
+	interval, err := c.Int("storage", "snapshot_interval")
+	if err != nil || interval <= 0 {
+		interval = 300
+	}
+	compactSize, err := c.Int("storage", "compact_size")
+	if err != nil || compactSize < 0 {
+		compactSize = 64 * 1024 * 1024
+	}
+	syncWrites, err := c.Bool("storage", "sync_writes")
+	if err != nil {
+		syncWrites = false
+	}
+	return &diskStorage{
+		localStorage:     local.(*localStorage),
+		path:             path,
+		syncWrites:       syncWrites,
+		snapshotInterval: time.Duration(interval) * time.Second,
+		compactSize:      int64(compactSize),
+		compact:          make(chan bool, 1),
+		quit:             make(chan bool),
+	}, nil
+}
@@ -0,0 +1,330 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testConfig is configurations of sections in memory
+type testConfig map[string]map[string]string
+
+func (c testConfig) String(section string, key string) (string, error) {
+	if val, ok := c[section][key]; ok {
+		return val, nil
+	}
+	return "", errors.New("Config item not found")
+}
+
+func (c testConfig) Int(section string, key string) (int, error) {
+	val, err := c.String(section, key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(val)
+}
+
+func (c testConfig) Bool(section string, key string) (bool, error) {
+	val, err := c.String(section, key)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(val)
+}
+
+func (c testConfig) MustString(section string, key string) string {
+	val, _ := c.String(section, key)
+	return val
+}
+
+func (c testConfig) MustInt(section string, key string) int {
+	val, _ := c.Int(section, key)
+	return val
+}
+
+func (c testConfig) MustBool(section string, key string) bool {
+	val, _ := c.Bool(section, key)
+	return val
+}
+
+func (c testConfig) SetValue(section string, key string, val string) {
+	if c[section] == nil {
+		c[section] = make(map[string]string)
+	}
+	c[section][key] = val
+}
+
+// openTestDiskStorage open disk storage in dir, snapshot is only written
+// when it is backed up explicitly
+func openTestDiskStorage(t *testing.T, dir string) *diskStorage {
+	c := testConfig{"storage": {
+		"path":              dir,
+		"snapshot_interval": "3600",
+		"compact_size":      "0",
+		"sync_writes":       "true",
+	}}
+	s, err := (&diskStorageFactory{}).New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return s.(*diskStorage)
+}
+
+// crashDiskStorage stop disk storage without the last snapshot, as if
+// broker is killed
+func crashDiskStorage(d *diskStorage) {
+	close(d.quit)
+	d.waitgroup.Wait()
+	d.journalMutex.Lock()
+	d.journal.Close()
+	d.journal = nil
+	d.journalMutex.Unlock()
+}
+
+// registerTestSession register connected session of client
+func registerTestSession(d *diskStorage, clientid string, cleanSession uint8) {
+	d.RegisterSession(&mqttSession{
+		clientID:     clientid,
+		username:     "user-" + clientid,
+		cleanSession: cleanSession,
+		mgr:          &mqtt{protocol: "mqtt:tcp"},
+	})
+}
+
+// storeTestMessages queue messages with payloads for client
+func storeTestMessages(d *diskStorage, clientid string, payloads ...string) {
+	for _, payload := range payloads {
+		d.StoreMessage(clientid, StorageMessage{Topic: "t", Qos: 1, Payload: []byte(payload)})
+	}
+}
+
+// diskState return persistent sessions, subscriptions, retained messages and
+// queued messages in storage in stable order
+func diskState(d *diskStorage) string {
+	snapshot := d.capture()
+	sessions := []string{}
+	for _, ss := range snapshot.Sessions {
+		sessions = append(sessions, ss.Id+":"+ss.Username)
+	}
+	sort.Strings(sessions)
+	subs := []string{}
+	for _, r := range snapshot.Subscriptions {
+		subs = append(subs, fmt.Sprintf("%s:%s:%d", r.Client, r.Topic, r.Qos))
+	}
+	sort.Strings(subs)
+	retained := []string{}
+	for _, r := range snapshot.Retained {
+		retained = append(retained, r.Topic+":"+string(r.Message.Payload))
+	}
+	sort.Strings(retained)
+	clients := []string{}
+	for id := range snapshot.Messages {
+		clients = append(clients, id)
+	}
+	sort.Strings(clients)
+	msgs := []string{}
+	for _, id := range clients {
+		payloads := []string{}
+		for _, msg := range snapshot.Messages[id] {
+			payloads = append(payloads, string(msg.Payload))
+		}
+		msgs = append(msgs, id+":"+strings.Join(payloads, ","))
+	}
+	return fmt.Sprintf("sessions[%s] subscriptions[%s] retained[%s] messages[%s]",
+		strings.Join(sessions, " "), strings.Join(subs, " "), strings.Join(retained, " "), strings.Join(msgs, " "))
+}
+
+func TestDiskRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openTestDiskStorage(t, dir)
+	registerTestSession(d, "c1", 0)
+	registerTestSession(d, "c2", 0)
+	registerTestSession(d, "c3", 1)
+	d.AddSubscription("c1", "a/+", 1, 0)
+	d.AddSubscription("c1", "$share/g/b", 2, 0)
+	d.AddSubscription("c2", "x", 0, 0)
+	d.AddSubscription("c3", "y", 0, 0)
+	d.StoreRetainMessage("r/1", StorageMessage{Topic: "r/1", Payload: []byte("p1")})
+	d.StoreRetainMessage("r/2", StorageMessage{Topic: "r/2", Payload: []byte("p2")})
+	storeTestMessages(d, "c1", "m1", "m2", "m3")
+	storeTestMessages(d, "c2", "n1")
+	if err := d.Backup(false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes after snapshot are in journals
+	d.RemoveSubscription("c1", "a/+")
+	d.AddSubscription("c1", "c/#", 1, 0)
+	d.PopMessage("c1")
+	storeTestMessages(d, "c1", "m4")
+	d.DeleteRetainMessage("r/2")
+	d.StoreRetainMessage("r/3", StorageMessage{Topic: "r/3", Payload: []byte("p3")})
+	d.DeleteSession("c2")
+	if _, err := d.rotateJournal(false); err != nil {
+		t.Fatal(err)
+	}
+	storeTestMessages(d, "c1", "m5")
+	d.AddSubscription("c1", "d", 0, 0)
+	want := diskState(d)
+	// The last record is broken while it is written
+	storeTestMessages(d, "c1", "m6")
+	crashDiskStorage(d)
+	path := d.journalPath(d.journalSeq)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data[:len(data)-5], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d = openTestDiskStorage(t, dir)
+	if got := diskState(d); got != want {
+		t.Errorf("restored state is\n%s\nwant\n%s", got, want)
+	}
+	if _, err := d.FindStoredSession("c3"); err == nil {
+		t.Errorf("clean session is restored")
+	}
+	// Message id is not reused after restore
+	storeTestMessages(d, "c1", "m7")
+	ids := []uint{}
+	for _, msg := range d.queuedMessages("c1") {
+		ids = append(ids, msg.ID)
+	}
+	if n := len(ids); n < 2 || ids[n-1] <= ids[n-2] {
+		t.Errorf("message ids after restore = %v", ids)
+	}
+	want = diskState(d)
+	crashDiskStorage(d)
+
+	// Journal truncated in last restore is appended and restored again
+	d = openTestDiskStorage(t, dir)
+	defer d.Close()
+	if got := diskState(d); got != want {
+		t.Errorf("state restored again is\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDiskRestoreRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openTestDiskStorage(t, dir)
+	registerTestSession(d, "c1", 0)
+	registerTestSession(d, "c2", 0)
+	d.AddSubscription("c1", "a", 1, 0)
+	storeTestMessages(d, "c1", "m1", "m2")
+	storeTestMessages(d, "c2", "n1")
+
+	// Changes made after journal is rotated and before snapshot is
+	// captured are in both of them, replaying them must be idempotent
+	seq, err := d.rotateJournal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.PopMessage("c1")
+	storeTestMessages(d, "c1", "m3")
+	d.RemoveSubscription("c1", "a")
+	d.AddSubscription("c1", "b", 2, 0)
+	d.StoreRetainMessage("r", StorageMessage{Topic: "r", Payload: []byte("p")})
+	d.DeleteSession("c2")
+	snapshot := d.capture()
+	snapshot.Seq = seq
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileSync(filepath.Join(dir, diskSnapshotFile), data); err != nil {
+		t.Fatal(err)
+	}
+	// Changes after snapshot is captured
+	storeTestMessages(d, "c1", "m4")
+	d.DeleteRetainMessage("r")
+	want := diskState(d)
+	crashDiskStorage(d)
+
+	d = openTestDiskStorage(t, dir)
+	if got := diskState(d); got != want {
+		t.Errorf("restored state is\n%s\nwant\n%s", got, want)
+	}
+	d.Close()
+}
+
+func TestDiskBackupConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openTestDiskStorage(t, dir)
+	clients := []string{"c1", "c2", "c3"}
+	for _, id := range clients {
+		registerTestSession(d, id, 0)
+	}
+	var wg sync.WaitGroup
+	for _, id := range clients {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				storeTestMessages(d, id, fmt.Sprintf("%s-%d", id, i))
+				if i%3 == 0 {
+					d.PopMessage(id)
+				}
+				topic := fmt.Sprintf("%s/%d", id, i%5)
+				if i%2 == 0 {
+					d.AddSubscription(id, topic, 1, 0)
+				} else {
+					d.RemoveSubscription(id, topic)
+				}
+				d.StoreRetainMessage(topic, StorageMessage{Topic: topic, Payload: []byte(strconv.Itoa(i))})
+			}
+		}(id)
+	}
+	for i := 0; i < 20; i++ {
+		if err := d.Backup(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+	want := diskState(d)
+	crashDiskStorage(d)
+
+	d = openTestDiskStorage(t, dir)
+	defer d.Close()
+	if got := diskState(d); got != want {
+		t.Errorf("restored state is\n%s\nwant\n%s", got, want)
+	}
+}
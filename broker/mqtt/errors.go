@@ -12,7 +12,10 @@
 
 package mqtt
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	mqttErrorInvalidProtocol = errors.New("Invalid protocol")
@@ -25,3 +28,31 @@ var (
 	mqttErrorAutoFailed      = errors.New("Auth failed")
 	mqttErrorUnkown          = errors.New("Unknown error")
 )
+
+// mqttReasonError is error with reason code which is sent to MQTT v5 client
+// in DISCONNECT packet
+type mqttReasonError struct {
+	reason uint8
+	msg    string
+}
+
+func newReasonError(reason uint8, format string, args ...interface{}) error {
+	return &mqttReasonError{reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *mqttReasonError) Error() string { return e.msg }
+
+// reasonCodeOfError return reason code for error
+func reasonCodeOfError(err error) uint8 {
+	switch e := err.(type) {
+	case *mqttReasonError:
+		return e.reason
+	}
+	switch err {
+	case mqttErrorInvalidProtocol:
+		return REASON_PROTOCOL_ERROR
+	case mqttErrorAutoFailed:
+		return REASON_NOT_AUTHORIZED
+	}
+	return REASON_UNSPECIFIED_ERROR
+}
@@ -0,0 +1,101 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cloustone/sentel/core"
+)
+
+// Message is message exchanged with services of other protocols through
+// gateway
+type Message struct {
+	Topic   string
+	Qos     uint8
+	Retain  bool
+	Payload []uint8
+}
+
+// Gateway let services of other protocols share routing with mqtt, their
+// clients publish and subscribe topics as mqtt clients do
+type Gateway struct {
+	storage Storage
+	cluster *clusterRouter
+}
+
+// GetGateway return gateway on storage shared by all mqtt services
+func GetGateway(c core.Config) (*Gateway, error) {
+	s, err := getSharedStorage(c.MustString("storage", "name"), c)
+	if err != nil {
+		return nil, errors.New("Failed to create storage in gateway")
+	}
+	return &Gateway{storage: s, cluster: getClusterRouter(c, s)}, nil
+}
+
+// Publish route message published by client to subscribers of all protocols
+func (g *Gateway) Publish(clientid string, msg *Message) error {
+	if err := checkPublishTopic(msg.Topic); err != nil {
+		return err
+	}
+	return dispatchMessage(g.storage, g.cluster, StorageMessage{
+		SourceID:  clientid,
+		Topic:     msg.Topic,
+		Direction: MessageDirectionIn,
+		Qos:       msg.Qos,
+		Retain:    msg.Retain,
+		Payload:   msg.Payload,
+	})
+}
+
+// Subscribe subscribe topic filter for client, messages matched with the
+// filter are passed to fn, each client has only one receiver
+func (g *Gateway) Subscribe(clientid string, filter string, qos uint8, fn func(msg *Message)) error {
+	if _, _, ok := parseSharedSubscription(filter); ok {
+		return fmt.Errorf("Shared subscription '%s' is not supported in gateway", filter)
+	}
+	if err := checkTopicFilter(filter); err != nil {
+		return err
+	}
+	g.storage.AddReceiver(clientid, func(msg StorageMessage) {
+		fn(&Message{Topic: msg.Topic, Qos: msg.Qos, Retain: msg.Retain, Payload: msg.Payload})
+	})
+	return g.storage.AddSubscription(clientid, filter, qos, 0)
+}
+
+// RemoveSubscription remove subscription on topic filter of client
+func (g *Gateway) RemoveSubscription(clientid string, filter string) error {
+	return g.storage.RemoveSubscription(clientid, filter)
+}
+
+// Unsubscribe remove all subscriptions and receiver of client
+func (g *Gateway) Unsubscribe(clientid string) {
+	g.storage.RemoveReceiver(clientid)
+}
+
+// RetainedMessages return retained messages matched with topic filter
+func (g *Gateway) RetainedMessages(filter string) []*Message {
+	msgs := []*Message{}
+	for _, msg := range g.storage.FindRetainMessages(filter) {
+		if !msg.Expired() {
+			msgs = append(msgs, &Message{Topic: msg.Topic, Qos: msg.Qos, Retain: true, Payload: msg.Payload})
+		}
+	}
+	return msgs
+}
+
+// DeleteRetainedMessage clear retained message on topic
+func (g *Gateway) DeleteRetainedMessage(topic string) error {
+	return g.storage.DeleteRetainMessage(topic)
+}
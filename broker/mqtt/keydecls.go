@@ -46,6 +46,7 @@ const (
 	metricBytesReceived         = "bytes/recevied"
 	metricBytesSent             = "bytes/sent"
 	metricMessageDroped         = "messages/droped"
+	metricClusterDropped        = "cluster/dropped"
 	metricMessageQos0Recevied   = "messages/qos0/received"
 	metricMessageQos0Sent       = "messages/qos0/sent"
 	metricMessageQos1Received   = "messages/qos1/recevied"
@@ -13,28 +13,43 @@
 package mqtt
 
 import (
+	"encoding/json"
 	"errors"
-	"strings"
+	"fmt"
+	"sync"
 
+	"github.com/cloustone/sentel/broker/queue"
 	"github.com/cloustone/sentel/core"
 	"github.com/golang/glog"
 )
 
-type subLeaf struct {
-	qos uint8
-}
-
-type subNode struct {
-	level     string
-	children  map[string]*subNode
-	subs      map[string]*subLeaf
-	retainMsg *StorageMessage
+type localStorage struct {
+	config        core.Config
+	sessions      map[string]*mqttSession
+	sessionMutex  sync.RWMutex
+	tree          *topicTree
+	strategy      string                        // Strategy for shared subscription
+	stored        map[string]StorageSession     // Persistent sessions restored without connection
+	subscriptions map[string]map[string]subLeaf // Subscriptions of each client
+	subMutex      sync.Mutex
+	messages      map[string]queue.Queue // Offline message queue of each client
+	messageMutex  sync.Mutex
+	lastID        uint
+	journal       func(r *storageRecord) // Record changes for persistent backend
+	watcher       func(filter string, subscribed bool)
+	shareFilter   func(share string) bool             // Check wether shared group is dispatched on this node
+	receivers     map[string]func(msg StorageMessage) // Subscribers which are not mqtt sessions
+	receiverMutex sync.RWMutex
+	// Watchers of messages dropped for restored sessions, keyed by service
+	dropWatchers map[string]func(clientid string, msg StorageMessage, reason string)
+	offlineMutex sync.Mutex
 }
 
-type localStorage struct {
-	config   core.Config
-	sessions map[string]*mqttSession
-	root     subNode
+// record pass change to journal if storage is persistent
+func (l *localStorage) record(r *storageRecord) {
+	if l.journal != nil {
+		l.journal(r)
+	}
 }
 
 // Open local storage
@@ -61,48 +76,119 @@ func (l *localStorage) Restore() error {
 
 // FindSession find session by id
 func (l *localStorage) FindSession(id string) (*mqttSession, error) {
-	v, ok := l.sessions[id]
-	if !ok {
-		return nil, errors.New("Session id does not exist")
+	l.sessionMutex.RLock()
+	defer l.sessionMutex.RUnlock()
+	if v, ok := l.sessions[id]; ok {
+		return v, nil
 	}
+	return nil, errors.New("Session id does not exist")
+}
 
-	return v, nil
+// FindStoredSession find persistent session restored from backup, which is
+// not resumed by client yet
+func (l *localStorage) FindStoredSession(id string) (StorageSession, error) {
+	l.sessionMutex.RLock()
+	defer l.sessionMutex.RUnlock()
+	if ss, ok := l.stored[id]; ok {
+		return ss, nil
+	}
+	return StorageSession{}, errors.New("Session id does not exist")
 }
 
-// DeleteSession delete session by id
+// DeleteSession delete session by id, subscriptions and queued messages
+// of the session are also removed
 func (l *localStorage) DeleteSession(id string) error {
+	l.sessionMutex.Lock()
 	_, ok := l.sessions[id]
-	if !ok {
+	_, restored := l.stored[id]
+	if !ok && !restored {
+		l.sessionMutex.Unlock()
 		return errors.New("Session id does not exist")
 	}
-
 	delete(l.sessions, id)
+	delete(l.stored, id)
+	l.record(&storageRecord{Op: recordDeleteSession, Client: id})
+	l.sessionMutex.Unlock()
+
+	l.subMutex.Lock()
+	topics := l.subscriptions[id]
+	delete(l.subscriptions, id)
+	l.subMutex.Unlock()
+	for topic := range topics {
+		l.removeTreeSubscription(id, topic)
+	}
 
+	l.messageMutex.Lock()
+	delete(l.messages, id)
+	l.messageMutex.Unlock()
 	return nil
 }
 
 // UpdateSession update session
 func (l *localStorage) UpdateSession(s *mqttSession) error {
-	_, ok := l.sessions[s.id]
-	if !ok {
+	l.sessionMutex.Lock()
+	defer l.sessionMutex.Unlock()
+	_, ok := l.sessions[s.clientID]
+	_, restored := l.stored[s.clientID]
+	if !ok && !restored {
 		return errors.New("Session id does not exist")
 	}
 
-	l.sessions[s.id] = s
+	l.sessions[s.clientID] = s
+	delete(l.stored, s.clientID)
+	l.recordSession(s)
 	return nil
 }
 
 // RegisterSession register new session
 func (l *localStorage) RegisterSession(s *mqttSession) error {
-	if _, ok := l.sessions[s.id]; ok {
+	l.sessionMutex.Lock()
+	defer l.sessionMutex.Unlock()
+	if _, ok := l.sessions[s.clientID]; ok {
 		return errors.New("Session id already exists")
 	}
 
-	glog.Infof("RegisterSession: id is %s", s.id)
-	l.sessions[s.id] = s
+	glog.Infof("RegisterSession: id is %s", s.clientID)
+	l.sessions[s.clientID] = s
+	l.recordSession(s)
 	return nil
 }
 
+// WalkSessions call fn for each session
+func (l *localStorage) WalkSessions(fn func(s *mqttSession)) {
+	l.sessionMutex.RLock()
+	sessions := make([]*mqttSession, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.sessionMutex.RUnlock()
+	for _, s := range sessions {
+		fn(s)
+	}
+}
+
+// WalkStoredSessions call fn for each session restored from backup without
+// connection
+func (l *localStorage) WalkStoredSessions(fn func(ss StorageSession)) {
+	l.sessionMutex.RLock()
+	stored := make([]StorageSession, 0, len(l.stored))
+	for _, ss := range l.stored {
+		stored = append(stored, ss)
+	}
+	l.sessionMutex.RUnlock()
+	for _, ss := range stored {
+		fn(ss)
+	}
+}
+
+// recordSession record persistent session, the caller must hold lock
+func (l *localStorage) recordSession(s *mqttSession) {
+	if s.cleanSession == 0 {
+		ss := s.storageSession()
+		l.record(&storageRecord{Op: recordSession, Client: s.clientID, Session: &ss})
+	}
+}
+
 // Device
 // AddDevice
 // func (l *localStorage) AddDevice(d Device) error {
@@ -154,149 +240,490 @@ func (l *localStorage) RegisterSession(s *mqttSession) error {
 // 	return nil, nil
 // }
 
-func (l *localStorage) findNode(node *subNode, lev string) *subNode {
-	for k, v := range node.children {
-		if k == lev {
-			return v
-		}
+// Subscription
+func (l *localStorage) AddSubscription(sessionid string, topic string, qos uint8, options uint8) error {
+	glog.Infof("AddSubscription: sessionid is %s, topic is %s, qos is %d", sessionid, topic, qos)
+	l.subMutex.Lock()
+	if _, ok := l.subscriptions[sessionid]; !ok {
+		l.subscriptions[sessionid] = make(map[string]subLeaf)
 	}
+	l.subscriptions[sessionid][topic] = subLeaf{qos: qos, options: options}
+	l.record(&storageRecord{Op: recordSubscribe, Client: sessionid, Topic: topic, Qos: qos, Options: options})
+	l.subMutex.Unlock()
 
-	return nil
-}
-
-func (l *localStorage) addNode(node *subNode, lev string) *subNode {
-	for k, v := range node.children {
-		if k == lev {
-			return v
+	if group, filter, ok := parseSharedSubscription(topic); ok {
+		if l.tree.subscribeShared(filter, group, sessionid, qos, options) {
+			l.notifyWatcher(topic, true)
 		}
+		return nil
 	}
-
-	tmp := &subNode{
-		level:    lev,
-		children: make(map[string]*subNode),
-		subs:     make(map[string]*subLeaf),
+	if l.tree.subscribe(topic, sessionid, qos, options) {
+		l.notifyWatcher(topic, true)
 	}
+	return nil
+}
 
-	node.children[lev] = tmp
+// WatchSubscriptions set watcher called when subscription on topic filter
+// is added or removed, member of shared group is watched with its shared
+// subscription
+func (l *localStorage) WatchSubscriptions(fn func(filter string, subscribed bool)) {
+	l.subMutex.Lock()
+	defer l.subMutex.Unlock()
+	l.watcher = fn
+}
 
-	return tmp
+// SetShareFilter set filter called before message is dispatched to shared
+// subscription group, the group is skipped if filter return false
+func (l *localStorage) SetShareFilter(fn func(share string) bool) {
+	l.subMutex.Lock()
+	defer l.subMutex.Unlock()
+	l.shareFilter = fn
 }
 
-// Subscription
-func (l *localStorage) AddSubscription(sessionid string, topic string, qos uint8) error {
-	glog.Infof("AddSubscription: sessionid is %s, topic is %s, qos is %d", sessionid, topic, qos)
-	node := &l.root
-	s := strings.Split(topic, "/")
-	for _, level := range s {
-		glog.Infof("AddSubscription: level is %s", level)
-		node = l.addNode(node, level)
+func (l *localStorage) notifyWatcher(filter string, subscribed bool) {
+	l.subMutex.Lock()
+	watcher := l.watcher
+	l.subMutex.Unlock()
+	if watcher != nil {
+		watcher(filter, subscribed)
 	}
+}
 
-	glog.Infof("AddSubscription: session id is %s", sessionid)
-	node.subs[sessionid] = &subLeaf{
-		qos: qos,
+// ExistSubscription check wether the session has subscribed the topic
+func (l *localStorage) ExistSubscription(sessionid string, topic string) bool {
+	if group, filter, ok := parseSharedSubscription(topic); ok {
+		g := l.tree.sharedGroup(filter, group)
+		return g != nil && g.exist(sessionid)
 	}
+	return l.tree.exist(topic, sessionid)
+}
 
-	return nil
+// WalkSessionSubscriptions call fn for each subscription of the session
+func (l *localStorage) WalkSessionSubscriptions(sessionid string, fn func(topic string, qos uint8, options uint8)) {
+	l.subMutex.Lock()
+	leafs := make(map[string]subLeaf, len(l.subscriptions[sessionid]))
+	for topic, leaf := range l.subscriptions[sessionid] {
+		leafs[topic] = leaf
+	}
+	l.subMutex.Unlock()
+	for topic, leaf := range leafs {
+		fn(topic, leaf.qos, leaf.options)
+	}
 }
 
-// RetainSubscription process RETAIN flag；
+// GetSubscriptionCount return subscription count of the session
+func (l *localStorage) GetSubscriptionCount(sessionid string) int {
+	l.subMutex.Lock()
+	defer l.subMutex.Unlock()
+	return len(l.subscriptions[sessionid])
+}
+
+// RetainSubscription deliver retained messages matched with new subscription
 func (l *localStorage) RetainSubscription(sessionid string, topic string, qos uint8) error {
+	s, err := l.FindSession(sessionid)
+	if err != nil {
+		return err
+	}
+	for _, msg := range l.FindRetainMessages(topic) {
+		if msg.Expired() {
+			continue
+		}
+		if err := s.sendPublish(qos, &msg, true); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// WalkSubscriptions call fn for each topic filter with subscriber count
+func (l *localStorage) WalkSubscriptions(fn func(topic string, count int)) {
+	l.tree.walk(fn)
+}
+
+// WalkClientSubscriptions call fn for each subscription of each client
+func (l *localStorage) WalkClientSubscriptions(fn func(sessionid string, topic string, qos uint8)) {
+	l.subMutex.Lock()
+	type clientSubscription struct {
+		sessionid string
+		topic     string
+		qos       uint8
+	}
+	subs := []clientSubscription{}
+	for sessionid, topics := range l.subscriptions {
+		for topic, leaf := range topics {
+			subs = append(subs, clientSubscription{sessionid, topic, leaf.qos})
+		}
+	}
+	l.subMutex.Unlock()
+	for _, sub := range subs {
+		fn(sub.sessionid, sub.topic, sub.qos)
+	}
+}
+
+// MatchSubscribers return id of sessions whose subscriptions match topic,
+// members of shared subscription groups are included
+func (l *localStorage) MatchSubscribers(topic string) []string {
+	subs, groups := l.tree.match(topic)
+	found := make(map[string]bool)
+	ids := []string{}
+	add := func(id string) {
+		if !found[id] {
+			found[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, sub := range subs {
+		add(sub.sessionid)
+	}
+	for _, g := range groups {
+		for _, id := range g.sessions() {
+			add(id)
+		}
+	}
+	return ids
+}
+
 func (l *localStorage) RemoveSubscription(sessionid string, topic string) error {
-	node := &l.root
-	s := strings.Split(topic, "/")
-	for _, level := range s {
-		node = l.findNode(node, level)
-		if node == nil {
-			return nil
+	l.subMutex.Lock()
+	if topics, ok := l.subscriptions[sessionid]; ok {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(l.subscriptions, sessionid)
 		}
 	}
+	l.record(&storageRecord{Op: recordUnsubscribe, Client: sessionid, Topic: topic})
+	l.subMutex.Unlock()
+	l.removeTreeSubscription(sessionid, topic)
+	return nil
+}
 
-	if _, ok := node.subs[sessionid]; ok {
-		delete(node.subs, sessionid)
+// removeTreeSubscription remove session's subscription from topic tree
+func (l *localStorage) removeTreeSubscription(sessionid string, topic string) {
+	if group, filter, ok := parseSharedSubscription(topic); ok {
+		if l.tree.unsubscribeShared(filter, group, sessionid) {
+			l.notifyWatcher(topic, false)
+		}
+		return
+	}
+	if l.tree.unsubscribe(topic, sessionid) {
+		l.notifyWatcher(topic, false)
 	}
+}
 
+// StoreRetainMessage store retained message for topic, the retained message
+// is cleared if the payload is empty
+func (l *localStorage) StoreRetainMessage(topic string, msg StorageMessage) error {
+	l.tree.storeRetain(topic, msg)
+	l.record(&storageRecord{Op: recordRetain, Topic: topic, Message: &msg})
 	return nil
 }
 
+// DeleteRetainMessage clear retained message for topic
+func (l *localStorage) DeleteRetainMessage(topic string) error {
+	l.tree.deleteRetain(topic)
+	l.record(&storageRecord{Op: recordDeleteRetain, Topic: topic})
+	return nil
+}
+
+// FindRetainMessages return retained messages matched with subscription
+func (l *localStorage) FindRetainMessages(subscription string) []StorageMessage {
+	return l.tree.findRetain(subscription)
+}
+
+// GetRetainMessageCount return retained message count
+func (l *localStorage) GetRetainMessageCount() int {
+	return l.tree.retainedCount()
+}
+
+// WalkRetainMessages call fn for each retained message
+func (l *localStorage) WalkRetainMessages(fn func(topic string, msg StorageMessage)) {
+	l.tree.walkRetain(fn)
+}
+
 // Message Management
 func (l *localStorage) FindMessage(clientid string, mid uint16) (bool, error) {
 	return false, nil
 }
 
+// StoreMessage append message to client's offline queue
 func (l *localStorage) StoreMessage(clientid string, msg StorageMessage) error {
+	l.messageMutex.Lock()
+	defer l.messageMutex.Unlock()
+	l.lastID++
+	msg.ID = l.lastID
+	if err := l.appendMessage(clientid, msg); err != nil {
+		return err
+	}
+	l.record(&storageRecord{Op: recordStoreMessage, Client: clientid, Message: &msg})
 	return nil
 }
 
+// PopMessage remove and return the oldest message in client's offline queue
+func (l *localStorage) PopMessage(clientid string) (StorageMessage, error) {
+	l.messageMutex.Lock()
+	defer l.messageMutex.Unlock()
+	q, ok := l.messages[clientid]
+	if !ok {
+		return StorageMessage{}, mqttErrorNotFound
+	}
+	qmsg, err := q.Pop()
+	if err != nil {
+		return StorageMessage{}, mqttErrorNotFound
+	}
+	q.Ack(qmsg.Seq)
+	if q.Len() == 0 {
+		delete(l.messages, clientid)
+	}
+	msg := StorageMessage{}
+	if err := json.Unmarshal(qmsg.Data, &msg); err != nil {
+		return StorageMessage{}, err
+	}
+	l.record(&storageRecord{Op: recordDeleteMessages, Client: clientid, IDs: []uint{msg.ID}})
+	return msg, nil
+}
+
+// DeleteMessageWithValidator remove queued messages which are not accepted
+// by validator
 func (l *localStorage) DeleteMessageWithValidator(clientid string, validator func(msg StorageMessage) bool) {
+	l.messageMutex.Lock()
+	defer l.messageMutex.Unlock()
+	if ids := l.removeMessages(clientid, validator); len(ids) > 0 {
+		l.record(&storageRecord{Op: recordDeleteMessages, Client: clientid, IDs: ids})
+	}
+}
 
+// appendMessage push message into client's offline queue, the caller must
+// hold lock
+func (l *localStorage) appendMessage(clientid string, msg StorageMessage) error {
+	q, ok := l.messages[clientid]
+	if !ok {
+		q = queue.NewMemoryQueue(0, 0, queue.DropOldest)
+		l.messages[clientid] = q
+	}
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	_, err = q.Push(data)
+	return err
 }
 
-func (l *localStorage) DeleteMessage(clientid string, mid uint16, direction MessageDirection) error {
-	return nil
+// removeMessages remove messages not accepted by validator from client's
+// offline queue and return their id, the caller must hold lock
+func (l *localStorage) removeMessages(clientid string, validator func(msg StorageMessage) bool) []uint {
+	q, ok := l.messages[clientid]
+	if !ok {
+		return nil
+	}
+	ids := []uint{}
+	q.Range(func(qmsg *queue.Message) bool {
+		msg := StorageMessage{}
+		if err := json.Unmarshal(qmsg.Data, &msg); err != nil || !validator(msg) {
+			q.Ack(qmsg.Seq)
+			ids = append(ids, msg.ID)
+		}
+		return true
+	})
+	if q.Len() == 0 {
+		delete(l.messages, clientid)
+	}
+	return ids
 }
 
-func (l *localStorage) subProcess(clientid string, msg *StorageMessage, node *subNode, setRetain bool) error {
-	if msg.Retain && setRetain {
-		node.retainMsg = msg
+// queuedMessages return messages in client's offline queue, the caller must
+// hold lock
+func (l *localStorage) queuedMessages(clientid string) []StorageMessage {
+	msgs := []StorageMessage{}
+	if q, ok := l.messages[clientid]; ok {
+		q.Range(func(qmsg *queue.Message) bool {
+			msg := StorageMessage{}
+			if err := json.Unmarshal(qmsg.Data, &msg); err == nil {
+				msgs = append(msgs, msg)
+			}
+			return true
+		})
 	}
+	return msgs
+}
+
+func (l *localStorage) DeleteMessage(clientid string, mid uint16, direction MessageDirection) error {
+	return nil
+}
 
-	for k, v := range node.subs {
-		glog.Infof("subProcess: session id is %s", k)
-		s, ok := l.sessions[k]
-		if !ok {
-			glog.Errorf("subProcess: sessions is nil")
+func (l *localStorage) QueueMessage(clientid string, msg StorageMessage) error {
+	glog.Infof("QueueMessage: Message Topic is %s", msg.Topic)
+	// Subscribers are collected firstly, so that no lock is held while
+	// message is sent to session
+	subs, groups := l.tree.match(msg.Topic)
+	for _, sub := range subs {
+		if sub.options&SubscriptionNoLocal != 0 && sub.sessionid == msg.SourceID {
 			continue
 		}
-		// if s.id == clientid {
-		// 	continue
-		// }
-
-		s.sendPublish(v.qos, msg.Qos, msg.Topic, msg.Payload)
+		retain := msg.Retain && sub.options&SubscriptionRetainAsPublished != 0
+		if l.queueReceiverMessage(sub, msg, retain) || l.queueStoredMessage(sub, msg, retain) {
+			continue
+		}
+		s, err := l.FindSession(sub.sessionid)
+		if err != nil {
+			glog.Errorf("QueueMessage: session %s does not exist", sub.sessionid)
+			continue
+		}
+		s.sendPublish(sub.qos, &msg, retain)
+	}
+	// Only one member in each shared subscription group receive the message
+	l.subMutex.Lock()
+	filter := l.shareFilter
+	l.subMutex.Unlock()
+	for _, g := range groups {
+		if filter == nil || filter(g.subscription()) {
+			l.dispatchShared(g, "", msg)
+		}
 	}
 	return nil
 }
 
-func (l *localStorage) subSearch(clientid string, msg *StorageMessage, node *subNode, levels []string, setRetain bool) error {
-	for k, v := range node.children {
-		sr := setRetain
-		if len(levels) != 0 && (k == levels[0] || k == "+") {
-			if k == "+" {
-				sr = false
-			}
-			ss := levels[1:]
-			l.subSearch(clientid, msg, v, ss, sr)
-			if len(ss) == 0 {
-				l.subProcess(clientid, msg, v, sr)
-			}
-		} else if k == "#" && len(v.children) > 0 {
-			l.subProcess(clientid, msg, v, sr)
+// queueReceiverMessage pass message to receiver added by service of other
+// protocol, it return false if subscriber is not a receiver
+func (l *localStorage) queueReceiverMessage(sub topicSubscriber, msg StorageMessage, retain bool) bool {
+	l.receiverMutex.RLock()
+	fn, ok := l.receivers[sub.sessionid]
+	l.receiverMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	if msg.Qos > sub.qos {
+		msg.Qos = sub.qos
+	}
+	if !msg.Expired() {
+		msg.Retain = retain
+		fn(msg)
+	}
+	return true
+}
+
+// AddReceiver add receiver of messages matched with subscriptions of id
+func (l *localStorage) AddReceiver(id string, fn func(msg StorageMessage)) {
+	l.receiverMutex.Lock()
+	defer l.receiverMutex.Unlock()
+	l.receivers[id] = fn
+}
+
+// RemoveReceiver remove receiver and its subscriptions
+func (l *localStorage) RemoveReceiver(id string) {
+	l.receiverMutex.Lock()
+	delete(l.receivers, id)
+	l.receiverMutex.Unlock()
+
+	l.subMutex.Lock()
+	topics := []string{}
+	for topic := range l.subscriptions[id] {
+		topics = append(topics, topic)
+	}
+	l.subMutex.Unlock()
+	for _, topic := range topics {
+		l.RemoveSubscription(id, topic)
+	}
+}
+
+// queueStoredMessage queue qos1/2 message for session restored from backup,
+// it return false if subscriber is not restored session
+func (l *localStorage) queueStoredMessage(sub topicSubscriber, msg StorageMessage, retain bool) bool {
+	l.sessionMutex.RLock()
+	ss, ok := l.stored[sub.sessionid]
+	l.sessionMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	if msg.Qos > sub.qos {
+		msg.Qos = sub.qos
+	}
+	if msg.Qos > 0 && !msg.Expired() {
+		msg.Retain = retain
+		msg.Direction = MessageDirectionOut
+		l.offlineMutex.Lock()
+		err := queueLimitedMessage(l, ss.Id, getQueueLimits(l.config, ss.Service), msg, func(dropped StorageMessage) {
+			l.notifyDropWatcher(ss, dropped, "Offline queue is full")
+		})
+		l.offlineMutex.Unlock()
+		if err != nil {
+			glog.Errorf("Failed to queue message for restored session %s:%s", ss.Id, err)
 		}
 	}
+	return true
+}
+
+// WatchDroppedMessages set watcher called when message is dropped from
+// offline queue of restored session served by service
+func (l *localStorage) WatchDroppedMessages(service string, fn func(clientid string, msg StorageMessage, reason string)) {
+	l.sessionMutex.Lock()
+	defer l.sessionMutex.Unlock()
+	l.dropWatchers[service] = fn
+}
+
+func (l *localStorage) notifyDropWatcher(ss StorageSession, msg StorageMessage, reason string) {
+	l.sessionMutex.RLock()
+	watcher := l.dropWatchers[ss.Service]
+	l.sessionMutex.RUnlock()
+	if watcher != nil {
+		watcher(ss.Id, msg, reason)
+	}
+}
+
+// QueueSharedMessage dispatch message to another member of shared
+// subscription group, the member with exclude session id is skipped
+func (l *localStorage) QueueSharedMessage(share string, exclude string, msg StorageMessage) error {
+	group, filter, ok := parseSharedSubscription(share)
+	if !ok {
+		return fmt.Errorf("Invalid shared subscription '%s'", share)
+	}
+	g := l.tree.sharedGroup(filter, group)
+	if g == nil {
+		return mqttErrorNotFound
+	}
+	if !l.dispatchShared(g, exclude, msg) {
+		return mqttErrorNotFound
+	}
 	return nil
 }
 
-func (l *localStorage) QueueMessage(clientid string, msg StorageMessage) error {
-	glog.Infof("QueueMessage: Message Topic is %s", msg.Topic)
-	s := strings.Split(msg.Topic, "/")
-
-	if msg.Retain {
-		/* We have a message that needs to be retained, so ensure that the subscription
-		 * tree for its topic exists.
-		 */
-		node := &l.root
-		for _, level := range s {
-			node = l.addNode(node, level)
+// dispatchShared send message to one available member of shared group
+func (l *localStorage) dispatchShared(g *shareGroup, exclude string, msg StorageMessage) bool {
+	sub, ok := g.pick(l.strategy, msg.SourceID, func(sessionid string) bool {
+		if sessionid == exclude {
+			return false
 		}
+		s, err := l.FindSession(sessionid)
+		return err == nil && s.isConnected()
+	})
+	if !ok {
+		glog.Warningf("No available member in shared subscription '%s'", g.subscription())
+		return false
 	}
-
-	return l.subSearch(clientid, &msg, &l.root, s, true)
+	s, err := l.FindSession(sub.sessionid)
+	if err != nil {
+		return false
+	}
+	s.sendSharedPublish(sub.qos, &msg, false, g.subscription())
+	return true
 }
 
+// GetMessageTotalCount return message count in client's offline queue
 func (l *localStorage) GetMessageTotalCount(clientid string) int {
+	l.messageMutex.Lock()
+	defer l.messageMutex.Unlock()
+	if q, ok := l.messages[clientid]; ok {
+		return q.Len()
+	}
+	return 0
+}
+
+// GetMessageTotalSize return bytes of messages in client's offline queue
+func (l *localStorage) GetMessageTotalSize(clientid string) int {
+	l.messageMutex.Lock()
+	defer l.messageMutex.Unlock()
+	if q, ok := l.messages[clientid]; ok {
+		return int(q.Size())
+	}
 	return 0
 }
 
@@ -317,13 +744,18 @@ type localStorageFactory struct{}
 
 func (l *localStorageFactory) New(c core.Config) (Storage, error) {
 	d := &localStorage{
-		config:   c,
-		sessions: make(map[string]*mqttSession),
-		root: subNode{
-			level:    "root",
-			children: make(map[string]*subNode),
-			subs:     make(map[string]*subLeaf),
-		},
+		config:        c,
+		sessions:      make(map[string]*mqttSession),
+		tree:          newTopicTree(),
+		strategy:      shareStrategyRoundRobin,
+		stored:        make(map[string]StorageSession),
+		dropWatchers:  make(map[string]func(clientid string, msg StorageMessage, reason string)),
+		subscriptions: make(map[string]map[string]subLeaf),
+		messages:      make(map[string]queue.Queue),
+		receivers:     make(map[string]func(msg StorageMessage)),
+	}
+	if strategy, err := c.String("broker", "shared_subscription_strategy"); err == nil && strategy != "" {
+		d.strategy = strategy
 	}
 	return d, nil
 }
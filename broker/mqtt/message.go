@@ -12,6 +12,8 @@
 
 package mqtt
 
+import "time"
+
 // Message state
 const (
 	mqttMessageStateInvalid        = 0
@@ -35,10 +37,17 @@ const (
 )
 
 type mqttMessage struct {
-	mid       uint16
-	direction int
-	topic     string
-	payload   []uint8
-	qos       uint8
-	retain    bool
+	mid        uint16
+	direction  int
+	state      int
+	dup        bool
+	timestamp  time.Time
+	topic      string
+	payload    []uint8
+	qos        uint8
+	retain     bool
+	properties []uint8         // Encoded properties forwarded in MQTT v5
+	expiry     time.Time       // Message is discarded after expiry if it is set
+	share      string          // Shared subscription which the message is dispatched by
+	origin     *StorageMessage // Original message for redispatching in shared subscription
 }
@@ -17,10 +17,14 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/event"
+	"github.com/cloustone/sentel/broker/metadata"
 	"github.com/cloustone/sentel/core"
 	uuid "github.com/satori/go.uuid"
 
@@ -31,8 +35,14 @@ import (
 const (
 	maxMqttConnections = 1000000
 	protocolName       = "mqtt3"
+	// Time waiting for session transferred from other node before CONNACK
+	defaultSessionTransferTimeout = 3 * time.Second
 )
 
+// nodeID identify this node in session notifications, notifications
+// launched by itself are ignored
+var nodeID = uuid.NewV4().String()
+
 // MQTT service declaration
 type mqtt struct {
 	config     core.Config
@@ -47,6 +57,14 @@ type mqtt struct {
 	protocol   string
 	stats      *base.Stats
 	metrics    *base.Metrics
+	willTimers map[string]*time.Timer // Delayed will messages in MQTT v5
+	willMutex  sync.Mutex
+	consumer   sarama.Consumer // Consumer of session notifications
+	consumers  []sarama.PartitionConsumer
+	cluster    *clusterRouter
+	// Connecting clients waiting for sessions transferred from other nodes
+	transfers     map[string]chan *SessionTopic
+	transferMutex sync.Mutex
 }
 
 // MqttFactory
@@ -73,7 +91,7 @@ func (m *MqttFactory) New(protocol string, c core.Config, ch chan base.ServiceCo
 	}
 	// Create storage
 	name := c.MustString("storage", "name")
-	if s, err = NewStorage(name, c); err != nil {
+	if s, err = getSharedStorage(name, c); err != nil {
 		return nil, errors.New("Failed to create storage in mqtt")
 	}
 
@@ -86,10 +104,31 @@ func (m *MqttFactory) New(protocol string, c core.Config, ch chan base.ServiceCo
 		storage:    s,
 		stats:      base.NewStats(true),
 		metrics:    base.NewMetrics(true),
+		willTimers: make(map[string]*time.Timer),
+		transfers:  make(map[string]chan *SessionTopic),
 	}
+	// Device disabled or removed in apiserver is kicked off
+	metadata.GetCache(c).Watch(t.kickoffDevice)
+	s.WatchDroppedMessages(protocol, t.storedMessageDropped)
+	t.cluster = getClusterRouter(c, s)
 	return t, nil
 }
 
+// storedMessageDropped count message dropped from offline queue of restored
+// session which is not connected to the service yet
+func (m *mqtt) storedMessageDropped(clientid string, msg StorageMessage, reason string) {
+	m.metrics.AddMetric(metricMessageDroped, 1)
+	event.GetBus(m.config).Notify(&event.Event{
+		Type:      event.MessageDropped,
+		ClientID:  clientid,
+		Protocol:  m.protocol,
+		Topic:     msg.Topic,
+		Qos:       msg.Qos,
+		Reason:    reason,
+		Timestamp: time.Now(),
+	})
+}
+
 // MQTT Service
 
 // Name
@@ -114,60 +153,296 @@ func (m *mqtt) getSessionTotalCount() int64 {
 func (m *mqtt) removeSession(s base.Session) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	m.sessions[s.Identifier()] = nil
+	delete(m.sessions, s.Identifier())
+	m.stats.SetStat(statClientsCount, uint64(len(m.sessions)))
 }
 func (m *mqtt) registerSession(s base.Session) {
 	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.sessions[s.Identifier()] = s
-	m.mutex.Unlock()
+	count := uint64(len(m.sessions))
+	m.stats.SetStat(statClientsCount, count)
+	if count > m.stats.GetStat(statClientsMax) {
+		m.stats.SetStat(statClientsMax, count)
+	}
 }
 
-// Info
-func (m *mqtt) Info() *base.ServiceInfo {
-	return &base.ServiceInfo{
-		ServiceName: "mqtt",
+// routeMessage store retained message and route message to subscribers,
+// message is also forwarded to other nodes with matched subscriptions and
+// bridges with matched topics
+func (m *mqtt) routeMessage(clientid string, msg StorageMessage) error {
+	if msg.Retain {
+		if err := m.storage.StoreRetainMessage(msg.Topic, msg); err != nil {
+			return err
+		}
+		m.metrics.AddMetric(metricMessageRetained, 1)
+		m.updateRetainedStats()
 	}
+	if !m.cluster.forward(msg) {
+		m.metrics.AddMetric(metricClusterDropped, 1)
+	}
+	forwardToBridges(msg)
+	return m.storage.QueueMessage(clientid, msg)
 }
 
+// publishWillMessage publish will message of client after delay, the
+// message is not published if client reconnect before that
+func (m *mqtt) publishWillMessage(clientid string, msg StorageMessage, delay time.Duration) {
+	if delay <= 0 {
+		if err := m.routeMessage(msg.SourceID, msg); err != nil {
+			glog.Errorf("Failed to publish will message of %s:%s", clientid, err)
+		}
+		return
+	}
+	m.willMutex.Lock()
+	defer m.willMutex.Unlock()
+	if t, ok := m.willTimers[clientid]; ok {
+		t.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		m.willMutex.Lock()
+		if m.willTimers[clientid] != timer {
+			m.willMutex.Unlock()
+			return
+		}
+		delete(m.willTimers, clientid)
+		m.willMutex.Unlock()
+		if err := m.routeMessage(msg.SourceID, msg); err != nil {
+			glog.Errorf("Failed to publish will message of %s:%s", clientid, err)
+		}
+	})
+	m.willTimers[clientid] = timer
+}
+
+// cancelWillMessage cancel delayed will message of client
+func (m *mqtt) cancelWillMessage(clientid string) {
+	m.willMutex.Lock()
+	defer m.willMutex.Unlock()
+	if t, ok := m.willTimers[clientid]; ok {
+		t.Stop()
+		delete(m.willTimers, clientid)
+	}
+}
+
+// updateRetainedStats update retained message count and max stats
+func (m *mqtt) updateRetainedStats() {
+	count := uint64(m.storage.GetRetainMessageCount())
+	m.stats.SetStat(statRetainedCount, count)
+	if count > m.stats.GetStat(statRetainedMax) {
+		m.stats.SetStat(statRetainedMax, count)
+	}
+}
+
+// Info
+func (m *mqtt) Info() *base.ServiceInfo { return m.GetServiceInfo() }
+
 // Stats and Metrics
 func (m *mqtt) GetStats() *base.Stats     { return m.stats }
 func (m *mqtt) GetMetrics() *base.Metrics { return m.metrics }
 
 // Client
-func (m *mqtt) GetClients() []*base.ClientInfo       { return nil }
-func (m *mqtt) GetClient(id string) *base.ClientInfo { return nil }
-func (m *mqtt) KickoffClient(id string) error        { return nil }
+func (m *mqtt) GetClients() []*base.ClientInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	clients := []*base.ClientInfo{}
+	for _, s := range m.sessions {
+		if session, ok := s.(*mqttSession); ok {
+			clients = append(clients, session.clientInfo())
+		}
+	}
+	return clients
+}
 
-// Session Info
-func (m *mqtt) GetSessions(conditions map[string]bool) []*base.SessionInfo { return nil }
-func (m *mqtt) GetSession(id string) *base.SessionInfo                     { return nil }
+func (m *mqtt) GetClient(id string) *base.ClientInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.sessions {
+		if session, ok := s.(*mqttSession); ok && session.clientID == id {
+			return session.clientInfo()
+		}
+	}
+	return nil
+}
+
+// KickoffClient disconnect client by administrator, will message of the
+// client is published as connection is not closed by DISCONNECT
+func (m *mqtt) KickoffClient(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.sessions {
+		if session, ok := s.(*mqttSession); ok && session.clientID == id && session.isConnected() {
+			glog.Infof("Kicking off client '%s'", id)
+			go session.kickoff(REASON_ADMINISTRATIVE_ACTION)
+			return nil
+		}
+	}
+	return fmt.Errorf("Client '%s' is not connected", id)
+}
+
+// kickoffDevice disconnect clients authenticated as device
+func (m *mqtt) kickoffDevice(d *metadata.Device) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.sessions {
+		session, ok := s.(*mqttSession)
+		if ok && session.device != nil &&
+			session.device.ProductKey == d.ProductKey && session.device.Name == d.Name {
+			glog.Infof("Kicking off device '%s' of product '%s'", d.Name, d.ProductKey)
+			go session.kickoff(REASON_NOT_AUTHORIZED)
+		}
+	}
+}
+
+// GetSessions return sessions in storage, only persistent or transient
+// sessions are returned if conditions are specified
+func (m *mqtt) GetSessions(conditions map[string]bool) []*base.SessionInfo {
+	sessions := []*base.SessionInfo{}
+	m.storage.WalkSessions(func(s *mqttSession) {
+		persistent := s.cleanSession == 0
+		if conditions["persistent"] != conditions["transient"] && conditions["persistent"] != persistent {
+			return
+		}
+		sessions = append(sessions, s.Info())
+	})
+	m.storage.WalkStoredSessions(func(ss StorageSession) {
+		persistent := ss.CleanSession == 0
+		if conditions["persistent"] != conditions["transient"] && conditions["persistent"] != persistent {
+			return
+		}
+		sessions = append(sessions, m.storedSessionInfo(ss))
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ClientId < sessions[j].ClientId })
+	return sessions
+}
 
-// Route Info
-func (m *mqtt) GetRoutes() []*base.RouteInfo { return nil }
-func (m *mqtt) GetRoute() *base.RouteInfo    { return nil }
+func (m *mqtt) GetSession(id string) *base.SessionInfo {
+	if s, err := m.storage.FindSession(id); err == nil {
+		return s.Info()
+	}
+	if ss, err := m.storage.FindStoredSession(id); err == nil {
+		return m.storedSessionInfo(ss)
+	}
+	return nil
+}
+
+// storedSessionInfo return information of persistent session restored from
+// backup, which only has messages queued in storage
+func (m *mqtt) storedSessionInfo(ss StorageSession) *base.SessionInfo {
+	info := &base.SessionInfo{
+		ClientId:       ss.Id,
+		CleanSession:   ss.CleanSession > 0,
+		MessageInQueue: uint64(m.storage.GetMessageTotalCount(ss.Id)),
+	}
+	if !ss.CreatedAt.IsZero() {
+		info.CreatedAt = ss.CreatedAt.Format(time.RFC3339)
+	}
+	return info
+}
+
+// GetRoutes return route table of cluster, which map subscribed topic
+// filters to nodes
+func (m *mqtt) GetRoutes() []*base.RouteInfo {
+	routes := []*base.RouteInfo{}
+	for filter, nodes := range m.cluster.getRoutes() {
+		routes = append(routes, &base.RouteInfo{Topic: filter, Route: nodes})
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Topic < routes[j].Topic })
+	return routes
+}
+
+// GetRoute return nodes which message published on topic is routed to
+func (m *mqtt) GetRoute(topic string) *base.RouteInfo {
+	nodes := m.cluster.getRoute(topic)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return &base.RouteInfo{Topic: topic, Route: nodes}
+}
 
 // Topic info
-func (m *mqtt) GetTopics() []*base.TopicInfo       { return nil }
-func (m *mqtt) GetTopic(id string) *base.TopicInfo { return nil }
+// GetTopics return subscribed topic filters and topics with retained
+// message
+func (m *mqtt) GetTopics() []*base.TopicInfo {
+	attributes := make(map[string][]string)
+	m.storage.WalkSubscriptions(func(topic string, count int) {
+		attributes[topic] = append(attributes[topic], fmt.Sprintf("subscribers=%d", count))
+	})
+	m.storage.WalkRetainMessages(func(topic string, msg StorageMessage) {
+		attributes[topic] = append(attributes[topic], "retained")
+	})
+	topics := []*base.TopicInfo{}
+	for topic, attrs := range attributes {
+		topics = append(topics, &base.TopicInfo{Topic: topic, Attribute: strings.Join(attrs, ",")})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+	return topics
+}
+
+func (m *mqtt) GetTopic(id string) *base.TopicInfo {
+	for _, topic := range m.GetTopics() {
+		if topic.Topic == id {
+			return topic
+		}
+	}
+	return nil
+}
 
 // SubscriptionInfo
-func (m *mqtt) GetSubscriptions() []*base.SubscriptionInfo       { return nil }
-func (m *mqtt) GetSubscription(id string) *base.SubscriptionInfo { return nil }
+func (m *mqtt) GetSubscriptions() []*base.SubscriptionInfo {
+	subs := []*base.SubscriptionInfo{}
+	m.storage.WalkClientSubscriptions(func(sessionid string, topic string, qos uint8) {
+		subs = append(subs, &base.SubscriptionInfo{
+			ClientId:  sessionid,
+			Topic:     topic,
+			Attribute: fmt.Sprintf("qos=%d", qos),
+		})
+	})
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].Topic != subs[j].Topic {
+			return subs[i].Topic < subs[j].Topic
+		}
+		return subs[i].ClientId < subs[j].ClientId
+	})
+	return subs
+}
+
+// GetTopicSubscriptions return subscriptions of clients on topic filter
+func (m *mqtt) GetTopicSubscriptions(topic string) []*base.SubscriptionInfo {
+	subs := []*base.SubscriptionInfo{}
+	for _, sub := range m.GetSubscriptions() {
+		if sub.Topic == topic {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
 
 // Service Info
-func (m *mqtt) GetServiceInfo() *base.ServiceInfo { return nil }
+func (m *mqtt) GetServiceInfo() *base.ServiceInfo {
+	listen, _ := m.config.String(m.protocol, "listen")
+	maxClients, _ := m.config.Int(m.protocol, "max_connections")
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return &base.ServiceInfo{
+		ServiceName:    m.protocol,
+		Listen:         listen,
+		Acceptors:      1,
+		MaxClients:     uint64(maxClients),
+		CurrentClients: uint64(len(m.sessions)),
+	}
+}
 
 // Start is mainloop for mqtt service
 func (m *mqtt) Start() error {
 	host, _ := m.config.String(m.protocol, "listen")
 
-	listen, err := net.Listen("tcp", host)
+	listen, err := m.listen(host)
 	if err != nil {
 		glog.Errorf("Mqtt listen failed:%s", err)
 		return err
 	}
-	// Launch montor
-	// TODO:how to wait the monitor to be terminated
+	// Launch montor, it is stopped in Stop
 	if err := m.launchMqttMonitor(); err != nil {
 		glog.Errorf("Mqtt monitor failed, reason:%s", err)
 		//return err
@@ -199,43 +474,64 @@ func (m *mqtt) Start() error {
 }
 
 // Stop
+// listen create listener according to service's transport, all transports
+// share the same session handling
+func (m *mqtt) listen(host string) (net.Listener, error) {
+	switch m.protocol {
+	case "mqtt:ws":
+		return newWebsocketListener(m, host)
+	case "mqtt:ssl":
+		return newTLSListener(m, host)
+	default:
+		return net.Listen("tcp", host)
+	}
+}
+
 func (m *mqtt) Stop() {
+	for _, pc := range m.consumers {
+		pc.AsyncClose()
+	}
+	m.wg.Wait()
+	if m.consumer != nil {
+		m.consumer.Close()
+	}
 }
 
-// launchMqttMonitor
+// launchMqttMonitor consume session notifications launched by other nodes
 func (m *mqtt) launchMqttMonitor() error {
 	glog.Info("Luanching mqtt monitor...")
 	//sarama.Logger = glog
-	khosts, _ := m.config.String("mqttbroker", "kafka-hosts")
+	khosts, err := m.config.String("mqttbroker", "kafka")
+	if err != nil || khosts == "" {
+		return errors.New("Kafka is not configured")
+	}
 	consumer, err := sarama.NewConsumer(strings.Split(khosts, ","), nil)
 	if err != nil {
 		return fmt.Errorf("Connecting with kafka:%s failed", khosts)
 	}
 
-	partitionList, err := consumer.Partitions("iothub-mqtt")
+	partitionList, err := consumer.Partitions(TopicNameSession)
 	if err != nil {
+		consumer.Close()
 		return fmt.Errorf("Failed to get list of partions:%v", err)
-		return err
 	}
-
-	for partition := range partitionList {
-		pc, err := consumer.ConsumePartition("mqttbroker", int32(partition), sarama.OffsetNewest)
+	m.consumer = consumer
+	for _, partition := range partitionList {
+		pc, err := consumer.ConsumePartition(TopicNameSession, partition, sarama.OffsetNewest)
 		if err != nil {
 			glog.Errorf("Failed  to start consumer for partion %d:%s", partition, err)
 			continue
 		}
-		defer pc.AsyncClose()
+		m.consumers = append(m.consumers, pc)
 		m.wg.Add(1)
 
-		go func(sarama.PartitionConsumer) {
+		go func(pc sarama.PartitionConsumer) {
 			defer m.wg.Done()
 			for msg := range pc.Messages() {
 				m.handleNotifications(string(msg.Topic), msg.Value)
 			}
 		}(pc)
 	}
-	m.wg.Wait()
-	consumer.Close()
 	return nil
 }
 
@@ -251,30 +547,241 @@ func (m *mqtt) handleNotifications(topic string, value []byte) error {
 // handleSessionNotifications handle session notification  from kafka
 func (m *mqtt) handleSessionNotifications(value []byte) error {
 	// Decode value received form other mqtt node
-	var topics []SessionTopic
-	if err := json.Unmarshal(value, &topics); err != nil {
+	topic := SessionTopic{}
+	if err := json.Unmarshal(value, &topic); err != nil {
 		glog.Errorf("Mqtt session notifications failure:%s", err)
 		return err
 	}
-	// Get local ip address
-	for _, topic := range topics {
-		switch topic.Action {
-		case ObjectActionUpdate:
-			// Only deal with notification that is not  launched by myself
-			for _, addr := range m.localAddrs {
-				if addr != topic.Launcher {
-					s, err := m.storage.FindSession(topic.SessionId)
-					if err != nil {
-						s.state = topic.State
-					}
-					//m.storage.UpdateSession(&StorageSession{Id: topic.SessionId, State: topic.State})
-				}
+	// Only deal with notification that is not launched by myself
+	if topic.Launcher == nodeID {
+		return nil
+	}
+	switch topic.Action {
+	case ObjectActionUpdate:
+		// Client is connected to other node, session is evicted without
+		// blocking notifications handling
+		go m.evictSession(topic.SessionId, topic.Launcher, topic.Wait)
+	case ObjectActionTransfer:
+		if topic.Target == nodeID && !m.deliverTransfer(&topic) {
+			m.resumeTransferredSession(&topic)
+		}
+	case ObjectActionDelete:
+	case ObjectActionRegister:
+	default:
+	}
+	return nil
+}
+
+// notifyTakeover notify other nodes that client is connected to this node,
+// connections of the client on them are closed. If wait is true, persistent
+// session transferred by them is returned, nil is returned if no peer has
+// the session or it is not transferred in time
+func (m *mqtt) notifyTakeover(clientid string, wait bool) *SessionTopic {
+	if khosts, err := m.config.String("mqttbroker", "kafka"); err != nil || khosts == "" {
+		return nil
+	}
+	// Peers are known by cluster router, each of them reply whether it has
+	// the session
+	peers := m.cluster.peers()
+	if len(peers) == 0 {
+		wait = false
+	}
+	var replies chan *SessionTopic
+	if wait {
+		replies = make(chan *SessionTopic, len(peers)*2)
+		m.transferMutex.Lock()
+		m.transfers[clientid] = replies
+		m.transferMutex.Unlock()
+		defer func() {
+			m.transferMutex.Lock()
+			if m.transfers[clientid] == replies {
+				delete(m.transfers, clientid)
 			}
-		case ObjectActionDelete:
+			m.transferMutex.Unlock()
+		}()
+	}
+	go base.AsyncProduceMessage(m.config,
+		TopicNameSession,
+		&SessionTopic{
+			Launcher:  nodeID,
+			SessionId: clientid,
+			Action:    ObjectActionUpdate,
+			State:     mqttStateDisconnecting,
+			Wait:      wait,
+		})
+	if !wait {
+		return nil
+	}
 
-		case ObjectActionRegister:
-		default:
+	timeout := defaultSessionTransferTimeout
+	if n, err := m.config.Int(m.protocol, "session_transfer_timeout"); err == nil && n >= 0 {
+		timeout = time.Duration(n) * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	replied := make(map[string]bool)
+	for len(replied) < len(peers) {
+		select {
+		case topic := <-replies:
+			if topic.Session != nil {
+				return topic
+			}
+			replied[topic.Launcher] = true
+		case <-timer.C:
+			glog.Warningf("Session of %s is not transferred in %v, %d of %d nodes replied",
+				clientid, timeout, len(replied), len(peers))
+			return nil
 		}
 	}
 	return nil
 }
+
+// deliverTransfer pass session transferred from other node to connecting
+// client waiting for it, false is returned if no client is waiting
+func (m *mqtt) deliverTransfer(topic *SessionTopic) bool {
+	m.transferMutex.Lock()
+	defer m.transferMutex.Unlock()
+	replies, ok := m.transfers[topic.SessionId]
+	if !ok {
+		return false
+	}
+	select {
+	case replies <- topic:
+		return true
+	default:
+		return false
+	}
+}
+
+// replyNoSession tell owner node waiting for client's session that the
+// session is not transferred by this node
+func (m *mqtt) replyNoSession(owner string, clientid string) {
+	go base.AsyncProduceMessage(m.config,
+		TopicNameSession,
+		&SessionTopic{
+			Launcher:  nodeID,
+			SessionId: clientid,
+			Action:    ObjectActionTransfer,
+			Target:    owner,
+		})
+}
+
+// evictSession close connection of client which is connected to owner
+// node, persistent session is transferred to that node and removed here.
+// If owner is waiting for the session, it is replied even if there is no
+// session to transfer
+func (m *mqtt) evictSession(clientid string, owner string, wait bool) {
+	var ss StorageSession
+	msgs := []StorageMessage{}
+	if s, err := m.storage.FindSession(clientid); err == nil {
+		// Session is evicted by the service serving it
+		if s.mgr != m {
+			return
+		}
+		glog.Infof("Client %s is connected to node %s, evicting its session", clientid, owner)
+		s.takeover()
+		ss = s.storageSession()
+		msgs = s.unacknowledgedMessages()
+	} else if ss, err = m.storage.FindStoredSession(clientid); err != nil {
+		if wait {
+			m.replyNoSession(owner, clientid)
+		}
+		return
+	} else if ss.Service != m.protocol {
+		return
+	}
+	// Delayed will message is not published as client is connected again
+	m.cancelWillMessage(clientid)
+	if found, err := m.storage.FindSession(clientid); err == nil && found.isConnected() {
+		if wait {
+			m.replyNoSession(owner, clientid)
+		}
+		return
+	}
+	if ss.CleanSession == 0 {
+		m.transferSession(owner, ss, msgs)
+	} else if wait {
+		m.replyNoSession(owner, clientid)
+	}
+	m.storage.DeleteSession(clientid)
+}
+
+// transferSession send subscriptions and queued messages of persistent
+// session to owner node which client is connected to
+func (m *mqtt) transferSession(owner string, ss StorageSession, msgs []StorageMessage) {
+	topic := &SessionTopic{
+		Launcher:  nodeID,
+		SessionId: ss.Id,
+		Action:    ObjectActionTransfer,
+		Target:    owner,
+		Session:   &ss,
+	}
+	m.storage.WalkSessionSubscriptions(ss.Id, func(filter string, qos uint8, options uint8) {
+		topic.Subscriptions = append(topic.Subscriptions, SessionSubscription{Topic: filter, Qos: qos, Options: options})
+	})
+	for {
+		msg, err := m.storage.PopMessage(ss.Id)
+		if err != nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	topic.Messages = msgs
+	glog.Infof("Transferring session of %s with %d subscriptions and %d messages to node %s",
+		ss.Id, len(topic.Subscriptions), len(msgs), owner)
+	go base.AsyncProduceMessage(m.config, TopicNameSession, topic)
+}
+
+// resumeTransferredSession take over subscriptions and queued messages of
+// session transferred from other node after client's CONNACK is sent
+func (m *mqtt) resumeTransferredSession(topic *SessionTopic) {
+	s, err := m.storage.FindSession(topic.SessionId)
+	if err != nil || s.mgr != m || topic.Session == nil {
+		return
+	}
+	glog.Warningf("Session of %s is transferred from node %s after CONNACK", s.clientID, topic.Launcher)
+	m.applyTransferredSession(s, topic)
+}
+
+// applyTransferredSession take over subscriptions and queued messages of
+// session transferred from other node, if the connected client resumed its
+// persistent session. Messages are queued offline if client is not
+// connected yet, and they are replayed after CONNACK
+func (m *mqtt) applyTransferredSession(s *mqttSession, topic *SessionTopic) bool {
+	if s.cleanStart != 0 || topic.Session.CleanSession != 0 {
+		glog.Infof("Session of %s transferred from node %s is discarded", s.clientID, topic.Launcher)
+		return false
+	}
+	for _, sub := range topic.Subscriptions {
+		if !m.storage.ExistSubscription(s.clientID, sub.Topic) {
+			m.storage.AddSubscription(s.clientID, sub.Topic, sub.Qos, sub.Options)
+		}
+	}
+	for _, msg := range topic.Messages {
+		if !s.isConnected() {
+			s.queueOfflineMessage(msg.SourceID, &mqttMessage{
+				topic:      msg.Topic,
+				payload:    msg.Payload,
+				qos:        msg.Qos,
+				retain:     msg.Retain,
+				properties: msg.Properties,
+				expiry:     msg.ExpiryAt,
+			})
+			continue
+		}
+		s.queueOutMessage(&mqttMessage{
+			direction:  mqttMessageDirectionOut,
+			state:      mqttMessateStateQueued,
+			topic:      msg.Topic,
+			payload:    msg.Payload,
+			qos:        msg.Qos,
+			retain:     msg.Retain,
+			properties: msg.Properties,
+			expiry:     msg.ExpiryAt,
+		})
+	}
+	s.flushOutMessages()
+	glog.Infof("Session of %s is transferred from node %s with %d subscriptions and %d messages",
+		s.clientID, topic.Launcher, len(topic.Subscriptions), len(topic.Messages))
+	return true
+}
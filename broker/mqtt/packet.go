@@ -26,6 +26,7 @@ const (
 
 	PROTOCOL_NAME_V311    = "MQTT"
 	PROTOCOL_VERSION_V311 = 4
+	PROTOCOL_VERSION_V5   = 5
 
 	// Message types
 	INVALID     = 0x00
@@ -43,6 +44,7 @@ const (
 	PINGREQ     = 0xC0
 	PINGRESP    = 0xD0
 	DISCONNECT  = 0xE0
+	AUTH        = 0xF0
 
 	// CONNACK result
 	CONNACK_ACCEPTED                      = 0
@@ -52,6 +54,51 @@ const (
 	CONNACK_REFUSED_BAD_USERNAME_PASSWORD = 4
 	CONNACK_REFUSED_NOT_AUTHORIZED        = 5
 
+	// Reason code in MQTT v5
+	REASON_SUCCESS                                = 0x00
+	REASON_GRANTED_QOS1                           = 0x01
+	REASON_GRANTED_QOS2                           = 0x02
+	REASON_DISCONNECT_WITH_WILL_MESSAGE           = 0x04
+	REASON_NO_MATCHING_SUBSCRIBERS                = 0x10
+	REASON_NO_SUBSCRIPTION_EXISTED                = 0x11
+	REASON_CONTINUE_AUTHENTICATION                = 0x18
+	REASON_REAUTHENTICATE                         = 0x19
+	REASON_UNSPECIFIED_ERROR                      = 0x80
+	REASON_MALFORMED_PACKET                       = 0x81
+	REASON_PROTOCOL_ERROR                         = 0x82
+	REASON_IMPLEMENTATION_SPECIFIC_ERROR          = 0x83
+	REASON_UNSUPPORTED_PROTOCOL_VERSION           = 0x84
+	REASON_CLIENT_IDENTIFIER_NOT_VALID            = 0x85
+	REASON_BAD_USERNAME_OR_PASSWORD               = 0x86
+	REASON_NOT_AUTHORIZED                         = 0x87
+	REASON_SERVER_UNAVAILABLE                     = 0x88
+	REASON_SERVER_BUSY                            = 0x89
+	REASON_BANNED                                 = 0x8A
+	REASON_SERVER_SHUTTING_DOWN                   = 0x8B
+	REASON_BAD_AUTHENTICATION_METHOD              = 0x8C
+	REASON_KEEP_ALIVE_TIMEOUT                     = 0x8D
+	REASON_SESSION_TAKEN_OVER                     = 0x8E
+	REASON_TOPIC_FILTER_INVALID                   = 0x8F
+	REASON_TOPIC_NAME_INVALID                     = 0x90
+	REASON_PACKET_IDENTIFIER_IN_USE               = 0x91
+	REASON_PACKET_IDENTIFIER_NOT_FOUND            = 0x92
+	REASON_RECEIVE_MAXIMUM_EXCEEDED               = 0x93
+	REASON_TOPIC_ALIAS_INVALID                    = 0x94
+	REASON_PACKET_TOO_LARGE                       = 0x95
+	REASON_MESSAGE_RATE_TOO_HIGH                  = 0x96
+	REASON_QUOTA_EXCEEDED                         = 0x97
+	REASON_ADMINISTRATIVE_ACTION                  = 0x98
+	REASON_PAYLOAD_FORMAT_INVALID                 = 0x99
+	REASON_RETAIN_NOT_SUPPORTED                   = 0x9A
+	REASON_QOS_NOT_SUPPORTED                      = 0x9B
+	REASON_USE_ANOTHER_SERVER                     = 0x9C
+	REASON_SERVER_MOVED                           = 0x9D
+	REASON_SHARED_SUBSCRIPTIONS_NOT_SUPPORTED     = 0x9E
+	REASON_CONNECTION_RATE_EXCEEDED               = 0x9F
+	REASON_MAXIMUM_CONNECT_TIME                   = 0xA0
+	REASON_SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED = 0xA1
+	REASON_WILDCARD_SUBSCRIPTIONS_NOT_SUPPORTED   = 0xA2
+
 	MQTT_MAX_PAYLOAD = 268435455
 )
 
@@ -109,7 +156,7 @@ func (p *mqttPacket) initializePacket() error {
 
 	remainingLength := p.remainingLength
 	p.remainingCount = 0
-	for remainingLength > 0 && p.remainingCount < 5 {
+	for p.remainingCount < 5 {
 		b := remainingLength % 128
 		remainingLength = remainingLength / 128
 		if remainingLength > 0 {
@@ -117,6 +164,9 @@ func (p *mqttPacket) initializePacket() error {
 		}
 		remainingBytes[p.remainingCount] = uint8(b)
 		p.remainingCount++
+		if remainingLength == 0 {
+			break
+		}
 	}
 	if p.remainingCount == 5 {
 		return errors.New("Invalid packet payload size")
@@ -288,14 +338,14 @@ func (p *mqttPacket) readUint16() (uint16, error) {
 	p.pos++
 	lsb := p.payload[p.pos]
 	p.pos++
-	w := (uint16(msb << 8)) + uint16(lsb)
+	w := (uint16(msb) << 8) + uint16(lsb)
 	return w, nil
 }
 
 // WriteUint16 write word into packet pyload
 func (p *mqttPacket) writeUint16(data uint16) error {
-	msb := uint8((data >> 8) & 0xF)
-	lsb := uint8(data & 0xF)
+	msb := uint8((data >> 8) & 0xFF)
+	lsb := uint8(data & 0xFF)
 	if err := p.writeByte(msb); err != nil {
 		return err
 	}
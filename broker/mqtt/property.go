@@ -0,0 +1,391 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import "fmt"
+
+// Property identifiers in MQTT v5
+const (
+	PROPERTY_PAYLOAD_FORMAT_INDICATOR          = 0x01
+	PROPERTY_MESSAGE_EXPIRY_INTERVAL           = 0x02
+	PROPERTY_CONTENT_TYPE                      = 0x03
+	PROPERTY_RESPONSE_TOPIC                    = 0x08
+	PROPERTY_CORRELATION_DATA                  = 0x09
+	PROPERTY_SUBSCRIPTION_IDENTIFIER           = 0x0B
+	PROPERTY_SESSION_EXPIRY_INTERVAL           = 0x11
+	PROPERTY_ASSIGNED_CLIENT_IDENTIFIER        = 0x12
+	PROPERTY_SERVER_KEEP_ALIVE                 = 0x13
+	PROPERTY_AUTHENTICATION_METHOD             = 0x15
+	PROPERTY_AUTHENTICATION_DATA               = 0x16
+	PROPERTY_REQUEST_PROBLEM_INFORMATION       = 0x17
+	PROPERTY_WILL_DELAY_INTERVAL               = 0x18
+	PROPERTY_REQUEST_RESPONSE_INFORMATION      = 0x19
+	PROPERTY_RESPONSE_INFORMATION              = 0x1A
+	PROPERTY_SERVER_REFERENCE                  = 0x1C
+	PROPERTY_REASON_STRING                     = 0x1F
+	PROPERTY_RECEIVE_MAXIMUM                   = 0x21
+	PROPERTY_TOPIC_ALIAS_MAXIMUM               = 0x22
+	PROPERTY_TOPIC_ALIAS                       = 0x23
+	PROPERTY_MAXIMUM_QOS                       = 0x24
+	PROPERTY_RETAIN_AVAILABLE                  = 0x25
+	PROPERTY_USER_PROPERTY                     = 0x26
+	PROPERTY_MAXIMUM_PACKET_SIZE               = 0x27
+	PROPERTY_WILDCARD_SUBSCRIPTION_AVAILABLE   = 0x28
+	PROPERTY_SUBSCRIPTION_IDENTIFIER_AVAILABLE = 0x29
+	PROPERTY_SHARED_SUBSCRIPTION_AVAILABLE     = 0x2A
+)
+
+// Property value types
+const (
+	propertyTypeByte = iota
+	propertyTypeUint16
+	propertyTypeUint32
+	propertyTypeVarInt
+	propertyTypeString
+	propertyTypeBinary
+	propertyTypeStringPair
+)
+
+var propertyTypes = map[uint8]int{
+	PROPERTY_PAYLOAD_FORMAT_INDICATOR:          propertyTypeByte,
+	PROPERTY_MESSAGE_EXPIRY_INTERVAL:           propertyTypeUint32,
+	PROPERTY_CONTENT_TYPE:                      propertyTypeString,
+	PROPERTY_RESPONSE_TOPIC:                    propertyTypeString,
+	PROPERTY_CORRELATION_DATA:                  propertyTypeBinary,
+	PROPERTY_SUBSCRIPTION_IDENTIFIER:           propertyTypeVarInt,
+	PROPERTY_SESSION_EXPIRY_INTERVAL:           propertyTypeUint32,
+	PROPERTY_ASSIGNED_CLIENT_IDENTIFIER:        propertyTypeString,
+	PROPERTY_SERVER_KEEP_ALIVE:                 propertyTypeUint16,
+	PROPERTY_AUTHENTICATION_METHOD:             propertyTypeString,
+	PROPERTY_AUTHENTICATION_DATA:               propertyTypeBinary,
+	PROPERTY_REQUEST_PROBLEM_INFORMATION:       propertyTypeByte,
+	PROPERTY_WILL_DELAY_INTERVAL:               propertyTypeUint32,
+	PROPERTY_REQUEST_RESPONSE_INFORMATION:      propertyTypeByte,
+	PROPERTY_RESPONSE_INFORMATION:              propertyTypeString,
+	PROPERTY_SERVER_REFERENCE:                  propertyTypeString,
+	PROPERTY_REASON_STRING:                     propertyTypeString,
+	PROPERTY_RECEIVE_MAXIMUM:                   propertyTypeUint16,
+	PROPERTY_TOPIC_ALIAS_MAXIMUM:               propertyTypeUint16,
+	PROPERTY_TOPIC_ALIAS:                       propertyTypeUint16,
+	PROPERTY_MAXIMUM_QOS:                       propertyTypeByte,
+	PROPERTY_RETAIN_AVAILABLE:                  propertyTypeByte,
+	PROPERTY_USER_PROPERTY:                     propertyTypeStringPair,
+	PROPERTY_MAXIMUM_PACKET_SIZE:               propertyTypeUint32,
+	PROPERTY_WILDCARD_SUBSCRIPTION_AVAILABLE:   propertyTypeByte,
+	PROPERTY_SUBSCRIPTION_IDENTIFIER_AVAILABLE: propertyTypeByte,
+	PROPERTY_SHARED_SUBSCRIPTION_AVAILABLE:     propertyTypeByte,
+}
+
+// Properties forwarded from PUBLISH to subscribers
+var forwardedProperties = map[uint8]bool{
+	PROPERTY_PAYLOAD_FORMAT_INDICATOR: true,
+	PROPERTY_CONTENT_TYPE:             true,
+	PROPERTY_RESPONSE_TOPIC:           true,
+	PROPERTY_CORRELATION_DATA:         true,
+	PROPERTY_USER_PROPERTY:            true,
+}
+
+type mqttProperty struct {
+	id    uint8
+	value uint32 // Byte, two byte, four byte and variable byte integer
+	data  []uint8
+	key   string // Name of user property
+}
+
+// mqttProperties is ordered property list in MQTT v5 packet
+type mqttProperties []*mqttProperty
+
+// get return the first property with identifier
+func (props mqttProperties) get(id uint8) *mqttProperty {
+	for _, p := range props {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// getInt return integer property with identifier
+func (props mqttProperties) getInt(id uint8) (uint32, bool) {
+	if p := props.get(id); p != nil {
+		return p.value, true
+	}
+	return 0, false
+}
+
+// getString return string property with identifier
+func (props mqttProperties) getString(id uint8) (string, bool) {
+	if p := props.get(id); p != nil {
+		return string(p.data), true
+	}
+	return "", false
+}
+
+// getBytes return binary property with identifier
+func (props mqttProperties) getBytes(id uint8) ([]uint8, bool) {
+	if p := props.get(id); p != nil {
+		return p.data, true
+	}
+	return nil, false
+}
+
+// addInt add integer property
+func (props *mqttProperties) addInt(id uint8, value uint32) {
+	*props = append(*props, &mqttProperty{id: id, value: value})
+}
+
+// addString add string property
+func (props *mqttProperties) addString(id uint8, value string) {
+	*props = append(*props, &mqttProperty{id: id, data: []uint8(value)})
+}
+
+// addBytes add binary property
+func (props *mqttProperties) addBytes(id uint8, value []uint8) {
+	*props = append(*props, &mqttProperty{id: id, data: value})
+}
+
+// forwarded return properties which should be forwarded to subscribers
+func (props mqttProperties) forwarded() mqttProperties {
+	result := mqttProperties{}
+	for _, p := range props {
+		if forwardedProperties[p.id] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// length return encoded length of properties without length field
+func (props mqttProperties) length() int {
+	length := 0
+	for _, p := range props {
+		length++
+		switch propertyTypes[p.id] {
+		case propertyTypeByte:
+			length++
+		case propertyTypeUint16:
+			length += 2
+		case propertyTypeUint32:
+			length += 4
+		case propertyTypeVarInt:
+			length += varIntLength(int(p.value))
+		case propertyTypeString, propertyTypeBinary:
+			length += 2 + len(p.data)
+		case propertyTypeStringPair:
+			length += 4 + len(p.key) + len(p.data)
+		}
+	}
+	return length
+}
+
+// encode serialize properties with length field
+func (props mqttProperties) encode() []uint8 {
+	length := props.length()
+	packet := &mqttPacket{
+		remainingLength: length + varIntLength(length),
+	}
+	packet.initializePacket()
+	packet.writeProperties(props)
+	return packet.payload[packet.length-packet.remainingLength:]
+}
+
+// decodeProperties parse properties with length field from bytes
+func decodeProperties(data []uint8) (mqttProperties, error) {
+	if len(data) == 0 {
+		return mqttProperties{}, nil
+	}
+	packet := &mqttPacket{
+		payload:         data,
+		remainingLength: len(data),
+	}
+	return packet.readProperties()
+}
+
+// varIntLength return length of variable byte integer
+func varIntLength(value int) int {
+	length := 1
+	for value >= 128 {
+		value /= 128
+		length++
+	}
+	return length
+}
+
+// readVarInt read variable byte integer from packet payload
+func (p *mqttPacket) readVarInt() (int, error) {
+	value := 0
+	mult := 1
+	for i := 0; i < 4; i++ {
+		b, err := p.readByte()
+		if err != nil {
+			return 0, err
+		}
+		value += int(b&127) * mult
+		mult *= 128
+		if b&128 == 0 {
+			return value, nil
+		}
+	}
+	return 0, mqttErrorInvalidProtocol
+}
+
+// writeVarInt write variable byte integer into packet payload
+func (p *mqttPacket) writeVarInt(value int) error {
+	for {
+		b := uint8(value % 128)
+		value /= 128
+		if value > 0 {
+			b |= 0x80
+		}
+		if err := p.writeByte(b); err != nil {
+			return err
+		}
+		if value == 0 {
+			return nil
+		}
+	}
+}
+
+// readUint32 read four byte integer from packet payload
+func (p *mqttPacket) readUint32() (uint32, error) {
+	if p.pos+4 > p.remainingLength {
+		return 0, mqttErrorInvalidProtocol
+	}
+	b := p.payload[p.pos : p.pos+4]
+	p.pos += 4
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3]), nil
+}
+
+// writeUint32 write four byte integer into packet payload
+func (p *mqttPacket) writeUint32(data uint32) error {
+	return p.writeBytes([]uint8{uint8(data >> 24), uint8(data >> 16), uint8(data >> 8), uint8(data)})
+}
+
+// readBinary read binary data with length prefix from packet payload
+func (p *mqttPacket) readBinary() ([]uint8, error) {
+	length, err := p.readUint16()
+	if err != nil {
+		return nil, err
+	}
+	return p.readBytes(int(length))
+}
+
+// writeBinary write binary data with length prefix into packet payload
+func (p *mqttPacket) writeBinary(data []uint8) error {
+	if err := p.writeUint16(uint16(len(data))); err != nil {
+		return err
+	}
+	return p.writeBytes(data)
+}
+
+// readProperties read properties with length field from packet payload
+func (p *mqttPacket) readProperties() (mqttProperties, error) {
+	props := mqttProperties{}
+	length, err := p.readVarInt()
+	if err != nil {
+		return nil, err
+	}
+	end := p.pos + length
+	if end > p.remainingLength {
+		return nil, mqttErrorInvalidProtocol
+	}
+	for p.pos < end {
+		id, err := p.readByte()
+		if err != nil {
+			return nil, err
+		}
+		t, ok := propertyTypes[id]
+		if !ok {
+			return nil, fmt.Errorf("Invalid property identifier:%d", id)
+		}
+		prop := &mqttProperty{id: id}
+		switch t {
+		case propertyTypeByte:
+			b, err := p.readByte()
+			if err != nil {
+				return nil, err
+			}
+			prop.value = uint32(b)
+		case propertyTypeUint16:
+			w, err := p.readUint16()
+			if err != nil {
+				return nil, err
+			}
+			prop.value = uint32(w)
+		case propertyTypeUint32:
+			if prop.value, err = p.readUint32(); err != nil {
+				return nil, err
+			}
+		case propertyTypeVarInt:
+			v, err := p.readVarInt()
+			if err != nil {
+				return nil, err
+			}
+			prop.value = uint32(v)
+		case propertyTypeString, propertyTypeBinary:
+			if prop.data, err = p.readBinary(); err != nil {
+				return nil, err
+			}
+		case propertyTypeStringPair:
+			if prop.key, err = p.readString(); err != nil {
+				return nil, err
+			}
+			if prop.data, err = p.readBinary(); err != nil {
+				return nil, err
+			}
+		}
+		// Only user property and subscription identifier can be included
+		// more than once
+		if id != PROPERTY_USER_PROPERTY && id != PROPERTY_SUBSCRIPTION_IDENTIFIER && props.get(id) != nil {
+			return nil, fmt.Errorf("Duplicated property:%d", id)
+		}
+		props = append(props, prop)
+	}
+	if p.pos != end {
+		return nil, mqttErrorInvalidProtocol
+	}
+	return props, nil
+}
+
+// writeProperties write properties with length field into packet payload
+func (p *mqttPacket) writeProperties(props mqttProperties) error {
+	if err := p.writeVarInt(props.length()); err != nil {
+		return err
+	}
+	for _, prop := range props {
+		if err := p.writeByte(prop.id); err != nil {
+			return err
+		}
+		var err error
+		switch propertyTypes[prop.id] {
+		case propertyTypeByte:
+			err = p.writeByte(uint8(prop.value))
+		case propertyTypeUint16:
+			err = p.writeUint16(uint16(prop.value))
+		case propertyTypeUint32:
+			err = p.writeUint32(prop.value)
+		case propertyTypeVarInt:
+			err = p.writeVarInt(int(prop.value))
+		case propertyTypeString, propertyTypeBinary:
+			err = p.writeBinary(prop.data)
+		case propertyTypeStringPair:
+			if err = p.writeString(prop.key); err == nil {
+				err = p.writeBinary(prop.data)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -14,13 +14,21 @@ package mqtt
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/codec"
+	"github.com/cloustone/sentel/broker/event"
+	"github.com/cloustone/sentel/broker/metadata"
+	"github.com/cloustone/sentel/broker/plugins"
+	"github.com/cloustone/sentel/broker/quto"
 	"github.com/cloustone/sentel/core"
 
 	auth "github.com/cloustone/sentel/broker/auth"
@@ -43,12 +51,20 @@ const (
 	mqttStateExpiring       = 9
 )
 
+// Time to wait for old connection to be closed when client is connected
+// again
+const sessionTakeoverTimeout = 5 * time.Second
+
+// Maximum PUBLISH waiting for rate limit delay, more are dropped
+const maxDelayedPublishes = 64
+
 // mqtt protocol
 const (
 	mqttProtocolInvalid = 0
 	mqttProtocol31      = 1
 	mqttProtocol311     = 2
 	mqttProtocolS       = 3
+	mqttProtocol5       = 4
 )
 
 type mqttSession struct {
@@ -78,13 +94,57 @@ type mqttSession struct {
 	sendStopChannel   chan int
 	sendPacketChannel chan *mqttPacket
 	sendMsgChannel    chan *mqttMessage
+	flushChannel      chan struct{} // Wake up sender to send queued qos1/2 messages
 	waitgroup         sync.WaitGroup
 	stats             *base.Stats
 	metrics           *base.Metrics
 
 	// resume field
-	msgs       []*mqttMessage
-	storedMsgs []*mqttMessage
+	connectTimeout time.Duration
+	lastMid        uint16
+	maxInflight    int
+	retryInterval  time.Duration
+	msgMutex       sync.Mutex // Protect msgs, storedMsgs and lastMid
+	msgs           []*mqttMessage
+	storedMsgs     []*mqttMessage
+
+	// Offline message queue limits for persistent session
+	queueLimits  queueLimits
+	offlineMutex sync.Mutex
+
+	// Closed after session is destroyed
+	destroyed chan struct{}
+
+	// Quota of client and tenant
+	quto   *quto.Quto
+	tenant string // Mount point whose connection is counted
+	// PUBLISH delayed by rate limit, later ones are queued to keep order
+	delayedChannel chan *publishRequest
+	delayedCount   int32
+
+	events *event.Bus
+	codecs *codec.Pipeline
+
+	// Device which client is authenticated as
+	metadata *metadata.Cache
+	device   *metadata.Device
+	// Identity is verified by certificate, observer or device registry
+	authenticated bool
+
+	// MQTT v5 field
+	cleanStart       uint8
+	sessionExpiry    uint32
+	receiveMaximum   int
+	maxPacketSize    uint32
+	topicAliasMax    uint16
+	topicAliases     map[uint16]string
+	clientIDAssigned bool
+	authMethod       string
+	authData         []uint8
+	willDelay        uint32
+	willExpiry       uint32
+	connectedAt      time.Time
+	createdAt        time.Time
 }
 
 // newMqttSession create new session  for each client connection
@@ -103,6 +163,25 @@ func newMqttSession(m *mqtt, conn net.Conn, id string) (*mqttSession, error) {
 	if err != nil {
 		msgqsize = 10
 	}
+	// Get max inflight messages and retry interval for qos1/2 messages
+	maxInflight, err := m.config.Int(m.protocol, "max_inflight_messages")
+	if err != nil || maxInflight <= 0 || maxInflight > 65535 {
+		maxInflight = 20
+	}
+	retryInterval, err := m.config.Int(m.protocol, "retry_interval")
+	if err != nil || retryInterval <= 0 {
+		retryInterval = 20
+	}
+	// Get timeout for connection which never send CONNECT
+	connectTimeout, err := m.config.Int(m.protocol, "connect_timeout")
+	if err != nil || connectTimeout <= 0 {
+		connectTimeout = 30
+	}
+	// Get topic alias maximum for MQTT v5 client
+	maxTopicAlias, err := m.config.Int(m.protocol, "max_topic_alias")
+	if err != nil || maxTopicAlias < 0 || maxTopicAlias > 65535 {
+		maxTopicAlias = 0
+	}
 
 	s := &mqttSession{
 		mgr:               m,
@@ -116,13 +195,29 @@ func newMqttSession(m *mqtt, conn net.Conn, id string) (*mqttSession, error) {
 		protocol:          mqttProtocolInvalid,
 		observer:          nil,
 		sendStopChannel:   make(chan int),
+		delayedChannel:    make(chan *publishRequest, maxDelayedPublishes),
 		sendPacketChannel: make(chan *mqttPacket, qsize),
 		authapi:           authapi,
 		stats:             base.NewStats(true),
 		metrics:           base.NewMetrics(true),
 		sendMsgChannel:    make(chan *mqttMessage, msgqsize),
-		msgs:              make([]*mqttMessage, msgqsize),
-		storedMsgs:        make([]*mqttMessage, msgqsize),
+		flushChannel:      make(chan struct{}, 1),
+		lastMessageIn:     time.Now(),
+		connectTimeout:    time.Duration(connectTimeout) * time.Second,
+		maxInflight:       maxInflight,
+		retryInterval:     time.Duration(retryInterval) * time.Second,
+		msgs:              make([]*mqttMessage, 0, msgqsize),
+		storedMsgs:        make([]*mqttMessage, 0, msgqsize),
+		receiveMaximum:    maxInflight,
+		topicAliasMax:     uint16(maxTopicAlias),
+		topicAliases:      make(map[uint16]string),
+		queueLimits:       getQueueLimits(m.config, m.protocol),
+		quto:              quto.GetQuto(m.config),
+		events:            event.GetBus(m.config),
+		codecs:            codec.GetPipeline(m.config),
+		metadata:          metadata.GetCache(m.config),
+		createdAt:         time.Now(),
+		destroyed:         make(chan struct{}),
 	}
 
 	return s, nil
@@ -138,39 +233,281 @@ func (s *mqttSession) RegisterObserver(o base.SessionObserver) {
 }
 func (s *mqttSession) GetStats() *base.Stats     { return s.stats }
 func (s *mqttSession) GetMetrics() *base.Metrics { return s.metrics }
-func (s *mqttSession) Info() *base.SessionInfo   { return nil }
+
+// Info return session information
+func (s *mqttSession) Info() *base.SessionInfo {
+	info := &base.SessionInfo{
+		ClientId:           s.clientID,
+		CleanSession:       s.cleanSession > 0,
+		MessageMaxInflight: uint64(s.maxInflight),
+		MessageDropped:     s.metrics.GetMetric(metricMessageDroped),
+		// Messages queued in storage while client is offline
+		MessageInQueue: uint64(s.storage.GetMessageTotalCount(s.clientID)),
+	}
+	if !s.createdAt.IsZero() {
+		info.CreatedAt = s.createdAt.Format(time.RFC3339)
+	}
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	for _, msg := range s.msgs {
+		switch msg.state {
+		case mqttMessateStateQueued:
+			info.MessageInQueue++
+		case mqttMessageStateWaitForPubAck, mqttMessageStateWaitForPubRec:
+			info.MessageInflight++
+			info.AwaitingAck++
+		case mqttMessageStateWaitForPubComp:
+			info.MessageInflight++
+			info.AwaitingComp++
+		}
+	}
+	info.AwaitingRel = uint64(len(s.storedMsgs))
+	return info
+}
+
+// storageSession return session information saved by persistent storage
+func (s *mqttSession) storageSession() StorageSession {
+	return StorageSession{
+		Id:           s.clientID,
+		Username:     s.username,
+		Keepalive:    s.keepalive,
+		CleanSession: s.cleanSession,
+		Protocol:     s.protocol,
+		CreatedAt:    s.createdAt,
+		Service:      s.mgr.protocol,
+	}
+}
+
+// notify publish event of the client to event bus, and call observer's
+// hook of the event
+func (s *mqttSession) notify(e *event.Event) {
+	if s.events == nil {
+		return
+	}
+	e.Timestamp = time.Now()
+	if e.ClientID == "" {
+		e.ClientID = s.clientID
+	}
+	if e.Username == "" {
+		e.Username = s.username
+	}
+	e.Protocol = s.mgr.protocol
+	if s.conn != nil {
+		e.Address = s.conn.RemoteAddr().String()
+	}
+	e.MountPoint = s.mountPoint()
+	if s.observer != nil {
+		switch e.Type {
+		case event.ClientConnected:
+			s.observer.OnConnect(s, e)
+		case event.ClientDisconnected:
+			s.observer.OnDisconnect(s, e)
+		case event.MessagePublished:
+			s.observer.OnPublish(s, e)
+		case event.MessageDelivered:
+			s.observer.OnMessage(s, e)
+		case event.SessionSubscribed:
+			s.observer.OnSubscribe(s, e)
+		case event.SessionUnsubscribed:
+			s.observer.OnUnsubscribe(s, e)
+		}
+	}
+	s.events.Notify(e)
+}
+
+// notifyAuthFailed notify authentication failure of client which is not
+// connected yet
+func (s *mqttSession) notifyAuthFailed(clientid string, username string, reason string) {
+	s.notify(&event.Event{Type: event.AuthFailed, ClientID: clientid, Username: username, Reason: reason})
+}
+
+// notifyPublished notify message published by the client is accepted
+func (s *mqttSession) notifyPublished(msg *StorageMessage) {
+	s.notify(&event.Event{Type: event.MessagePublished, Topic: msg.Topic, Qos: msg.Qos, Retain: msg.Retain, Payload: msg.Payload})
+}
+
+// mountPoint return mount point prefixed to topics of client, it is given
+// by observer or by the device client is authenticated as
+func (s *mqttSession) mountPoint() string {
+	if s.observer != nil {
+		if mp := s.observer.OnGetMountPoint(); mp != "" {
+			return mp
+		}
+	}
+	if s.device != nil {
+		return s.device.MountPoint()
+	}
+	return ""
+}
+
+// authenticateDevice authenticate client as device in metadata cache, the
+// device secret is not checked if client is authenticated by certificate
+func (s *mqttSession) authenticateDevice(username string, password string, certAuthenticated bool) (*metadata.Device, error) {
+	if !certAuthenticated {
+		return s.metadata.Authenticate(username, password)
+	}
+	name, key, err := metadata.ParseUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	device := s.metadata.GetDevice(key, name)
+	if device == nil {
+		return nil, metadata.ErrorDeviceNotFound
+	}
+	return device, s.metadata.Authorize(device)
+}
+
+// checkAcl check topic access with plugins and auth api, and check whether
+// device of client is still enabled
+func (s *mqttSession) checkAcl(clientid string, topic string, access string) error {
+	// $SYS topics are published by broker only
+	if access == auth.AclActionWrite && isSysTopic(topic) {
+		return fmt.Errorf("Client can not publish on '%s'", topic)
+	}
+	if err := plugins.CheckAcl(clientid, s.username, topic, access); err != nil {
+		return err
+	}
+	if err := s.authapi.CheckAcl(context.Background(), clientid, s.username, topic, access); err != nil {
+		return err
+	}
+	if s.device != nil {
+		return s.metadata.Authorize(s.device)
+	}
+	return nil
+}
+
+// kickoff disconnect client by server, MQTT v5 client is notified with
+// reason code
+func (s *mqttSession) kickoff(reason uint8) {
+	if s.protocol == mqttProtocol5 && s.isConnected() {
+		s.queuePacket(newDisconnectPacket(reason))
+	}
+	// Blocked reading is interrupted, and the session is destroyed
+	s.conn.SetReadDeadline(time.Now())
+}
+
+// dropMessage count message dropped for the client
+func (s *mqttSession) dropMessage(topic string, qos uint8, reason string) {
+	s.mgr.metrics.AddMetric(metricMessageDroped, 1)
+	s.metrics.AddMetric(metricMessageDroped, 1)
+	s.notify(&event.Event{Type: event.MessageDropped, Topic: topic, Qos: qos, Reason: reason})
+}
+
+// clientInfo return client information with tls state of connection
+func (s *mqttSession) clientInfo() *base.ClientInfo {
+	version, cipher := connectionTLSInfo(s.conn)
+	info := &base.ClientInfo{
+		UserName:     s.username,
+		CleanSession: (s.cleanSession == 1),
+		PeerName:     s.conn.RemoteAddr().String(),
+		TLSVersion:   version,
+		TLSCipher:    cipher,
+	}
+	if !s.connectedAt.IsZero() {
+		info.ConnectTime = s.connectedAt.Format(time.RFC3339)
+	}
+	return info
+}
 
 // launchPacketSendHandler launch goroutine to send packet queued for client
 func (s *mqttSession) launchPacketSendHandler() {
-	go func(stopChannel chan int, packetChannel chan *mqttPacket, msgChannel chan *mqttMessage) {
-		defer s.waitgroup.Add(1)
+	s.waitgroup.Add(1)
+	go func(stopChannel chan int, packetChannel chan *mqttPacket, msgChannel chan *mqttMessage, flushChannel chan struct{}) {
+		defer s.waitgroup.Done()
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
 
 		for {
 			select {
 			case <-stopChannel:
+				s.drainPackets(packetChannel)
 				return
 			case p := <-packetChannel:
-				for p.toprocess > 0 {
-					len, err := s.conn.Write(p.payload[p.pos:p.toprocess])
-					if err != nil {
-						glog.Fatal("Failed to send packet to '%s:%s'", s.id, err)
-						return
-					}
-					if len > 0 {
-						p.toprocess -= len
-						p.pos += len
-					} else {
-						glog.Fatal("Failed to send packet to '%s'", s.id)
-						return
-					}
+				if err := s.writePacket(p); err != nil {
+					glog.Errorf("Failed to send packet to '%s':%s", s.id, err)
+					s.conn.Close()
+					return
 				}
 			case msg := <-msgChannel:
 				s.processMessage(msg)
-			case <-time.After(1 * time.Second):
-				s.processTimeout()
+			case <-flushChannel:
+				if err := s.sendOutMessages(); err != nil {
+					glog.Errorf("Failed to send packet to '%s':%s", s.id, err)
+					s.conn.Close()
+					return
+				}
+			case <-ticker.C:
+				if err := s.processTimeout(); err != nil {
+					glog.Errorf("Failed to send packet to '%s':%s", s.id, err)
+					s.conn.Close()
+					return
+				}
+			}
+		}
+	}(s.sendStopChannel, s.sendPacketChannel, s.sendMsgChannel, s.flushChannel)
+}
+
+// drainPackets write packets left in channel before sender quit, such as
+// DISCONNECT sent to MQTT v5 client on error
+func (s *mqttSession) drainPackets(packetChannel chan *mqttPacket) {
+	s.conn.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	for {
+		select {
+		case p := <-packetChannel:
+			if err := s.writePacket(p); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// launchDelayedPublishHandler process PUBLISH delayed by rate limit in
+// order, so that reading of PINGREQ and acknowledges is not blocked
+func (s *mqttSession) launchDelayedPublishHandler() {
+	s.waitgroup.Add(1)
+	go func(stopChannel chan int, delayedChannel chan *publishRequest) {
+		defer s.waitgroup.Done()
+		for {
+			select {
+			case <-stopChannel:
+				return
+			case req := <-delayedChannel:
+				timer := time.NewTimer(time.Until(req.due))
+				select {
+				case <-stopChannel:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+				err := s.processPublish(req)
+				atomic.AddInt32(&s.delayedCount, -1)
+				if err != nil {
+					glog.Error(err)
+					s.kickoff(reasonCodeOfError(err))
+					return
+				}
 			}
 		}
-	}(s.sendStopChannel, s.sendPacketChannel, s.sendMsgChannel)
+	}(s.sendStopChannel, s.delayedChannel)
+}
+
+// writePacket write packet to connection, it should only be called in
+// packet send handler
+func (s *mqttSession) writePacket(p *mqttPacket) error {
+	for p.toprocess > 0 {
+		len, err := s.conn.Write(p.payload[p.pos:p.length])
+		if err != nil {
+			return err
+		}
+		if len <= 0 {
+			return errors.New("Connection closed")
+		}
+		p.toprocess -= len
+		p.pos += len
+	}
+	return nil
 }
 
 // processMessage proceess messages
@@ -179,12 +516,92 @@ func (s *mqttSession) processMessage(msg *mqttMessage) error {
 	return nil
 }
 
-// processTimeout proceess timeout
+// processTimeout proceess timeout, reap idle connection and retransmit
+// inflight messages which have not been acknowledged in retry interval
 func (s *mqttSession) processTimeout() error {
+	now := time.Now()
+	if expired, connected := s.checkExpired(now); expired {
+		// MQTT v5 client is notified with reason before reaped
+		if connected && s.protocol == mqttProtocol5 {
+			s.writePacket(newDisconnectPacket(REASON_KEEP_ALIVE_TIMEOUT))
+		}
+		// Closing the connection let the session be destroyed through
+		// normal disconnect path in Handle
+		s.conn.Close()
+		return nil
+	}
+	packets := []*mqttPacket{}
 
+	s.msgMutex.Lock()
+	for _, msg := range s.msgs {
+		if msg.state == mqttMessateStateQueued || now.Sub(msg.timestamp) < s.retryInterval {
+			continue
+		}
+		msg.timestamp = now
+		switch msg.state {
+		case mqttMessageStateWaitForPubAck, mqttMessageStateWaitForPubRec:
+			msg.dup = true
+			packets = append(packets, s.newPublishPacket(msg))
+		case mqttMessageStateWaitForPubComp:
+			packets = append(packets, newCommandPacket(PUBREL|0x02, msg.mid, false))
+		}
+	}
+	s.msgMutex.Unlock()
+
+	for _, p := range packets {
+		glog.Infof("Resending packet(%d) to %s", p.command&0xF0, s.id)
+		if err := s.writePacket(p); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// checkExpired check wether the connection should be reaped, a client
+// which never send CONNECT is reaped after connect timeout, and a connected
+// client is reaped if no packet is received in 1.5 times of keepalive
+func (s *mqttSession) checkExpired(now time.Time) (expired bool, connected bool) {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	idle := now.Sub(s.lastMessageIn)
+	switch s.state {
+	case mqttStateNew:
+		if idle > s.connectTimeout {
+			glog.Infof("Client %s has not sent CONNECT in %v, disconnecting", s.id, s.connectTimeout)
+			return true, false
+		}
+	case mqttStateConnected:
+		if s.keepalive > 0 && idle > time.Duration(s.keepalive)*time.Second*3/2 {
+			glog.Infof("Client %s has exceeded timeout, disconnecting", s.clientID)
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// isConnected return wether client is connected
+func (s *mqttSession) isConnected() bool {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+	return s.state == mqttStateConnected
+}
+
+// setState change session state, the state is also read by packet send
+// handler in checkExpired
+func (s *mqttSession) setState(state uint8) {
+	s.stateMutex.Lock()
+	s.state = state
+	s.stateMutex.Unlock()
+}
+
+// updateLastMessageIn record the time when packet is received
+func (s *mqttSession) updateLastMessageIn() {
+	s.stateMutex.Lock()
+	s.lastMessageIn = time.Now()
+	s.stateMutex.Unlock()
+}
+
 // Handle is mainprocessor for iot device client
 func (s *mqttSession) Handle() error {
 
@@ -192,13 +609,25 @@ func (s *mqttSession) Handle() error {
 	defer s.Destroy()
 
 	s.launchPacketSendHandler()
+	s.launchDelayedPublishHandler()
 	for {
 		var err error
 		if err = s.inpacket.DecodeFromReader(s.conn, base.NilDecodeFeedback{}); err != nil {
 			glog.Error(err)
 			return err
 		}
-		switch s.inpacket.command & 0xF0 {
+		s.updateLastMessageIn()
+		command := s.inpacket.command & 0xF0
+		// Only CONNECT is allowed before connection is accepted, and AUTH
+		// while enhanced authentication is in progress
+		if s.state != mqttStateConnected && command != CONNECT &&
+			!(command == AUTH && s.state == mqttStateConnectPending) &&
+			!(command == DISCONNECT && s.state == mqttStateConnectPending) {
+			err = fmt.Errorf("Unexpected command %d before connection is accepted", int(command))
+			glog.Error(err)
+			return err
+		}
+		switch command {
 		case PINGREQ:
 			err = s.handlePingReq()
 		case CONNECT:
@@ -207,17 +636,29 @@ func (s *mqttSession) Handle() error {
 			err = s.handleDisconnect()
 		case PUBLISH:
 			err = s.handlePublish()
+		case PUBACK:
+			err = s.handlePubAck()
+		case PUBREC:
+			err = s.handlePubRec()
 		case PUBREL:
 			err = s.handlePubRel()
+		case PUBCOMP:
+			err = s.handlePubComp()
 		case SUBSCRIBE:
 			err = s.handleSubscribe()
 		case UNSUBSCRIBE:
 			err = s.handleUnsubscribe()
+		case AUTH:
+			err = s.handleAuth()
 		default:
 			err = fmt.Errorf("Unrecognized protocol command:%d", int(s.inpacket.command&0xF0))
 		}
 		if err != nil {
 			glog.Error(err)
+			// Notify MQTT v5 client with reason code before disconnecting
+			if s.protocol == mqttProtocol5 && s.state == mqttStateConnected {
+				s.queuePacket(newDisconnectPacket(reasonCodeOfError(err)))
+			}
 			return err
 		}
 		// Check sesstion state
@@ -231,16 +672,104 @@ func (s *mqttSession) Handle() error {
 
 // Destroy will destory the current session
 func (s *mqttSession) Destroy() error {
-	// Stop packet sender goroutine
-	s.sendStopChannel <- 1
+	// Session is not closed by DISCONNECT, publish will message
+	s.publishWillMessage()
+	// Stop packet sender goroutine, packets left are sent before it quit
+	close(s.sendStopChannel)
 	s.waitgroup.Wait()
+	s.disconnect()
+	s.redispatchSharedMessages()
+	if !s.connectedAt.IsZero() {
+		s.notify(&event.Event{Type: event.ClientDisconnected})
+	}
 	if s.conn != nil {
 		s.conn.Close()
 	}
+	s.quto.ReleaseConnection(s.tenant)
+	s.quto.ReleaseClient(s.clientID)
 	s.mgr.removeSession(s)
+	close(s.destroyed)
 	return nil
 }
 
+// takeover close connection of the session whose client is connected
+// again, it return after the session is destroyed so that its state can be
+// taken over by the new connection
+func (s *mqttSession) takeover() {
+	if s.conn == nil || s.destroyed == nil {
+		return
+	}
+	select {
+	case <-s.destroyed:
+		return
+	default:
+	}
+	glog.Infof("Session of %s is taken over", s.clientID)
+	go s.kickoff(REASON_SESSION_TAKEN_OVER)
+	select {
+	case <-s.destroyed:
+		return
+	case <-time.After(sessionTakeoverTimeout):
+	}
+	// Client doesn't read packets, connection is closed immediately
+	glog.Warningf("Session of %s is not closed in %v, closing connection", s.clientID, sessionTakeoverTimeout)
+	s.conn.Close()
+	select {
+	case <-s.destroyed:
+	case <-time.After(sessionTakeoverTimeout):
+		glog.Errorf("Session of %s is not destroyed after connection is closed", s.clientID)
+	}
+}
+
+// redispatchSharedMessages dispatch messages received through shared
+// subscription to other members, if they are not acknowledged by client
+func (s *mqttSession) redispatchSharedMessages() {
+	msgs := []*mqttMessage{}
+	s.msgMutex.Lock()
+	remains := s.msgs[:0]
+	for _, msg := range s.msgs {
+		// Qos2 message is owned by client after PUBREC is received
+		if msg.share != "" && msg.state != mqttMessageStateWaitForPubComp {
+			msgs = append(msgs, msg)
+			continue
+		}
+		remains = append(remains, msg)
+	}
+	s.msgs = remains
+	s.msgMutex.Unlock()
+
+	for _, msg := range msgs {
+		glog.Infof("Redispatching message on '%s' from %s in '%s'", msg.topic, s.id, msg.share)
+		if err := s.storage.QueueSharedMessage(msg.share, s.clientID, *msg.origin); err != nil {
+			glog.Errorf("Failed to redispatch message in '%s':%s", msg.share, err)
+			s.dropMessage(msg.topic, msg.qos, err.Error())
+		}
+	}
+}
+
+// unacknowledgedMessages return outgoing messages not received by client,
+// they are transferred with session to other node
+func (s *mqttSession) unacknowledgedMessages() []StorageMessage {
+	msgs := []StorageMessage{}
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	for _, msg := range s.msgs {
+		if msg.direction != mqttMessageDirectionOut || msg.share != "" || msg.state == mqttMessageStateWaitForPubComp {
+			continue
+		}
+		msgs = append(msgs, StorageMessage{
+			Topic:      msg.topic,
+			Direction:  MessageDirectionOut,
+			Qos:        msg.qos,
+			Retain:     msg.retain,
+			Payload:    msg.payload,
+			Properties: msg.properties,
+			ExpiryAt:   msg.expiry,
+		})
+	}
+	return msgs
+}
+
 // generateId generate id fro session or client
 func (s *mqttSession) generateId() string {
 	return uuid.NewV4().String()
@@ -274,10 +803,15 @@ func (s *mqttSession) handleConnect() error {
 			s.sendConnAck(0, CONNACK_REFUSED_PROTOCOL_VERSION)
 			return fmt.Errorf("Invalid protocol version '%d' in CONNECT packet", protocolVersion)
 		}
-		s.protocol = mqttProtocol311
+		s.protocol = mqttProtocol31
 
 	case PROTOCOL_NAME_V311:
-		if protocolVersion&0x7F != PROTOCOL_VERSION_V311 {
+		switch protocolVersion & 0x7F {
+		case PROTOCOL_VERSION_V311:
+			s.protocol = mqttProtocol311
+		case PROTOCOL_VERSION_V5:
+			s.protocol = mqttProtocol5
+		default:
 			s.sendConnAck(0, CONNACK_REFUSED_PROTOCOL_VERSION)
 			return fmt.Errorf("Invalid protocol version '%d' in CONNECT packet", protocolVersion)
 		}
@@ -285,7 +819,6 @@ func (s *mqttSession) handleConnect() error {
 		if s.inpacket.command&0x0F != 0x00 {
 			return fmt.Errorf("Invalid protocol version '%d' in CONNECT packet", protocolVersion)
 		}
-		s.protocol = mqttProtocol311
 	default:
 		return fmt.Errorf("Invalid protocol name '%s' in CONNECT packet", protocolName)
 	}
@@ -295,13 +828,9 @@ func (s *mqttSession) handleConnect() error {
 	if err != nil {
 		return nil
 	}
-	/*
-		if s.mgr.protocol == mqttProtocol311 {
-			if cflags&0x01 != 0x00 {
-				return errors.New("Invalid protocol version in connect flags")
-			}
-		}
-	*/
+	if s.protocol == mqttProtocol5 && cflags&0x01 != 0x00 {
+		return mqttErrorInvalidProtocol
+	}
 	cleanSession := (cflags & 0x02) >> 1
 	will := cflags & 0x04
 	willQos := (cflags & 0x18) >> 3
@@ -318,6 +847,19 @@ func (s *mqttSession) handleConnect() error {
 	}
 	s.keepalive = keepalive
 
+	// Deal with properties in MQTT v5
+	var authData []uint8
+	if s.protocol == mqttProtocol5 {
+		props, err := s.inpacket.readProperties()
+		if err != nil {
+			return err
+		}
+		if err := s.applyConnectProperties(props); err != nil {
+			return err
+		}
+		authData, _ = props.getBytes(PROPERTY_AUTHENTICATION_DATA)
+	}
+
 	// Deal with client identifier
 	clientid, err := s.inpacket.readString()
 	if err != nil {
@@ -326,13 +868,15 @@ func (s *mqttSession) handleConnect() error {
 	if clientid == "" {
 		if s.protocol == mqttProtocol31 {
 			s.sendConnAck(0, CONNACK_REFUSED_IDENTIFIER_REJECTED)
+			return errors.New("Invalid mqtt packet with client id")
 		} else {
-			if option, err := s.config.Bool(s.mgr.protocol, "allow_zero_length_clientid"); err != nil && (!option || cleanSession == 0) {
+			option, err := s.config.Bool(s.mgr.protocol, "allow_zero_length_clientid")
+			if err != nil || !option || (s.protocol == mqttProtocol311 && cleanSession == 0) {
 				s.sendConnAck(0, CONNACK_REFUSED_IDENTIFIER_REJECTED)
 				return errors.New("Invalid mqtt packet with client id")
 			}
-
 			clientid = s.generateId()
+			s.clientIDAssigned = true
 		}
 	}
 
@@ -345,16 +889,25 @@ func (s *mqttSession) handleConnect() error {
 
 	if will > 0 {
 		willMsg = new(mqttMessage)
+		// Will properties in MQTT v5
+		if s.protocol == mqttProtocol5 {
+			props, err := s.inpacket.readProperties()
+			if err != nil {
+				return err
+			}
+			s.willDelay, _ = props.getInt(PROPERTY_WILL_DELAY_INTERVAL)
+			s.willExpiry, _ = props.getInt(PROPERTY_MESSAGE_EXPIRY_INTERVAL)
+			if forwarded := props.forwarded(); len(forwarded) > 0 {
+				willMsg.properties = forwarded.encode()
+			}
+		}
 		// Get topic
 		topic, err := s.inpacket.readString()
 		if err != nil || topic == "" {
-			return nil
+			return mqttErrorInvalidProtocol
 		}
 		willTopic = topic
-		if s.observer != nil {
-			willTopic = s.observer.OnGetMountPoint() + topic
-		}
-		if err := checkTopicValidity(willTopic); err != nil {
+		if err := checkPublishTopic(willTopic); err != nil {
 			return err
 		}
 		// Get willtopic's payload
@@ -369,7 +922,7 @@ func (s *mqttSession) handleConnect() error {
 			}
 		}
 	} else {
-		if s.protocol == mqttProtocol311 {
+		if s.protocol != mqttProtocol31 {
 			if willQos != 0 || willRetain {
 				return mqttErrorInvalidProtocol
 			}
@@ -405,15 +958,43 @@ func (s *mqttSession) handleConnect() error {
 			if passwordFlag > 0 {
 				return mqttErrorInvalidProtocol
 			}
+		} else if s.protocol == mqttProtocol5 && passwordFlag > 0 {
+			// Password without username is allowed in MQTT v5
+			if password, err = s.inpacket.readString(); err != nil {
+				return err
+			}
 		}
 	}
 
-	if usernameFlag > 0 {
+	// Identity in verified client certificate is used as username or
+	// client id, the client is authenticated by the certificate
+	certAuthenticated := false
+	if identity, ok := s.certificateIdentity(); ok {
+		if identity == "" {
+			s.notifyAuthFailed(clientid, username, "No identity in certificate")
+			s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
+			return mqttErrorAutoFailed
+		}
+		if as, _ := s.config.String("security", "certificate_identity_as"); as == "clientid" {
+			clientid = identity
+			s.clientIDAssigned = false
+		} else {
+			username = identity
+			certAuthenticated = true
+		}
+	}
+
+	if certAuthenticated {
+		s.username = username
+		s.password = ""
+		s.authenticated = true
+	} else if usernameFlag > 0 {
 		if s.observer != nil {
 			err := s.observer.OnAuthenticate(s, username, password)
 			switch err {
 			case nil:
 			case base.IotErrorAuthFailed:
+				s.notifyAuthFailed(clientid, username, err.Error())
 				s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
 				s.disconnect()
 				return err
@@ -422,74 +1003,198 @@ func (s *mqttSession) handleConnect() error {
 				return err
 
 			}
-			// Get username and passowrd sucessfuly
-			s.username = username
-			s.password = password
+			s.authenticated = true
 		}
+		// Get username and passowrd sucessfuly
+		s.username = username
+		s.password = password
+	} else {
 		// Get anonymous allow configuration
 		allowAnonymous, _ := s.config.Bool(s.mgr.protocol, "allow_anonymous")
-		if usernameFlag > 0 && allowAnonymous == false {
+		if allowAnonymous == false && s.authMethod == "" {
 			// Dont allow anonymous client connection
+			s.notifyAuthFailed(clientid, "", "Anonymous client is not allowed")
 			s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
 			return mqttErrorInvalidProtocol
 		}
 	}
+	// Client is authenticated as device registered in apiserver
+	if s.metadata.Enabled() {
+		device, err := s.authenticateDevice(username, password, certAuthenticated)
+		if err != nil {
+			glog.Errorf("Client %s is rejected as device:%s", clientid, err)
+			s.notifyAuthFailed(clientid, username, err.Error())
+			s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
+			return err
+		}
+		s.device = device
+		s.authenticated = true
+	}
+	// Authentication hooks of plugins
+	if err := plugins.Authenticate(clientid, s.username, s.password); err != nil {
+		glog.Errorf("Client %s is rejected by plugin:%s", clientid, err)
+		s.notifyAuthFailed(clientid, s.username, err.Error())
+		s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
+		return err
+	}
 	// Check wether username will be used as client id,
 	// The connection request will be refused if the option is set
-	if option, err := s.config.Bool(s.mgr.protocol, "user_name_as_client_id"); err != nil && option {
+	if option, err := s.config.Bool(s.mgr.protocol, "user_name_as_client_id"); err == nil && option {
 		if s.username != "" {
 			clientid = s.username
+			s.clientIDAssigned = false
 		} else {
 			s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
 			return mqttErrorInvalidProtocol
 		}
 	}
+	// Check will topic access before the connection is accepted
+	if willMsg != nil {
+		willTopic = s.mountPoint() + willTopic
+		if err := s.checkAcl(clientid, willTopic, auth.AclActionWrite); err != nil {
+			glog.Errorf("Will topic '%s' is denied for %s:%s", willTopic, clientid, err)
+			s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
+			return err
+		}
+		s.willMsg = willMsg
+		s.willMsg.topic = willTopic
+		if len(payload) > 0 {
+			s.willMsg.payload = append([]uint8{}, payload...)
+		} else {
+			s.willMsg.payload = nil
+		}
+		s.willMsg.qos = willQos
+		s.willMsg.retain = willRetain
+	}
+	s.clientID = clientid
+	s.cleanStart = cleanSession
+	s.cleanSession = cleanSession
+	if s.protocol == mqttProtocol5 {
+		// Session is kept after disconnect only if session expiry is set
+		s.cleanSession = 0
+		if s.sessionExpiry == 0 {
+			s.cleanSession = 1
+		}
+	}
+
+	// Enhanced authentication in MQTT v5
+	if s.authMethod != "" {
+		if getAuthMethod(s.authMethod) == nil {
+			s.sendConnAck(0, REASON_BAD_AUTHENTICATION_METHOD)
+			return fmt.Errorf("Unsupported authentication method '%s' from %s", s.authMethod, s.id)
+		}
+		return s.continueAuthentication(authData)
+	}
+	return s.acceptConnect()
+}
+
+// applyConnectProperties apply properties in CONNECT packet of MQTT v5
+func (s *mqttSession) applyConnectProperties(props mqttProperties) error {
+	s.sessionExpiry, _ = props.getInt(PROPERTY_SESSION_EXPIRY_INTERVAL)
+	if max, ok := props.getInt(PROPERTY_RECEIVE_MAXIMUM); ok {
+		if max == 0 {
+			return mqttErrorInvalidProtocol
+		}
+		// Outgoing qos1/2 messages are limited by client's receive maximum
+		if int(max) < s.maxInflight {
+			s.maxInflight = int(max)
+		}
+	}
+	if size, ok := props.getInt(PROPERTY_MAXIMUM_PACKET_SIZE); ok {
+		if size == 0 {
+			return mqttErrorInvalidProtocol
+		}
+		s.maxPacketSize = size
+	}
+	s.authMethod, _ = props.getString(PROPERTY_AUTHENTICATION_METHOD)
+	return nil
+}
+
+// certificateIdentity return identity in client certificate if identity
+// mapping is configured and client is connected through tls
+func (s *mqttSession) certificateIdentity() (string, bool) {
+	kind, err := s.config.String("security", "certificate_identity")
+	if err != nil || kind == certIdentityNone {
+		return "", false
+	}
+	if _, ok := s.conn.(*tls.Conn); !ok {
+		return "", false
+	}
+	return certificateIdentity(s.conn, kind), true
+}
+
+// acceptConnect accept the connection after client is authenticated
+func (s *mqttSession) acceptConnect() error {
+	clientid := s.clientID
+	// Client connected already is disconnected, and will message of old
+	// connection is published before its state is taken over
+	if found, _ := s.storage.FindSession(clientid); found != nil && found != s {
+		found.takeover()
+	}
+	// Connections of tenant are limited by quota
+	if s.observer != nil || s.device != nil {
+		tenant := s.mountPoint()
+		if v := s.quto.AcquireConnection(tenant); v != nil {
+			glog.Errorf("Connection of %s is rejected:%s", clientid, v)
+			s.mgr.metrics.AddMetric(quto.MetricConnectionsRejected, 1)
+			if s.protocol == mqttProtocol5 {
+				s.sendConnAck(0, REASON_QUOTA_EXCEEDED)
+			} else {
+				s.sendConnAck(0, CONNACK_REFUSED_SERVER_UNAVAILABLE)
+			}
+			return v
+		}
+		s.tenant = tenant
+	}
+	// Delayed will message is not published if client reconnect in time
+	s.mgr.cancelWillMessage(clientid)
+
 	conack := 0
+	resumed := false
+	waiting := false
 	// Find if the client already has an entry, this must be done after any security check
 	if found, _ := s.storage.FindSession(clientid); found != nil {
 		// Found old session
 		if found.state == mqttStateInvalid {
 			glog.Errorf("Invalid session(%s) in store", found.id)
 		}
-		if s.protocol == mqttProtocol311 {
-			if cleanSession == 0 {
-				conack |= 0x01
-			}
+		if s.cleanStart == 0 && found.cleanSession == 0 {
+			// Resume last session, subscriptions are kept in storage
+			s.resumeSession(found)
+			s.storage.UpdateSession(s)
+			resumed = true
+		} else {
+			// Subscriptions and queued messages of old session are discarded
+			s.storage.DeleteSession(clientid)
+			s.storage.RegisterSession(s)
 		}
-		s.cleanSession = cleanSession
-
-		if s.cleanSession == 0 && found.cleanSession == 0 {
-			// Resume last session   // fix me ssddn
+	} else if ss, err := s.storage.FindStoredSession(clientid); err == nil {
+		// Session restored from backup only carry state saved in storage
+		if s.cleanStart == 0 && ss.CleanSession == 0 {
+			if !ss.CreatedAt.IsZero() {
+				s.createdAt = ss.CreatedAt
+			}
 			s.storage.UpdateSession(s)
-			// Notify other mqtt node to release resource
-			base.AsyncProduceMessage(s.config,
-				TopicNameSession,
-				&SessionTopic{
-					Launcher:  s.conn.LocalAddr().String(),
-					SessionId: clientid,
-					Action:    ObjectActionUpdate,
-					State:     mqttStateDisconnecting,
-				})
+			resumed = true
+		} else {
+			s.storage.DeleteSession(clientid)
+			s.storage.RegisterSession(s)
 		}
-
 	} else {
 		// Register the session in storage
 		s.storage.RegisterSession(s)
+		waiting = s.cleanStart == 0
 	}
-
-	if willMsg != nil {
-		s.willMsg = willMsg
-		s.willMsg.topic = willTopic
-		if len(payload) > 0 {
-			s.willMsg.payload = payload
-		} else {
-			s.willMsg.payload = nil
-		}
-		s.willMsg.qos = willQos
-		s.willMsg.retain = willRetain
+	// Connections of the client on other nodes are closed, persistent
+	// session on them is transferred before CONNACK so that session present
+	// flag is right
+	if topic := s.mgr.notifyTakeover(clientid, waiting); topic != nil {
+		resumed = s.mgr.applyTransferredSession(s, topic)
 	}
-	s.clientID = clientid
-	s.cleanSession = cleanSession
+	if resumed && s.protocol != mqttProtocol31 {
+		conack |= 0x01
+	}
+
 	s.pingTime = nil
 	s.isDroping = false
 
@@ -498,54 +1203,273 @@ func (s *mqttSession) handleConnect() error {
 	s.storage.DeleteMessageWithValidator(
 		clientid,
 		func(msg StorageMessage) bool {
-			err := s.authapi.CheckAcl(context.Background(), clientid, username, willTopic, auth.AclActionRead)
-			if err != nil {
-				return false
-			}
-			return true
+			return s.checkAcl(clientid, msg.Topic, auth.AclActionRead) == nil
 		})
 
-	s.state = mqttStateConnected
-	err = s.sendConnAck(uint8(conack), CONNACK_ACCEPTED)
-	return err
+	s.connectedAt = time.Now()
+	s.setState(mqttStateConnected)
+	if err := s.sendConnAck(uint8(conack), CONNACK_ACCEPTED); err != nil {
+		return err
+	}
+	s.notify(&event.Event{Type: event.ClientConnected})
+	if resumed {
+		s.resendInflightMessages()
+		s.replayOfflineMessages()
+	}
+	return nil
 }
 
-// handleDisconnect handle disconnect packet
-func (s *mqttSession) handleDisconnect() error {
-	glog.Infof("Received DISCONNECT from %s", s.id)
+// resumeSession take over inflight messages from old session of the
+// client, they are resent after CONNACK
+func (s *mqttSession) resumeSession(found *mqttSession) {
+	if found == s {
+		return
+	}
+	found.msgMutex.Lock()
+	msgs := found.msgs
+	storedMsgs := found.storedMsgs
+	lastMid := found.lastMid
+	found.msgs = nil
+	found.storedMsgs = nil
+	found.msgMutex.Unlock()
+
+	s.msgMutex.Lock()
+	s.msgs = append(msgs, s.msgs...)
+	s.storedMsgs = append(storedMsgs, s.storedMsgs...)
+	s.lastMid = lastMid
+	s.msgMutex.Unlock()
+	if !found.createdAt.IsZero() {
+		s.createdAt = found.createdAt
+	}
+	glog.Infof("Session of %s is resumed with %d inflight messages", s.clientID, len(msgs))
+}
+
+// resendInflightMessages resend unacknowledged PUBLISH with DUP and PUBREL
+// after session is resumed
+func (s *mqttSession) resendInflightMessages() {
+	packets := []*mqttPacket{}
+	now := time.Now()
+	s.msgMutex.Lock()
+	for _, msg := range s.msgs {
+		switch msg.state {
+		case mqttMessageStateWaitForPubAck, mqttMessageStateWaitForPubRec:
+			msg.dup = true
+			msg.timestamp = now
+			packets = append(packets, s.newPublishPacket(msg))
+		case mqttMessageStateWaitForPubComp:
+			msg.timestamp = now
+			packets = append(packets, newCommandPacket(PUBREL|0x02, msg.mid, false))
+		}
+	}
+	s.msgMutex.Unlock()
+	for _, p := range packets {
+		s.queuePacket(p)
+	}
+}
+
+// replayOfflineMessages send messages queued in storage while client is
+// offline, in the order they are received
+func (s *mqttSession) replayOfflineMessages() {
+	count := 0
+	for {
+		msg, err := s.storage.PopMessage(s.clientID)
+		if err != nil {
+			break
+		}
+		if msg.Expired() {
+			s.dropMessage(msg.Topic, msg.Qos, "Message expired")
+			continue
+		}
+		s.queueOutMessage(&mqttMessage{
+			direction:  mqttMessageDirectionOut,
+			state:      mqttMessateStateQueued,
+			topic:      msg.Topic,
+			payload:    msg.Payload,
+			qos:        msg.Qos,
+			retain:     msg.Retain,
+			properties: msg.Properties,
+			expiry:     msg.ExpiryAt,
+		})
+		count++
+	}
+	if count > 0 {
+		glog.Infof("Replayed %d offline messages to %s", count, s.clientID)
+	}
+	s.flushOutMessages()
+}
 
-	if s.inpacket.remainingLength != 0 {
+// continueAuthentication run enhanced authentication exchange with data
+// received from client, in CONNECT or AUTH packet
+func (s *mqttSession) continueAuthentication(data []uint8) error {
+	method := getAuthMethod(s.authMethod)
+	if method == nil {
+		return newReasonError(REASON_BAD_AUTHENTICATION_METHOD, "Unsupported authentication method '%s'", s.authMethod)
+	}
+	resp, done, err := method.Authenticate(s.clientID, s.username, data)
+	if err != nil {
+		glog.Errorf("Authentication with '%s' failed for %s:%s", s.authMethod, s.clientID, err)
+		s.notifyAuthFailed(s.clientID, s.username, err.Error())
+		if s.state == mqttStateConnected {
+			return newReasonError(REASON_NOT_AUTHORIZED, "Re-authentication failed for %s", s.clientID)
+		}
+		s.sendConnAck(0, CONNACK_REFUSED_NOT_AUTHORIZED)
+		return err
+	}
+	s.authData = resp
+	if !done {
+		if s.state != mqttStateConnected {
+			s.setState(mqttStateConnectPending)
+		}
+		return s.sendAuth(REASON_CONTINUE_AUTHENTICATION)
+	}
+	if s.state == mqttStateConnected {
+		// Re-authentication is completed
+		return s.sendAuth(REASON_SUCCESS)
+	}
+	return s.acceptConnect()
+}
+
+// handleAuth handle auth packet in MQTT v5
+func (s *mqttSession) handleAuth() error {
+	glog.Infof("Received AUTH from %s", s.id)
+
+	if s.protocol != mqttProtocol5 || s.authMethod == "" {
 		return mqttErrorInvalidProtocol
 	}
-	if s.protocol == mqttProtocol311 && (s.inpacket.command&0x0F) != 0x00 {
+	if s.inpacket.command&0x0F != 0x00 {
+		return mqttErrorInvalidProtocol
+	}
+	reason := uint8(REASON_SUCCESS)
+	props := mqttProperties{}
+	if s.inpacket.remainingLength > 0 {
+		var err error
+		if reason, err = s.inpacket.readByte(); err != nil {
+			return err
+		}
+		if s.inpacket.remainingLength > 1 {
+			if props, err = s.inpacket.readProperties(); err != nil {
+				return err
+			}
+		}
+	}
+	if method, _ := props.getString(PROPERTY_AUTHENTICATION_METHOD); method != s.authMethod {
+		return mqttErrorInvalidProtocol
+	}
+	switch {
+	case s.state == mqttStateConnectPending && reason == REASON_CONTINUE_AUTHENTICATION:
+	case s.state == mqttStateConnected && (reason == REASON_REAUTHENTICATE || reason == REASON_CONTINUE_AUTHENTICATION):
+	default:
+		return mqttErrorInvalidProtocol
+	}
+	data, _ := props.getBytes(PROPERTY_AUTHENTICATION_DATA)
+	return s.continueAuthentication(data)
+}
+
+// handleDisconnect handle disconnect packet
+func (s *mqttSession) handleDisconnect() error {
+	glog.Infof("Received DISCONNECT from %s", s.id)
+
+	reason := uint8(REASON_SUCCESS)
+	if s.protocol == mqttProtocol5 {
+		var err error
+		if s.inpacket.remainingLength > 0 {
+			if reason, err = s.inpacket.readByte(); err != nil {
+				return err
+			}
+		}
+		if s.inpacket.remainingLength > 1 {
+			props, err := s.inpacket.readProperties()
+			if err != nil {
+				return err
+			}
+			// Session expiry can not be set by DISCONNECT if it is zero
+			if expiry, ok := props.getInt(PROPERTY_SESSION_EXPIRY_INTERVAL); ok {
+				if s.sessionExpiry == 0 && expiry != 0 {
+					return mqttErrorInvalidProtocol
+				}
+				s.sessionExpiry = expiry
+			}
+		}
+	} else if s.inpacket.remainingLength != 0 {
+		return mqttErrorInvalidProtocol
+	}
+	if s.protocol != mqttProtocol31 && (s.inpacket.command&0x0F) != 0x00 {
 		s.disconnect()
 		return mqttErrorInvalidProtocol
 	}
-	s.state = mqttStateDisconnecting
+	// Will message must not be published after a clean DISCONNECT
+	if reason != REASON_DISCONNECT_WITH_WILL_MESSAGE {
+		s.willMsg = nil
+	}
+	s.setState(mqttStateDisconnecting)
 	s.disconnect()
 	return nil
 }
 
+// publishWillMessage publish will message through normal routing path
+func (s *mqttSession) publishWillMessage() {
+	if s.willMsg == nil || s.connectedAt.IsZero() {
+		return
+	}
+	msg := s.willMsg
+	s.willMsg = nil
+
+	// Will message is delayed in MQTT v5, but not longer than session expiry
+	delay := time.Duration(0)
+	if s.protocol == mqttProtocol5 {
+		interval := s.willDelay
+		if s.sessionExpiry < interval {
+			interval = s.sessionExpiry
+		}
+		delay = time.Duration(interval) * time.Second
+	}
+	glog.Infof("Publishing will message of %s on '%s' after %v", s.clientID, msg.topic, delay)
+	smsg := StorageMessage{
+		SourceID:   s.clientID,
+		Topic:      msg.topic,
+		Direction:  MessageDirectionIn,
+		Qos:        msg.qos,
+		Retain:     msg.retain,
+		Payload:    msg.payload,
+		Properties: msg.properties,
+	}
+	if s.willExpiry > 0 {
+		smsg.ExpiryAt = time.Now().Add(delay + time.Duration(s.willExpiry)*time.Second)
+	}
+	s.mgr.publishWillMessage(s.clientID, smsg, delay)
+}
+
 // disconnect will disconnect current connection because of protocol error
 func (s *mqttSession) disconnect() {
 	if s.state == mqttStateDisconnected {
 		return
 	}
-	if s.cleanSession > 0 {
-		s.storage.DeleteSession(s.id)
-		s.id = ""
+	s.setState(mqttStateDisconnected)
+	// Session in storage may have been resumed by new connection
+	if found, _ := s.storage.FindSession(s.clientID); found == s {
+		if s.cleanSession > 0 {
+			s.storage.DeleteSession(s.clientID)
+		} else if s.protocol == mqttProtocol5 && s.sessionExpiry != 0xFFFFFFFF {
+			// Persistent session in MQTT v5 is removed after session
+			// expiry interval if it is not resumed
+			time.AfterFunc(time.Duration(s.sessionExpiry)*time.Second, func() {
+				if found, _ := s.storage.FindSession(s.clientID); found == s {
+					s.storage.DeleteSession(s.clientID)
+				}
+			})
+		}
 	}
-	s.state = mqttStateDisconnected
 	s.conn.Close()
-	s.conn = nil
 }
 
 // handleSubscribe handle subscribe packet
 func (s *mqttSession) handleSubscribe() error {
 	payload := make([]uint8, 0)
+	subs := make([]string, 0)
+	retains := make([]bool, 0)
 
 	glog.Infof("Received SUBSCRIBE from %s", s.id)
-	if s.protocol == mqttProtocol311 {
+	if s.protocol != mqttProtocol31 {
 		if (s.inpacket.command & 0x0F) != 0x02 {
 			return mqttErrorInvalidProtocol
 		}
@@ -555,6 +1479,16 @@ func (s *mqttSession) handleSubscribe() error {
 	if err != nil {
 		return err
 	}
+	// Subscription identifier is not supported now, other properties are ignored
+	if s.protocol == mqttProtocol5 {
+		props, err := s.inpacket.readProperties()
+		if err != nil {
+			return err
+		}
+		if props.get(PROPERTY_SUBSCRIPTION_IDENTIFIER) != nil {
+			return newReasonError(REASON_SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED, "Subscription identifier from %s", s.id)
+		}
+	}
 	// Deal each subscription
 	for s.inpacket.pos < s.inpacket.remainingLength {
 		sub := ""
@@ -562,66 +1496,191 @@ func (s *mqttSession) handleSubscribe() error {
 		if sub, err = s.inpacket.readString(); err != nil {
 			return err
 		}
-		if checkTopicValidity(sub) != nil {
+		if checkTopicFilter(sub) != nil || checkSharedSubscription(sub) != nil {
 			glog.Errorf("Invalid subscription topic %s from %s, disconnecting", sub, s.id)
 			return mqttErrorInvalidProtocol
 		}
+		_, _, shared := parseSharedSubscription(sub)
 		if qos, err = s.inpacket.readByte(); err != nil {
 			return err
 		}
+		// Subscription options in MQTT v5
+		options := uint8(0)
+		retainHandling := uint8(0)
+		if s.protocol == mqttProtocol5 {
+			if qos&0xC0 != 0 {
+				return mqttErrorInvalidProtocol
+			}
+			retainHandling = (qos & 0x30) >> 4
+			if retainHandling == 3 {
+				return mqttErrorInvalidProtocol
+			}
+			options = qos & (SubscriptionNoLocal | SubscriptionRetainAsPublished)
+			qos &= 0x03
+			// No local is not allowed in shared subscription
+			if shared && options&SubscriptionNoLocal != 0 {
+				return mqttErrorInvalidProtocol
+			}
+		}
 
 		if qos > 2 {
 			glog.Errorf("Invalid Qos in subscription %s from %s", sub, s.id)
 			return mqttErrorInvalidProtocol
 		}
+		// Only authenticated admin users can subscribe $SYS topics
+		if isSysTopic(sub) && !(s.authenticated && isSysAdmin(s.config, s.mgr.protocol, s.username)) {
+			glog.Errorf("Subscription %s from %s is not authorized", sub, s.id)
+			if s.protocol == mqttProtocol5 {
+				payload = append(payload, REASON_NOT_AUTHORIZED)
+			} else {
+				payload = append(payload, 0x80)
+			}
+			subs = append(subs, sub)
+			retains = append(retains, false)
+			continue
+		}
 
-		if s.observer != nil {
-			mp := s.observer.OnGetMountPoint()
-			sub = mp + sub
+		// Subscription is authorized by plugins and device registry
+		if err := s.checkAcl(s.clientID, sub, auth.AclActionRead); err != nil {
+			glog.Errorf("Subscription %s from %s is denied:%s", sub, s.id, err)
+			if s.protocol == mqttProtocol5 {
+				payload = append(payload, REASON_NOT_AUTHORIZED)
+			} else {
+				payload = append(payload, 0x80)
+			}
+			subs = append(subs, sub)
+			retains = append(retains, false)
+			continue
 		}
-		if qos != 0x80 {
-			if err := s.storage.AddSubscription(s.id, sub, qos); err != nil {
-				return err
+
+		sub = s.mountSubscription(sub)
+		exist := s.storage.ExistSubscription(s.clientID, sub)
+		// New subscription is rejected if session's subscriptions exceed quota
+		if !exist {
+			if v := s.quto.CheckSubscriptions(s.storage.GetSubscriptionCount(s.clientID) + 1); v != nil {
+				glog.Errorf("Subscription %s from %s is rejected:%s", sub, s.id, v)
+				s.mgr.metrics.AddMetric(quto.MetricSubscriptionRejected, 1)
+				if s.protocol == mqttProtocol5 {
+					payload = append(payload, REASON_QUOTA_EXCEEDED)
+				} else {
+					payload = append(payload, 0x80)
+				}
+				subs = append(subs, sub)
+				retains = append(retains, false)
+				continue
 			}
-			if err := s.storage.RetainSubscription(s.id, sub, qos); err != nil {
+		}
+		if qos != 0x80 {
+			if err := s.storage.AddSubscription(s.clientID, sub, qos, options); err != nil {
 				return err
 			}
 		}
+		subs = append(subs, sub)
 		payload = append(payload, qos)
+		// Retained messages are not sent for shared subscription
+		retains = append(retains, !shared && (retainHandling == 0 || (retainHandling == 1 && !exist)))
 	}
 
-	if s.protocol == mqttProtocol311 && len(payload) == 0 {
+	if s.protocol != mqttProtocol31 && len(payload) == 0 {
 		return mqttErrorInvalidProtocol
 	}
-	return s.sendSubAck(mid, payload)
+	if err := s.sendSubAck(mid, payload); err != nil {
+		return err
+	}
+	for i, sub := range subs {
+		if payload[i] < 0x80 {
+			s.notify(&event.Event{Type: event.SessionSubscribed, Topic: sub, Qos: payload[i]})
+		}
+	}
+	// Retained messages are delivered after SUBACK with granted qos
+	for i, sub := range subs {
+		if !retains[i] {
+			continue
+		}
+		if err := s.storage.RetainSubscription(s.clientID, sub, payload[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // handleUnsubscribe handle unsubscribe packet
 func (s *mqttSession) handleUnsubscribe() error {
 	glog.Infof("Received UNSUBSCRIBE from %s", s.id)
 
-	if s.protocol == mqttProtocol311 && (s.inpacket.command&0x0f) != 0x02 {
+	if s.protocol != mqttProtocol31 && (s.inpacket.command&0x0f) != 0x02 {
 		return mqttErrorInvalidProtocol
 	}
 	mid, err := s.inpacket.readUint16()
 	if err != nil {
 		return err
 	}
+	if s.protocol == mqttProtocol5 {
+		if _, err := s.inpacket.readProperties(); err != nil {
+			return err
+		}
+	}
 	// Iterate all subscription
+	reasons := []uint8{}
 	for s.inpacket.pos < s.inpacket.remainingLength {
 		sub, err := s.inpacket.readString()
 		if err != nil {
 			return mqttErrorInvalidProtocol
 		}
-		if err := checkTopicValidity(sub); err != nil {
+		if err := checkTopicFilter(sub); err != nil {
 			return fmt.Errorf("Invalid unsubscription string from %s, disconnecting", s.id)
 		}
-		s.storage.RemoveSubscription(s.id, sub)
+		// Subscription is stored with mount point as it is subscribed
+		sub = s.mountSubscription(sub)
+		if s.storage.ExistSubscription(s.clientID, sub) {
+			reasons = append(reasons, REASON_SUCCESS)
+			s.notify(&event.Event{Type: event.SessionUnsubscribed, Topic: sub})
+		} else {
+			reasons = append(reasons, REASON_NO_SUBSCRIPTION_EXISTED)
+		}
+		s.storage.RemoveSubscription(s.clientID, sub)
+	}
+	if s.protocol == mqttProtocol5 {
+		return s.sendUnsubAck(mid, reasons)
 	}
-
 	return s.sendCommandWithMid(UNSUBACK, mid, false)
 }
 
+// mountSubscription prefix subscription's topic filter with mount point of
+// client authenticated by observer or device registry
+func (s *mqttSession) mountSubscription(sub string) string {
+	if s.observer == nil && s.device == nil {
+		return sub
+	}
+	mp := s.mountPoint()
+	if group, filter, ok := parseSharedSubscription(sub); ok {
+		return sharedSubscriptionPrefix + group + "/" + mp + filter
+	}
+	return mp + sub
+}
+
+// resolveTopicAlias map topic alias to topic name in MQTT v5 PUBLISH
+func (s *mqttSession) resolveTopicAlias(topic string, props mqttProperties) (string, error) {
+	alias, ok := props.getInt(PROPERTY_TOPIC_ALIAS)
+	if !ok {
+		if topic == "" {
+			return "", mqttErrorInvalidProtocol
+		}
+		return topic, nil
+	}
+	if alias == 0 || alias > uint32(s.topicAliasMax) {
+		return "", newReasonError(REASON_TOPIC_ALIAS_INVALID, "Invalid topic alias %d from %s", alias, s.id)
+	}
+	if topic != "" {
+		s.topicAliases[uint16(alias)] = topic
+		return topic, nil
+	}
+	if topic, ok = s.topicAliases[uint16(alias)]; !ok {
+		return "", newReasonError(REASON_PROTOCOL_ERROR, "Unknown topic alias %d from %s", alias, s.id)
+	}
+	return topic, nil
+}
+
 // handlePublish handle publish packet
 func (s *mqttSession) handlePublish() error {
 	glog.Infof("Received PUBLISH from %s", s.id)
@@ -630,6 +1689,8 @@ func (s *mqttSession) handlePublish() error {
 	var mid uint16
 	var err error
 	var payload []uint8
+	var properties []uint8
+	var expiryAt time.Time
 
 	dup := (s.inpacket.command & 0x08) >> 3
 	qos := (s.inpacket.command & 0x06) >> 1
@@ -642,81 +1703,230 @@ func (s *mqttSession) handlePublish() error {
 	if topic, err = s.inpacket.readString(); err != nil {
 		return fmt.Errorf("Invalid topic in PUBLISH from %s", s.id)
 	}
-	if checkTopicValidity(topic) != nil {
-		return fmt.Errorf("Invalid topic in PUBLISH(%s) from %s", topic, s.id)
-	}
-	if s.observer != nil && s.observer.OnGetMountPoint() != "" {
-		topic = s.observer.OnGetMountPoint() + topic
-	}
-
 	if qos > 0 {
 		mid, err = s.inpacket.readUint16()
 		if err != nil {
 			return err
 		}
 	}
+	// Properties in MQTT v5
+	if s.protocol == mqttProtocol5 {
+		props, err := s.inpacket.readProperties()
+		if err != nil {
+			return err
+		}
+		if topic, err = s.resolveTopicAlias(topic, props); err != nil {
+			return err
+		}
+		if expiry, ok := props.getInt(PROPERTY_MESSAGE_EXPIRY_INTERVAL); ok {
+			expiryAt = time.Now().Add(time.Duration(expiry) * time.Second)
+		}
+		if forwarded := props.forwarded(); len(forwarded) > 0 {
+			properties = forwarded.encode()
+		}
+	}
+	if checkPublishTopic(topic) != nil {
+		return fmt.Errorf("Invalid topic in PUBLISH(%s) from %s", topic, s.id)
+	}
+	if mp := s.mountPoint(); mp != "" {
+		topic = mp + topic
+	}
 
 	// Payload
 	payloadlen := s.inpacket.remainingLength - s.inpacket.pos
 	if payloadlen > 0 {
 		limitSize, _ := s.config.Int(s.mgr.protocol, "message_size_limit")
-		if payloadlen > limitSize {
-			return mqttErrorInvalidProtocol
+		if limitSize > 0 && payloadlen > limitSize {
+			return newReasonError(REASON_PACKET_TOO_LARGE, "Too large PUBLISH from %s", s.id)
 		}
 		payload, err = s.inpacket.readBytes(payloadlen)
 		if err != nil {
 			return err
 		}
 	}
-	// Check for topic access
-	if s.observer != nil {
-		err := s.authapi.CheckAcl(context.Background(), s.id, s.username, topic, auth.AclActionWrite)
-		switch err {
-		case auth.ErrorAclDenied:
-			return mqttErrorInvalidProtocol
-		default:
-			return err
+	// Check for topic access, MQTT v5 client is notified with reason code
+	// in acknowledge
+	if err := s.checkAcl(s.clientID, topic, auth.AclActionWrite); err != nil {
+		glog.Errorf("PUBLISH to '%s' from %s is denied:%s", topic, s.id, err)
+		if s.protocol == mqttProtocol5 && qos > 0 {
+			return s.sendPublishAck(qos, mid, REASON_NOT_AUTHORIZED)
 		}
+		return mqttErrorInvalidProtocol
 	}
 	glog.Infof("Received PUBLISH from %s(d:%d, q:%d r:%d, m:%d, '%s',..(%d)bytes",
 		s.id, dup, qos, retain, mid, topic, payloadlen)
 
-	// Check wether the message has been stored
-	dup = 0
-	var storedMsg *mqttMessage
-	if qos > 0 {
-		for _, storedMsg = range s.storedMsgs {
-			if storedMsg.mid == mid && storedMsg.direction == mqttMessageDirectionIn {
-				dup = 1
-				break
+	req := &publishRequest{
+		topic:      topic,
+		mid:        mid,
+		qos:        qos,
+		retain:     retain,
+		payload:    payload,
+		properties: properties,
+		expiryAt:   expiryAt,
+	}
+
+	// Check publish rate of client, username and mount point, delayed
+	// message is processed later without blocking the session
+	if v := s.quto.CheckPublish(s.clientID, s.username, s.mountPoint(), payloadlen); v != nil {
+		switch v.Action {
+		case quto.ActionDelay:
+			s.mgr.metrics.AddMetric(quto.MetricPublishDelayed, 1)
+			return s.delayPublish(req, v.Delay)
+		case quto.ActionDisconnect:
+			s.mgr.metrics.AddMetric(quto.MetricPublishDisconnected, 1)
+			return newReasonError(REASON_QUOTA_EXCEEDED, "%s", v)
+		default:
+			return s.dropPublish(req, v.Reason)
+		}
+	}
+	if atomic.LoadInt32(&s.delayedCount) > 0 {
+		return s.delayPublish(req, 0)
+	}
+	return s.processPublish(req)
+}
+
+// publishRequest is PUBLISH accepted from client, which may be delayed
+// by rate limit
+type publishRequest struct {
+	topic      string
+	mid        uint16
+	qos        uint8
+	retain     uint8
+	payload    []uint8
+	properties []uint8
+	expiryAt   time.Time
+	due        time.Time
+}
+
+// delayPublish queue PUBLISH to be processed after delay, the message is
+// dropped if too many messages are delayed
+func (s *mqttSession) delayPublish(req *publishRequest, delay time.Duration) error {
+	req.due = time.Now().Add(delay)
+	atomic.AddInt32(&s.delayedCount, 1)
+	select {
+	case s.delayedChannel <- req:
+		return nil
+	default:
+		atomic.AddInt32(&s.delayedCount, -1)
+		return s.dropPublish(req, "Too many delayed messages")
+	}
+}
+
+// dropPublish drop PUBLISH exceeding quota, qos1/2 message is acknowledged
+func (s *mqttSession) dropPublish(req *publishRequest, reason string) error {
+	glog.Warningf("PUBLISH from %s is dropped:%s", s.id, reason)
+	s.mgr.metrics.AddMetric(quto.MetricPublishDropped, 1)
+	s.notify(&event.Event{Type: event.MessageDropped, Topic: req.topic, Qos: req.qos, Reason: reason})
+	switch {
+	case req.qos == 0:
+		return nil
+	case s.protocol == mqttProtocol5:
+		return s.sendPublishAck(req.qos, req.mid, REASON_QUOTA_EXCEEDED)
+	case req.qos == 1:
+		return s.sendPubAck(req.mid)
+	default:
+		return s.sendPubRec(req.mid)
+	}
+}
+
+// processPublish route PUBLISH from client, qos2 message is stored until
+// PUBREL is received
+func (s *mqttSession) processPublish(req *publishRequest) error {
+	var err error
+	topic, mid, qos, retain := req.topic, req.mid, req.qos, req.retain
+	payload, properties, expiryAt := req.payload, req.properties, req.expiryAt
+
+	// Message transform hooks of plugins
+	transformed, err := plugins.Transform(&plugins.Message{
+		ClientID: s.clientID,
+		Username: s.username,
+		Topic:    topic,
+		Qos:      qos,
+		Retain:   retain > 0,
+		Payload:  payload,
+	})
+	if err != nil || transformed == nil {
+		glog.Warningf("PUBLISH from %s is dropped by plugin:%v", s.id, err)
+		s.notify(&event.Event{Type: event.MessageDropped, Topic: topic, Qos: qos, Reason: "Dropped by plugin"})
+		if qos > 0 {
+			return s.sendPublishAck(qos, mid, REASON_IMPLEMENTATION_SPECIFIC_ERROR)
+		}
+		return nil
+	}
+	if checkPublishTopic(transformed.Topic) != nil || isSysTopic(transformed.Topic) {
+		return fmt.Errorf("Invalid topic '%s' transformed by plugin", transformed.Topic)
+	}
+	topic, payload = transformed.Topic, transformed.Payload
+	if transformed.Retain {
+		retain = 1
+	} else {
+		retain = 0
+	}
+
+	// Payload conversion of codec bindings, message failed to be converted
+	// is routed to dead letter topic with original payload if configured
+	if converted, err := s.codecs.Publish(topic, payload); err != nil {
+		s.mgr.metrics.AddMetric(codec.MetricPublishErrors, 1)
+		deadLetter := s.codecs.DeadLetterTopic(topic)
+		if deadLetter == "" {
+			glog.Warningf("PUBLISH from %s is dropped, failed to convert payload:%s", s.id, err)
+			s.notify(&event.Event{Type: event.MessageDropped, Topic: topic, Qos: qos, Reason: err.Error()})
+			if qos > 0 {
+				return s.sendPublishAck(qos, mid, REASON_PAYLOAD_FORMAT_INVALID)
 			}
+			return nil
 		}
+		glog.Warningf("PUBLISH from %s is routed to '%s', failed to convert payload:%s", s.id, deadLetter, err)
+		s.mgr.metrics.AddMetric(codec.MetricDeadLetter, 1)
+		topic = deadLetter
+	} else {
+		payload = converted
 	}
+
 	msg := StorageMessage{
-		ID:        uint(mid),
-		SourceID:  s.id,
-		Topic:     topic,
-		Direction: MessageDirectionIn,
-		State:     0,
-		Qos:       qos,
-		Retain:    (retain > 0),
-		Payload:   payload,
+		ID:         uint(mid),
+		SourceID:   s.clientID,
+		Topic:      topic,
+		Direction:  MessageDirectionIn,
+		State:      0,
+		Qos:        qos,
+		Retain:     (retain > 0),
+		Payload:    payload,
+		Properties: properties,
+		ExpiryAt:   expiryAt,
 	}
 
 	switch qos {
 	case 0:
-		err = s.storage.QueueMessage(s.id, msg)
+		s.notifyPublished(&msg)
+		err = s.mgr.routeMessage(s.clientID, msg)
 	case 1:
-		err = s.storage.QueueMessage(s.id, msg)
-		err = s.sendPubAck(mid)
-	case 2:
-		err = nil
-		if dup > 0 {
-			err = s.storage.InsertMessage(s.id, mid, MessageDirectionIn, msg)
+		s.notifyPublished(&msg)
+		if err = s.mgr.routeMessage(s.clientID, msg); err == nil {
+			err = s.sendPubAck(mid)
 		}
-		if err == nil {
-			err = s.sendPubRec(mid)
+	case 2:
+		// The message is routed only when PUBREL is received, a duplicated
+		// message with same mid is not stored again
+		if s.findInMessage(mid) == nil {
+			if s.protocol == mqttProtocol5 && s.inMessageCount() >= s.receiveMaximum {
+				return newReasonError(REASON_RECEIVE_MAXIMUM_EXCEEDED, "Receive maximum exceeded by %s", s.id)
+			}
+			s.storeInMessage(&mqttMessage{
+				mid:        mid,
+				direction:  mqttMessageDirectionIn,
+				state:      mqttMessageStateWaitForPubRel,
+				timestamp:  time.Now(),
+				topic:      topic,
+				payload:    append([]uint8{}, payload...),
+				qos:        qos,
+				retain:     (retain > 0),
+				properties: properties,
+				expiry:     expiryAt,
+			})
 		}
+		err = s.sendPubRec(mid)
 	default:
 		err = mqttErrorInvalidProtocol
 	}
@@ -724,10 +1934,27 @@ func (s *mqttSession) handlePublish() error {
 	return err
 }
 
+// readAckReason read reason code and properties in MQTT v5 acknowledge
+func (s *mqttSession) readAckReason() (uint8, error) {
+	if s.protocol != mqttProtocol5 || s.inpacket.pos >= s.inpacket.remainingLength {
+		return REASON_SUCCESS, nil
+	}
+	reason, err := s.inpacket.readByte()
+	if err != nil {
+		return 0, err
+	}
+	if s.inpacket.pos < s.inpacket.remainingLength {
+		if _, err := s.inpacket.readProperties(); err != nil {
+			return 0, err
+		}
+	}
+	return reason, nil
+}
+
 // handlePubRel handle pubrel packet
 func (s *mqttSession) handlePubRel() error {
 	// Check protocol specifal requriement
-	if s.protocol == mqttProtocol311 {
+	if s.protocol != mqttProtocol31 {
 		if (s.inpacket.command & 0x0F) != 0x02 {
 			return mqttErrorInvalidProtocol
 		}
@@ -737,17 +1964,118 @@ func (s *mqttSession) handlePubRel() error {
 	if err != nil {
 		return err
 	}
+	if _, err := s.readAckReason(); err != nil {
+		return err
+	}
+	glog.Infof("Received PUBREL from %s with MID:%d", s.id, mid)
+	s.mgr.metrics.AddMetric(metricPacketPubrelReceived, 1)
 
-	s.storage.DeleteMessage(s.id, mid, MessageDirectionIn)
+	// Route the stored qos2 message now
+	msg := s.releaseInMessage(mid)
+	if msg == nil {
+		return s.sendCommandWithReason(PUBCOMP, mid, REASON_PACKET_IDENTIFIER_NOT_FOUND)
+	}
+	smsg := StorageMessage{
+		ID:         uint(mid),
+		SourceID:   s.clientID,
+		Topic:      msg.topic,
+		Direction:  MessageDirectionIn,
+		State:      0,
+		Qos:        msg.qos,
+		Retain:     msg.retain,
+		Payload:    msg.payload,
+		Properties: msg.properties,
+		ExpiryAt:   msg.expiry,
+	}
+	s.notifyPublished(&smsg)
+	if err := s.mgr.routeMessage(s.clientID, smsg); err != nil {
+		return err
+	}
 	return s.sendPubComp(mid)
 }
 
+// handlePubAck handle puback packet for outgoing qos1 message
+func (s *mqttSession) handlePubAck() error {
+	mid, err := s.inpacket.readUint16()
+	if err != nil {
+		return err
+	}
+	if _, err := s.readAckReason(); err != nil {
+		return err
+	}
+	glog.Infof("Received PUBACK from %s with MID:%d", s.id, mid)
+	s.mgr.metrics.AddMetric(metricPacketPubackRecevied, 1)
+
+	msg, err := s.releaseOutMessage(mid, mqttMessageStateWaitForPubAck)
+	if err != nil {
+		glog.Warningf("Received PUBACK from %s with unknown MID:%d", s.id, mid)
+		return nil
+	}
+	s.notify(&event.Event{Type: event.MessageAcked, Topic: msg.topic, Qos: msg.qos})
+	s.flushOutMessages()
+	return nil
+}
+
+// handlePubRec handle pubrec packet for outgoing qos2 message
+func (s *mqttSession) handlePubRec() error {
+	mid, err := s.inpacket.readUint16()
+	if err != nil {
+		return err
+	}
+	reason, err := s.readAckReason()
+	if err != nil {
+		return err
+	}
+	glog.Infof("Received PUBREC from %s with MID:%d", s.id, mid)
+	s.mgr.metrics.AddMetric(metricPacketPubrecReceived, 1)
+
+	// Message is rejected by MQTT v5 client, the flow is ended without PUBREL
+	if reason >= REASON_UNSPECIFIED_ERROR {
+		glog.Warningf("PUBLISH(%d) is rejected by %s with reason:%d", mid, s.id, reason)
+		if msg, err := s.releaseOutMessage(mid, mqttMessageStateWaitForPubRec); err == nil {
+			s.dropMessage(msg.topic, msg.qos, fmt.Sprintf("Rejected by client with reason %d", reason))
+		}
+		s.flushOutMessages()
+		return nil
+	}
+	if err := s.updateOutMessage(mid, mqttMessageStateWaitForPubComp); err != nil {
+		glog.Warningf("Received PUBREC from %s with unknown MID:%d", s.id, mid)
+		if s.protocol == mqttProtocol5 {
+			return s.sendCommandWithReason(PUBREL|0x02, mid, REASON_PACKET_IDENTIFIER_NOT_FOUND)
+		}
+	}
+	return s.sendPubRel(mid)
+}
+
+// handlePubComp handle pubcomp packet for outgoing qos2 message
+func (s *mqttSession) handlePubComp() error {
+	mid, err := s.inpacket.readUint16()
+	if err != nil {
+		return err
+	}
+	if _, err := s.readAckReason(); err != nil {
+		return err
+	}
+	glog.Infof("Received PUBCOMP from %s with MID:%d", s.id, mid)
+	s.mgr.metrics.AddMetric(metricPacketPubcompReceived, 1)
+
+	msg, err := s.releaseOutMessage(mid, mqttMessageStateWaitForPubComp)
+	if err != nil {
+		glog.Warningf("Received PUBCOMP from %s with unknown MID:%d", s.id, mid)
+		return nil
+	}
+	s.notify(&event.Event{Type: event.MessageAcked, Topic: msg.topic, Qos: msg.qos})
+	s.flushOutMessages()
+	return nil
+}
+
 // sendSimpleCommand send a simple command
 func (s *mqttSession) sendSimpleCommand(cmd uint8) error {
 	p := &mqttPacket{
 		command:        cmd,
 		remainingCount: 0,
 	}
+	p.initializePacket()
 	return s.queuePacket(p)
 }
 
@@ -757,10 +2085,23 @@ func (s *mqttSession) sendPingRsp() error {
 	return s.sendSimpleCommand(PINGRESP)
 }
 
+// connackReasonCodes map MQTT v3 return code to MQTT v5 reason code
+var connackReasonCodes = map[uint8]uint8{
+	CONNACK_ACCEPTED:                      REASON_SUCCESS,
+	CONNACK_REFUSED_PROTOCOL_VERSION:      REASON_UNSUPPORTED_PROTOCOL_VERSION,
+	CONNACK_REFUSED_IDENTIFIER_REJECTED:   REASON_CLIENT_IDENTIFIER_NOT_VALID,
+	CONNACK_REFUSED_SERVER_UNAVAILABLE:    REASON_SERVER_UNAVAILABLE,
+	CONNACK_REFUSED_BAD_USERNAME_PASSWORD: REASON_BAD_USERNAME_OR_PASSWORD,
+	CONNACK_REFUSED_NOT_AUTHORIZED:        REASON_NOT_AUTHORIZED,
+}
+
 // sendConnAck send connection response to client
 func (s *mqttSession) sendConnAck(ack uint8, result uint8) error {
 	glog.Infof("Sending CONNACK from %s", s.id)
 
+	if s.protocol == mqttProtocol5 {
+		return s.sendConnAckV5(ack, result)
+	}
 	packet := &mqttPacket{
 		command:         CONNACK,
 		remainingLength: 2,
@@ -772,6 +2113,74 @@ func (s *mqttSession) sendConnAck(ack uint8, result uint8) error {
 	return s.queuePacket(packet)
 }
 
+// sendConnAckV5 send connection response with properties to MQTT v5 client
+func (s *mqttSession) sendConnAckV5(ack uint8, result uint8) error {
+	if reason, ok := connackReasonCodes[result]; ok {
+		result = reason
+	}
+	props := mqttProperties{}
+	if result == REASON_SUCCESS {
+		props.addInt(PROPERTY_RECEIVE_MAXIMUM, uint32(s.receiveMaximum))
+		props.addInt(PROPERTY_TOPIC_ALIAS_MAXIMUM, uint32(s.topicAliasMax))
+		props.addInt(PROPERTY_SUBSCRIPTION_IDENTIFIER_AVAILABLE, 0)
+		props.addInt(PROPERTY_SHARED_SUBSCRIPTION_AVAILABLE, 1)
+		if s.clientIDAssigned {
+			props.addString(PROPERTY_ASSIGNED_CLIENT_IDENTIFIER, s.clientID)
+		}
+		if s.authMethod != "" {
+			props.addString(PROPERTY_AUTHENTICATION_METHOD, s.authMethod)
+			if len(s.authData) > 0 {
+				props.addBytes(PROPERTY_AUTHENTICATION_DATA, s.authData)
+			}
+		}
+	}
+	length := props.length()
+	packet := &mqttPacket{
+		command:         CONNACK,
+		remainingLength: 2 + varIntLength(length) + length,
+	}
+	packet.initializePacket()
+	packet.writeByte(ack)
+	packet.writeByte(result)
+	packet.writeProperties(props)
+
+	return s.queuePacket(packet)
+}
+
+// sendAuth send auth packet to MQTT v5 client
+func (s *mqttSession) sendAuth(reason uint8) error {
+	glog.Infof("Sending AUTH to %s with reason:%d", s.id, reason)
+
+	props := mqttProperties{}
+	props.addString(PROPERTY_AUTHENTICATION_METHOD, s.authMethod)
+	if len(s.authData) > 0 {
+		props.addBytes(PROPERTY_AUTHENTICATION_DATA, s.authData)
+	}
+	length := props.length()
+	packet := &mqttPacket{
+		command:         AUTH,
+		remainingLength: 1 + varIntLength(length) + length,
+	}
+	packet.initializePacket()
+	packet.writeByte(reason)
+	packet.writeProperties(props)
+
+	return s.queuePacket(packet)
+}
+
+// newDisconnectPacket create disconnect packet with reason for MQTT v5 client
+func newDisconnectPacket(reason uint8) *mqttPacket {
+	packet := &mqttPacket{
+		command:         DISCONNECT,
+		remainingLength: 1,
+	}
+	packet.initializePacket()
+	packet.writeByte(reason)
+	packet.pos = 0
+	packet.toprocess = packet.length
+	return packet
+}
+
 // sendSubAck send subscription acknowledge to client
 func (s *mqttSession) sendSubAck(mid uint16, payload []uint8) error {
 	glog.Infof("Sending SUBACK on %s", s.id)
@@ -779,17 +2188,38 @@ func (s *mqttSession) sendSubAck(mid uint16, payload []uint8) error {
 		command:         SUBACK,
 		remainingLength: 2 + int(len(payload)),
 	}
+	// Empty properties in MQTT v5
+	if s.protocol == mqttProtocol5 {
+		packet.remainingLength++
+	}
 
 	packet.initializePacket()
 	packet.writeUint16(mid)
+	if s.protocol == mqttProtocol5 {
+		packet.writeByte(0)
+	}
 	if len(payload) > 0 {
 		packet.writeBytes(payload)
 	}
 	return s.queuePacket(packet)
 }
 
-// sendCommandWithMid send command with message identifier
-func (s *mqttSession) sendCommandWithMid(command uint8, mid uint16, dup bool) error {
+// sendUnsubAck send unsubscription acknowledge with reasons to MQTT v5 client
+func (s *mqttSession) sendUnsubAck(mid uint16, reasons []uint8) error {
+	glog.Infof("Sending UNSUBACK on %s", s.id)
+	packet := &mqttPacket{
+		command:         UNSUBACK,
+		remainingLength: 3 + len(reasons),
+	}
+	packet.initializePacket()
+	packet.writeUint16(mid)
+	packet.writeByte(0)
+	packet.writeBytes(reasons)
+	return s.queuePacket(packet)
+}
+
+// newCommandPacket create command packet with message identifier
+func newCommandPacket(command uint8, mid uint16, dup bool) *mqttPacket {
 	packet := &mqttPacket{
 		command:         command,
 		remainingLength: 2,
@@ -800,31 +2230,74 @@ func (s *mqttSession) sendCommandWithMid(command uint8, mid uint16, dup bool) er
 	packet.initializePacket()
 	packet.payload[packet.pos+0] = uint8((mid & 0xFF00) >> 8)
 	packet.payload[packet.pos+1] = uint8(mid & 0xff)
+	packet.pos = 0
+	packet.toprocess = packet.length
+	return packet
+}
+
+// sendCommandWithMid send command with message identifier
+func (s *mqttSession) sendCommandWithMid(command uint8, mid uint16, dup bool) error {
+	return s.queuePacket(newCommandPacket(command, mid, dup))
+}
+
+// sendCommandWithReason send acknowledge with reason code, the reason is
+// only sent to MQTT v5 client if it is not success
+func (s *mqttSession) sendCommandWithReason(command uint8, mid uint16, reason uint8) error {
+	if s.protocol != mqttProtocol5 || reason == REASON_SUCCESS {
+		return s.sendCommandWithMid(command, mid, false)
+	}
+	packet := &mqttPacket{
+		command:         command,
+		remainingLength: 3,
+	}
+	packet.initializePacket()
+	packet.writeUint16(mid)
+	packet.writeByte(reason)
 	return s.queuePacket(packet)
 }
 
+// sendPublishAck send PUBACK or PUBREC with reason for incoming message
+func (s *mqttSession) sendPublishAck(qos uint8, mid uint16, reason uint8) error {
+	if qos == 1 {
+		return s.sendCommandWithReason(PUBACK, mid, reason)
+	}
+	return s.sendCommandWithReason(PUBREC, mid, reason)
+}
+
 // sendPubAck
 func (s *mqttSession) sendPubAck(mid uint16) error {
-	glog.Info("Sending PUBACK to %s with MID:%d", s.id, mid)
+	glog.Infof("Sending PUBACK to %s with MID:%d", s.id, mid)
 	return s.sendCommandWithMid(PUBACK, mid, false)
 }
 
 // sendPubRec
 func (s *mqttSession) sendPubRec(mid uint16) error {
-	glog.Info("Sending PUBRREC to %s with MID:%d", s.id, mid)
+	glog.Infof("Sending PUBRREC to %s with MID:%d", s.id, mid)
 	return s.sendCommandWithMid(PUBREC, mid, false)
 }
 
 func (s *mqttSession) sendPubComp(mid uint16) error {
-	glog.Info("Sending PUBCOMP to %s with MID:%d", s.id, mid)
+	glog.Infof("Sending PUBCOMP to %s with MID:%d", s.id, mid)
 	return s.sendCommandWithMid(PUBCOMP, mid, false)
 }
 
+// sendPubRel
+func (s *mqttSession) sendPubRel(mid uint16) error {
+	glog.Infof("Sending PUBREL to %s with MID:%d", s.id, mid)
+	s.mgr.metrics.AddMetric(metricPacketPubrelSent, 1)
+	return s.sendCommandWithMid(PUBREL|0x02, mid, false)
+}
+
 func (s *mqttSession) queuePacket(p *mqttPacket) error {
 	p.pos = 0
 	p.toprocess = p.length
-	s.sendPacketChannel <- p
-	return nil
+	// Packet is discarded if packet sender has quit
+	select {
+	case s.sendPacketChannel <- p:
+		return nil
+	case <-s.sendStopChannel:
+		return errors.New("Session is closed")
+	}
 }
 
 func (s *mqttSession) QueueMessage(msg *mqttMessage) error {
@@ -832,48 +2305,345 @@ func (s *mqttSession) QueueMessage(msg *mqttMessage) error {
 	return nil
 }
 
+// findInMessage find incoming qos2 message with mid
+func (s *mqttSession) findInMessage(mid uint16) *mqttMessage {
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	for _, msg := range s.storedMsgs {
+		if msg.mid == mid {
+			return msg
+		}
+	}
+	return nil
+}
+
+// inMessageCount return count of incoming qos2 messages awaiting PUBREL
+func (s *mqttSession) inMessageCount() int {
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	return len(s.storedMsgs)
+}
+
+// storeInMessage store incoming qos2 message until PUBREL is received
+func (s *mqttSession) storeInMessage(msg *mqttMessage) {
+	s.msgMutex.Lock()
+	s.storedMsgs = append(s.storedMsgs, msg)
+	s.msgMutex.Unlock()
+}
+
+// releaseInMessage remove incoming qos2 message with mid and return it
+func (s *mqttSession) releaseInMessage(mid uint16) *mqttMessage {
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	for i, msg := range s.storedMsgs {
+		if msg.mid == mid {
+			s.storedMsgs = append(s.storedMsgs[:i], s.storedMsgs[i+1:]...)
+			return msg
+		}
+	}
+	return nil
+}
+
+// updateOutMessage change inflight message's state after acknowledge
 func (s *mqttSession) updateOutMessage(mid uint16, state int) error {
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	for _, msg := range s.msgs {
+		if msg.mid == mid && msg.state != mqttMessateStateQueued {
+			msg.state = state
+			msg.timestamp = time.Now()
+			return nil
+		}
+	}
+	return mqttErrorNotFound
+}
+
+// releaseOutMessage remove inflight message which is in expected state
+func (s *mqttSession) releaseOutMessage(mid uint16, state int) (*mqttMessage, error) {
+	s.msgMutex.Lock()
+	defer s.msgMutex.Unlock()
+	for i, msg := range s.msgs {
+		if msg.mid == mid && msg.state == state {
+			s.msgs = append(s.msgs[:i], s.msgs[i+1:]...)
+			return msg, nil
+		}
+	}
+	return nil, mqttErrorNotFound
+}
+
+// flushOutMessages wake up packet sender to send queued messages, it never
+// block so that message can be queued by publisher of other session
+func (s *mqttSession) flushOutMessages() {
+	select {
+	case s.flushChannel <- struct{}{}:
+	default:
+		// Sender has been woken up and will send all queued messages
+	}
+}
+
+// sendOutMessages move queued messages into inflight window and send them,
+// it is only called by packet sender so that messages are sent in order
+func (s *mqttSession) sendOutMessages() error {
+	packets := []*mqttPacket{}
+	sent := []*mqttMessage{}
+	expired := []*mqttMessage{}
+	s.msgMutex.Lock()
+	inflight := 0
+	now := time.Now()
+	msgs := s.msgs[:0]
+	for _, msg := range s.msgs {
+		// Expired message is dropped if it has not been sent
+		if msg.state == mqttMessateStateQueued && !msg.expiry.IsZero() && now.After(msg.expiry) {
+			expired = append(expired, msg)
+			continue
+		}
+		if msg.state != mqttMessateStateQueued {
+			inflight++
+		}
+		msgs = append(msgs, msg)
+	}
+	s.msgs = msgs
+	for _, msg := range s.msgs {
+		if inflight >= s.maxInflight {
+			break
+		}
+		if msg.state != mqttMessateStateQueued {
+			continue
+		}
+		msg.mid = s.generateMid()
+		msg.timestamp = time.Now()
+		if msg.qos == 1 {
+			msg.state = mqttMessageStateWaitForPubAck
+		} else {
+			msg.state = mqttMessageStateWaitForPubRec
+		}
+		packets = append(packets, s.newPublishPacket(msg))
+		sent = append(sent, msg)
+		inflight++
+	}
+	s.msgMutex.Unlock()
+
+	for _, msg := range expired {
+		s.dropMessage(msg.topic, msg.qos, "Message expired")
+	}
+	for i, p := range packets {
+		if err := s.writePacket(p); err != nil {
+			return err
+		}
+		msg := sent[i]
+		s.notify(&event.Event{Type: event.MessageDelivered, Topic: msg.topic, Qos: msg.qos, Retain: msg.retain, Payload: msg.payload})
+	}
 	return nil
 }
 
+// generateMid generate message identifier which is not used by inflight
+// messages, the caller must hold msgMutex
 func (s *mqttSession) generateMid() uint16 {
-	return 0
+	for {
+		s.lastMid++
+		if s.lastMid == 0 {
+			continue
+		}
+		used := false
+		for _, msg := range s.msgs {
+			if msg.mid == s.lastMid && msg.state != mqttMessateStateQueued {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return s.lastMid
+		}
+	}
+}
+
+// newPublishPacket create publish packet for message, properties and
+// remaining expiry interval are added for MQTT v5 client
+func (s *mqttSession) newPublishPacket(msg *mqttMessage) *mqttPacket {
+	var props mqttProperties
+	if s.protocol == mqttProtocol5 {
+		props, _ = decodeProperties(msg.properties)
+		if !msg.expiry.IsZero() {
+			remaining := msg.expiry.Sub(time.Now()) / time.Second
+			if remaining < 1 {
+				remaining = 1
+			}
+			props.addInt(PROPERTY_MESSAGE_EXPIRY_INTERVAL, uint32(remaining))
+		}
+	}
+	// Client see topics without its mount point
+	topic := msg.topic
+	if mp := s.mountPoint(); mp != "" {
+		topic = strings.TrimPrefix(topic, mp)
+	}
+	packet := newMqttPacket()
+	packet.command = PUBLISH
+	packet.dup = msg.dup
+	packet.qos = msg.qos
+	packet.retain = msg.retain
+	packet.remainingLength = 2 + len(topic) + len(msg.payload)
+	if msg.qos > 0 {
+		packet.remainingLength += 2
+	}
+	if s.protocol == mqttProtocol5 {
+		length := props.length()
+		packet.remainingLength += varIntLength(length) + length
+	}
+	packet.initializePacket()
+	packet.writeString(topic)
+	if msg.qos > 0 {
+		packet.writeUint16(msg.mid)
+	}
+	if s.protocol == mqttProtocol5 {
+		packet.writeProperties(props)
+	}
+	packet.writeBytes(msg.payload)
+	packet.pos = 0
+	packet.toprocess = packet.length
+	return &packet
+}
+
+// sendPublish send message to client with qos granted by subscription
+func (s *mqttSession) sendPublish(subQos uint8, smsg *StorageMessage, retain bool) error {
+	return s.sendSharedPublish(subQos, smsg, retain, "")
 }
 
-func (s *mqttSession) sendPublish(subQos uint8, srcQos uint8, topic string, payload []uint8) error {
+// sendSharedPublish send message dispatched by shared subscription, the
+// message is redispatched to other member if it is not acknowledged before
+// session is closed
+func (s *mqttSession) sendSharedPublish(subQos uint8, smsg *StorageMessage, retain bool, share string) error {
 	/* Check for ACL topic access. */
 	// TODO
 
+	if smsg.Expired() {
+		return nil
+	}
 	var qos uint8
-	if option, err := s.config.Bool(s.mgr.protocol, "upgrade_outgoing_qos"); err != nil && option {
+	if option, err := s.config.Bool(s.mgr.protocol, "upgrade_outgoing_qos"); err == nil && option {
 		qos = subQos
 	} else {
-		if srcQos > subQos {
+		if smsg.Qos > subQos {
 			qos = subQos
 		} else {
-			qos = srcQos
+			qos = smsg.Qos
 		}
 	}
 
-	var mid uint16
-	if qos > 0 {
-		mid = s.generateMid()
-	} else {
-		mid = 0
+	payload, err := s.codecs.Deliver(smsg.Topic, smsg.Payload)
+	if err != nil {
+		s.mgr.metrics.AddMetric(codec.MetricDeliverErrors, 1)
+		s.dropMessage(smsg.Topic, qos, fmt.Sprintf("Failed to convert payload:%s", err))
+		return nil
 	}
 
-	packet := newMqttPacket()
-	packet.command = PUBLISH
-	packet.remainingLength = 2 + len(topic) + len(payload)
-	if qos > 0 {
-		packet.remainingLength += 2
+	msg := &mqttMessage{
+		direction:  mqttMessageDirectionOut,
+		state:      mqttMessateStateQueued,
+		topic:      smsg.Topic,
+		payload:    payload,
+		qos:        qos,
+		retain:     retain,
+		properties: smsg.Properties,
+		expiry:     smsg.ExpiryAt,
 	}
-	packet.initializePacket()
-	packet.writeString(topic)
-	if qos > 0 {
-		packet.writeUint16(mid)
+	if share != "" && qos > 0 {
+		origin := *smsg
+		msg.share = share
+		msg.origin = &origin
+	}
+	if !s.isConnected() {
+		// Only qos1/2 message is queued for offline client of persistent
+		// session, and it is sent after session is resumed
+		if qos == 0 || s.cleanSession > 0 {
+			return nil
+		}
+		return s.queueOfflineMessage(smsg.SourceID, msg)
 	}
-	packet.writeBytes(payload)
+	if qos == 0 {
+		packet := s.newPublishPacket(msg)
+		// Packet larger than client's maximum packet size is discarded
+		if s.maxPacketSize > 0 && packet.length > int(s.maxPacketSize) {
+			s.dropMessage(msg.topic, qos, "Packet too large")
+			return nil
+		}
+		// Publisher of other session is not blocked by slow subscriber,
+		// qos0 message is dropped if packet sender is busy
+		select {
+		case s.sendPacketChannel <- packet:
+		case <-s.sendStopChannel:
+			return errors.New("Session is closed")
+		default:
+			s.dropMessage(msg.topic, qos, "Outgoing queue is full")
+			return nil
+		}
+		s.notify(&event.Event{Type: event.MessageDelivered, Topic: msg.topic, Qos: qos, Retain: retain, Payload: msg.payload})
+		return nil
+	}
+	if s.maxPacketSize > 0 && s.newPublishPacket(msg).length > int(s.maxPacketSize) {
+		s.dropMessage(msg.topic, qos, "Packet too large")
+		return nil
+	}
+	// Qos1/2 message is queued firstly, and then sent by packet sender when
+	// inflight window is available
+	s.queueOutMessage(msg)
+	s.flushOutMessages()
+	return nil
+}
+
+// queueOutMessage append qos1/2 message to outgoing message queue, the
+// messages waiting for inflight window are limited as offline queue
+func (s *mqttSession) queueOutMessage(msg *mqttMessage) {
+	s.msgMutex.Lock()
+	var dropped *mqttMessage
+	if s.queueLimits.maxMessages > 0 && s.queuedOutMessages() >= s.queueLimits.maxMessages {
+		dropped = msg
+		if s.queueLimits.dropPolicy == queueDropOldest {
+			for i, m := range s.msgs {
+				if m.state == mqttMessateStateQueued {
+					dropped = m
+					s.msgs = append(s.msgs[:i], s.msgs[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	if dropped != msg {
+		s.msgs = append(s.msgs, msg)
+	}
+	s.msgMutex.Unlock()
+	if dropped != nil {
+		s.dropMessage(dropped.topic, dropped.qos, "Outgoing queue is full")
+		glog.Warningf("Outgoing queue of %s is full, message on '%s' is dropped", s.clientID, dropped.topic)
+	}
+}
+
+// queuedOutMessages return count of messages not sent yet, msgMutex must
+// be held
+func (s *mqttSession) queuedOutMessages() int {
+	count := 0
+	for _, msg := range s.msgs {
+		if msg.state == mqttMessateStateQueued {
+			count++
+		}
+	}
+	return count
+}
 
-	return s.queuePacket(&packet)
+// queueOfflineMessage store message in storage while client is offline,
+// the oldest or the new message is dropped if queue limits are exceeded
+func (s *mqttSession) queueOfflineMessage(source string, msg *mqttMessage) error {
+	s.offlineMutex.Lock()
+	defer s.offlineMutex.Unlock()
+	return queueLimitedMessage(s.storage, s.clientID, s.queueLimits, StorageMessage{
+		SourceID:   source,
+		Topic:      msg.topic,
+		Direction:  MessageDirectionOut,
+		Qos:        msg.qos,
+		Retain:     msg.retain,
+		Payload:    msg.payload,
+		Properties: msg.properties,
+		ExpiryAt:   msg.expiry,
+	}, func(dropped StorageMessage) {
+		s.dropMessage(dropped.Topic, dropped.Qos, "Offline queue is full")
+	})
 }
@@ -0,0 +1,173 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+const sharedSubscriptionPrefix = "$share/"
+
+// Strategy to select member in shared subscription group
+const (
+	shareStrategyRoundRobin = "round_robin"
+	shareStrategyRandom     = "random"
+	shareStrategyHash       = "hash"
+	shareStrategySticky     = "sticky"
+)
+
+// parseSharedSubscription split shared subscription into group name and
+// topic filter, ok is false if it is not a shared subscription
+func parseSharedSubscription(topic string) (group string, filter string, ok bool) {
+	if !strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(topic[len(sharedSubscriptionPrefix):], "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// checkSharedSubscription check shared subscription's validity, group name
+// must not be empty or contain wildcard
+func checkSharedSubscription(topic string) error {
+	if !strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		return nil
+	}
+	group, _, ok := parseSharedSubscription(topic)
+	if !ok || group == "" || strings.ContainsAny(group, "+#") {
+		return mqttErrorInvalidProtocol
+	}
+	return nil
+}
+
+// shareGroup is members of shared subscription group on a topic filter,
+// only one member receive each message
+type shareGroup struct {
+	mutex   sync.Mutex
+	name    string
+	filter  string
+	members []topicSubscriber
+	next    int
+	sticky  string
+}
+
+// subscription return shared subscription string of the group
+func (g *shareGroup) subscription() string {
+	return sharedSubscriptionPrefix + g.name + "/" + g.filter
+}
+
+// add add or update member in group, it return true if member is new
+func (g *shareGroup) add(sub topicSubscriber) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, m := range g.members {
+		if m.sessionid == sub.sessionid {
+			g.members[i] = sub
+			return false
+		}
+	}
+	g.members = append(g.members, sub)
+	return true
+}
+
+// remove remove member from group, it return true if member is found
+func (g *shareGroup) remove(sessionid string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for i, m := range g.members {
+		if m.sessionid == sessionid {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			if g.sticky == sessionid {
+				g.sticky = ""
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// exist check wether session is member of group
+func (g *shareGroup) exist(sessionid string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, m := range g.members {
+		if m.sessionid == sessionid {
+			return true
+		}
+	}
+	return false
+}
+
+// sessions return session id of members in group
+func (g *shareGroup) sessions() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ids := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		ids = append(ids, m.sessionid)
+	}
+	return ids
+}
+
+// size return member count of group
+func (g *shareGroup) size() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.members)
+}
+
+// pick select one available member with strategy, key is used by hash
+// strategy, members not available are skipped
+func (g *shareGroup) pick(strategy string, key string, available func(sessionid string) bool) (topicSubscriber, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	count := len(g.members)
+	if count == 0 {
+		return topicSubscriber{}, false
+	}
+	start := 0
+	switch strategy {
+	case shareStrategyRandom:
+		start = rand.Intn(count)
+	case shareStrategyHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		start = int(h.Sum32() % uint32(count))
+	case shareStrategySticky:
+		for i, m := range g.members {
+			if m.sessionid == g.sticky {
+				start = i
+				break
+			}
+		}
+	default:
+		start = g.next % count
+	}
+	for i := 0; i < count; i++ {
+		index := (start + i) % count
+		m := g.members[index]
+		if !available(m.sessionid) {
+			continue
+		}
+		g.next = index + 1
+		g.sticky = m.sessionid
+		return m, true
+	}
+	return topicSubscriber{}, false
+}
@@ -14,6 +14,7 @@ package mqtt
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cloustone/sentel/core"
@@ -35,6 +36,8 @@ type StorageSession struct {
 	SubscribeCount     uint32
 	Protocol           uint8
 	RefCount           uint8
+	CreatedAt          time.Time
+	Service            string // Service serving the session, such as mqtt:tcp
 }
 
 type MessageDirection int
@@ -54,16 +57,29 @@ type MessageState int
 
 // StorageMessage ...
 type StorageMessage struct {
-	ID        uint
-	SourceID  string
-	Topic     string
-	Direction MessageDirection
-	State     MessageState
-	Qos       uint8
-	Retain    bool
-	Payload   []uint8
+	ID         uint
+	SourceID   string
+	Topic      string
+	Direction  MessageDirection
+	State      MessageState
+	Qos        uint8
+	Retain     bool
+	Payload    []uint8
+	Properties []uint8   // Encoded MQTT v5 properties forwarded to subscribers
+	ExpiryAt   time.Time // Message is discarded after expiry time if set
 }
 
+// Expired return wether message is expired
+func (m *StorageMessage) Expired() bool {
+	return !m.ExpiryAt.IsZero() && time.Now().After(m.ExpiryAt)
+}
+
+// Subscription options in MQTT v5
+const (
+	SubscriptionNoLocal           = 0x04
+	SubscriptionRetainAsPublished = 0x08
+)
+
 // Storage ...
 type Storage interface {
 	Open() error
@@ -76,6 +92,11 @@ type Storage interface {
 	DeleteSession(id string) error
 	UpdateSession(s *mqttSession) error
 	RegisterSession(s *mqttSession) error
+	WalkSessions(fn func(s *mqttSession))
+
+	// Persistent sessions restored from backup without connection
+	FindStoredSession(id string) (StorageSession, error)
+	WalkStoredSessions(fn func(ss StorageSession))
 
 	// Device
 	// AddDevice(d StorageDevice) error
@@ -94,23 +115,125 @@ type Storage interface {
 	// GetTopicSubscribers(t StorageTopic) ([]string, error)
 
 	// Subscription
-	AddSubscription(sessionid string, topic string, qos uint8) error
+	AddSubscription(sessionid string, topic string, qos uint8, options uint8) error
+	ExistSubscription(sessionid string, topic string) bool
+	GetSubscriptionCount(sessionid string) int
+	WalkSubscriptions(fn func(topic string, count int))
+	WalkClientSubscriptions(fn func(sessionid string, topic string, qos uint8))
+	WalkSessionSubscriptions(sessionid string, fn func(topic string, qos uint8, options uint8))
+	WatchSubscriptions(fn func(filter string, subscribed bool))
+	SetShareFilter(fn func(share string) bool)
+	MatchSubscribers(topic string) []string
+	QueueSharedMessage(share string, exclude string, msg StorageMessage) error
 	RetainSubscription(sessionid string, topic string, qos uint8) error
 	RemoveSubscription(sessionid string, topic string) error
 
+	// Receiver of subscriptions made by services of other protocols
+	AddReceiver(id string, fn func(msg StorageMessage))
+	RemoveReceiver(id string)
+
+	// Watcher of messages dropped from offline queue of restored sessions
+	WatchDroppedMessages(service string, fn func(clientid string, msg StorageMessage, reason string))
+
+	// Retained message
+	StoreRetainMessage(topic string, msg StorageMessage) error
+	DeleteRetainMessage(topic string) error
+	FindRetainMessages(subscription string) []StorageMessage
+	GetRetainMessageCount() int
+	WalkRetainMessages(fn func(topic string, msg StorageMessage))
+
 	// Message Management
 	FindMessage(clientid string, mid uint16) (bool, error)
 	StoreMessage(clientid string, msg StorageMessage) error
+	PopMessage(clientid string) (StorageMessage, error)
 	DeleteMessageWithValidator(clientid string, validator func(StorageMessage) bool)
 	DeleteMessage(clientid string, mid uint16, direction MessageDirection) error
 
 	QueueMessage(clientid string, msg StorageMessage) error
 	GetMessageTotalCount(clientid string) int
+	GetMessageTotalSize(clientid string) int
 	InsertMessage(clientid string, mid uint16, direction MessageDirection, msg StorageMessage) error
 	ReleaseMessage(clientid string, mid uint16, direction MessageDirection) error
 	UpdateMessage(clientid string, mid uint16, direction MessageDirection, state MessageState)
 }
 
+// Policy to drop message when offline message queue is full
+const (
+	queueDropOldest = "oldest"
+	queueDropNewest = "newest"
+)
+
+// queueLimits is offline message queue limits of client, zero means no limit
+type queueLimits struct {
+	maxMessages int
+	maxBytes    int
+	dropPolicy  string
+}
+
+// getQueueLimits return offline and outgoing message queue limits of service
+func getQueueLimits(c core.Config, service string) queueLimits {
+	limits := queueLimits{maxMessages: 1000, dropPolicy: queueDropOldest}
+	if n, err := c.Int(service, "max_queued_messages"); err == nil && n >= 0 {
+		limits.maxMessages = n
+	}
+	if n, err := c.Int(service, "max_queued_bytes"); err == nil && n >= 0 {
+		limits.maxBytes = n
+	}
+	if policy, err := c.String(service, "queue_drop_policy"); err == nil && policy == queueDropNewest {
+		limits.dropPolicy = queueDropNewest
+	}
+	return limits
+}
+
+// queueLimitedMessage store offline message of client, the oldest or the new
+// message is dropped and passed to drop if queue limits are exceeded
+func queueLimitedMessage(storage Storage, clientid string, limits queueLimits, msg StorageMessage, drop func(msg StorageMessage)) error {
+	size := len(msg.Payload)
+	for {
+		count := storage.GetMessageTotalCount(clientid)
+		if (limits.maxMessages == 0 || count < limits.maxMessages) &&
+			(limits.maxBytes == 0 || storage.GetMessageTotalSize(clientid)+size <= limits.maxBytes) {
+			break
+		}
+		if limits.dropPolicy == queueDropNewest || count == 0 {
+			glog.Warningf("Offline queue of %s is full, message on '%s' is dropped", clientid, msg.Topic)
+			drop(msg)
+			return nil
+		}
+		oldest, err := storage.PopMessage(clientid)
+		if err != nil {
+			return err
+		}
+		drop(oldest)
+	}
+	return storage.StoreMessage(clientid, msg)
+}
+
+// Operations recorded by persistent storage
+const (
+	recordSession        = "session"
+	recordDeleteSession  = "delsession"
+	recordSubscribe      = "subscribe"
+	recordUnsubscribe    = "unsubscribe"
+	recordRetain         = "retain"
+	recordDeleteRetain   = "delretain"
+	recordStoreMessage   = "store"
+	recordDeleteMessages = "delmessages"
+)
+
+// storageRecord is one change in storage, persistent storage replay them
+// to recover from crash
+type storageRecord struct {
+	Op      string          `json:"op"`
+	Client  string          `json:"client,omitempty"`
+	Topic   string          `json:"topic,omitempty"`
+	Qos     uint8           `json:"qos,omitempty"`
+	Options uint8           `json:"options,omitempty"`
+	Session *StorageSession `json:"session,omitempty"`
+	Message *StorageMessage `json:"message,omitempty"`
+	IDs     []uint          `json:"ids,omitempty"`
+}
+
 type storageFactory interface {
 	New(c core.Config) (Storage, error)
 }
@@ -133,6 +256,31 @@ func NewStorage(name string, c core.Config) (Storage, error) {
 	return _allStorage[name].New(c)
 }
 
+var (
+	_sharedStorages     = make(map[string]Storage)
+	_sharedStorageMutex sync.Mutex
+)
+
+// getSharedStorage return storage shared by all mqtt services, so that
+// clients connected through different transport can talk with each other
+func getSharedStorage(name string, c core.Config) (Storage, error) {
+	_sharedStorageMutex.Lock()
+	defer _sharedStorageMutex.Unlock()
+	if s, ok := _sharedStorages[name]; ok {
+		return s, nil
+	}
+	s, err := NewStorage(name, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+	_sharedStorages[name] = s
+	return s, nil
+}
+
 func init() {
 	registerStorage("local", &localStorageFactory{})
+	registerStorage("disk", &diskStorageFactory{})
 }
@@ -0,0 +1,159 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+const sysTopicPrefix = "$SYS/broker/"
+
+// SysConfigs is default configurations for $SYS publisher
+var SysConfigs = map[string]string{
+	"interval": "10",
+}
+
+// sysService publish broker's stats and metrics in $SYS topics
+type sysService struct {
+	config    core.Config
+	chn       chan base.ServiceCommand
+	storage   Storage
+	protocol  string
+	interval  time.Duration
+	startedAt time.Time
+	values    map[string]string // Last published values
+	ticker    *time.Ticker
+	quit      chan bool
+}
+
+// SysFactory create $SYS publisher service
+type SysFactory struct{}
+
+// New create $SYS publisher service
+func (m *SysFactory) New(protocol string, c core.Config, ch chan base.ServiceCommand) (base.Service, error) {
+	name := c.MustString("storage", "name")
+	s, err := getSharedStorage(name, c)
+	if err != nil {
+		return nil, errors.New("Failed to create storage in $SYS publisher")
+	}
+	interval, err := c.Int(protocol, "interval")
+	if err != nil || interval <= 0 {
+		interval = 10
+	}
+	return &sysService{
+		config:    c,
+		chn:       ch,
+		storage:   s,
+		protocol:  protocol,
+		interval:  time.Duration(interval) * time.Second,
+		startedAt: time.Now(),
+		values:    make(map[string]string),
+		quit:      make(chan bool),
+	}, nil
+}
+
+// Info
+func (p *sysService) Info() *base.ServiceInfo {
+	return &base.ServiceInfo{
+		ServiceName: "sys-publisher",
+	}
+}
+
+// Start
+func (p *sysService) Start() error {
+	p.ticker = time.NewTicker(p.interval)
+	p.publish("version", base.GetServiceManager().GetVersion())
+	for {
+		select {
+		case <-p.ticker.C:
+			p.publishStats()
+		case <-p.quit:
+			return nil
+		}
+	}
+}
+
+// Stop
+func (p *sysService) Stop() {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+	close(p.quit)
+}
+
+// publishStats publish uptime and all stats and metrics of mqtt services
+func (p *sysService) publishStats() {
+	mgr := base.GetServiceManager()
+	uptime := int64(time.Since(p.startedAt) / time.Second)
+	p.publish("uptime", fmt.Sprintf("%d seconds", uptime))
+	for k, v := range mgr.GetStats("mqtt") {
+		p.publish(k, fmt.Sprintf("%d", v))
+	}
+	for k, v := range mgr.GetMetrics("mqtt") {
+		p.publish(k, fmt.Sprintf("%d", v))
+	}
+}
+
+// publish route retained message on $SYS topic if the value is changed
+func (p *sysService) publish(name string, value string) {
+	if p.values[name] == value {
+		return
+	}
+	p.values[name] = value
+	topic := sysTopicPrefix + name
+	msg := StorageMessage{
+		SourceID:  "$SYS",
+		Topic:     topic,
+		Direction: MessageDirectionIn,
+		Qos:       0,
+		Retain:    true,
+		Payload:   []uint8(value),
+	}
+	if err := p.storage.StoreRetainMessage(topic, msg); err != nil {
+		glog.Errorf("Failed to store $SYS message on '%s':%s", topic, err)
+		return
+	}
+	p.storage.QueueMessage(msg.SourceID, msg)
+}
+
+// isSysTopic check wether topic or subscription is in $SYS tree
+func isSysTopic(topic string) bool {
+	if _, filter, ok := parseSharedSubscription(topic); ok {
+		topic = filter
+	}
+	return topic == "$SYS" || strings.HasPrefix(topic, "$SYS/")
+}
+
+// isSysAdmin check wether user is allowed to subscribe $SYS topics
+func isSysAdmin(c core.Config, protocol string, username string) bool {
+	if username == "" {
+		return false
+	}
+	admins, err := c.String(protocol, "sys_admin_users")
+	if err != nil {
+		return false
+	}
+	for _, admin := range strings.Split(admins, ",") {
+		if strings.TrimSpace(admin) == username {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// Certificate identity used as client's username or client id
+const (
+	certIdentityNone = ""
+	certIdentityCN   = "cn"
+	certIdentitySAN  = "san"
+)
+
+// tlsLoader load server certificate and client CA from files configured in
+// security section, the files are checked in reload interval and reloaded
+// when their contents are changed, so that certificates can be renewed
+// without restarting broker. Handshakes are served with the last loaded
+// config without touching files
+type tlsLoader struct {
+	certFile    string
+	keyFile     string
+	caFile      string
+	caPath      string
+	requireCert bool
+	interval    time.Duration
+	digest      []uint8
+	config      atomic.Value // *tls.Config
+	quit        chan bool
+	closeOnce   sync.Once
+}
+
+// tlsListener stop reloading certificates when it is closed
+type tlsListener struct {
+	net.Listener
+	loader *tlsLoader
+}
+
+func (l *tlsListener) Close() error {
+	l.loader.stop()
+	return l.Listener.Close()
+}
+
+// newTLSListener create tls listener on host with security configurations
+func newTLSListener(m *mqtt, host string) (net.Listener, error) {
+	loader, err := newTLSLoader(m.config)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return loader.getConfig(), nil
+		},
+	}
+	listener, err := tls.Listen("tcp", host, config)
+	if err != nil {
+		loader.stop()
+		return nil, err
+	}
+	glog.Infof("Mqtt tls is served on '%s'", host)
+	return &tlsListener{Listener: listener, loader: loader}, nil
+}
+
+// newTLSLoader create loader and load certificates for the first time
+func newTLSLoader(c core.Config) (*tlsLoader, error) {
+	l := &tlsLoader{interval: 60 * time.Second, quit: make(chan bool)}
+	l.certFile, _ = c.String("security", "certfile")
+	l.keyFile, _ = c.String("security", "keyfile")
+	l.caFile, _ = c.String("security", "cafile")
+	l.caPath, _ = c.String("security", "capath")
+	if option, err := c.Bool("security", "require_certificate"); err == nil && option {
+		l.requireCert = true
+	}
+	if interval, err := c.Int("security", "reload_interval"); err == nil && interval > 0 {
+		l.interval = time.Duration(interval) * time.Second
+	}
+	if l.certFile == "" || l.keyFile == "" {
+		return nil, errors.New("Certificate and key file must be set in security section")
+	}
+	if l.requireCert && l.caFile == "" && l.caPath == "" {
+		return nil, errors.New("Client certificate is required without cafile or capath")
+	}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	go l.watch()
+	return l, nil
+}
+
+// getConfig return tls config loaded last time
+func (l *tlsLoader) getConfig() *tls.Config {
+	return l.config.Load().(*tls.Config)
+}
+
+// watch reload certificates in interval until loader is stopped
+func (l *tlsLoader) watch() {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.reload(); err != nil {
+				// Keep using old certificates if new ones are broken
+				glog.Errorf("Failed to reload certificates:%s", err)
+			}
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *tlsLoader) stop() {
+	l.closeOnce.Do(func() { close(l.quit) })
+}
+
+// reload load certificates if contents of files are changed, files are
+// compared by contents since renewed files may be swapped in by symlinks
+// with older modification time
+func (l *tlsLoader) reload() error {
+	digest := l.fingerprint()
+	if l.digest != nil && bytes.Equal(digest, l.digest) {
+		return nil
+	}
+	config, err := l.load()
+	if err != nil {
+		return err
+	}
+	if l.digest != nil {
+		glog.Infof("Certificates are reloaded")
+	}
+	l.config.Store(config)
+	l.digest = digest
+	return nil
+}
+
+// load read certificates from files and build tls config
+func (l *tlsLoader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.NoClientCert,
+	}
+	if l.caFile == "" && l.caPath == "" {
+		return config, nil
+	}
+	pool := x509.NewCertPool()
+	for _, file := range l.caFiles() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No valid certificate in '%s'", file)
+		}
+	}
+	config.ClientCAs = pool
+	if l.requireCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// caFiles return ca file and all certificate files in ca path
+func (l *tlsLoader) caFiles() []string {
+	files := []string{}
+	if l.caFile != "" {
+		files = append(files, l.caFile)
+	}
+	if l.caPath != "" {
+		for _, pattern := range []string{"*.pem", "*.crt"} {
+			matches, _ := filepath.Glob(filepath.Join(l.caPath, pattern))
+			files = append(files, matches...)
+		}
+	}
+	return files
+}
+
+// fingerprint return digest of names and contents of certificate files
+func (l *tlsLoader) fingerprint() []uint8 {
+	h := sha256.New()
+	for _, file := range append([]string{l.certFile, l.keyFile}, l.caFiles()...) {
+		h.Write([]uint8(file))
+		if data, err := ioutil.ReadFile(file); err == nil {
+			h.Write(data)
+		}
+	}
+	return h.Sum(nil)
+}
+
+// certificateIdentity return identity in client certificate according to
+// mapping type, it is empty if no certificate is presented
+func certificateIdentity(conn net.Conn, identity string) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := state.PeerCertificates[0]
+	switch identity {
+	case certIdentityCN:
+		return cert.Subject.CommonName
+	case certIdentitySAN:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+		if len(cert.IPAddresses) > 0 {
+			return cert.IPAddresses[0].String()
+		}
+	}
+	return ""
+}
+
+// tlsVersionNames map tls version to readable name
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1.0",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// connectionTLSInfo return tls version and cipher suite of connection
+func connectionTLSInfo(conn net.Conn) (string, string) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", ""
+	}
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return "", ""
+	}
+	return tlsVersionNames[state.Version], tls.CipherSuiteName(state.CipherSuite)
+}
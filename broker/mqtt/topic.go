@@ -26,15 +26,31 @@ const (
 	ObjectActionRetrieve   = "retrieve"
 	ObjectActionDelete     = "delete"
 	ObjectActionUpdate     = "update"
+	ObjectActionTransfer   = "transfer"
 )
 
 type TenantTopic struct{}
 
+// SessionSubscription is subscription of transferred session
+type SessionSubscription struct {
+	Topic   string `json:"topic"`
+	Qos     uint8  `json:"qos"`
+	Options uint8  `json:"options"`
+}
+
 type SessionTopic struct {
 	Launcher  string `json:"launcher"`
 	SessionId string `json:"sessionId"`
 	Action    string `json:"action"`
 	State     uint8  `json:"oldState"`
+	// Launcher of update wait for sessions transferred by other nodes
+	Wait bool `json:"wait,omitempty"`
+
+	// State of persistent session transferred to the node of new connection
+	Target        string                `json:"target,omitempty"`
+	Session       *StorageSession       `json:"session,omitempty"`
+	Subscriptions []SessionSubscription `json:"subscriptions,omitempty"`
+	Messages      []StorageMessage      `json:"messages,omitempty"`
 
 	encoded []byte
 	err     error
@@ -0,0 +1,441 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// subLeaf is subscription of a session on topic filter
+type subLeaf struct {
+	qos     uint8
+	options uint8
+}
+
+// topicSubscriber is subscriber matched with published topic
+type topicSubscriber struct {
+	sessionid string
+	qos       uint8
+	options   uint8
+}
+
+// topicNode is one level in topic tree, each node is protected by its own
+// lock so that different branches can be updated concurrently
+type topicNode struct {
+	mutex     sync.RWMutex
+	level     string
+	parent    *topicNode
+	children  map[string]*topicNode
+	subs      map[string]*subLeaf
+	shared    map[string]*shareGroup // Shared subscription groups by name
+	retainMsg *StorageMessage
+	subCount  int32 // Subscriber count on this node, read without lock
+	removed   bool  // Node is pruned from tree, writers must retry
+}
+
+// topicTree is subscription and retained message tree with MQTT wildcard
+// semantics, lookups only take read locks along the path
+type topicTree struct {
+	root        *topicNode
+	subCount    int64
+	retainCount int64
+}
+
+// newTopicTree create empty topic tree
+func newTopicTree() *topicTree {
+	return &topicTree{root: newTopicNode(nil, "")}
+}
+
+func newTopicNode(parent *topicNode, level string) *topicNode {
+	return &topicNode{
+		level:    level,
+		parent:   parent,
+		children: make(map[string]*topicNode),
+		subs:     make(map[string]*subLeaf),
+		shared:   make(map[string]*shareGroup),
+	}
+}
+
+// child return child node with level
+func (n *topicNode) child(level string) *topicNode {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.children[level]
+}
+
+// isEmpty return wether node can be pruned, the caller must hold lock
+func (n *topicNode) isEmpty() bool {
+	return len(n.subs) == 0 && len(n.shared) == 0 && len(n.children) == 0 && n.retainMsg == nil
+}
+
+// lookup return node for topic, nil is returned if it does not exist
+func (t *topicTree) lookup(topic string) *topicNode {
+	node := t.root
+	for _, level := range strings.Split(topic, "/") {
+		if node = node.child(level); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// update create node for topic if needed and call fn with node locked,
+// it retry from root if the node is pruned concurrently
+func (t *topicTree) update(topic string, fn func(node *topicNode)) {
+	levels := strings.Split(topic, "/")
+retry:
+	node := t.root
+	for _, level := range levels {
+		next := node.child(level)
+		if next == nil {
+			node.mutex.Lock()
+			if node.removed {
+				node.mutex.Unlock()
+				goto retry
+			}
+			if next = node.children[level]; next == nil {
+				next = newTopicNode(node, level)
+				node.children[level] = next
+			}
+			node.mutex.Unlock()
+		}
+		node = next
+	}
+	node.mutex.Lock()
+	if node.removed {
+		node.mutex.Unlock()
+		goto retry
+	}
+	fn(node)
+	node.mutex.Unlock()
+}
+
+// prune remove empty nodes from node up to root
+func (t *topicTree) prune(node *topicNode) {
+	for node != nil && node.parent != nil {
+		parent := node.parent
+		parent.mutex.Lock()
+		node.mutex.Lock()
+		if node.removed || !node.isEmpty() {
+			node.mutex.Unlock()
+			parent.mutex.Unlock()
+			return
+		}
+		node.removed = true
+		delete(parent.children, node.level)
+		node.mutex.Unlock()
+		parent.mutex.Unlock()
+		node = parent
+	}
+}
+
+// subscribe add session's subscription on topic filter, it return true if
+// the subscription is new
+func (t *topicTree) subscribe(topic string, sessionid string, qos uint8, options uint8) bool {
+	isNew := false
+	t.update(topic, func(node *topicNode) {
+		if _, ok := node.subs[sessionid]; !ok {
+			isNew = true
+			atomic.AddInt32(&node.subCount, 1)
+			atomic.AddInt64(&t.subCount, 1)
+		}
+		node.subs[sessionid] = &subLeaf{qos: qos, options: options}
+	})
+	return isNew
+}
+
+// unsubscribe remove session's subscription on topic filter, empty nodes
+// are pruned
+func (t *topicTree) unsubscribe(topic string, sessionid string) bool {
+	node := t.lookup(topic)
+	if node == nil {
+		return false
+	}
+	node.mutex.Lock()
+	_, ok := node.subs[sessionid]
+	if ok {
+		delete(node.subs, sessionid)
+		atomic.AddInt32(&node.subCount, -1)
+		atomic.AddInt64(&t.subCount, -1)
+	}
+	node.mutex.Unlock()
+	if ok {
+		t.prune(node)
+	}
+	return ok
+}
+
+// exist check wether session has subscribed the topic filter
+func (t *topicTree) exist(topic string, sessionid string) bool {
+	node := t.lookup(topic)
+	if node == nil {
+		return false
+	}
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	_, ok := node.subs[sessionid]
+	return ok
+}
+
+// subscribeShared add session into shared subscription group on topic
+// filter, it return true if the session is new member of the group
+func (t *topicTree) subscribeShared(topic string, group string, sessionid string, qos uint8, options uint8) bool {
+	isNew := false
+	t.update(topic, func(node *topicNode) {
+		g, ok := node.shared[group]
+		if !ok {
+			g = &shareGroup{name: group, filter: topic}
+			node.shared[group] = g
+		}
+		if g.add(topicSubscriber{sessionid: sessionid, qos: qos, options: options}) {
+			isNew = true
+			atomic.AddInt32(&node.subCount, 1)
+			atomic.AddInt64(&t.subCount, 1)
+		}
+	})
+	return isNew
+}
+
+// unsubscribeShared remove session from shared subscription group, empty
+// group and nodes are pruned
+func (t *topicTree) unsubscribeShared(topic string, group string, sessionid string) bool {
+	node := t.lookup(topic)
+	if node == nil {
+		return false
+	}
+	node.mutex.Lock()
+	found := false
+	if g, ok := node.shared[group]; ok && g.remove(sessionid) {
+		found = true
+		atomic.AddInt32(&node.subCount, -1)
+		atomic.AddInt64(&t.subCount, -1)
+		if g.size() == 0 {
+			delete(node.shared, group)
+		}
+	}
+	node.mutex.Unlock()
+	if found {
+		t.prune(node)
+	}
+	return found
+}
+
+// sharedGroup return shared subscription group on topic filter
+func (t *topicTree) sharedGroup(topic string, group string) *shareGroup {
+	node := t.lookup(topic)
+	if node == nil {
+		return nil
+	}
+	node.mutex.RLock()
+	defer node.mutex.RUnlock()
+	return node.shared[group]
+}
+
+// match return subscribers whose topic filter match published topic and
+// shared subscription groups matched, topics beginning with '$' are not
+// matched by wildcard at the first level
+func (t *topicTree) match(topic string) ([]topicSubscriber, []*shareGroup) {
+	subs := []topicSubscriber{}
+	groups := []*shareGroup{}
+	t.matchNode(t.root, strings.Split(topic, "/"), true, &subs, &groups)
+	return subs, groups
+}
+
+func (t *topicTree) matchNode(node *topicNode, levels []string, root bool, subs *[]topicSubscriber, groups *[]*shareGroup) {
+	node.mutex.RLock()
+	if len(levels) == 0 {
+		collectSubscribers(node, subs, groups)
+		// '#' also match the parent level
+		if v, ok := node.children["#"]; ok {
+			v.mutex.RLock()
+			collectSubscribers(v, subs, groups)
+			v.mutex.RUnlock()
+		}
+		node.mutex.RUnlock()
+		return
+	}
+	wildcard := !(root && strings.HasPrefix(levels[0], "$"))
+	multi := node.children["#"]
+	single := node.children["+"]
+	exact := node.children[levels[0]]
+	node.mutex.RUnlock()
+
+	if multi != nil && wildcard {
+		multi.mutex.RLock()
+		collectSubscribers(multi, subs, groups)
+		multi.mutex.RUnlock()
+	}
+	if single != nil && wildcard {
+		t.matchNode(single, levels[1:], false, subs, groups)
+	}
+	if exact != nil {
+		t.matchNode(exact, levels[1:], false, subs, groups)
+	}
+}
+
+// collectSubscribers append node's subscribers and shared subscription
+// groups, the caller must hold lock
+func collectSubscribers(node *topicNode, subs *[]topicSubscriber, groups *[]*shareGroup) {
+	for k, v := range node.subs {
+		*subs = append(*subs, topicSubscriber{sessionid: k, qos: v.qos, options: v.options})
+	}
+	for _, g := range node.shared {
+		*groups = append(*groups, g)
+	}
+}
+
+// storeRetain store retained message on topic, the retained message is
+// cleared if payload is empty
+func (t *topicTree) storeRetain(topic string, msg StorageMessage) {
+	if len(msg.Payload) == 0 {
+		t.deleteRetain(topic)
+		return
+	}
+	t.update(topic, func(node *topicNode) {
+		if node.retainMsg == nil {
+			atomic.AddInt64(&t.retainCount, 1)
+		}
+		node.retainMsg = &msg
+	})
+}
+
+// deleteRetain clear retained message on topic
+func (t *topicTree) deleteRetain(topic string) {
+	node := t.lookup(topic)
+	if node == nil {
+		return
+	}
+	node.mutex.Lock()
+	found := node.retainMsg != nil
+	if found {
+		node.retainMsg = nil
+		atomic.AddInt64(&t.retainCount, -1)
+	}
+	node.mutex.Unlock()
+	if found {
+		t.prune(node)
+	}
+}
+
+// findRetain return retained messages matched with subscription
+func (t *topicTree) findRetain(subscription string) []StorageMessage {
+	msgs := []StorageMessage{}
+	t.retainSearch(t.root, strings.Split(subscription, "/"), true, &msgs)
+	return msgs
+}
+
+// retainSearch collect retained messages matched with subscription levels
+func (t *topicTree) retainSearch(node *topicNode, levels []string, root bool, msgs *[]StorageMessage) {
+	node.mutex.RLock()
+	if len(levels) == 0 {
+		if node.retainMsg != nil {
+			*msgs = append(*msgs, *node.retainMsg)
+		}
+		node.mutex.RUnlock()
+		return
+	}
+	children := []*topicNode{}
+	switch levels[0] {
+	case "#":
+		// '#' also match the parent level
+		if node.retainMsg != nil && !root {
+			*msgs = append(*msgs, *node.retainMsg)
+		}
+		for k, v := range node.children {
+			if !(root && strings.HasPrefix(k, "$")) {
+				children = append(children, v)
+			}
+		}
+		node.mutex.RUnlock()
+		for _, v := range children {
+			t.retainSearch(v, levels, false, msgs)
+		}
+		return
+	case "+":
+		for k, v := range node.children {
+			if !(root && strings.HasPrefix(k, "$")) {
+				children = append(children, v)
+			}
+		}
+	default:
+		if v, ok := node.children[levels[0]]; ok {
+			children = append(children, v)
+		}
+	}
+	node.mutex.RUnlock()
+	for _, v := range children {
+		t.retainSearch(v, levels[1:], false, msgs)
+	}
+}
+
+// walk call fn for each topic filter which has subscribers, with count of
+// subscribers on it
+func (t *topicTree) walk(fn func(topic string, count int)) {
+	t.walkNode(t.root, "", fn)
+}
+
+func (t *topicTree) walkNode(node *topicNode, topic string, fn func(topic string, count int)) {
+	if count := atomic.LoadInt32(&node.subCount); count > 0 && node != t.root {
+		fn(topic, int(count))
+	}
+	node.mutex.RLock()
+	children := make([]*topicNode, 0, len(node.children))
+	for _, v := range node.children {
+		children = append(children, v)
+	}
+	node.mutex.RUnlock()
+	for _, v := range children {
+		if node == t.root {
+			t.walkNode(v, v.level, fn)
+		} else {
+			t.walkNode(v, topic+"/"+v.level, fn)
+		}
+	}
+}
+
+// walkRetain call fn for each retained message in tree
+func (t *topicTree) walkRetain(fn func(topic string, msg StorageMessage)) {
+	t.walkRetainNode(t.root, "", fn)
+}
+
+func (t *topicTree) walkRetainNode(node *topicNode, topic string, fn func(topic string, msg StorageMessage)) {
+	node.mutex.RLock()
+	msg := node.retainMsg
+	children := make([]*topicNode, 0, len(node.children))
+	for _, v := range node.children {
+		children = append(children, v)
+	}
+	node.mutex.RUnlock()
+	if msg != nil {
+		fn(topic, *msg)
+	}
+	for _, v := range children {
+		if node == t.root {
+			t.walkRetainNode(v, v.level, fn)
+		} else {
+			t.walkRetainNode(v, topic+"/"+v.level, fn)
+		}
+	}
+}
+
+// subscriptionCount return total subscription count in tree
+func (t *topicTree) subscriptionCount() int {
+	return int(atomic.LoadInt64(&t.subCount))
+}
+
+// retainedCount return total retained message count in tree
+func (t *topicTree) retainedCount() int {
+	return int(atomic.LoadInt64(&t.retainCount))
+}
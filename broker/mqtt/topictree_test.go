@@ -0,0 +1,243 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloustone/sentel/broker/base"
+)
+
+// matchedSessions return sorted session ids subscribing topic
+func matchedSessions(tree *topicTree, topic string) string {
+	subs, _ := tree.match(topic)
+	ids := []string{}
+	for _, sub := range subs {
+		ids = append(ids, sub.sessionid)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestTopicTreeMatch(t *testing.T) {
+	tree := newTopicTree()
+	filters := []string{"#", "+", "a/#", "a/+", "a/b", "+/b", "+/+", "a/b/#", "$SYS/#", "$SYS/+", "+/broker"}
+	for _, filter := range filters {
+		tree.subscribe(filter, filter, 0, 0)
+	}
+	cases := []struct {
+		topic string
+		want  string
+	}{
+		{"a", "#,+,a/#"},
+		{"a/b", "#,+/+,+/b,a/#,a/+,a/b,a/b/#"},
+		{"a/b/c", "#,a/#,a/b/#"},
+		{"a/", "#,+/+,a/#,a/+"},
+		{"x/b", "#,+/+,+/b"},
+		// Topics beginning with $ are not matched by leading wildcards
+		{"$SYS", "$SYS/#"},
+		{"$SYS/broker", "$SYS/#,$SYS/+"},
+		{"$SYS/broker/uptime", "$SYS/#"},
+		{"$other/b", ""},
+	}
+	for _, c := range cases {
+		if got := matchedSessions(tree, c.topic); got != c.want {
+			t.Errorf("match('%s') = %s, want %s", c.topic, got, c.want)
+		}
+		// Matcher shared by other packages has the same semantics
+		for _, filter := range filters {
+			want := strings.Contains(","+c.want+",", ","+filter+",")
+			if base.MatchTopic(filter, c.topic) != want {
+				t.Errorf("MatchTopic('%s', '%s') = %v, want %v", filter, c.topic, !want, want)
+			}
+		}
+	}
+}
+
+func TestTopicTreeUnsubscribe(t *testing.T) {
+	tree := newTopicTree()
+	tree.subscribe("a/b/c", "s1", 1, 0)
+	tree.subscribe("a/b/c", "s2", 1, 0)
+	if !tree.exist("a/b/c", "s1") || tree.subscriptionCount() != 2 {
+		t.Fatal("subscriptions are not added")
+	}
+	if !tree.unsubscribe("a/b/c", "s1") || tree.unsubscribe("a/b/c", "s1") {
+		t.Fatal("subscription is not removed once")
+	}
+	if got := matchedSessions(tree, "a/b/c"); got != "s2" {
+		t.Fatalf("match after unsubscribe = %s", got)
+	}
+	tree.unsubscribe("a/b/c", "s2")
+	// Empty nodes are pruned
+	if tree.lookup("a") != nil || tree.subscriptionCount() != 0 {
+		t.Fatal("empty nodes are not pruned")
+	}
+}
+
+func TestTopicTreeRetain(t *testing.T) {
+	tree := newTopicTree()
+	for _, topic := range []string{"a", "a/b", "a/b/c", "x/b", "$SYS/uptime"} {
+		tree.storeRetain(topic, StorageMessage{Topic: topic, Payload: []uint8(topic)})
+	}
+	cases := []struct {
+		filter string
+		want   string
+	}{
+		{"#", "a,a/b,a/b/c,x/b"},
+		{"a/#", "a,a/b,a/b/c"},
+		{"+/b", "a/b,x/b"},
+		{"a/+/c", "a/b/c"},
+		{"$SYS/#", "$SYS/uptime"},
+		{"+/uptime", ""},
+	}
+	for _, c := range cases {
+		topics := []string{}
+		for _, msg := range tree.findRetain(c.filter) {
+			topics = append(topics, msg.Topic)
+		}
+		sort.Strings(topics)
+		if got := strings.Join(topics, ","); got != c.want {
+			t.Errorf("findRetain('%s') = %s, want %s", c.filter, got, c.want)
+		}
+	}
+	// Empty payload clear retained message
+	tree.storeRetain("a/b", StorageMessage{Topic: "a/b"})
+	if tree.retainedCount() != 4 || len(tree.findRetain("a/b")) != 0 {
+		t.Fatal("retained message is not deleted")
+	}
+}
+
+func TestTopicTreeConcurrent(t *testing.T) {
+	tree := newTopicTree()
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				topic := fmt.Sprintf("c/%d/%d", g, i%50)
+				tree.subscribe(topic, "s", 0, 0)
+				tree.match(topic)
+				tree.storeRetain(topic, StorageMessage{Topic: topic, Payload: []uint8(topic)})
+				tree.findRetain("c/#")
+				tree.deleteRetain(topic)
+				tree.unsubscribe(topic, "s")
+			}
+		}(g)
+	}
+	wg.Wait()
+	if tree.subscriptionCount() != 0 || tree.retainedCount() != 0 || tree.lookup("c") != nil {
+		t.Fatal("tree is not empty after concurrent updates")
+	}
+}
+
+func TestCheckTopic(t *testing.T) {
+	for _, filter := range []string{"a", "a/b", "#", "+", "a/#", "+/+/c", "a//b", "/"} {
+		if err := checkTopicFilter(filter); err != nil {
+			t.Errorf("filter '%s' is rejected:%s", filter, err)
+		}
+	}
+	for _, filter := range []string{"", "a/#/b", "a+", "a/b#", "#/a", "a/+b"} {
+		if checkTopicFilter(filter) == nil {
+			t.Errorf("invalid filter '%s' is accepted", filter)
+		}
+	}
+	for _, topic := range []string{"", "a/+", "a/#", "a+"} {
+		if checkPublishTopic(topic) == nil {
+			t.Errorf("invalid publish topic '%s' is accepted", topic)
+		}
+	}
+}
+
+const benchmarkFilters = 1000000
+
+var (
+	benchmarkTree     *topicTree
+	benchmarkTreeOnce sync.Once
+)
+
+// benchmarkFilter return one of a million filters, a tenth of them have
+// wildcards
+func benchmarkFilter(i int) string {
+	switch i % 10 {
+	case 0:
+		return fmt.Sprintf("dev/%d/+/status", i%1000)
+	case 1:
+		return fmt.Sprintf("dev/%d/%d/#", i%1000, i/1000)
+	default:
+		return fmt.Sprintf("dev/%d/%d/status", i%1000, i/1000)
+	}
+}
+
+// getBenchmarkTree return tree with a million subscriptions
+func getBenchmarkTree() *topicTree {
+	benchmarkTreeOnce.Do(func() {
+		benchmarkTree = newTopicTree()
+		for i := 0; i < benchmarkFilters; i++ {
+			benchmarkTree.subscribe(benchmarkFilter(i), fmt.Sprintf("s%d", i), 1, 0)
+		}
+	})
+	return benchmarkTree
+}
+
+func BenchmarkTopicTreeSubscribe(b *testing.B) {
+	filters := make([]string, benchmarkFilters)
+	for i := range filters {
+		filters[i] = benchmarkFilter(i)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree := newTopicTree()
+		for _, filter := range filters {
+			tree.subscribe(filter, filter, 1, 0)
+		}
+	}
+}
+
+func BenchmarkTopicTreeMatch(b *testing.B) {
+	tree := getBenchmarkTree()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.match(fmt.Sprintf("dev/%d/%d/status", n%1000, n%1000))
+	}
+}
+
+func BenchmarkTopicTreeMatchParallel(b *testing.B) {
+	tree := getBenchmarkTree()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			tree.match(fmt.Sprintf("dev/%d/%d/status", n%1000, n%1000))
+			n++
+		}
+	})
+}
+
+func BenchmarkTopicTreeSubscribeParallel(b *testing.B) {
+	tree := getBenchmarkTree()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := 0
+		for pb.Next() {
+			filter := fmt.Sprintf("bench/%d/+/status", n%10000)
+			tree.subscribe(filter, "bench", 1, 0)
+			tree.unsubscribe(filter, "bench")
+			n++
+		}
+	})
+}
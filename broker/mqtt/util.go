@@ -12,7 +12,51 @@
 
 package mqtt
 
-// checkTopiValidity will check topic's validity
-func checkTopicValidity(topic string) error {
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// checkPublishTopic check topic which message is published on, wildcards
+// are not allowed in it
+func checkPublishTopic(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("Invalid publish topic '%s'", topic)
+	}
+	return nil
+}
+
+// checkTopicFilter check wildcards in topic filter, multi-level wildcard
+// must be the last level and wildcards must occupy entire level
+func checkTopicFilter(filter string) error {
+	if filter == "" {
+		return errors.New("Empty topic filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if !strings.ContainsAny(level, "+#") {
+			continue
+		}
+		if len(level) != 1 || (level == "#" && i != len(levels)-1) {
+			return fmt.Errorf("Invalid topic filter '%s'", filter)
+		}
+	}
 	return nil
 }
+
+// overlapTopicFilters check wether some topic is matched by both filters
+func overlapTopicFilters(a string, b string) bool {
+	la, lb := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; ; i++ {
+		if (i < len(la) && la[i] == "#") || (i < len(lb) && lb[i] == "#") {
+			return true
+		}
+		if i == len(la) || i == len(lb) {
+			return len(la) == len(lb)
+		}
+		if la[i] != lb[i] && la[i] != "+" && lb[i] != "+" {
+			return false
+		}
+	}
+}
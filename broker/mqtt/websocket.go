@@ -0,0 +1,162 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/websocket"
+)
+
+// Subprotocols accepted in websocket handshake, "mqttv3.1" is used by
+// some old clients
+var websocketSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+// websocketConn is websocket connection used as net.Conn by mqtt session,
+// websocket handler is blocked until the connection is closed
+type websocketConn struct {
+	*websocket.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+// Close close websocket connection and release websocket handler
+func (c *websocketConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { close(c.done) })
+	return err
+}
+
+// RemoteAddr return address of http peer, websocket.Conn return origin
+// of handshake in server side which may be absent
+func (c *websocketConn) RemoteAddr() net.Addr {
+	if req := c.Conn.Request(); req != nil {
+		if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+			return addr
+		}
+	}
+	return &net.TCPAddr{}
+}
+
+// websocketListener accept mqtt connections over websocket, it implement
+// net.Listener so that websocket client is served as tcp client
+type websocketListener struct {
+	listener net.Listener
+	path     string
+	origins  []string
+	conns    chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// newWebsocketListener create websocket listener on host with configured
+// path and allowed origins
+func newWebsocketListener(m *mqtt, host string) (net.Listener, error) {
+	path, err := m.config.String(m.protocol, "websocket_path")
+	if err != nil || path == "" {
+		path = "/mqtt"
+	}
+	origins := []string{}
+	if val, err := m.config.String(m.protocol, "websocket_origins"); err == nil {
+		for _, origin := range strings.Split(val, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				origins = append(origins, strings.ToLower(origin))
+			}
+		}
+	}
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	l := &websocketListener{
+		listener: listener,
+		path:     path,
+		origins:  origins,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{
+		Handshake: l.handshake,
+		Handler:   l.handle,
+	})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			glog.Errorf("Websocket server on '%s' quit:%s", host, err)
+		}
+	}()
+	glog.Infof("Mqtt websocket is served on '%s%s'", host, path)
+	return l, nil
+}
+
+// handshake check origin and select mqtt subprotocol
+func (l *websocketListener) handshake(config *websocket.Config, req *http.Request) error {
+	if len(l.origins) > 0 {
+		origin := strings.ToLower(req.Header.Get("Origin"))
+		allowed := false
+		for _, o := range l.origins {
+			if o == "*" || o == origin {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Websocket origin '%s' is not allowed", origin)
+		}
+	}
+	for _, protocol := range config.Protocol {
+		for _, p := range websocketSubprotocols {
+			if strings.EqualFold(strings.TrimSpace(protocol), p) {
+				config.Protocol = []string{p}
+				return nil
+			}
+		}
+	}
+	return errors.New("Websocket subprotocol 'mqtt' is not requested")
+}
+
+// handle hand over websocket connection to Accept and wait until it is closed
+func (l *websocketListener) handle(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	conn := &websocketConn{Conn: ws, done: make(chan struct{})}
+	select {
+	case l.conns <- conn:
+		<-conn.done
+	case <-l.closed:
+	}
+}
+
+// Accept wait for and return next websocket connection
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("Websocket listener closed")
+	}
+}
+
+// Close stop accepting websocket connection
+func (l *websocketListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return l.listener.Close()
+}
+
+// Addr return listener's network address
+func (l *websocketListener) Addr() net.Addr { return l.listener.Addr() }
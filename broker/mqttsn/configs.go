@@ -0,0 +1,34 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqttsn
+
+var Configs = map[string]string{
+	"listen":     "localhost:1884",
+	"loglevel":   "debug",
+	"gateway_id": "1",
+	// Topic ids known by clients in advance, "id:topic" separated by comma
+	"predefined_topics": "",
+	// ADVERTISE is sent to the address periodically if it is set, SEARCHGW
+	// sent to multicast address is also answered
+	"advertise_address":  "",
+	"advertise_interval": "900",
+	// Messages buffered for sleeping or disconnected clients
+	"max_queued_messages":   "100",
+	"max_inflight_messages": "1",
+	// QoS 2 messages from client waiting for PUBREL
+	"max_awaiting_rel": "10",
+	// Unacknowledged message is retransmitted in seconds, client is lost
+	// after max retries
+	"retry_interval": "10",
+	"max_retries":    "3",
+}
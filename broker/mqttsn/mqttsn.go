@@ -0,0 +1,489 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqttsn
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloustone/sentel/broker/auth"
+	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/mqtt"
+	"github.com/cloustone/sentel/broker/plugins"
+	"github.com/cloustone/sentel/core"
+
+	"github.com/golang/glog"
+)
+
+const maxDatagram = 65535
+
+// Stats and metrics of mqttsn service
+const (
+	statSessionsCount      = "sessions/count"
+	statSubscriptionsCount = "subscriptions/count"
+	metricPacketReceived   = "packets/received"
+	metricPacketSent       = "packets/sent"
+	metricPacketResent     = "packets/retransmitted"
+	metricMessageReceived  = "messages/received"
+	metricMessageSent      = "messages/sent"
+	metricMessageDropped   = "messages/dropped"
+)
+
+// endpoint is address of client, node is wireless node id of client
+// behind forwarder
+type endpoint struct {
+	addr net.Addr
+	node []uint8
+}
+
+func (e endpoint) key() string {
+	if e.node == nil {
+		return e.addr.String()
+	}
+	return e.addr.String() + "/" + hex.EncodeToString(e.node)
+}
+
+type mqttsn struct {
+	config            core.Config
+	chn               chan base.ServiceCommand
+	protocol          string
+	gateway           *mqtt.Gateway
+	authapi           auth.IAuthAPI
+	conn              net.PacketConn
+	predefined        *predefinedTopics
+	gwID              uint8
+	sessions          map[string]*mqttsnSession // Sessions keyed by endpoint
+	clients           map[string]*mqttsnSession // Sessions keyed by client id
+	mutex             sync.Mutex
+	wg                sync.WaitGroup
+	stats             *base.Stats
+	metrics           *base.Metrics
+	maxQueued         int
+	maxInflight       int
+	maxAwaitingRel    int
+	retryInterval     time.Duration
+	maxRetries        int
+	advertiseAddr     string
+	advertiseInterval time.Duration
+	quit              chan bool
+}
+
+// MqttsnFactory
+type MqttsnFactory struct{}
+
+// New create mqttsn service
+func (m *MqttsnFactory) New(protocol string, c core.Config, ch chan base.ServiceCommand) (base.Service, error) {
+	// Messages are routed through storage shared with mqtt
+	gateway, err := mqtt.GetGateway(c)
+	if err != nil {
+		return nil, err
+	}
+	authapi, err := auth.NewAuthApi(c)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := c.String(protocol, "predefined_topics")
+	predefined, err := parsePredefinedTopics(value)
+	if err != nil {
+		return nil, err
+	}
+	t := &mqttsn{
+		config:            c,
+		chn:               ch,
+		protocol:          protocol,
+		gateway:           gateway,
+		authapi:           authapi,
+		predefined:        predefined,
+		gwID:              1,
+		sessions:          make(map[string]*mqttsnSession),
+		clients:           make(map[string]*mqttsnSession),
+		stats:             base.NewStats(true),
+		metrics:           base.NewMetrics(true),
+		maxQueued:         100,
+		maxInflight:       1,
+		maxAwaitingRel:    10,
+		retryInterval:     10 * time.Second,
+		maxRetries:        3,
+		advertiseInterval: 900 * time.Second,
+		quit:              make(chan bool),
+	}
+	if id, err := c.Int(protocol, "gateway_id"); err == nil && id > 0 && id < 256 {
+		t.gwID = uint8(id)
+	}
+	if size, err := c.Int(protocol, "max_queued_messages"); err == nil && size > 0 {
+		t.maxQueued = size
+	}
+	if size, err := c.Int(protocol, "max_inflight_messages"); err == nil && size > 0 {
+		t.maxInflight = size
+	}
+	if size, err := c.Int(protocol, "max_awaiting_rel"); err == nil && size > 0 {
+		t.maxAwaitingRel = size
+	}
+	if interval, err := c.Int(protocol, "retry_interval"); err == nil && interval > 0 {
+		t.retryInterval = time.Duration(interval) * time.Second
+	}
+	if retries, err := c.Int(protocol, "max_retries"); err == nil && retries >= 0 {
+		t.maxRetries = retries
+	}
+	t.advertiseAddr, _ = c.String(protocol, "advertise_address")
+	if interval, err := c.Int(protocol, "advertise_interval"); err == nil && interval > 0 {
+		t.advertiseInterval = time.Duration(interval) * time.Second
+	}
+	return t, nil
+}
+
+// Start listen on udp address and dispatch messages to sessions
+func (m *mqttsn) Start() error {
+	host, _ := m.config.String(m.protocol, "listen")
+
+	conn, err := net.ListenPacket("udp", host)
+	if err != nil {
+		glog.Errorf("Mqttsn listen failed:%s", err)
+		return err
+	}
+	m.conn = conn
+	glog.Infof("Mqttsn gateway is listening on '%s'...", host)
+	if m.advertiseAddr != "" {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			m.advertise()
+		}()
+	}
+	buf := make([]uint8, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-m.quit:
+				return nil
+			default:
+			}
+			glog.Errorf("Mqttsn failed to read datagram:%s", err)
+			continue
+		}
+		m.dispatch(addr, append([]uint8{}, buf[:n]...))
+	}
+}
+
+// Stop close listener and remove all sessions
+func (m *mqttsn) Stop() {
+	close(m.quit)
+	if m.conn != nil {
+		m.conn.Close()
+	}
+	for _, s := range m.getSessions() {
+		s.Destroy()
+	}
+	m.wg.Wait()
+}
+
+// advertise send ADVERTISE to advertise address periodically, SEARCHGW
+// sent to the address is answered if it is multicast address
+func (m *mqttsn) advertise() {
+	addr, err := net.ResolveUDPAddr("udp", m.advertiseAddr)
+	if err != nil {
+		glog.Errorf("Invalid mqttsn advertise address '%s':%s", m.advertiseAddr, err)
+		return
+	}
+	if addr.IP.IsMulticast() {
+		if conn, err := net.ListenMulticastUDP("udp", nil, addr); err != nil {
+			glog.Warningf("Mqttsn failed to join multicast group '%s':%s", m.advertiseAddr, err)
+		} else {
+			defer conn.Close()
+			go m.serveSearch(conn)
+		}
+	}
+	ticker := time.NewTicker(m.advertiseInterval)
+	defer ticker.Stop()
+	for {
+		p := &packet{typ: ADVERTISE, gwID: m.gwID, duration: uint16(m.advertiseInterval / time.Second)}
+		if _, err := m.conn.WriteTo(p.encode(), addr); err != nil {
+			glog.Warningf("Mqttsn failed to advertise to '%s':%s", m.advertiseAddr, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+// serveSearch answer SEARCHGW sent to multicast group
+func (m *mqttsn) serveSearch(conn *net.UDPConn) {
+	buf := make([]uint8, maxDatagram)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if p, err := parsePacket(buf[:n]); err == nil && p.typ == SEARCHGW {
+			m.write(endpoint{addr: addr}, &packet{typ: GWINFO, gwID: m.gwID})
+		}
+	}
+}
+
+// dispatch pass message to session of endpoint, session is created or
+// found with client id for CONNECT. Sleeping client wake up from the
+// endpoint it is bound to, or connect again from another endpoint
+func (m *mqttsn) dispatch(addr net.Addr, data []uint8) {
+	m.metrics.AddMetric(metricPacketReceived, 1)
+	ep := endpoint{addr: addr}
+	if len(data) >= 2 && data[1] == ENCAPSULATED {
+		node, msg, err := parseEncapsulated(data)
+		if err != nil {
+			glog.Warningf("Invalid mqttsn encapsulated message from %s", addr)
+			return
+		}
+		ep.node, data = append([]uint8{}, node...), msg
+	}
+	p, err := parsePacket(data)
+	if err != nil {
+		glog.Warningf("Invalid mqttsn message from %s:%s", ep.key(), err)
+		return
+	}
+	switch p.typ {
+	case SEARCHGW:
+		m.write(ep, &packet{typ: GWINFO, gwID: m.gwID})
+		return
+	case ADVERTISE, GWINFO:
+		// Other gateways are ignored
+		return
+	case PUBLISH:
+		if p.qos() == qosMinusOne {
+			m.publishMinusOne(ep, p)
+			return
+		}
+	}
+
+	m.mutex.Lock()
+	s, ok := m.sessions[ep.key()]
+	if ok && p.typ == CONNECT && p.clientID != s.clientID {
+		// Endpoint connect as another client
+		m.mutex.Unlock()
+		s.Destroy()
+		m.mutex.Lock()
+		ok = false
+	}
+	if !ok && p.typ == CONNECT {
+		if s, ok = m.clients[p.clientID]; ok {
+			m.bindEndpoint(s, ep)
+		} else {
+			s = m.newSession(ep, p.clientID)
+		}
+	}
+	m.mutex.Unlock()
+	if s == nil {
+		// Client must connect at first
+		glog.Warningf("Mqttsn %s from unknown client %s", packetName(p.typ), ep.key())
+		m.write(ep, &packet{typ: DISCONNECT})
+		return
+	}
+	s.receive(p)
+}
+
+// newSession create and launch session for client
+func (m *mqttsn) newSession(ep endpoint, clientID string) *mqttsnSession {
+	s := newMqttsnSession(m, ep, clientID)
+	m.sessions[ep.key()] = s
+	m.clients[clientID] = s
+	m.stats.SetStat(statSessionsCount, uint64(len(m.clients)))
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		s.Handle()
+	}()
+	return s
+}
+
+// bindEndpoint move session to endpoint client connect from
+func (m *mqttsn) bindEndpoint(s *mqttsnSession, ep endpoint) {
+	old := s.getEndpoint()
+	if m.sessions[old.key()] == s {
+		delete(m.sessions, old.key())
+	}
+	m.sessions[ep.key()] = s
+	s.setEndpoint(ep)
+}
+
+// removeSession remove session of client
+func (m *mqttsn) removeSession(s *mqttsnSession) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if key := s.getEndpoint().key(); m.sessions[key] == s {
+		delete(m.sessions, key)
+	}
+	if m.clients[s.clientID] == s {
+		delete(m.clients, s.clientID)
+	}
+	m.stats.SetStat(statSessionsCount, uint64(len(m.clients)))
+}
+
+// publishMinusOne publish QoS -1 message sent without connection, topic
+// must be predefined topic id or short topic name
+func (m *mqttsn) publishMinusOne(ep endpoint, p *packet) {
+	var topic string
+	switch p.topicIDType() {
+	case TOPIC_PREDEFINED:
+		topic = m.predefined.names[p.topicID]
+	case TOPIC_SHORT:
+		topic = shortTopicName(p.topicID)
+	}
+	if topic == "" {
+		glog.Warningf("Mqttsn QoS -1 message with invalid topic %d from %s", p.topicID, ep.key())
+		return
+	}
+	if err := plugins.CheckAcl("", "", topic, auth.AclActionWrite); err != nil {
+		glog.Errorf("Mqttsn QoS -1 publish to '%s' from %s is denied:%s", topic, ep.key(), err)
+		return
+	}
+	msg := &mqtt.Message{Topic: topic, Qos: 0, Retain: p.retain(), Payload: p.data}
+	if err := m.gateway.Publish("mqttsn:"+ep.key(), msg); err != nil {
+		glog.Warningf("Failed to publish on '%s' from %s:%s", topic, ep.key(), err)
+		return
+	}
+	m.metrics.AddMetric(metricMessageReceived, 1)
+}
+
+// write send message to endpoint, message to wireless node is
+// encapsulated for forwarder
+func (m *mqttsn) write(ep endpoint, p *packet) error {
+	data := p.encode()
+	if ep.node != nil {
+		data = encapsulate(ep.node, data)
+	}
+	m.metrics.AddMetric(metricPacketSent, 1)
+	_, err := m.conn.WriteTo(data, ep.addr)
+	return err
+}
+
+// getSessions return sessions in order of creation
+func (m *mqttsn) getSessions() []*mqttsnSession {
+	m.mutex.Lock()
+	sessions := make([]*mqttsnSession, 0, len(m.clients))
+	for _, s := range m.clients {
+		sessions = append(sessions, s)
+	}
+	m.mutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].createdAt.Before(sessions[j].createdAt) })
+	return sessions
+}
+
+// findSession return session of client
+func (m *mqttsn) findSession(clientID string) *mqttsnSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.clients[clientID]
+}
+
+// Info
+func (m *mqttsn) Info() *base.ServiceInfo { return m.GetServiceInfo() }
+
+func (m *mqttsn) GetMetrics() *base.Metrics { return m.metrics }
+
+// GetStats return stats with subscription count of all clients
+func (m *mqttsn) GetStats() *base.Stats {
+	m.stats.SetStat(statSubscriptionsCount, uint64(len(m.GetSubscriptions())))
+	return m.stats
+}
+
+// GetClients return clients connected or sleeping
+func (m *mqttsn) GetClients() []*base.ClientInfo {
+	clients := []*base.ClientInfo{}
+	for _, s := range m.getSessions() {
+		clients = append(clients, s.clientInfo())
+	}
+	return clients
+}
+
+// GetClient return client with id
+func (m *mqttsn) GetClient(id string) *base.ClientInfo {
+	if s := m.findSession(id); s != nil {
+		return s.clientInfo()
+	}
+	return nil
+}
+
+// KickoffClient remove session and subscriptions of client
+func (m *mqttsn) KickoffClient(id string) error {
+	if s := m.findSession(id); s != nil {
+		return s.Destroy()
+	}
+	return fmt.Errorf("Client '%s' is not found", id)
+}
+
+// GetSessions return sessions filtered by persistent and transient
+func (m *mqttsn) GetSessions(conditions map[string]bool) []*base.SessionInfo {
+	sessions := []*base.SessionInfo{}
+	for _, s := range m.getSessions() {
+		info := s.Info()
+		if (conditions["persistent"] && info.CleanSession) || (conditions["transient"] && !info.CleanSession) {
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	return sessions
+}
+
+// GetSession return session information of client
+func (m *mqttsn) GetSession(id string) *base.SessionInfo {
+	if s := m.findSession(id); s != nil {
+		return s.Info()
+	}
+	return nil
+}
+
+// Routes and topics are kept by mqtt which mqttsn share storage with
+func (m *mqttsn) GetRoutes() []*base.RouteInfo          { return nil }
+func (m *mqttsn) GetRoute(topic string) *base.RouteInfo { return nil }
+
+// Topic info
+func (m *mqttsn) GetTopics() []*base.TopicInfo       { return nil }
+func (m *mqttsn) GetTopic(id string) *base.TopicInfo { return nil }
+
+// GetSubscriptions return subscriptions of all clients
+func (m *mqttsn) GetSubscriptions() []*base.SubscriptionInfo {
+	subs := []*base.SubscriptionInfo{}
+	for _, s := range m.getSessions() {
+		subs = append(subs, s.subscriptionInfos()...)
+	}
+	return subs
+}
+
+// GetTopicSubscriptions return subscriptions on topic
+func (m *mqttsn) GetTopicSubscriptions(topic string) []*base.SubscriptionInfo {
+	subs := []*base.SubscriptionInfo{}
+	for _, sub := range m.GetSubscriptions() {
+		if sub.Topic == topic {
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// GetServiceInfo return service information
+func (m *mqttsn) GetServiceInfo() *base.ServiceInfo {
+	host, _ := m.config.String(m.protocol, "listen")
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return &base.ServiceInfo{
+		ServiceName:    m.protocol,
+		Listen:         host,
+		Acceptors:      1,
+		CurrentClients: uint64(len(m.clients)),
+	}
+}
@@ -0,0 +1,360 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqttsn
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Message types in MQTT-SN 1.2
+const (
+	ADVERTISE     = 0x00
+	SEARCHGW      = 0x01
+	GWINFO        = 0x02
+	CONNECT       = 0x04
+	CONNACK       = 0x05
+	WILLTOPICREQ  = 0x06
+	WILLTOPIC     = 0x07
+	WILLMSGREQ    = 0x08
+	WILLMSG       = 0x09
+	REGISTER      = 0x0A
+	REGACK        = 0x0B
+	PUBLISH       = 0x0C
+	PUBACK        = 0x0D
+	PUBCOMP       = 0x0E
+	PUBREC        = 0x0F
+	PUBREL        = 0x10
+	SUBSCRIBE     = 0x12
+	SUBACK        = 0x13
+	UNSUBSCRIBE   = 0x14
+	UNSUBACK      = 0x15
+	PINGREQ       = 0x16
+	PINGRESP      = 0x17
+	DISCONNECT    = 0x18
+	WILLTOPICUPD  = 0x1A
+	WILLTOPICRESP = 0x1B
+	WILLMSGUPD    = 0x1C
+	WILLMSGRESP   = 0x1D
+	ENCAPSULATED  = 0xFE
+)
+
+// Return codes
+const (
+	RC_ACCEPTED           = 0x00
+	RC_REJECTED_CONGESTED = 0x01
+	RC_INVALID_TOPIC_ID   = 0x02
+	RC_NOT_SUPPORTED      = 0x03
+)
+
+// Flags
+const (
+	FLAG_DUP           = 0x80
+	FLAG_QOS_MASK      = 0x60
+	FLAG_RETAIN        = 0x10
+	FLAG_WILL          = 0x08
+	FLAG_CLEAN_SESSION = 0x04
+	FLAG_TOPIC_MASK    = 0x03
+)
+
+// Topic id types in flags
+const (
+	TOPIC_NORMAL     = 0x00
+	TOPIC_PREDEFINED = 0x01
+	TOPIC_SHORT      = 0x02
+)
+
+// qosMinusOne is QoS -1 publishing without connection, it is 0b11 in flags
+const qosMinusOne = 3
+
+const protocolID = 0x01
+
+var errorPacketFormat = errors.New("Invalid mqttsn packet format")
+
+// packet is MQTT-SN message, fields are set according to message type
+type packet struct {
+	typ         uint8
+	flags       uint8
+	gwID        uint8
+	radius      uint8
+	protocolID  uint8
+	duration    uint16
+	hasDuration bool
+	clientID    string
+	topicID     uint16
+	msgID       uint16
+	returnCode  uint8
+	topicName   string
+	data        []uint8
+}
+
+// qos return QoS in flags, QoS -1 is returned as qosMinusOne
+func (p *packet) qos() uint8         { return (p.flags & FLAG_QOS_MASK) >> 5 }
+func (p *packet) retain() bool       { return p.flags&FLAG_RETAIN != 0 }
+func (p *packet) dup() bool          { return p.flags&FLAG_DUP != 0 }
+func (p *packet) will() bool         { return p.flags&FLAG_WILL != 0 }
+func (p *packet) cleanSession() bool { return p.flags&FLAG_CLEAN_SESSION != 0 }
+func (p *packet) topicIDType() uint8 { return p.flags & FLAG_TOPIC_MASK }
+
+// qosFlags return flags of QoS
+func qosFlags(qos uint8) uint8 { return (qos << 5) & FLAG_QOS_MASK }
+
+// packetName return readable message type
+func packetName(typ uint8) string {
+	names := map[uint8]string{
+		ADVERTISE: "ADVERTISE", SEARCHGW: "SEARCHGW", GWINFO: "GWINFO",
+		CONNECT: "CONNECT", CONNACK: "CONNACK",
+		WILLTOPICREQ: "WILLTOPICREQ", WILLTOPIC: "WILLTOPIC",
+		WILLMSGREQ: "WILLMSGREQ", WILLMSG: "WILLMSG",
+		REGISTER: "REGISTER", REGACK: "REGACK",
+		PUBLISH: "PUBLISH", PUBACK: "PUBACK", PUBCOMP: "PUBCOMP", PUBREC: "PUBREC", PUBREL: "PUBREL",
+		SUBSCRIBE: "SUBSCRIBE", SUBACK: "SUBACK", UNSUBSCRIBE: "UNSUBSCRIBE", UNSUBACK: "UNSUBACK",
+		PINGREQ: "PINGREQ", PINGRESP: "PINGRESP", DISCONNECT: "DISCONNECT",
+		WILLTOPICUPD: "WILLTOPICUPD", WILLTOPICRESP: "WILLTOPICRESP",
+		WILLMSGUPD: "WILLMSGUPD", WILLMSGRESP: "WILLMSGRESP",
+		ENCAPSULATED: "ENCAPSULATED",
+	}
+	if name, ok := names[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", typ)
+}
+
+// splitHeader return message type and body of message in datagram
+func splitHeader(data []uint8) (uint8, []uint8, error) {
+	if len(data) < 2 {
+		return 0, nil, errorPacketFormat
+	}
+	length, size := int(data[0]), 1
+	if data[0] == 0x01 {
+		if len(data) < 4 {
+			return 0, nil, errorPacketFormat
+		}
+		length, size = int(data[1])<<8|int(data[2]), 3
+	}
+	if length < size+1 || length > len(data) {
+		return 0, nil, errorPacketFormat
+	}
+	return data[size], data[size+1 : length], nil
+}
+
+// parsePacket decode message in datagram
+func parsePacket(data []uint8) (*packet, error) {
+	typ, body, err := splitHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	p := &packet{typ: typ}
+	r := &reader{data: body}
+	switch typ {
+	case ADVERTISE:
+		p.gwID = r.uint8()
+		p.duration = r.uint16()
+	case SEARCHGW:
+		p.radius = r.uint8()
+	case GWINFO:
+		p.gwID = r.uint8()
+		p.data = r.rest()
+	case CONNECT:
+		p.flags = r.uint8()
+		p.protocolID = r.uint8()
+		p.duration = r.uint16()
+		p.clientID = string(r.rest())
+	case CONNACK, WILLTOPICRESP, WILLMSGRESP:
+		p.returnCode = r.uint8()
+	case WILLTOPICREQ, WILLMSGREQ, PINGRESP:
+	case WILLTOPIC, WILLTOPICUPD:
+		// Empty will topic delete will
+		if !r.empty() {
+			p.flags = r.uint8()
+			p.topicName = string(r.rest())
+		}
+	case WILLMSG, WILLMSGUPD:
+		p.data = r.rest()
+	case REGISTER:
+		p.topicID = r.uint16()
+		p.msgID = r.uint16()
+		p.topicName = string(r.rest())
+	case REGACK, PUBACK:
+		p.topicID = r.uint16()
+		p.msgID = r.uint16()
+		p.returnCode = r.uint8()
+	case PUBLISH:
+		p.flags = r.uint8()
+		p.topicID = r.uint16()
+		p.msgID = r.uint16()
+		p.data = r.rest()
+	case PUBCOMP, PUBREC, PUBREL, UNSUBACK:
+		p.msgID = r.uint16()
+	case SUBSCRIBE, UNSUBSCRIBE:
+		p.flags = r.uint8()
+		p.msgID = r.uint16()
+		switch p.topicIDType() {
+		case TOPIC_NORMAL, TOPIC_SHORT:
+			p.topicName = string(r.rest())
+		case TOPIC_PREDEFINED:
+			p.topicID = r.uint16()
+		}
+	case SUBACK:
+		p.flags = r.uint8()
+		p.topicID = r.uint16()
+		p.msgID = r.uint16()
+		p.returnCode = r.uint8()
+	case PINGREQ:
+		p.clientID = string(r.rest())
+	case DISCONNECT:
+		if !r.empty() {
+			p.duration = r.uint16()
+			p.hasDuration = true
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported mqttsn message %s", packetName(typ))
+	}
+	if r.err != nil || !r.empty() {
+		return nil, errorPacketFormat
+	}
+	return p, nil
+}
+
+// encode serialize message with length header
+func (p *packet) encode() []uint8 {
+	w := &writer{}
+	switch p.typ {
+	case ADVERTISE:
+		w.uint8(p.gwID)
+		w.uint16(p.duration)
+	case SEARCHGW:
+		w.uint8(p.radius)
+	case GWINFO:
+		w.uint8(p.gwID)
+		w.bytes(p.data)
+	case CONNECT:
+		w.uint8(p.flags)
+		w.uint8(p.protocolID)
+		w.uint16(p.duration)
+		w.bytes([]uint8(p.clientID))
+	case CONNACK, WILLTOPICRESP, WILLMSGRESP:
+		w.uint8(p.returnCode)
+	case WILLTOPIC, WILLTOPICUPD:
+		if p.topicName != "" {
+			w.uint8(p.flags)
+			w.bytes([]uint8(p.topicName))
+		}
+	case WILLMSG, WILLMSGUPD:
+		w.bytes(p.data)
+	case REGISTER:
+		w.uint16(p.topicID)
+		w.uint16(p.msgID)
+		w.bytes([]uint8(p.topicName))
+	case REGACK, PUBACK:
+		w.uint16(p.topicID)
+		w.uint16(p.msgID)
+		w.uint8(p.returnCode)
+	case PUBLISH:
+		w.uint8(p.flags)
+		w.uint16(p.topicID)
+		w.uint16(p.msgID)
+		w.bytes(p.data)
+	case PUBCOMP, PUBREC, PUBREL, UNSUBACK:
+		w.uint16(p.msgID)
+	case SUBSCRIBE, UNSUBSCRIBE:
+		w.uint8(p.flags)
+		w.uint16(p.msgID)
+		if p.topicIDType() == TOPIC_PREDEFINED {
+			w.uint16(p.topicID)
+		} else {
+			w.bytes([]uint8(p.topicName))
+		}
+	case SUBACK:
+		w.uint8(p.flags)
+		w.uint16(p.topicID)
+		w.uint16(p.msgID)
+		w.uint8(p.returnCode)
+	case PINGREQ:
+		w.bytes([]uint8(p.clientID))
+	case DISCONNECT:
+		if p.hasDuration {
+			w.uint16(p.duration)
+		}
+	}
+	return withHeader(p.typ, w.data)
+}
+
+// withHeader prefix message type and length to body, length is encoded in
+// 3 bytes if message is longer than 255 bytes
+func withHeader(typ uint8, body []uint8) []uint8 {
+	length := len(body) + 2
+	if length < 256 {
+		return append([]uint8{uint8(length), typ}, body...)
+	}
+	length += 2
+	return append([]uint8{0x01, uint8(length >> 8), uint8(length), typ}, body...)
+}
+
+// parseEncapsulated return wireless node id and message forwarded by
+// forwarder in encapsulated message
+func parseEncapsulated(data []uint8) ([]uint8, []uint8, error) {
+	if len(data) < 3 || int(data[0]) < 3 || int(data[0]) >= len(data) {
+		return nil, nil, errorPacketFormat
+	}
+	return data[3:data[0]], data[data[0]:], nil
+}
+
+// encapsulate wrap message to be forwarded to wireless node
+func encapsulate(node []uint8, msg []uint8) []uint8 {
+	header := []uint8{uint8(3 + len(node)), ENCAPSULATED, 0}
+	return append(append(header, node...), msg...)
+}
+
+// reader decode fields of message body, err is set if body is short
+type reader struct {
+	data []uint8
+	err  error
+}
+
+func (r *reader) uint8() uint8 {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = errorPacketFormat
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = errorPacketFormat
+		return 0
+	}
+	n := uint16(r.data[0])<<8 | uint16(r.data[1])
+	r.data = r.data[2:]
+	return n
+}
+
+func (r *reader) rest() []uint8 {
+	b := append([]uint8{}, r.data...)
+	r.data = nil
+	return b
+}
+
+func (r *reader) empty() bool { return len(r.data) == 0 }
+
+// writer encode fields of message body
+type writer struct {
+	data []uint8
+}
+
+func (w *writer) uint8(b uint8)   { w.data = append(w.data, b) }
+func (w *writer) uint16(n uint16) { w.data = append(w.data, uint8(n>>8), uint8(n)) }
+func (w *writer) bytes(b []uint8) { w.data = append(w.data, b...) }
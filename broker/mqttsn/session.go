@@ -0,0 +1,877 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqttsn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloustone/sentel/broker/auth"
+	"github.com/cloustone/sentel/broker/base"
+	"github.com/cloustone/sentel/broker/mqtt"
+	"github.com/cloustone/sentel/broker/plugins"
+	"github.com/cloustone/sentel/core"
+
+	"github.com/golang/glog"
+)
+
+const (
+	sessionTick    = time.Second
+	connectTimeout = 30 * time.Second
+	incomingQueue  = 64
+	messageQueue   = 256
+)
+
+// Client states in MQTT-SN 1.2
+const (
+	stateConnecting   = iota // Will topic and message are being negotiated
+	stateActive              // Client is connected
+	stateAsleep              // Messages are buffered for client
+	stateAwake               // Buffered messages are being delivered
+	stateDisconnected        // Persistent session is kept for client
+	stateClosed
+)
+
+// outgoing is PUBLISH or REGISTER sent to client, it is retransmitted
+// until it is acknowledged
+type outgoing struct {
+	pkt      *packet
+	released bool // PUBREL is sent for QoS 2 message
+	attempts int
+	deadline time.Time
+}
+
+type mqttsnSession struct {
+	mgr           *mqttsn
+	config        core.Config
+	id            string // Receiver id in gateway
+	clientID      string
+	endpoint      endpoint
+	observer      base.SessionObserver
+	incoming      chan *packet
+	messages      chan *mqtt.Message
+	mutex         sync.Mutex
+	state         int
+	cleanSession  bool
+	keepAlive     time.Duration
+	sleepDuration time.Duration
+	will          *mqtt.Message
+	topics        *topicRegistry
+	unconfirmed   map[string]bool  // Topics registered by gateway and not acknowledged
+	subscriptions map[string]uint8 // Subscribed QoS keyed by topic filter
+	queue         []*mqtt.Message
+	inflight      map[uint16]*outgoing
+	awaitingRel   map[uint16]*mqtt.Message
+	lastMid       uint16
+	dropped       uint64
+	createdAt     time.Time
+	connectedAt   time.Time
+	lastActive    time.Time
+	stats         *base.Stats
+	metrics       *base.Metrics
+	quit          chan bool
+	destroyOnce   sync.Once
+}
+
+// newMqttsnSession create session for client, session is kept across
+// connections of client if it is not clean session
+func newMqttsnSession(m *mqttsn, ep endpoint, clientID string) *mqttsnSession {
+	s := &mqttsnSession{
+		mgr:           m,
+		config:        m.config,
+		id:            "mqttsn:" + clientID,
+		clientID:      clientID,
+		endpoint:      ep,
+		observer:      nil,
+		incoming:      make(chan *packet, incomingQueue),
+		messages:      make(chan *mqtt.Message, messageQueue),
+		state:         stateDisconnected,
+		cleanSession:  true,
+		topics:        newTopicRegistry(),
+		unconfirmed:   make(map[string]bool),
+		subscriptions: make(map[string]uint8),
+		inflight:      make(map[uint16]*outgoing),
+		awaitingRel:   make(map[uint16]*mqtt.Message),
+		createdAt:     time.Now(),
+		lastActive:    time.Now(),
+		stats:         base.NewStats(true),
+		metrics:       base.NewMetrics(true),
+		quit:          make(chan bool),
+	}
+	return s
+}
+
+// RegisterObserver register observer on session
+func (s *mqttsnSession) RegisterObserver(o base.SessionObserver) {
+	if s.observer != nil {
+		glog.Error("MqttsnSession register multiple observer")
+	}
+	s.observer = o
+}
+
+// checkAcl check topic access of client, CONNECT of mqttsn carries no
+// credentials and client id is the username of client
+func (s *mqttsnSession) checkAcl(topic string, access string) error {
+	if err := plugins.CheckAcl(s.clientID, s.clientID, topic, access); err != nil {
+		return err
+	}
+	return s.mgr.authapi.CheckAcl(context.Background(), s.clientID, s.clientID, topic, access)
+}
+
+// receive queue message from client, message is dropped if session is
+// busy and client will retransmit it
+func (s *mqttsnSession) receive(p *packet) {
+	select {
+	case s.incoming <- p:
+	default:
+		glog.Warningf("Mqttsn %s from %s is dropped, session is busy", packetName(p.typ), s.clientID)
+	}
+}
+
+// deliver queue message routed to client by gateway
+func (s *mqttsnSession) deliver(msg *mqtt.Message) {
+	select {
+	case s.messages <- msg:
+	default:
+		s.mgr.metrics.AddMetric(metricMessageDropped, 1)
+		glog.Warningf("Message to %s is dropped, queue is full", s.clientID)
+	}
+}
+
+func (s *mqttsnSession) getEndpoint() endpoint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.endpoint
+}
+
+func (s *mqttsnSession) setEndpoint(ep endpoint) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.endpoint = ep
+}
+
+// Handle is mainprocessor for client, messages from client and gateway
+// are handled in order
+func (s *mqttsnSession) Handle() error {
+	glog.Infof("Handling mqttsn session:%s", s.clientID)
+	defer s.Destroy()
+
+	ticker := time.NewTicker(sessionTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case p := <-s.incoming:
+			s.mutex.Lock()
+			s.lastActive = time.Now()
+			s.handlePacket(p)
+		case msg := <-s.messages:
+			s.mutex.Lock()
+			s.enqueue(msg)
+		case now := <-ticker.C:
+			s.mutex.Lock()
+			s.retransmit(now)
+			s.supervise(now)
+		case <-s.quit:
+			return nil
+		}
+		s.flush()
+		closed := s.state == stateClosed
+		s.mutex.Unlock()
+		if closed {
+			return nil
+		}
+	}
+}
+
+// handlePacket handle message from client according to client state
+func (s *mqttsnSession) handlePacket(p *packet) {
+	glog.Infof("Mqttsn %s from %s", packetName(p.typ), s.clientID)
+	switch p.typ {
+	case CONNECT:
+		s.handleConnect(p)
+		return
+	case PINGREQ:
+		s.handlePingReq(p)
+		return
+	case DISCONNECT:
+		s.handleDisconnect(p)
+		return
+	case WILLTOPIC, WILLMSG:
+		if s.state == stateConnecting {
+			s.handleWill(p)
+			return
+		}
+	}
+	if s.state != stateActive && s.state != stateAwake {
+		// Client must connect again
+		s.write(&packet{typ: DISCONNECT})
+		return
+	}
+	switch p.typ {
+	case REGISTER:
+		s.handleRegister(p)
+	case REGACK:
+		s.handleRegAck(p)
+	case PUBLISH:
+		s.handlePublish(p)
+	case PUBACK:
+		s.handlePubAck(p)
+	case PUBREC:
+		s.handlePubRec(p)
+	case PUBREL:
+		s.handlePubRel(p)
+	case PUBCOMP:
+		s.handlePubComp(p)
+	case SUBSCRIBE:
+		s.handleSubscribe(p)
+	case UNSUBSCRIBE:
+		s.handleUnsubscribe(p)
+	case WILLTOPICUPD:
+		s.handleWillTopicUpdate(p)
+	case WILLMSGUPD:
+		s.handleWillMsgUpdate(p)
+	default:
+		glog.Warningf("Unexpected mqttsn %s from %s", packetName(p.typ), s.clientID)
+	}
+}
+
+// handleConnect connect client, will topic and message are requested if
+// will flag is set
+func (s *mqttsnSession) handleConnect(p *packet) {
+	if p.protocolID != protocolID {
+		s.write(&packet{typ: CONNACK, returnCode: RC_NOT_SUPPORTED})
+		if s.state == stateDisconnected && s.cleanSession {
+			s.state = stateClosed
+		}
+		return
+	}
+	if p.cleanSession() {
+		s.reset()
+	}
+	s.cleanSession = p.cleanSession()
+	s.keepAlive = time.Duration(p.duration) * time.Second
+	s.sleepDuration = 0
+	s.will = nil
+	if p.will() {
+		s.state = stateConnecting
+		s.write(&packet{typ: WILLTOPICREQ})
+		return
+	}
+	s.connected()
+}
+
+// handleWill handle will topic and will message negotiated in connection
+func (s *mqttsnSession) handleWill(p *packet) {
+	switch p.typ {
+	case WILLTOPIC:
+		if p.topicName == "" {
+			// Client has no will
+			s.connected()
+			return
+		}
+		s.will = &mqtt.Message{Topic: p.topicName, Qos: p.qos(), Retain: p.retain()}
+		s.write(&packet{typ: WILLMSGREQ})
+	case WILLMSG:
+		if s.will == nil {
+			s.write(&packet{typ: WILLTOPICREQ})
+			return
+		}
+		s.will.Payload = p.data
+		s.connected()
+	}
+}
+
+// connected accept connection, inflight messages of persistent session
+// are sent again
+func (s *mqttsnSession) connected() {
+	s.state = stateActive
+	s.connectedAt = time.Now()
+	s.write(&packet{typ: CONNACK, returnCode: RC_ACCEPTED})
+	s.resend()
+	if s.observer != nil {
+		s.observer.OnConnect(s, nil)
+	}
+	glog.Infof("Mqttsn client %s is connected", s.clientID)
+}
+
+// reset clear subscriptions, topics and messages of session
+func (s *mqttsnSession) reset() {
+	s.mgr.gateway.Unsubscribe(s.id)
+	s.subscriptions = make(map[string]uint8)
+	s.topics = newTopicRegistry()
+	s.unconfirmed = make(map[string]bool)
+	s.queue = nil
+	s.inflight = make(map[uint16]*outgoing)
+	s.awaitingRel = make(map[uint16]*mqtt.Message)
+	s.stats.SetStat(statSubscriptionsCount, 0)
+}
+
+// handlePingReq keep client alive, sleeping client with its client id wake
+// up to receive buffered messages and PINGRESP is sent after them
+func (s *mqttsnSession) handlePingReq(p *packet) {
+	if p.clientID == s.clientID && (s.state == stateAsleep || s.state == stateAwake) {
+		s.state = stateAwake
+		s.resend()
+		return
+	}
+	if s.state == stateDisconnected {
+		s.write(&packet{typ: DISCONNECT})
+		return
+	}
+	s.write(&packet{typ: PINGRESP})
+}
+
+// handleDisconnect disconnect client, client go to sleep if sleep
+// duration is specified
+func (s *mqttsnSession) handleDisconnect(p *packet) {
+	if p.hasDuration && p.duration > 0 && s.state != stateDisconnected {
+		s.state = stateAsleep
+		s.sleepDuration = time.Duration(p.duration) * time.Second
+		s.write(&packet{typ: DISCONNECT})
+		glog.Infof("Mqttsn client %s is asleep for %s", s.clientID, s.sleepDuration)
+		return
+	}
+	s.write(&packet{typ: DISCONNECT})
+	s.will = nil
+	s.disconnected()
+}
+
+// lost handle client not active in keepalive or sleep duration, will is
+// published for it
+func (s *mqttsnSession) lost() {
+	glog.Infof("Mqttsn client %s is lost", s.clientID)
+	if s.will != nil {
+		if err := s.mgr.gateway.Publish(s.id, s.will); err != nil {
+			glog.Warningf("Failed to publish will of %s:%s", s.clientID, err)
+		}
+		s.will = nil
+	}
+	s.disconnected()
+}
+
+// disconnected close clean session, persistent session keep buffering
+// messages for client
+func (s *mqttsnSession) disconnected() {
+	if s.observer != nil {
+		s.observer.OnDisconnect(s, nil)
+	}
+	if s.cleanSession {
+		s.state = stateClosed
+		return
+	}
+	s.state = stateDisconnected
+}
+
+// supervise check wether client is alive in keepalive or sleep duration,
+// client is considered lost after 1.5 times of the duration
+func (s *mqttsnSession) supervise(now time.Time) {
+	idle := now.Sub(s.lastActive)
+	switch s.state {
+	case stateConnecting:
+		if idle > connectTimeout {
+			s.lost()
+		}
+	case stateActive:
+		if s.keepAlive > 0 && idle > s.keepAlive*3/2 {
+			s.lost()
+		}
+	case stateAsleep, stateAwake:
+		if s.sleepDuration > 0 && idle > s.sleepDuration*3/2 {
+			s.lost()
+		}
+	}
+}
+
+// handleRegister assign topic id to topic name registered by client
+func (s *mqttsnSession) handleRegister(p *packet) {
+	ack := &packet{typ: REGACK, msgID: p.msgID, returnCode: RC_ACCEPTED}
+	if p.topicName == "" || strings.ContainsAny(p.topicName, "+#") {
+		ack.returnCode = RC_NOT_SUPPORTED
+	} else if id, ok := s.topics.register(p.topicName); !ok {
+		ack.returnCode = RC_REJECTED_CONGESTED
+	} else {
+		ack.topicID = id
+		delete(s.unconfirmed, p.topicName)
+	}
+	s.write(ack)
+}
+
+// handleRegAck handle REGACK of topic registered by gateway, messages on
+// rejected topic are dropped
+func (s *mqttsnSession) handleRegAck(p *packet) {
+	o, ok := s.inflight[p.msgID]
+	if !ok || o.pkt.typ != REGISTER {
+		return
+	}
+	delete(s.inflight, p.msgID)
+	topic := o.pkt.topicName
+	delete(s.unconfirmed, topic)
+	if p.returnCode == RC_ACCEPTED {
+		return
+	}
+	glog.Warningf("Topic '%s' is rejected by %s", topic, s.clientID)
+	s.topics.remove(topic)
+	queue := []*mqtt.Message{}
+	for _, msg := range s.queue {
+		if msg.Topic == topic {
+			s.drop()
+			continue
+		}
+		queue = append(queue, msg)
+	}
+	s.queue = queue
+}
+
+// resolveTopic return topic name of topic id in message
+func (s *mqttsnSession) resolveTopic(p *packet) (string, uint8) {
+	switch p.topicIDType() {
+	case TOPIC_NORMAL:
+		if topic, ok := s.topics.name(p.topicID); ok {
+			return topic, RC_ACCEPTED
+		}
+	case TOPIC_PREDEFINED:
+		if topic, ok := s.mgr.predefined.names[p.topicID]; ok {
+			return topic, RC_ACCEPTED
+		}
+	case TOPIC_SHORT:
+		return shortTopicName(p.topicID), RC_ACCEPTED
+	default:
+		return "", RC_NOT_SUPPORTED
+	}
+	return "", RC_INVALID_TOPIC_ID
+}
+
+// handlePublish publish message from client, QoS 2 message is published
+// when it is released
+func (s *mqttsnSession) handlePublish(p *packet) {
+	qos := p.qos()
+	topic, rc := s.resolveTopic(p)
+	if rc == RC_ACCEPTED {
+		if err := s.checkAcl(topic, auth.AclActionWrite); err != nil {
+			glog.Errorf("Mqttsn publish to '%s' from %s is denied:%s", topic, s.clientID, err)
+			rc = RC_NOT_SUPPORTED
+		}
+	}
+	if rc != RC_ACCEPTED {
+		s.write(&packet{typ: PUBACK, topicID: p.topicID, msgID: p.msgID, returnCode: rc})
+		return
+	}
+	if qos == qosMinusOne {
+		qos = 0
+	}
+	msg := &mqtt.Message{Topic: topic, Qos: qos, Retain: p.retain(), Payload: p.data}
+	switch qos {
+	case 0:
+		s.publish(msg)
+	case 1:
+		if err := s.publish(msg); err != nil {
+			rc = RC_NOT_SUPPORTED
+		}
+		s.write(&packet{typ: PUBACK, topicID: p.topicID, msgID: p.msgID, returnCode: rc})
+	case 2:
+		if _, ok := s.awaitingRel[p.msgID]; !ok {
+			if len(s.awaitingRel) >= s.mgr.maxAwaitingRel {
+				glog.Warningf("Mqttsn client %s has too many messages awaiting release", s.clientID)
+				s.write(&packet{typ: PUBACK, topicID: p.topicID, msgID: p.msgID, returnCode: RC_REJECTED_CONGESTED})
+				return
+			}
+			s.awaitingRel[p.msgID] = msg
+		}
+		s.write(&packet{typ: PUBREC, msgID: p.msgID})
+	}
+}
+
+// handlePubRel publish QoS 2 message released by client
+func (s *mqttsnSession) handlePubRel(p *packet) {
+	if msg, ok := s.awaitingRel[p.msgID]; ok {
+		delete(s.awaitingRel, p.msgID)
+		s.publish(msg)
+	}
+	s.write(&packet{typ: PUBCOMP, msgID: p.msgID})
+}
+
+// publish route message to subscribers of all protocols
+func (s *mqttsnSession) publish(msg *mqtt.Message) error {
+	if err := s.mgr.gateway.Publish(s.id, msg); err != nil {
+		glog.Warningf("Failed to publish on '%s' from %s:%s", msg.Topic, s.clientID, err)
+		return err
+	}
+	s.mgr.metrics.AddMetric(metricMessageReceived, 1)
+	return nil
+}
+
+// handlePubAck handle PUBACK of QoS 1 message, topic is registered again
+// if client does not know its id
+func (s *mqttsnSession) handlePubAck(p *packet) {
+	o, ok := s.inflight[p.msgID]
+	if !ok || o.pkt.typ != PUBLISH {
+		if p.returnCode == RC_INVALID_TOPIC_ID {
+			s.forgetTopic(p.topicID)
+		}
+		return
+	}
+	delete(s.inflight, p.msgID)
+	switch p.returnCode {
+	case RC_ACCEPTED:
+	case RC_INVALID_TOPIC_ID:
+		s.forgetTopic(p.topicID)
+		s.drop()
+	default:
+		s.drop()
+	}
+}
+
+// forgetTopic remove normal topic not known by client
+func (s *mqttsnSession) forgetTopic(id uint16) {
+	if topic, ok := s.topics.name(id); ok {
+		s.topics.remove(topic)
+	}
+}
+
+// handlePubRec release QoS 2 message received by client
+func (s *mqttsnSession) handlePubRec(p *packet) {
+	if o, ok := s.inflight[p.msgID]; ok && o.pkt.typ == PUBLISH {
+		o.released = true
+		o.attempts = 0
+		o.deadline = time.Now().Add(s.mgr.retryInterval)
+	}
+	s.write(&packet{typ: PUBREL, msgID: p.msgID})
+}
+
+// handlePubComp complete QoS 2 message
+func (s *mqttsnSession) handlePubComp(p *packet) {
+	if o, ok := s.inflight[p.msgID]; ok && o.released {
+		delete(s.inflight, p.msgID)
+	}
+}
+
+// subscriptionTopic return topic filter and topic id of SUBSCRIBE and
+// UNSUBSCRIBE, topic id is assigned to normal topic without wildcards
+func (s *mqttsnSession) subscriptionTopic(p *packet) (string, uint16, uint8) {
+	switch p.topicIDType() {
+	case TOPIC_NORMAL:
+		if p.topicName == "" {
+			return "", 0, RC_NOT_SUPPORTED
+		}
+		if strings.ContainsAny(p.topicName, "+#") {
+			return p.topicName, 0, RC_ACCEPTED
+		}
+		id, ok := s.topics.register(p.topicName)
+		if !ok {
+			return "", 0, RC_REJECTED_CONGESTED
+		}
+		delete(s.unconfirmed, p.topicName)
+		return p.topicName, id, RC_ACCEPTED
+	case TOPIC_PREDEFINED:
+		if topic, ok := s.mgr.predefined.names[p.topicID]; ok {
+			return topic, p.topicID, RC_ACCEPTED
+		}
+		return "", 0, RC_INVALID_TOPIC_ID
+	case TOPIC_SHORT:
+		if len(p.topicName) != 2 {
+			return "", 0, RC_NOT_SUPPORTED
+		}
+		return p.topicName, 0, RC_ACCEPTED
+	}
+	return "", 0, RC_NOT_SUPPORTED
+}
+
+// handleSubscribe subscribe topic in gateway, retained messages are
+// delivered to client
+func (s *mqttsnSession) handleSubscribe(p *packet) {
+	qos := p.qos()
+	ack := &packet{typ: SUBACK, msgID: p.msgID}
+	filter, id, rc := s.subscriptionTopic(p)
+	if rc == RC_ACCEPTED && qos > 2 {
+		rc = RC_NOT_SUPPORTED
+	}
+	if rc == RC_ACCEPTED {
+		if err := s.checkAcl(filter, auth.AclActionRead); err != nil {
+			glog.Errorf("Mqttsn subscribe to '%s' from %s is denied:%s", filter, s.clientID, err)
+			rc = RC_NOT_SUPPORTED
+		}
+	}
+	if rc == RC_ACCEPTED {
+		if err := s.mgr.gateway.Subscribe(s.id, filter, qos, s.deliver); err != nil {
+			glog.Warningf("Mqttsn failed to subscribe '%s' for %s:%s", filter, s.clientID, err)
+			rc = RC_NOT_SUPPORTED
+		}
+	}
+	ack.returnCode = rc
+	if rc != RC_ACCEPTED {
+		s.write(ack)
+		return
+	}
+	s.subscriptions[filter] = qos
+	s.stats.SetStat(statSubscriptionsCount, uint64(len(s.subscriptions)))
+	ack.flags = qosFlags(qos)
+	ack.topicID = id
+	s.write(ack)
+	for _, msg := range s.mgr.gateway.RetainedMessages(filter) {
+		if msg.Qos > qos {
+			msg.Qos = qos
+		}
+		s.enqueue(msg)
+	}
+}
+
+// handleUnsubscribe remove subscription in gateway
+func (s *mqttsnSession) handleUnsubscribe(p *packet) {
+	if filter, _, rc := s.subscriptionTopic(p); rc == RC_ACCEPTED {
+		s.mgr.gateway.RemoveSubscription(s.id, filter)
+		delete(s.subscriptions, filter)
+		s.stats.SetStat(statSubscriptionsCount, uint64(len(s.subscriptions)))
+	}
+	s.write(&packet{typ: UNSUBACK, msgID: p.msgID})
+}
+
+// handleWillTopicUpdate update or remove will of client
+func (s *mqttsnSession) handleWillTopicUpdate(p *packet) {
+	if p.topicName == "" {
+		s.will = nil
+	} else {
+		payload := []uint8{}
+		if s.will != nil {
+			payload = s.will.Payload
+		}
+		s.will = &mqtt.Message{Topic: p.topicName, Qos: p.qos(), Retain: p.retain(), Payload: payload}
+	}
+	s.write(&packet{typ: WILLTOPICRESP, returnCode: RC_ACCEPTED})
+}
+
+// handleWillMsgUpdate update will message of client
+func (s *mqttsnSession) handleWillMsgUpdate(p *packet) {
+	rc := uint8(RC_ACCEPTED)
+	if s.will != nil {
+		s.will.Payload = p.data
+	} else {
+		rc = RC_NOT_SUPPORTED
+	}
+	s.write(&packet{typ: WILLMSGRESP, returnCode: rc})
+}
+
+// enqueue buffer message to client, oldest message is dropped if queue is
+// full. QoS 0 messages are not kept for disconnected client
+func (s *mqttsnSession) enqueue(msg *mqtt.Message) {
+	if s.state == stateClosed || (s.state == stateDisconnected && msg.Qos == 0) {
+		return
+	}
+	if len(s.queue) >= s.mgr.maxQueued {
+		s.queue = s.queue[1:]
+		s.drop()
+	}
+	s.queue = append(s.queue, msg)
+}
+
+// drop count message dropped for client
+func (s *mqttsnSession) drop() {
+	s.dropped++
+	s.mgr.metrics.AddMetric(metricMessageDropped, 1)
+}
+
+// outgoingTopic return topic id type and id of topic, ok is false if
+// topic must be registered to client before it is published
+func (s *mqttsnSession) outgoingTopic(topic string) (uint8, uint16, bool) {
+	if id, ok := s.mgr.predefined.ids[topic]; ok {
+		return TOPIC_PREDEFINED, id, true
+	}
+	if isShortTopic(topic) {
+		return TOPIC_SHORT, shortTopicID(topic), true
+	}
+	if id, ok := s.topics.id(topic); ok && !s.unconfirmed[topic] {
+		return TOPIC_NORMAL, id, true
+	}
+	return TOPIC_NORMAL, 0, false
+}
+
+// flush send queued messages to active or awake client within inflight
+// window, unknown topic is registered before message on it is sent.
+// Awake client go to sleep again after all messages are delivered
+func (s *mqttsnSession) flush() {
+	if s.state != stateActive && s.state != stateAwake {
+		return
+	}
+	for len(s.queue) > 0 && len(s.inflight) < s.mgr.maxInflight {
+		msg := s.queue[0]
+		typ, id, ok := s.outgoingTopic(msg.Topic)
+		if !ok {
+			if s.unconfirmed[msg.Topic] {
+				// Wait for REGACK
+				break
+			}
+			id, ok = s.topics.register(msg.Topic)
+			if !ok {
+				s.queue = s.queue[1:]
+				s.drop()
+				continue
+			}
+			s.unconfirmed[msg.Topic] = true
+			s.send(&packet{typ: REGISTER, topicID: id, msgID: s.nextMid(), topicName: msg.Topic})
+			continue
+		}
+		s.queue = s.queue[1:]
+		flags := qosFlags(msg.Qos) | typ
+		if msg.Retain {
+			flags |= FLAG_RETAIN
+		}
+		p := &packet{typ: PUBLISH, flags: flags, topicID: id, data: msg.Payload}
+		s.mgr.metrics.AddMetric(metricMessageSent, 1)
+		if msg.Qos == 0 {
+			s.write(p)
+			continue
+		}
+		p.msgID = s.nextMid()
+		s.send(p)
+	}
+	if s.state == stateAwake && len(s.queue) == 0 && len(s.inflight) == 0 {
+		s.write(&packet{typ: PINGRESP})
+		s.state = stateAsleep
+	}
+}
+
+// send write message which is retransmitted until it is acknowledged
+func (s *mqttsnSession) send(p *packet) {
+	s.inflight[p.msgID] = &outgoing{pkt: p, deadline: time.Now().Add(s.mgr.retryInterval)}
+	s.write(p)
+}
+
+// resend send inflight messages again after client connect or wake up
+func (s *mqttsnSession) resend() {
+	for _, o := range s.inflight {
+		o.attempts = 0
+		o.deadline = time.Time{}
+	}
+	s.retransmit(time.Now())
+}
+
+// retransmit send messages not acknowledged in retry interval, client is
+// lost after max retries
+func (s *mqttsnSession) retransmit(now time.Time) {
+	if s.state != stateActive && s.state != stateAwake {
+		return
+	}
+	for _, o := range s.inflight {
+		if now.Before(o.deadline) {
+			continue
+		}
+		if o.attempts >= s.mgr.maxRetries {
+			glog.Warningf("Mqttsn %s is not acknowledged by %s", packetName(o.pkt.typ), s.clientID)
+			s.lost()
+			return
+		}
+		if !o.deadline.IsZero() {
+			o.attempts++
+			s.mgr.metrics.AddMetric(metricPacketResent, 1)
+		}
+		o.deadline = now.Add(s.mgr.retryInterval)
+		switch {
+		case o.released:
+			s.write(&packet{typ: PUBREL, msgID: o.pkt.msgID})
+		case o.pkt.typ == PUBLISH:
+			o.pkt.flags |= FLAG_DUP
+			s.write(o.pkt)
+		default:
+			s.write(o.pkt)
+		}
+	}
+}
+
+// nextMid return message id not used by inflight messages
+func (s *mqttsnSession) nextMid() uint16 {
+	for {
+		s.lastMid++
+		if _, ok := s.inflight[s.lastMid]; s.lastMid != 0 && !ok {
+			return s.lastMid
+		}
+	}
+}
+
+// write send message to client
+func (s *mqttsnSession) write(p *packet) {
+	if err := s.mgr.write(s.endpoint, p); err != nil {
+		glog.Errorf("Failed to send mqttsn %s to %s:%s", packetName(p.typ), s.clientID, err)
+	}
+}
+
+// Destroy remove subscriptions and session
+func (s *mqttsnSession) Destroy() error {
+	s.destroyOnce.Do(func() {
+		close(s.quit)
+		s.mgr.gateway.Unsubscribe(s.id)
+		s.mgr.removeSession(s)
+		glog.Infof("Mqttsn session %s is destroyed", s.clientID)
+	})
+	return nil
+}
+
+func (s *mqttsnSession) Identifier() string        { return s.clientID }
+func (s *mqttsnSession) Service() base.Service     { return s.mgr }
+func (s *mqttsnSession) GetStats() *base.Stats     { return s.stats }
+func (s *mqttsnSession) GetMetrics() *base.Metrics { return s.metrics }
+
+// Info return session information
+func (s *mqttsnSession) Info() *base.SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info := &base.SessionInfo{
+		ClientId:           s.clientID,
+		CleanSession:       s.cleanSession,
+		MessageMaxInflight: uint64(s.mgr.maxInflight),
+		MessageInQueue:     uint64(len(s.queue)),
+		MessageDropped:     s.dropped,
+		AwaitingRel:        uint64(len(s.awaitingRel)),
+		CreatedAt:          s.createdAt.Format(time.RFC3339),
+	}
+	for _, o := range s.inflight {
+		if o.pkt.typ != PUBLISH {
+			continue
+		}
+		info.MessageInflight++
+		switch {
+		case o.released:
+			info.AwaitingComp++
+		default:
+			info.AwaitingAck++
+		}
+	}
+	return info
+}
+
+// clientInfo return client information
+func (s *mqttsnSession) clientInfo() *base.ClientInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return &base.ClientInfo{
+		CleanSession: s.cleanSession,
+		PeerName:     s.endpoint.key(),
+		ConnectTime:  s.connectedAt.Format(time.RFC3339),
+	}
+}
+
+// subscriptionInfos return subscriptions of client
+func (s *mqttsnSession) subscriptionInfos() []*base.SubscriptionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subs := []*base.SubscriptionInfo{}
+	for filter, qos := range s.subscriptions {
+		subs = append(subs, &base.SubscriptionInfo{
+			ClientId:  s.clientID,
+			Topic:     filter,
+			Attribute: fmt.Sprintf("qos=%d", qos),
+		})
+	}
+	return subs
+}
@@ -0,0 +1,121 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package mqttsn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// predefinedTopics is topic ids known by gateway and clients in advance
+type predefinedTopics struct {
+	names map[uint16]string
+	ids   map[string]uint16
+}
+
+// parsePredefinedTopics parse comma separated "id:topic" items
+func parsePredefinedTopics(value string) (*predefinedTopics, error) {
+	t := &predefinedTopics{names: make(map[uint16]string), ids: make(map[string]uint16)}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		index := strings.Index(item, ":")
+		if index <= 0 || index == len(item)-1 {
+			return nil, fmt.Errorf("Invalid predefined topic '%s'", item)
+		}
+		id, err := strconv.ParseUint(item[:index], 10, 16)
+		if err != nil || id == 0 || id == 0xFFFF {
+			return nil, fmt.Errorf("Invalid predefined topic id '%s'", item[:index])
+		}
+		topic := item[index+1:]
+		if strings.ContainsAny(topic, "+#") {
+			return nil, fmt.Errorf("Predefined topic '%s' has wildcards", topic)
+		}
+		t.names[uint16(id)] = topic
+		t.ids[topic] = uint16(id)
+	}
+	return t, nil
+}
+
+// isShortTopic check wether topic can be sent as short topic name
+func isShortTopic(topic string) bool {
+	return len(topic) == 2 && !strings.ContainsAny(topic, "+#")
+}
+
+// shortTopicID return short topic name in topic id field
+func shortTopicID(topic string) uint16 {
+	return uint16(topic[0])<<8 | uint16(topic[1])
+}
+
+// shortTopicName return short topic name in topic id field
+func shortTopicName(id uint16) string {
+	return string([]uint8{uint8(id >> 8), uint8(id)})
+}
+
+// topicRegistry is normal topic ids registered by client or gateway, the
+// ids are valid in session
+type topicRegistry struct {
+	names  map[uint16]string
+	ids    map[string]uint16
+	lastID uint16
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{names: make(map[uint16]string), ids: make(map[string]uint16)}
+}
+
+// register return id of topic, new id is assigned if topic is not
+// registered. It return false if all ids are used
+func (r *topicRegistry) register(topic string) (uint16, bool) {
+	if id, ok := r.ids[topic]; ok {
+		return id, true
+	}
+	if len(r.names) >= 0xFFFE {
+		return 0, false
+	}
+	for {
+		r.lastID++
+		if r.lastID == 0 || r.lastID == 0xFFFF {
+			r.lastID = 1
+		}
+		if _, ok := r.names[r.lastID]; !ok {
+			break
+		}
+	}
+	r.names[r.lastID] = topic
+	r.ids[topic] = r.lastID
+	return r.lastID, true
+}
+
+// name return topic registered with id
+func (r *topicRegistry) name(id uint16) (string, bool) {
+	topic, ok := r.names[id]
+	return topic, ok
+}
+
+// id return id of registered topic
+func (r *topicRegistry) id(topic string) (uint16, bool) {
+	id, ok := r.ids[topic]
+	return id, ok
+}
+
+// remove delete topic registration
+func (r *topicRegistry) remove(topic string) {
+	if id, ok := r.ids[topic]; ok {
+		delete(r.ids, topic)
+		delete(r.names, id)
+	}
+}
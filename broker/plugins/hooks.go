@@ -0,0 +1,113 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package plugins
+
+// AuthHook authenticate client and authorize topic access, nil error
+// means the hook allow it. Access is auth.AclActionRead or AclActionWrite
+type AuthHook interface {
+	Authenticate(clientid string, username string, password string) error
+	CheckAcl(clientid string, username string, topic string, access string) error
+}
+
+// Message is message published by client, it is passed through transform
+// hooks before it is routed
+type Message struct {
+	ClientID string
+	Username string
+	Topic    string
+	Qos      uint8
+	Retain   bool
+	Payload  []byte
+}
+
+// TransformHook change message published by client, message is dropped if
+// nil is returned
+type TransformHook func(msg *Message) (*Message, error)
+
+type namedAuthHook struct {
+	name string
+	hook AuthHook
+}
+
+type namedTransformHook struct {
+	name string
+	hook TransformHook
+}
+
+// hookSet is hooks of all started plugins in pipeline order
+type hookSet struct {
+	auth      []namedAuthHook
+	transform []namedTransformHook
+}
+
+// remove remove hooks of plugin, slices are copied because pipelines may
+// be iterating them
+func (h *hookSet) remove(name string) {
+	auth := []namedAuthHook{}
+	for _, hook := range h.auth {
+		if hook.name != name {
+			auth = append(auth, hook)
+		}
+	}
+	transform := []namedTransformHook{}
+	for _, hook := range h.transform {
+		if hook.name != name {
+			transform = append(transform, hook)
+		}
+	}
+	h.auth = auth
+	h.transform = transform
+}
+
+// Authenticate run authentication pipeline, client is rejected by the
+// first hook which return error
+func Authenticate(clientid string, username string, password string) error {
+	_hookMux.RLock()
+	hooks := _hooks.auth
+	_hookMux.RUnlock()
+	for _, h := range hooks {
+		if err := h.hook.Authenticate(clientid, username, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckAcl run authorization pipeline, access is denied by the first hook
+// which return error
+func CheckAcl(clientid string, username string, topic string, access string) error {
+	_hookMux.RLock()
+	hooks := _hooks.auth
+	_hookMux.RUnlock()
+	for _, h := range hooks {
+		if err := h.hook.CheckAcl(clientid, username, topic, access); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transform run message transform pipeline, nil is returned if message is
+// dropped by any hook
+func Transform(msg *Message) (*Message, error) {
+	_hookMux.RLock()
+	hooks := _hooks.transform
+	_hookMux.RUnlock()
+	for _, h := range hooks {
+		var err error
+		if msg, err = h.hook(msg); err != nil || msg == nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,312 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cloustone/sentel/broker/event"
+	"github.com/cloustone/sentel/core"
+	"github.com/golang/glog"
+)
+
+// Plugin state
+const (
+	StateLoaded  = "loaded"
+	StateStarted = "started"
+	StateStopped = "stopped"
+	StateFailed  = "failed"
+)
+
+// Plugin is extension of broker, it register hooks into broker when it is
+// started, and all its hooks are removed after it is stopped
+type Plugin interface {
+	Version() string
+	Description() string
+	Start(ctx *Context) error
+	Stop() error
+	// Reload apply configurations changed in plugin's config section
+	Reload(c core.Config) error
+}
+
+// PluginFactory create plugin with configurations
+type PluginFactory interface {
+	New(c core.Config) (Plugin, error)
+}
+
+// PluginInfo is plugin information reported to operators
+type PluginInfo struct {
+	Name        string
+	Version     string
+	Description string
+	State       string
+	Error       string
+}
+
+var _allPlugins = make(map[string]PluginFactory)
+
+// RegisterPlugin register plugin factory, it is called in plugin's init
+func RegisterPlugin(name string, factory PluginFactory) {
+	if _allPlugins[name] != nil {
+		glog.Errorf("Plugin '%s' is already registered", name)
+		return
+	}
+	_allPlugins[name] = factory
+}
+
+// ConfigSection return name of plugin's config section
+func ConfigSection(name string) string {
+	return "plugin:" + name
+}
+
+// loadedPlugin is plugin instance with its state and hooks
+type loadedPlugin struct {
+	name    string
+	plugin  Plugin
+	state   string
+	err     error
+	context *Context
+}
+
+var (
+	_config  core.Config
+	_loaded  = make(map[string]*loadedPlugin)
+	_mutex   sync.Mutex
+	_hooks   hookSet
+	_hookMux sync.RWMutex
+)
+
+// Load create plugins listed in plugins section, plugin failed to be
+// created is reported with failed state
+func Load(c core.Config) error {
+	_mutex.Lock()
+	defer _mutex.Unlock()
+	_config = c
+	names, err := c.String("plugins", "load")
+	if err != nil {
+		return nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := _loaded[name]; ok {
+			continue
+		}
+		p := &loadedPlugin{name: name}
+		_loaded[name] = p
+		factory := _allPlugins[name]
+		if factory == nil {
+			p.fail(fmt.Errorf("Plugin '%s' is not registered", name))
+			continue
+		}
+		if p.plugin, err = factory.New(c); err != nil {
+			p.fail(err)
+			continue
+		}
+		p.state = StateLoaded
+		glog.Infof("Plugin '%s' is loaded", name)
+	}
+	return nil
+}
+
+// Start start all loaded plugins
+func Start() error {
+	for _, name := range names() {
+		if err := StartPlugin(name); err != nil {
+			glog.Errorf("Failed to start plugin '%s':%s", name, err)
+		}
+	}
+	return nil
+}
+
+// Stop stop all started plugins
+func Stop() {
+	for _, name := range names() {
+		if err := StopPlugin(name); err != nil {
+			glog.Errorf("Failed to stop plugin '%s':%s", name, err)
+		}
+	}
+}
+
+// StartPlugin start loaded or stopped plugin
+func StartPlugin(name string) error {
+	_mutex.Lock()
+	defer _mutex.Unlock()
+	p, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	if p.state == StateStarted {
+		return nil
+	}
+	ctx := &Context{name: name, config: _config}
+	if err := p.plugin.Start(ctx); err != nil {
+		ctx.release()
+		p.fail(err)
+		return err
+	}
+	p.context = ctx
+	p.state = StateStarted
+	p.err = nil
+	glog.Infof("Plugin '%s' is started", name)
+	return nil
+}
+
+// StopPlugin stop plugin and remove its hooks
+func StopPlugin(name string) error {
+	_mutex.Lock()
+	defer _mutex.Unlock()
+	p, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	if p.state != StateStarted {
+		return nil
+	}
+	p.context.release()
+	p.context = nil
+	p.state = StateStopped
+	if err := p.plugin.Stop(); err != nil {
+		p.err = err
+		return err
+	}
+	glog.Infof("Plugin '%s' is stopped", name)
+	return nil
+}
+
+// ReloadPlugin read plugin's config section from config files again and
+// apply it to plugin
+func ReloadPlugin(name string) error {
+	_mutex.Lock()
+	defer _mutex.Unlock()
+	p, err := lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := core.ReloadConfigSection(ConfigSection(name)); err != nil {
+		p.err = err
+		return err
+	}
+	if err := p.plugin.Reload(_config); err != nil {
+		p.err = err
+		return err
+	}
+	p.err = nil
+	glog.Infof("Plugin '%s' is reloaded", name)
+	return nil
+}
+
+// GetPlugins return information of loaded plugins
+func GetPlugins() []PluginInfo {
+	_mutex.Lock()
+	defer _mutex.Unlock()
+	infos := []PluginInfo{}
+	for _, name := range sortedNames() {
+		p := _loaded[name]
+		info := PluginInfo{Name: name, State: p.state}
+		if p.plugin != nil {
+			info.Version = p.plugin.Version()
+			info.Description = p.plugin.Description()
+		}
+		if p.err != nil {
+			info.Error = p.err.Error()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// lookup return plugin which is created, the caller must hold lock
+func lookup(name string) (*loadedPlugin, error) {
+	p, ok := _loaded[name]
+	if !ok {
+		return nil, fmt.Errorf("Plugin '%s' is not loaded", name)
+	}
+	if p.plugin == nil {
+		return nil, fmt.Errorf("Plugin '%s' failed to load:%v", name, p.err)
+	}
+	return p, nil
+}
+
+func (p *loadedPlugin) fail(err error) {
+	glog.Errorf("Plugin '%s' failed:%s", p.name, err)
+	p.state = StateFailed
+	p.err = err
+}
+
+func names() []string {
+	_mutex.Lock()
+	defer _mutex.Unlock()
+	return sortedNames()
+}
+
+// sortedNames return names of loaded plugins, the caller must hold lock
+func sortedNames() []string {
+	names := make([]string, 0, len(_loaded))
+	for name := range _loaded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Context is given to plugin when it is started, hooks are registered
+// through it so that they can be removed when plugin is stopped
+type Context struct {
+	name     string
+	config   core.Config
+	eventIDs []uint64
+}
+
+// Name return plugin name
+func (ctx *Context) Name() string { return ctx.name }
+
+// Config return configurations, plugin's own configurations are in
+// section returned by ConfigSection
+func (ctx *Context) Config() core.Config { return ctx.config }
+
+// AddAuthHook add hook into authentication and authorization pipeline
+func (ctx *Context) AddAuthHook(hook AuthHook) {
+	_hookMux.Lock()
+	defer _hookMux.Unlock()
+	_hooks.auth = append(_hooks.auth, namedAuthHook{ctx.name, hook})
+}
+
+// AddTransformHook add hook into message transform pipeline
+func (ctx *Context) AddTransformHook(hook TransformHook) {
+	_hookMux.Lock()
+	defer _hookMux.Unlock()
+	_hooks.transform = append(_hooks.transform, namedTransformHook{ctx.name, hook})
+}
+
+// Subscribe handle broker events of kind, all events are handled if kind
+// is empty
+func (ctx *Context) Subscribe(kind string, handler event.Handler) {
+	id := event.GetBus(ctx.config).Subscribe(kind, handler)
+	ctx.eventIDs = append(ctx.eventIDs, id)
+}
+
+// release remove all hooks registered by plugin
+func (ctx *Context) release() {
+	_hookMux.Lock()
+	_hooks.remove(ctx.name)
+	_hookMux.Unlock()
+	for _, id := range ctx.eventIDs {
+		event.GetBus(ctx.config).Unsubscribe(id)
+	}
+	ctx.eventIDs = nil
+}
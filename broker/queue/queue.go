@@ -1 +1,331 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
 package queue
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Fsync policy of durable queue
+const (
+	SyncNever    = "never"    // Leave flushing to operating system
+	SyncAlways   = "always"   // Fsync after each write
+	SyncInterval = "interval" // Fsync periodically with SyncPeriod
+)
+
+// Policy to drop message when queue limits are exceeded
+const (
+	DropOldest = "oldest"
+	DropNewest = "newest"
+)
+
+var (
+	ErrQueueEmpty  = errors.New("Queue is empty")
+	ErrQueueFull   = errors.New("Queue is full")
+	ErrQueueClosed = errors.New("Queue is closed")
+	ErrNotFound    = errors.New("Message not found")
+)
+
+// Options of queue, zero limit means no limit
+type Options struct {
+	Path              string        // Directory of segment files, queue is kept in memory if empty
+	SegmentSize       int64         // Segment file is rotated after it exceed the size
+	SyncPolicy        string        // Fsync policy
+	SyncPeriod        time.Duration // Fsync period for interval policy
+	MaxCount          int           // Max message count in queue
+	MaxBytes          int64         // Max data bytes in queue
+	MaxAge            time.Duration // Message older than it is dropped
+	DropPolicy        string        // Drop oldest message or reject new message if queue is full
+	RedeliveryTimeout time.Duration // Message not acknowledged in timeout is delivered again
+}
+
+// Message in queue
+type Message struct {
+	Seq        uint64
+	Data       []byte
+	Timestamp  time.Time
+	Deliveries int // Times the message is delivered
+}
+
+// Queue is FIFO queue with consumer acknowledgement, message popped is
+// kept in queue until it is acknowledged
+type Queue interface {
+	// Push append data to queue and return its sequence
+	Push(data []byte) (uint64, error)
+	// Pop return the oldest message not being delivered, ErrQueueEmpty
+	// is returned if no message is available
+	Pop() (*Message, error)
+	// Ack remove message from queue
+	Ack(seq uint64) error
+	// Requeue make delivered message available to Pop again
+	Requeue(seq uint64) error
+	// Range call fn for each message in order until fn return false
+	Range(fn func(msg *Message) bool)
+	// Len return message count in queue
+	Len() int
+	// Size return data bytes in queue
+	Size() int64
+	// Dropped return count of messages dropped because of limits
+	Dropped() uint64
+	// Close flush and close queue
+	Close() error
+}
+
+// New create queue with options, queue is recovered from segment files if
+// path is set
+func New(opts Options) (Queue, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 16 * 1024 * 1024
+	}
+	if opts.SyncPolicy == "" {
+		opts.SyncPolicy = SyncInterval
+	}
+	if opts.SyncPeriod <= 0 {
+		opts.SyncPeriod = time.Second
+	}
+	if opts.DropPolicy != DropNewest {
+		opts.DropPolicy = DropOldest
+	}
+	q := &fifo{
+		opts:    opts,
+		msgs:    list.New(),
+		index:   make(map[uint64]*list.Element),
+		nextSeq: 1,
+	}
+	if opts.Path == "" {
+		return q, nil
+	}
+	store, msgs, err := openSegmentStore(opts)
+	if err != nil {
+		return nil, err
+	}
+	q.store = store
+	for _, msg := range msgs {
+		q.add(msg)
+		q.nextSeq = msg.Seq + 1
+	}
+	if next := store.nextSeq(); next > q.nextSeq {
+		q.nextSeq = next
+	}
+	return q, nil
+}
+
+// NewMemoryQueue create queue in memory with limits
+func NewMemoryQueue(maxCount int, maxBytes int64, dropPolicy string) Queue {
+	q, _ := New(Options{MaxCount: maxCount, MaxBytes: maxBytes, DropPolicy: dropPolicy})
+	return q
+}
+
+// entry is message with delivery state
+type entry struct {
+	msg      Message
+	inflight bool
+	deadline time.Time
+}
+
+// fifo implement queue in memory, changes are written to segment store if
+// queue is durable
+type fifo struct {
+	mutex   sync.Mutex
+	opts    Options
+	store   *segmentStore
+	msgs    *list.List
+	index   map[uint64]*list.Element
+	nextSeq uint64
+	size    int64
+	dropped uint64
+	closed  bool
+}
+
+// add append message to list, the caller must hold lock
+func (q *fifo) add(msg *Message) {
+	q.index[msg.Seq] = q.msgs.PushBack(&entry{msg: *msg})
+	q.size += int64(len(msg.Data))
+}
+
+// remove remove message from list and record acknowledge in store, the
+// caller must hold lock
+func (q *fifo) remove(e *list.Element) error {
+	ent := e.Value.(*entry)
+	q.msgs.Remove(e)
+	delete(q.index, ent.msg.Seq)
+	q.size -= int64(len(ent.msg.Data))
+	if q.store != nil {
+		return q.store.ack(ent.msg.Seq)
+	}
+	return nil
+}
+
+// expire drop messages older than max age, the caller must hold lock
+func (q *fifo) expire(now time.Time) {
+	if q.opts.MaxAge <= 0 {
+		return
+	}
+	for e := q.msgs.Front(); e != nil; e = q.msgs.Front() {
+		if now.Sub(e.Value.(*entry).msg.Timestamp) <= q.opts.MaxAge {
+			return
+		}
+		q.remove(e)
+		q.dropped++
+	}
+}
+
+// full check wether queue can not accept data of size
+func (q *fifo) full(size int) bool {
+	return (q.opts.MaxCount > 0 && q.msgs.Len() >= q.opts.MaxCount) ||
+		(q.opts.MaxBytes > 0 && q.size+int64(size) > q.opts.MaxBytes)
+}
+
+// Push append data to queue
+func (q *fifo) Push(data []byte) (uint64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return 0, ErrQueueClosed
+	}
+	now := time.Now()
+	q.expire(now)
+	if q.opts.MaxBytes > 0 && int64(len(data)) > q.opts.MaxBytes {
+		q.dropped++
+		return 0, ErrQueueFull
+	}
+	for q.full(len(data)) {
+		if q.opts.DropPolicy == DropNewest {
+			q.dropped++
+			return 0, ErrQueueFull
+		}
+		if err := q.remove(q.msgs.Front()); err != nil {
+			return 0, err
+		}
+		q.dropped++
+	}
+	msg := &Message{
+		Seq:       q.nextSeq,
+		Data:      append([]byte{}, data...),
+		Timestamp: now,
+	}
+	if q.store != nil {
+		if err := q.store.push(msg); err != nil {
+			return 0, err
+		}
+	}
+	q.nextSeq++
+	q.add(msg)
+	return msg.Seq, nil
+}
+
+// Pop return the oldest message which is not being delivered, or whose
+// redelivery timeout is reached
+func (q *fifo) Pop() (*Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	now := time.Now()
+	q.expire(now)
+	for e := q.msgs.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*entry)
+		if ent.inflight && (q.opts.RedeliveryTimeout <= 0 || now.Before(ent.deadline)) {
+			continue
+		}
+		ent.inflight = true
+		ent.deadline = now.Add(q.opts.RedeliveryTimeout)
+		ent.msg.Deliveries++
+		msg := ent.msg
+		return &msg, nil
+	}
+	return nil, ErrQueueEmpty
+}
+
+// Ack remove message from queue
+func (q *fifo) Ack(seq uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	e, ok := q.index[seq]
+	if !ok {
+		return ErrNotFound
+	}
+	return q.remove(e)
+}
+
+// Requeue make message available to Pop immediately
+func (q *fifo) Requeue(seq uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	e, ok := q.index[seq]
+	if !ok {
+		return ErrNotFound
+	}
+	e.Value.(*entry).inflight = false
+	return nil
+}
+
+// Range call fn for each message in order
+func (q *fifo) Range(fn func(msg *Message) bool) {
+	q.mutex.Lock()
+	msgs := make([]Message, 0, q.msgs.Len())
+	for e := q.msgs.Front(); e != nil; e = e.Next() {
+		msgs = append(msgs, e.Value.(*entry).msg)
+	}
+	q.mutex.Unlock()
+	for i := range msgs {
+		if !fn(&msgs[i]) {
+			return
+		}
+	}
+}
+
+// Len return message count
+func (q *fifo) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.msgs.Len()
+}
+
+// Size return data bytes
+func (q *fifo) Size() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+// Dropped return dropped message count
+func (q *fifo) Dropped() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+// Close close segment store
+func (q *fifo) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	if q.store != nil {
+		return q.store.close()
+	}
+	return nil
+}
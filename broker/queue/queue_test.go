@@ -0,0 +1,327 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordSize is size of push record with data of length in segment file
+func recordSize(length int) int64 {
+	return int64(recordHeadSize + recordBodySize + length)
+}
+
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func openTestQueue(t *testing.T, opts Options) Queue {
+	q, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// segmentFiles return names of segment files in dir
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		files[i] = filepath.Base(f)
+	}
+	return files
+}
+
+// queuedData return data of messages in queue joined by comma
+func queuedData(q Queue) string {
+	data := []string{}
+	q.Range(func(msg *Message) bool {
+		data = append(data, string(msg.Data))
+		return true
+	})
+	return strings.Join(data, ",")
+}
+
+// pushData push each data into queue
+func pushData(t *testing.T, q Queue, data ...string) []uint64 {
+	seqs := []uint64{}
+	for _, d := range data {
+		seq, err := q.Push([]byte(d))
+		if err != nil {
+			t.Fatalf("Push('%s') failed:%s", d, err)
+		}
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func TestQueueSegmentRotation(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	// Segment is rotated after two push records
+	opts := Options{Path: dir, SegmentSize: 2 * recordSize(2), SyncPolicy: SyncNever}
+	q := openTestQueue(t, opts)
+	defer q.Close()
+	seqs := pushData(t, q, "m1", "m2", "m3", "m4", "m5", "m6")
+	files := segmentFiles(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("segments = %v, want 3 segments", files)
+	}
+	cases := []struct {
+		ack  uint64
+		want []string
+	}{
+		// Acknowledgement is written into active segment, head segment
+		// is removed when all of its messages are acknowledged
+		{seqs[1], files},
+		{seqs[0], files[1:]},
+		{seqs[3], files[1:]},
+		{seqs[2], files[2:]},
+		{seqs[4], files[2:]},
+		// Active segment is kept even if it is empty
+		{seqs[5], files[2:]},
+	}
+	for _, c := range cases {
+		if err := q.Ack(c.ack); err != nil {
+			t.Fatalf("Ack(%d) failed:%s", c.ack, err)
+		}
+		if got := segmentFiles(t, dir); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("segments after Ack(%d) = %v, want %v", c.ack, got, c.want)
+		}
+	}
+	if q.Len() != 0 || q.Size() != 0 {
+		t.Errorf("Len() = %d, Size() = %d after all messages are acknowledged", q.Len(), q.Size())
+	}
+}
+
+func TestQueueRecovery(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	opts := Options{Path: dir, SegmentSize: 3 * recordSize(2), SyncPolicy: SyncAlways}
+	q := openTestQueue(t, opts)
+	seqs := pushData(t, q, "m1", "m2", "m3", "m4", "m5", "m6", "m7", "m8")
+	// Acknowledgements of messages in head segments are written into
+	// later segments
+	for _, i := range []int{6, 0, 3, 1, 7} {
+		if err := q.Ack(seqs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Message popped but not acknowledged is recovered
+	if _, err := q.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q = openTestQueue(t, opts)
+	if got, want := queuedData(q), "m3,m5,m6"; got != want {
+		t.Errorf("recovered messages = %s, want %s", got, want)
+	}
+	if q.Size() != 6 {
+		t.Errorf("recovered Size() = %d, want 6", q.Size())
+	}
+	msg, err := q.Pop()
+	if err != nil || msg.Seq != seqs[2] || msg.Deliveries != 1 {
+		t.Errorf("Pop() after recovery = %v, %v, want message %d delivered once", msg, err, seqs[2])
+	}
+	// Sequence is not reused even if the last message is acknowledged
+	if seq := pushData(t, q, "m9")[0]; seq != seqs[7]+1 {
+		t.Errorf("Push() after recovery = %d, want %d", seq, seqs[7]+1)
+	}
+	q.Ack(seqs[2])
+	q.Close()
+
+	// Recovery is repeatable after acknowledgements of recovered messages
+	q = openTestQueue(t, opts)
+	defer q.Close()
+	if got, want := queuedData(q), "m5,m6,m9"; got != want {
+		t.Errorf("recovered messages again = %s, want %s", got, want)
+	}
+}
+
+func TestQueueTruncate(t *testing.T) {
+	cases := []struct {
+		name    string
+		corrupt func(data []byte, last int64) []byte
+	}{
+		{"partial head", func(data []byte, last int64) []byte {
+			return data[:last+4]
+		}},
+		{"partial body", func(data []byte, last int64) []byte {
+			return data[:len(data)-1]
+		}},
+		{"bad crc", func(data []byte, last int64) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+		{"bad length", func(data []byte, last int64) []byte {
+			binary.BigEndian.PutUint32(data[last:], 0xfffffff0)
+			return data
+		}},
+		{"short body", func(data []byte, last int64) []byte {
+			binary.BigEndian.PutUint32(data[last:], recordBodySize-1)
+			return data
+		}},
+	}
+	for _, c := range cases {
+		dir := newTestDir(t)
+		opts := Options{Path: dir, SyncPolicy: SyncAlways}
+		q := openTestQueue(t, opts)
+		pushData(t, q, "m1", "m2", "m3")
+		q.Close()
+
+		path := filepath.Join(dir, segmentFiles(t, dir)[0])
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := int64(len(data)) - recordSize(2)
+		if err := ioutil.WriteFile(path, c.corrupt(data, last), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		q = openTestQueue(t, opts)
+		if got := queuedData(q); got != "m1,m2" {
+			t.Errorf("%s: recovered messages = %s, want m1,m2", c.name, got)
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() != last {
+			t.Errorf("%s: segment is not truncated at %d", c.name, last)
+		}
+		// Records written after truncation are recovered
+		pushData(t, q, "m4")
+		q.Close()
+		q = openTestQueue(t, opts)
+		if got := queuedData(q); got != "m1,m2,m4" {
+			t.Errorf("%s: messages after truncation = %s, want m1,m2,m4", c.name, got)
+		}
+		q.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    Options
+		data    []string
+		want    string
+		dropped uint64
+		err     error // Error of the last push
+	}{
+		{"count oldest", Options{MaxCount: 2}, []string{"a", "b", "c"}, "b,c", 1, nil},
+		{"count newest", Options{MaxCount: 2, DropPolicy: DropNewest}, []string{"a", "b", "c"}, "a,b", 1, ErrQueueFull},
+		{"bytes oldest", Options{MaxBytes: 4}, []string{"aa", "bb", "c"}, "bb,c", 1, nil},
+		{"bytes newest", Options{MaxBytes: 4, DropPolicy: DropNewest}, []string{"aa", "bb", "c"}, "aa,bb", 1, ErrQueueFull},
+		// Message larger than limit is never accepted
+		{"too large", Options{MaxBytes: 4}, []string{"aa", "bbbbb"}, "aa", 1, ErrQueueFull},
+	}
+	for _, c := range cases {
+		q := openTestQueue(t, c.opts)
+		var err error
+		for _, d := range c.data {
+			_, err = q.Push([]byte(d))
+		}
+		if err != c.err {
+			t.Errorf("%s: last Push() = %v, want %v", c.name, err, c.err)
+		}
+		if got := queuedData(q); got != c.want {
+			t.Errorf("%s: messages = %s, want %s", c.name, got, c.want)
+		}
+		if q.Dropped() != c.dropped {
+			t.Errorf("%s: Dropped() = %d, want %d", c.name, q.Dropped(), c.dropped)
+		}
+		q.Close()
+	}
+}
+
+func TestQueueMaxAge(t *testing.T) {
+	q := openTestQueue(t, Options{MaxAge: 50 * time.Millisecond})
+	defer q.Close()
+	pushData(t, q, "a", "b")
+	time.Sleep(100 * time.Millisecond)
+	pushData(t, q, "c")
+	if got := queuedData(q); got != "c" || q.Dropped() != 2 {
+		t.Errorf("messages = %s, dropped %d, want c and 2 dropped", got, q.Dropped())
+	}
+	time.Sleep(100 * time.Millisecond)
+	if msg, err := q.Pop(); err != ErrQueueEmpty {
+		t.Errorf("Pop() of expired message = %v, %v", msg, err)
+	}
+}
+
+func TestQueueDroppedRecovery(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+	opts := Options{Path: dir, MaxCount: 2, SyncPolicy: SyncAlways}
+	q := openTestQueue(t, opts)
+	pushData(t, q, "a", "b", "c", "d")
+	q.Close()
+	// Dropped messages are acknowledged in segment
+	q = openTestQueue(t, opts)
+	defer q.Close()
+	if got := queuedData(q); got != "c,d" {
+		t.Errorf("recovered messages = %s, want c,d", got)
+	}
+}
+
+func TestQueueRequeue(t *testing.T) {
+	q := openTestQueue(t, Options{RedeliveryTimeout: 50 * time.Millisecond})
+	seqs := pushData(t, q, "a", "b")
+	cases := []struct {
+		requeue    uint64
+		wait       time.Duration
+		seq        uint64
+		deliveries int
+	}{
+		{0, 0, seqs[0], 1},
+		{0, 0, seqs[1], 1},
+		{seqs[1], 0, seqs[1], 2},
+		// Message is delivered again after redelivery timeout
+		{0, 100 * time.Millisecond, seqs[0], 2},
+	}
+	for i, c := range cases {
+		if c.requeue != 0 {
+			if err := q.Requeue(c.requeue); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(c.wait)
+		msg, err := q.Pop()
+		if err != nil || msg.Seq != c.seq || msg.Deliveries != c.deliveries {
+			t.Errorf("%d: Pop() = %v, %v, want message %d delivered %d times", i, msg, err, c.seq, c.deliveries)
+		}
+	}
+	if err := q.Requeue(100); err != ErrNotFound {
+		t.Errorf("Requeue() of unknown message = %v", err)
+	}
+	q.Close()
+	if err := q.Requeue(seqs[0]); err != ErrQueueClosed {
+		t.Errorf("Requeue() after close = %v", err)
+	}
+}
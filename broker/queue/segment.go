@@ -0,0 +1,352 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	segmentSuffix = ".seg"
+	// Record is length and crc32 of body, and body is type, sequence,
+	// timestamp and data
+	recordHeadSize = 8
+	recordBodySize = 17
+)
+
+// Record type in segment file
+const (
+	recordPush = 1
+	recordAck  = 2
+)
+
+// segment is one file of queue, it is named with sequence of the first
+// message written into it
+type segment struct {
+	first uint64
+	path  string
+	live  int // Messages in segment not acknowledged
+}
+
+// segmentStore write pushed messages and acknowledgements into segment
+// files. Acknowledgement is written into active segment, so that segments
+// are removed only from head when all their messages are acknowledged
+type segmentStore struct {
+	mutex      sync.Mutex
+	opts       Options
+	segments   []*segment
+	active     *os.File
+	activeSize int64
+	lastSeq    uint64
+	dirty      bool
+	quit       chan bool
+	waitgroup  sync.WaitGroup
+}
+
+// openSegmentStore open segment files in path and recover messages which
+// are not acknowledged, broken record at the tail of segment is truncated
+func openSegmentStore(opts Options) (*segmentStore, []*Message, error) {
+	if err := os.MkdirAll(opts.Path, 0755); err != nil {
+		return nil, nil, err
+	}
+	s := &segmentStore{opts: opts, quit: make(chan bool)}
+	msgs, err := s.recover()
+	if err != nil {
+		return nil, nil, err
+	}
+	s.removeSegments()
+	if err := s.openActive(); err != nil {
+		return nil, nil, err
+	}
+	if opts.SyncPolicy == SyncInterval {
+		s.waitgroup.Add(1)
+		go s.syncLoop()
+	}
+	return s, msgs, nil
+}
+
+// segmentPath return file path of segment beginning with sequence
+func (s *segmentStore) segmentPath(first uint64) string {
+	return filepath.Join(s.opts.Path, fmt.Sprintf("%020d%s", first, segmentSuffix))
+}
+
+// recover read all segments and return messages not acknowledged in order
+func (s *segmentStore) recover() ([]*Message, error) {
+	files, err := ioutil.ReadDir(s.opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{first: first, path: filepath.Join(s.opts.Path, f.Name())})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].first < s.segments[j].first })
+
+	pending := make(map[uint64]*Message)
+	for _, seg := range s.segments {
+		if err := s.readSegment(seg, pending); err != nil {
+			return nil, err
+		}
+	}
+	msgs := make([]*Message, 0, len(pending))
+	for _, msg := range pending {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+	return msgs, nil
+}
+
+// readSegment apply records in segment to pending messages
+func (s *segmentStore) readSegment(seg *segment, pending map[uint64]*Message) error {
+	f, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(f)
+	head := make([]byte, recordHeadSize)
+	offset := int64(0)
+	for {
+		if _, err := io.ReadFull(reader, head); err != nil {
+			if err != io.EOF {
+				glog.Warningf("Truncated record in queue segment '%s' at %d", seg.path, offset)
+				return f.Truncate(offset)
+			}
+			return nil
+		}
+		length := binary.BigEndian.Uint32(head[0:4])
+		// Corrupted length must not allocate more than rest of the segment
+		if int64(length) > info.Size()-offset-int64(recordHeadSize) {
+			glog.Warningf("Invalid record length %d in queue segment '%s' at %d, segment is truncated", length, seg.path, offset)
+			return f.Truncate(offset)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil || length < recordBodySize ||
+			crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(head[4:8]) {
+			glog.Warningf("Broken record in queue segment '%s' at %d, segment is truncated", seg.path, offset)
+			return f.Truncate(offset)
+		}
+		seq := binary.BigEndian.Uint64(body[1:9])
+		switch body[0] {
+		case recordPush:
+			pending[seq] = &Message{
+				Seq:       seq,
+				Data:      body[recordBodySize:],
+				Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(body[9:17]))),
+			}
+			seg.live++
+		case recordAck:
+			if _, ok := pending[seq]; ok {
+				delete(pending, seq)
+				if owner := s.findSegment(seq); owner != nil {
+					owner.live--
+				}
+			}
+		}
+		if seq > s.lastSeq && body[0] == recordPush {
+			s.lastSeq = seq
+		}
+		offset += int64(recordHeadSize) + int64(length)
+	}
+}
+
+// findSegment return segment which contain message with sequence
+func (s *segmentStore) findSegment(seq uint64) *segment {
+	i := sort.Search(len(s.segments), func(i int) bool { return s.segments[i].first > seq })
+	if i == 0 {
+		return nil
+	}
+	return s.segments[i-1]
+}
+
+// removeSegments remove segments from head whose messages are all
+// acknowledged, the caller must hold lock
+func (s *segmentStore) removeSegments() {
+	for len(s.segments) > 1 && s.segments[0].live <= 0 {
+		if err := os.Remove(s.segments[0].path); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Failed to remove queue segment '%s':%s", s.segments[0].path, err)
+			return
+		}
+		s.segments = s.segments[1:]
+	}
+}
+
+// openActive open segment for writing, a new segment is created if no
+// segment exist or the last one is full
+func (s *segmentStore) openActive() error {
+	if n := len(s.segments); n > 0 {
+		last := s.segments[n-1]
+		if info, err := os.Stat(last.path); err == nil && info.Size() < s.opts.SegmentSize {
+			f, err := os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			s.active = f
+			s.activeSize = info.Size()
+			return nil
+		}
+	}
+	return s.rotate()
+}
+
+// rotate close active segment and create new one, the caller must hold lock
+func (s *segmentStore) rotate() error {
+	if s.active != nil {
+		s.active.Sync()
+		s.active.Close()
+		s.active = nil
+	}
+	seg := &segment{first: s.lastSeq + 1}
+	seg.path = s.segmentPath(seg.first)
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if n := len(s.segments); n == 0 || s.segments[n-1].first != seg.first {
+		s.segments = append(s.segments, seg)
+	}
+	s.active = f
+	s.activeSize = 0
+	s.removeSegments()
+	return nil
+}
+
+// nextSeq return sequence after the last message written
+func (s *segmentStore) nextSeq() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastSeq + 1
+}
+
+// write append record into active segment, the caller must hold lock
+func (s *segmentStore) write(kind byte, seq uint64, timestamp time.Time, data []byte) error {
+	if s.active == nil {
+		return ErrQueueClosed
+	}
+	buf := make([]byte, recordHeadSize+recordBodySize+len(data))
+	body := buf[recordHeadSize:]
+	body[0] = kind
+	binary.BigEndian.PutUint64(body[1:9], seq)
+	binary.BigEndian.PutUint64(body[9:17], uint64(timestamp.UnixNano()))
+	copy(body[recordBodySize:], data)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(body))
+	if _, err := s.active.Write(buf); err != nil {
+		return err
+	}
+	s.activeSize += int64(len(buf))
+	s.dirty = true
+	if s.opts.SyncPolicy == SyncAlways {
+		if err := s.active.Sync(); err != nil {
+			return err
+		}
+		s.dirty = false
+	}
+	return nil
+}
+
+// push write message into active segment
+func (s *segmentStore) push(msg *Message) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.activeSize >= s.opts.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if n := len(s.segments); n > 0 && s.segments[n-1].first > msg.Seq {
+		// Active segment is named after pushed sequence, it is only
+		// possible after sequence is reset
+		return fmt.Errorf("Sequence %d is before active segment", msg.Seq)
+	}
+	if err := s.write(recordPush, msg.Seq, msg.Timestamp, msg.Data); err != nil {
+		return err
+	}
+	s.segments[len(s.segments)-1].live++
+	s.lastSeq = msg.Seq
+	return nil
+}
+
+// ack write acknowledgement and remove segments no longer needed
+func (s *segmentStore) ack(seq uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.write(recordAck, seq, time.Now(), nil); err != nil {
+		return err
+	}
+	if seg := s.findSegment(seq); seg != nil {
+		seg.live--
+	}
+	s.removeSegments()
+	return nil
+}
+
+// syncLoop fsync active segment periodically
+func (s *segmentStore) syncLoop() {
+	defer s.waitgroup.Done()
+	ticker := time.NewTicker(s.opts.SyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mutex.Lock()
+			if s.dirty && s.active != nil {
+				s.active.Sync()
+				s.dirty = false
+			}
+			s.mutex.Unlock()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// close fsync and close active segment
+func (s *segmentStore) close() error {
+	close(s.quit)
+	s.waitgroup.Wait()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Sync()
+	s.active.Close()
+	s.active = nil
+	return err
+}
@@ -0,0 +1,71 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
+package quto
+
+import (
+	"sync"
+	"time"
+)
+
+// bucket is token bucket refilled with rate per second, its capacity is
+// one second of rate. Cost larger than capacity is allowed when bucket is
+// full, and later messages wait for the debt to be refilled
+type bucket struct {
+	mutex    sync.Mutex
+	rate     float64
+	tokens   float64
+	lastFill time.Time
+	lastUsed time.Time
+	removed  bool // Bucket is expired and removed from quota manager
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	return &bucket{rate: rate, tokens: rate, lastFill: now, lastUsed: now}
+}
+
+// refill add tokens for elapsed time
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastFill).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.lastFill = now
+}
+
+// wait return time to wait until cost can be taken
+func (b *bucket) wait(cost float64) time.Duration {
+	if cost > b.rate {
+		cost = b.rate
+	}
+	if b.tokens >= cost {
+		return 0
+	}
+	return time.Duration((cost - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take remove tokens from bucket refilled just now
+func (b *bucket) take(cost float64) {
+	b.tokens -= cost
+	b.lastUsed = b.lastFill
+}
+
+// idle return wether bucket is not used since time and debt is refilled, so
+// that it can be removed without losing state
+func (b *bucket) idle(since time.Time, now time.Time) bool {
+	b.refill(now)
+	return b.lastUsed.Before(since) && b.tokens >= b.rate
+}
@@ -1 +1,316 @@
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may
+//  not use this file except in compliance with the License. You may obtain
+//  a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//  WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//  License for the specific language governing permissions and limitations
+//  under the License.
+
 package quto
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloustone/sentel/core"
+)
+
+// Action taken when quota is exceeded
+const (
+	ActionDrop       = "drop"
+	ActionDisconnect = "disconnect"
+	ActionDelay      = "delay"
+)
+
+// Metrics names of quota violations
+const (
+	MetricPublishDropped       = "quto/publish/dropped"
+	MetricPublishDelayed       = "quto/publish/delayed"
+	MetricPublishDisconnected  = "quto/publish/disconnected"
+	MetricConnectionsRejected  = "quto/connections/rejected"
+	MetricSubscriptionRejected = "quto/subscriptions/rejected"
+)
+
+// Violation describe exceeded quota and the action to take
+type Violation struct {
+	Action string
+	Delay  time.Duration // Time to wait before message is accepted if action is delay
+	Reason string
+}
+
+func (v *Violation) Error() string { return v.Reason }
+
+// Quto enforce publish rate limits per client, username and mount point,
+// connection count per tenant and subscription count per session. Zero
+// limit means no limit
+type Quto struct {
+	clientRate       float64
+	clientBytes      float64
+	usernameRate     float64
+	usernameBytes    float64
+	mountpointRate   float64
+	mountpointBytes  float64
+	maxConnections   int
+	maxSubscriptions int
+	action           string
+	maxDelay         time.Duration
+	mutex            sync.Mutex
+	connections      map[string]int
+	bucketMutex      sync.RWMutex
+	buckets          map[string]*bucket
+	lastExpire       time.Time
+}
+
+// Buckets not used in bucketIdleTimeout are removed once they are refilled
+const bucketIdleTimeout = time.Minute
+
+var (
+	_quto      *Quto
+	_qutoMutex sync.Mutex
+)
+
+// GetQuto return quota manager shared by all services, it is created with
+// configurations in quto section at first time
+func GetQuto(c core.Config) *Quto {
+	_qutoMutex.Lock()
+	defer _qutoMutex.Unlock()
+	if _quto == nil {
+		_quto = NewQuto(c)
+	}
+	return _quto
+}
+
+// NewQuto create quota manager with configurations in quto section
+func NewQuto(c core.Config) *Quto {
+	q := &Quto{
+		clientRate:       configFloat(c, "client_publish_rate"),
+		clientBytes:      configFloat(c, "client_publish_bytes"),
+		usernameRate:     configFloat(c, "username_publish_rate"),
+		usernameBytes:    configFloat(c, "username_publish_bytes"),
+		mountpointRate:   configFloat(c, "mountpoint_publish_rate"),
+		mountpointBytes:  configFloat(c, "mountpoint_publish_bytes"),
+		maxConnections:   int(configFloat(c, "tenant_max_connections")),
+		maxSubscriptions: int(configFloat(c, "session_max_subscriptions")),
+		action:           ActionDrop,
+		maxDelay:         time.Second,
+		buckets:          make(map[string]*bucket),
+		connections:      make(map[string]int),
+		lastExpire:       time.Now(),
+	}
+	if action, err := c.String("quto", "violation_action"); err == nil {
+		switch action {
+		case ActionDisconnect, ActionDelay:
+			q.action = action
+		}
+	}
+	if delay, err := c.Int("quto", "max_delay"); err == nil && delay > 0 {
+		q.maxDelay = time.Duration(delay) * time.Millisecond
+	}
+	return q
+}
+
+// configFloat return non-negative limit in quto section
+func configFloat(c core.Config, key string) float64 {
+	val, err := c.Int("quto", key)
+	if err != nil || val < 0 {
+		return 0
+	}
+	return float64(val)
+}
+
+// CheckPublish take tokens for message of size from client's buckets, nil
+// is returned if message is accepted. With delay action, tokens are only
+// taken if they are refilled in max delay, and the message should be
+// accepted after delay. Otherwise the message is dropped
+func (q *Quto) CheckPublish(clientid string, username string, mountpoint string, size int) *Violation {
+	now := time.Now()
+	q.expireBuckets(now)
+
+	charges := []charge{}
+	add := func(kind string, id string, rate float64, cost float64) {
+		if rate > 0 && id != "" {
+			charges = append(charges, charge{key: kind + id, rate: rate, cost: cost})
+		}
+	}
+	add("client/rate/", clientid, q.clientRate, 1)
+	add("client/bytes/", clientid, q.clientBytes, float64(size))
+	add("username/rate/", username, q.usernameRate, 1)
+	add("username/bytes/", username, q.usernameBytes, float64(size))
+	add("mountpoint/rate/", mountpoint, q.mountpointRate, 1)
+	add("mountpoint/bytes/", mountpoint, q.mountpointBytes, float64(size))
+	if len(charges) == 0 {
+		return nil
+	}
+	// Buckets are always locked in the same order of charges, bucket
+	// removed by expiration meanwhile is looked up again
+	for !q.lockBuckets(charges, now) {
+	}
+	defer func() {
+		for _, c := range charges {
+			c.bucket.mutex.Unlock()
+		}
+	}()
+
+	wait := time.Duration(0)
+	for _, c := range charges {
+		if w := c.bucket.wait(c.cost); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 && q.action != ActionDelay {
+		return &Violation{
+			Action: q.action,
+			Reason: fmt.Sprintf("Publish rate of %s exceeded", clientid),
+		}
+	}
+	if wait > q.maxDelay {
+		return &Violation{
+			Action: ActionDrop,
+			Reason: fmt.Sprintf("Publish rate of %s exceeded, delay %v is longer than %v", clientid, wait, q.maxDelay),
+		}
+	}
+	for _, c := range charges {
+		c.bucket.take(c.cost)
+	}
+	if wait == 0 {
+		return nil
+	}
+	return &Violation{
+		Action: ActionDelay,
+		Delay:  wait,
+		Reason: fmt.Sprintf("Publish rate of %s exceeded, delayed %v", clientid, wait),
+	}
+}
+
+// charge is tokens to take from bucket with key
+type charge struct {
+	key    string
+	rate   float64
+	cost   float64
+	bucket *bucket
+}
+
+// lockBuckets lock and refill buckets of charges, false is returned if one
+// of them is removed before it is locked. Buckets are looked up before any
+// of them is locked, as expiration lock them with bucketMutex held
+func (q *Quto) lockBuckets(charges []charge, now time.Time) bool {
+	for i := range charges {
+		charges[i].bucket = q.bucket(charges[i].key, charges[i].rate, now)
+	}
+	for i, c := range charges {
+		c.bucket.mutex.Lock()
+		if c.bucket.removed {
+			for _, locked := range charges[:i+1] {
+				locked.bucket.mutex.Unlock()
+			}
+			return false
+		}
+		c.bucket.refill(now)
+	}
+	return true
+}
+
+// bucket return token bucket with key, it is created if not exist
+func (q *Quto) bucket(key string, rate float64, now time.Time) *bucket {
+	q.bucketMutex.RLock()
+	b, ok := q.buckets[key]
+	q.bucketMutex.RUnlock()
+	if ok {
+		return b
+	}
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+	if b, ok = q.buckets[key]; !ok {
+		b = newBucket(rate, now)
+		q.buckets[key] = b
+	}
+	return b
+}
+
+// expireBuckets remove idle buckets of clients, usernames and mount points
+// periodically
+func (q *Quto) expireBuckets(now time.Time) {
+	q.bucketMutex.RLock()
+	expire := now.Sub(q.lastExpire) >= bucketIdleTimeout
+	q.bucketMutex.RUnlock()
+	if !expire {
+		return
+	}
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+	if now.Sub(q.lastExpire) < bucketIdleTimeout {
+		return
+	}
+	q.lastExpire = now
+	since := now.Add(-bucketIdleTimeout)
+	for key, b := range q.buckets {
+		b.mutex.Lock()
+		if b.idle(since, now) {
+			b.removed = true
+			delete(q.buckets, key)
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// ReleaseClient remove client's buckets after it is disconnected
+func (q *Quto) ReleaseClient(clientid string) {
+	q.bucketMutex.Lock()
+	defer q.bucketMutex.Unlock()
+	for _, key := range []string{"client/rate/" + clientid, "client/bytes/" + clientid} {
+		if b, ok := q.buckets[key]; ok {
+			b.mutex.Lock()
+			b.removed = true
+			b.mutex.Unlock()
+			delete(q.buckets, key)
+		}
+	}
+}
+
+// AcquireConnection count new connection of tenant, violation is returned
+// if tenant's connections exceed limit
+func (q *Quto) AcquireConnection(tenant string) *Violation {
+	if tenant == "" || q.maxConnections == 0 {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.connections[tenant] >= q.maxConnections {
+		return &Violation{
+			Action: ActionDisconnect,
+			Reason: fmt.Sprintf("Connections of tenant '%s' exceed %d", tenant, q.maxConnections),
+		}
+	}
+	q.connections[tenant]++
+	return nil
+}
+
+// ReleaseConnection count closed connection of tenant
+func (q *Quto) ReleaseConnection(tenant string) {
+	if tenant == "" || q.maxConnections == 0 {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.connections[tenant] > 1 {
+		q.connections[tenant]--
+	} else {
+		delete(q.connections, tenant)
+	}
+}
+
+// CheckSubscriptions check wether session can have count subscriptions
+func (q *Quto) CheckSubscriptions(count int) *Violation {
+	if q.maxSubscriptions == 0 || count <= q.maxSubscriptions {
+		return nil
+	}
+	return &Violation{
+		Action: ActionDrop,
+		Reason: fmt.Sprintf("Subscriptions exceed %d", q.maxSubscriptions),
+	}
+}
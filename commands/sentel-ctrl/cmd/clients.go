@@ -34,7 +34,7 @@ func clientCmdHandler(cmd *cobra.Command, args []string) {
 	}
 	switch args[0] {
 	case "list": // Print client list
-		reply, err := sentelApi.Clients(&pb.ClientsRequest{Category: args[0]})
+		reply, err := sentelApi.Clients(&pb.ClientsRequest{Category: args[0], Offset: offset, Limit: limit})
 		if err != nil {
 			fmt.Println("Error:%v", err)
 			return
@@ -43,6 +43,7 @@ func clientCmdHandler(cmd *cobra.Command, args []string) {
 			fmt.Printf("username:%s, cleanSession:%T, peername:%s, connectTime:%s",
 				info.UserName, info.CleanSession, info.PeerName, info.ConnectTime)
 		}
+		fmt.Printf("total:%d\n", reply.Total)
 	case "show":
 		if len(args) != 2 {
 			fmt.Println("Usage error, please see help")
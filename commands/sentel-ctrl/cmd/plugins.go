@@ -15,14 +15,43 @@ package cmd
 import (
 	"fmt"
 
+	pb "github.com/cloustone/sentel/broker/api"
+
 	"github.com/spf13/cobra"
 )
 
 var pluginsCmd = &cobra.Command{
 	Use:   "plugins",
-	Short: "List all installed plugins",
-	Long:  `All software has versions. This is Hugo's`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Plugins:")
-	},
+	Short: "List and control plugins loaded by broker",
+	Long:  `List all loaded plugins, or start, stop and reload specific plugin`,
+	Run:   pluginsCmdHandler,
+}
+
+func pluginsCmdHandler(cmd *cobra.Command, args []string) {
+	req := &pb.PluginsRequest{Category: "list"}
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "list":
+	case len(args) == 2 && (args[0] == "start" || args[0] == "stop" || args[0] == "reload"):
+		req.Category = args[0]
+		req.Name = args[1]
+	default:
+		fmt.Println("Usage error, please see help")
+		return
+	}
+	reply, err := sentelApi.Plugins(req)
+	if err != nil {
+		fmt.Printf("Error:%v\n", err)
+		return
+	}
+	if !reply.Header.Success {
+		fmt.Printf("Error:%s\n", reply.Header.Reason)
+	}
+	fmt.Println("Plugins:")
+	for _, info := range reply.Plugins {
+		fmt.Printf("%s %s %s %s\n", info.Name, info.Version, info.State, info.Description)
+		if info.Error != "" {
+			fmt.Printf("\terror:%s\n", info.Error)
+		}
+	}
 }
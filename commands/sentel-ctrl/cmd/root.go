@@ -32,6 +32,8 @@ var RootCmd = &cobra.Command{
 var (
 	cfgFile   string
 	sentelApi *api.SentelApi
+	offset    uint32 // Paging of list commands
+	limit     uint32
 )
 
 func init() {
@@ -39,6 +41,8 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file ")
 	RootCmd.PersistentFlags().StringP("author", "a", "cloudstone", "cloudstone")
 	RootCmd.PersistentFlags().Bool("viper", true, "Use Viper for configuration")
+	RootCmd.PersistentFlags().Uint32Var(&offset, "offset", 0, "Offset of the first item listed")
+	RootCmd.PersistentFlags().Uint32Var(&limit, "limit", 0, "Maximum items listed, no limit if it is zero")
 	viper.BindPFlag("author", RootCmd.PersistentFlags().Lookup("author"))
 	viper.BindPFlag("useViper", RootCmd.PersistentFlags().Lookup("viper"))
 	viper.SetDefault("author", "cloudstone")
@@ -32,7 +32,7 @@ func routesCmdHandler(cmd *cobra.Command, args []string) {
 		fmt.Println("Usage error, please see help")
 		return
 	}
-	req := &pb.RoutesRequest{Category: args[0], Service: ""}
+	req := &pb.RoutesRequest{Category: args[0], Service: "", Offset: offset, Limit: limit}
 	switch args[0] {
 	case "list":
 		if len(args) == 2 {
@@ -45,6 +45,7 @@ func routesCmdHandler(cmd *cobra.Command, args []string) {
 			for _, info := range reply.Routes {
 				fmt.Printf("%s ->%v", info.Topic, info.Route)
 			}
+			fmt.Printf("total:%d\n", reply.Total)
 		}
 	case "show":
 		if len(args) != 2 {
@@ -55,6 +55,9 @@ func listAllServicesStatus(cmd *cobra.Command, args []string) {
 		fmt.Printf("\tmax_clients:%d", service.MaxClients)
 		fmt.Printf("\tcurrent_clients:%d", service.CurrentClients)
 		fmt.Printf("\tshutdown_count:%d", service.Acceptors)
+		if service.Status != "" {
+			fmt.Printf("\tstatus:%s", service.Status)
+		}
 	}
 	return
 
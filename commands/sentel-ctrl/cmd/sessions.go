@@ -33,7 +33,12 @@ func sessionsCmdHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	req := &pb.SessionsRequest{Category: args[0], Conditions: make(map[string]bool)}
+	req := &pb.SessionsRequest{
+		Category:   args[0],
+		Conditions: make(map[string]bool),
+		Offset:     offset,
+		Limit:      limit,
+	}
 
 	switch args[0] {
 	case "list": // Print client list
@@ -64,6 +69,7 @@ func sessionsCmdHandler(cmd *cobra.Command, args []string) {
 				session.AwaitingComp,
 				session.AwaitingAck)
 		}
+		fmt.Printf("total:%d\n", reply.Total)
 	case "show":
 		if len(args) != 2 {
 			fmt.Println("Usage error, please see help")
@@ -33,7 +33,7 @@ func subscriptionsCmdHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	req := &pb.SubscriptionsRequest{Category: args[0]}
+	req := &pb.SubscriptionsRequest{Category: args[0], Offset: offset, Limit: limit}
 
 	switch args[0] {
 	case "list": // Print topic list
@@ -46,6 +46,7 @@ func subscriptionsCmdHandler(cmd *cobra.Command, args []string) {
 			fmt.Printf("clientid:%s, topic:%s, attribute:%s",
 				sub.ClientId, sub.Topic, sub.Attribute)
 		}
+		fmt.Printf("total:%d\n", reply.Total)
 	case "show":
 		if len(args) != 2 {
 			fmt.Println("Usage error, please see help")
@@ -55,14 +56,13 @@ func subscriptionsCmdHandler(cmd *cobra.Command, args []string) {
 		if reply, err := sentelApi.Subscriptions(req); err != nil {
 			fmt.Println("Error:%v", err)
 			return
-		} else if len(reply.Subscriptions) != 1 {
-			fmt.Println("Error:sentel server return multiple subscriptions")
-			return
 		} else {
-			sub := reply.Subscriptions[0]
-			fmt.Printf("clientid:%s, topic:%s, attribute:%s",
-				sub.ClientId, sub.Topic, sub.Attribute)
-
+			// Subscribers of the topic are listed
+			for _, sub := range reply.Subscriptions {
+				fmt.Printf("clientid:%s, topic:%s, attribute:%s",
+					sub.ClientId, sub.Topic, sub.Attribute)
+			}
+			fmt.Printf("total:%d\n", reply.Total)
 		}
 	default:
 		fmt.Println("Usage error, please see help")
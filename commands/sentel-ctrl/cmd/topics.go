@@ -33,7 +33,7 @@ func topicsCmdHandler(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	req := &pb.TopicsRequest{Category: args[0]}
+	req := &pb.TopicsRequest{Category: args[0], Offset: offset, Limit: limit}
 
 	switch args[0] {
 	case "list": // Print topic list
@@ -45,6 +45,7 @@ func topicsCmdHandler(cmd *cobra.Command, args []string) {
 		for _, topic := range reply.Topics {
 			fmt.Printf("%s, %s", topic.Topic, topic.Attribute)
 		}
+		fmt.Printf("total:%d\n", reply.Total)
 	case "show":
 		if len(args) != 2 {
 			fmt.Println("Usage error, please see help")
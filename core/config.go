@@ -41,6 +41,9 @@ type globalConfig struct{}
 
 var _allConfigSections map[string]*configSection = make(map[string]*configSection)
 
+// Files loaded by NewWithConfigFile, sections are reloaded from them
+var _configFiles []string
+
 var (
 	ErrorInvalidConfiguration = errors.New("Invalid configuration")
 )
@@ -122,6 +125,7 @@ func (c *globalConfig) SetValue(section string, key string, valu string) {
 // NewWithConfigFile load configurations from files
 func NewWithConfigFile(fileName string, moreFiles ...string) (Config, error) {
 	// load all config sections in _allConfigSections, get section and item to overide
+	_configFiles = append([]string{fileName}, moreFiles...)
 	cfg, err := goconfig.LoadConfigFile(fileName, moreFiles...)
 	if err == nil {
 		sections := cfg.GetSectionList()
@@ -141,6 +145,24 @@ func NewWithConfigFile(fileName string, moreFiles ...string) (Config, error) {
 	return &globalConfig{}, nil
 }
 
+// ReloadConfigSection load items of section from config files again, items
+// not in files keep their values
+func ReloadConfigSection(sectionName string) error {
+	if len(_configFiles) == 0 {
+		return errors.New("No config file is loaded")
+	}
+	cfg, err := goconfig.LoadConfigFile(_configFiles[0], _configFiles[1:]...)
+	if err != nil {
+		return err
+	}
+	items, err := cfg.GetSection(sectionName)
+	if err != nil {
+		return nil
+	}
+	RegisterConfig(sectionName, items)
+	return nil
+}
+
 // Config global functions
 func RegisterConfig(sectionName string, items map[string]string) {
 	if _allConfigSections[sectionName] != nil { // section already exist